@@ -1,6 +1,6 @@
 // MIT License
 //
-// (C) Copyright [2019-2021,2023,2025] Hewlett Packard Enterprise Development LP
+// (C) Copyright [2019-2021,2023,2025-2026] Hewlett Packard Enterprise Development LP
 //
 // Permission is hereby granted, free of charge, to any person obtaining a
 // copy of this software and associated documentation files (the "Software"),
@@ -79,14 +79,30 @@ import (
 // ../sm/sm.go SCNPayload structure format.  TODO: put in a common place?
 
 type Scn struct {
-	Components     []string `json:"Components"`
-	Enabled        *bool    `json:"Enabled,omitempty"`
-	Flag           string   `json:"Flag,omitempty"`
-	Role           string   `json:"Role,omitempty"`
-	SubRole        string   `json:"SubRole,omitempty"`
-	SoftwareStatus string   `json:"SoftwareStatus,omitempty"`
-	State          string   `json:"State,omitempty"`
-	Timestamp      string   `json:"Timestamp,omitempty"`
+	Components     []string          `json:"Components"`
+	Enabled        *bool             `json:"Enabled,omitempty"`
+	Flag           string            `json:"Flag,omitempty"`
+	Role           string            `json:"Role,omitempty"`
+	SubRole        string            `json:"SubRole,omitempty"`
+	SoftwareStatus string            `json:"SoftwareStatus,omitempty"`
+	State          string            `json:"State,omitempty"`
+	Timestamp      string            `json:"Timestamp,omitempty"`
+	Reconciled     bool              `json:"Reconciled,omitempty"`    //made by hmnfd's HSM reconcile
+	Subscriptions  []ScnSubscription `json:"Subscriptions,omitempty"` //subscriptions an SCN sent out is for
+	Sequence       int64             `json:"Sequence,omitempty"`      //order of a batched SCN
+	Service        string            `json:"Service,omitempty"`       //service a service event is about
+}
+
+// A subscription an SCN sent out is for, identified the way the
+// subscriptions API lists it: the subscriber and what it subscribed to.
+
+type ScnSubscription struct {
+	Subscriber     string   `json:"Subscriber"`               //[agent@]xname or agent@service.name
+	States         []string `json:"States,omitempty"`         //HW states subscribed to
+	SoftwareStatus []string `json:"SoftwareStatus,omitempty"` //SW states subscribed to
+	Enabled        *bool    `json:"Enabled,omitempty"`        //true==all enable/disable SCNs
+	Roles          []string `json:"Roles,omitempty"`          //roles subscribed to
+	SubRoles       []string `json:"SubRoles,omitempty"`       //sub-roles subscribed to
 }
 
 // SCN subscription.  Used for hmnfd->HSM subscriptions and also node->hmnfd
@@ -101,12 +117,21 @@ type ScnSubscribe struct {
 	Subscriber          string   `json:"Subscriber,omitempty"`          //[service@]xname (nodes) or 'hmnfd'
 	SubscriberComponent string   `json:"SubscriberComponent,omitempty"` //xname (nodes) or 'hmnfd'
 	SubscriberAgent     string   `json:"SubscriberAgent,omitempty"`     //agent
+	SubscriberService   string   `json:"SubscriberService,omitempty"`   //service, for service subscribers
+	InitialSnapshot     bool     `json:"InitialSnapshot,omitempty"`     //send current state on subscribe
+	Durable             bool     `json:"Durable,omitempty"`             //suspend, don't delete, on prune
+	Suspended           bool     `json:"Suspended,omitempty"`           //read-only, suspended by a prune
+	LeaseSeconds        int      `json:"LeaseSeconds,omitempty"`        //service subscription lease
+	LeaseExpires        string   `json:"LeaseExpires,omitempty"`        //read-only, lease expiry
 	Enabled             *bool    `json:"Enabled,omitempty"`             //true==all enable/disable SCNs
 	Roles               []string `json:"Roles,omitempty"`               //Subscribe to role changes
 	SubRoles            []string `json:"SubRoles,omitempty"`            //Subscribe to sub-role changes
 	SoftwareStatus      []string `json:"SoftwareStatus,omitempty"`      //Subscribe to these SW SCNs
 	States              []string `json:"States,omitempty"`              //Subscribe to these HW SCNs
 	Url                 string   `json:"Url"`                           //URL to send SCNs to
+
+	Delivery *DeliveryPolicy   `json:"Delivery,omitempty"` //delivery settings, nil==global
+	Auth     *SubscriptionAuth `json:"Auth,omitempty"`     //outbound auth, redacted
 }
 
 // JSON data for subscription deletion coming into /subscribe
@@ -120,8 +145,27 @@ type NodeSubscriptionDelete struct {
 // Data stored in ETCD subscription records
 
 type SubData struct {
-	Url      string   `json:"Url"`
-	ScnNodes []string `json:"ScnNodes"`
+	Url         string   `json:"Url"`
+	ScnNodes    []string `json:"ScnNodes"`
+	Durable     bool     `json:"Durable,omitempty"`     //suspend, don't delete, on prune
+	Suspended   bool     `json:"Suspended,omitempty"`   //pruned, waiting to resume
+	SuspendedAt string   `json:"SuspendedAt,omitempty"` //when suspended, RFC3339
+
+	LeaseSeconds int    `json:"LeaseSeconds,omitempty"` //service lease, 0==none
+	LeaseExpires string `json:"LeaseExpires,omitempty"` //lease expiry, RFC3339
+
+	Generation int64 `json:"Generation,omitempty"` //changed on each POST/PATCH
+
+	Delivery *DeliveryPolicy   `json:"Delivery,omitempty"` //nil==global settings
+	Secret   string            `json:"Secret,omitempty"`   //encrypted signing secret
+	Auth     string            `json:"Auth,omitempty"`     //encrypted outbound auth
+	AuthInfo *SubscriptionAuth `json:"AuthInfo,omitempty"` //Auth, redacted, for GETs
+}
+
+// Get a subscription's options for sending its SCNs.
+
+func (sd *SubData) sendOpts() scnSendOpts {
+	return scnSendOpts{Delivery: sd.Delivery, Secret: sd.Secret, Auth: sd.Auth}
 }
 
 // Subscription list returned by /subscriptions
@@ -194,11 +238,15 @@ var prunemap_mutex = &sync.Mutex{}
 
 var kq_chan = make(chan string, 10000)
 var scnQ = make(chan Scn, 10000)
+var prune_stop = make(chan bool) //stops the pruning loop (for testing)
 
 var jdCache Scn
 var jdCount = 0
 var jdcMutex = &sync.Mutex{}
 
+var scnCacheDelay = SCN_CACHE_DELAY //Scn_cache_delay, for checkSCNCache()
+var scnCacheDelayMutex = &sync.Mutex{}
+
 /////////////////////////////////////////////////////////////////////////////
 // Find the intersection of 2 string arrays.  The arrays don't have
 // to be the same length.  The compares are case sensitive.  Note that
@@ -257,28 +305,17 @@ func intersect(subarr []string, hsmarr []string) []string {
 }
 
 /////////////////////////////////////////////////////////////////////////////
-// Convenience function to determine if a given state equates to
-// "unavailable".
+// Convenience function to determine if a given SCN equates to
+// "unavailable", meaning its components are to be pruned per the prune
+// policy.
 //
-// state(in):  State to examine
-// Return:     true if state == unavailable, else false.
+// scn(in):  SCN to examine
+// Return:   true if state == unavailable, else false.
 /////////////////////////////////////////////////////////////////////////////
 
 func isStateUnavailable(scn Scn) bool {
-	switch strings.ToLower(scn.State) {
-	case strings.ToLower(base.StateEmpty.String()):
-		fallthrough
-	case strings.ToLower(base.StateOff.String()):
-		fallthrough
-	case strings.ToLower(base.StateHalt.String()):
-		return true
-	}
-	if (scn.Enabled != nil) && (*scn.Enabled == false) {
-		return true
-	}
-	//TODO: need checking for SW status -- dunno which ones are bad!
-
-	return false
+	return prunePolicy().Components.matchComponent(scn.State,
+		scn.SoftwareStatus, scn.Flag, scn.Enabled)
 }
 
 /////////////////////////////////////////////////////////////////////////////
@@ -318,6 +355,8 @@ func subPrune() {
 		return
 	}
 
+	containers := prunedContainers()
+
 	for _, sub := range kvlist {
 		//Tokenize the key and separate out the relevant bits, and match
 		//subscription keys.
@@ -326,19 +365,64 @@ func subPrune() {
 		//and will happen during pruning based on an SCN that takes nodes
 		//into bad states.
 
-		toks := strings.Split(sub.Key, SUBSCRIBER_KEY_DELIM)
-		xname := toks[SUBSCRIBER_TOKNUM_XNAME]
+		xname, agent := parseSubscriptionKey(sub.Key)
 		subscriber := "bad_sub"
-
-		ix := strings.Index(sub.Key, SUBSCRIBER_KEY_SVC)
-		if ix > 0 {
-			tt := strings.Split(sub.Key[(ix+len(SUBSCRIBER_KEY_SVC)+1):], SUBSCRIBER_KEY_DELIM)
-			subscriber = tt[0] + SUBSCRIBER_SVC_DELIM + toks[SUBSCRIBER_TOKNUM_XNAME]
+		if agent != "" {
+			subscriber = agent + SUBSCRIBER_SVC_DELIM + xname
 		}
 
 		val, ok := prunemap[xname]
 		val2, ok2 := prunemap[subscriber]
-		if (ok && val) || (ok2 && val2) {
+		cause := prunecauses[xname]
+
+		//A subscriber entry is an explicit delete, unless its cause says
+		//to suspend (e.g. its SCN queue overflowed).
+
+		explicit := ok2 && val2
+		if explicit && prunecauses[subscriber].Suspend {
+			explicit = false
+			if !(ok && val) {
+				cause = prunecauses[subscriber]
+				ok, val = true, true
+			}
+		}
+
+		//Subscribers in a pruned container are pruned along with it, as
+		//the prune policy says for their type.
+
+		if !(ok && val) && !explicit {
+			parent := unavailableContainer(xname, containers)
+			if parent != "" {
+				action := containmentAction(xname)
+				if action != CONTAIN_ACTION_IGNORE {
+					cause = containedCause(parent, prunecauses[parent], action)
+					ok, val = true, true
+				}
+			}
+		}
+
+		//Durable subscriptions are suspended rather than deleted, unless
+		//they were explicitly deleted.  So are any the cause says to.
+
+		if (ok && val) && !explicit {
+			var sd SubData
+			if (json.Unmarshal([]byte(sub.Value), &sd) == nil) &&
+				(sd.Durable || cause.Suspend) {
+				if sd.Suspended {
+					continue
+				}
+				err := suspendSubscription(sub.Key, sd)
+				if err != nil {
+					log.Println("WARNING, key not suspended:", sub.Key, ":", err)
+				} else {
+					logPrune(newPruneRecord(sub.Key, sub.Value,
+						cause, PRUNE_ACTION_SUSPENDED))
+				}
+				continue
+			}
+		}
+
+		if (ok && val) || explicit {
 			//prune
 			if app_params.Debug > 1 {
 				log.Printf("PRUNING: '%s'\n", sub.Key)
@@ -349,6 +433,13 @@ func subPrune() {
 				//play it safe and don't delete the prunemap entry.  If the node
 				//is really dead, and we just can't find the subscription, it
 				//will get deleted eventually by 400 failures.
+			} else {
+				forgetSubscriptionGeneration(sub.Key)
+				if explicit {
+					cause = prunecauses[subscriber]
+				}
+				logPrune(newPruneRecord(sub.Key, sub.Value, cause,
+					PRUNE_ACTION_DELETED))
 			}
 		}
 	}
@@ -362,21 +453,47 @@ func subPrune() {
 // to be pruned; this bridges the gap from when a subscriber needs to be
 // pruned until it is actually pruned in ETCD.
 //
+// Only the leader deletes subscription records, expires service
+// subscription leases and prune decisions, and trims the prune log.  Other
+// replicas hand their prune map entries off to the leader instead, keeping
+// them until the leader has pruned.  All
+// replicas re-read the prune decisions, in case a watch was missed.
+// Returns when told to via prune_stop, once done with the current pass.
+//
 // Args,Return: None.
 /////////////////////////////////////////////////////////////////////////////
 
 func prune() {
 	for {
-		time.Sleep(10 * time.Second)
+		select {
+		case <-time.After(10 * time.Second):
+		case <-prune_stop:
+			return
+		}
+		applyPruneDecisions()
+		if !isLeader() {
+			publishPruneRequests()
+			continue
+		}
+		prunemap_mutex.Lock()
+		reqkeys := collectPruneRequests()
+		prunemap_mutex.Unlock()
 		if len(prunemap) > 0 {
 			//Perform the prune
 			prunemap_mutex.Lock()
 			subPrune()
 			for pm := range prunemap {
-				delete(prunemap, pm)
+				unmarkPrune(pm)
 			}
 			prunemap_mutex.Unlock()
+			clearPruneRequests(reqkeys)
+			trimPruneLog()
+			trimDeadLetters()
+		}
+		if expireSubscriptionLeases() > 0 {
+			trimPruneLog()
 		}
+		expirePruneDecisions()
 	}
 }
 
@@ -744,6 +861,7 @@ func doSubscribePost(w http.ResponseWriter, r *http.Request) {
 		base.SendProblemDetails(w, pdet, 0)
 		return
 	}
+	clearPruneDecisions(parseSubscriptionKey(subKey))
 	hsmsub_chan <- jdata //subscribe to SCN from HSM
 
 	w.Header().Add("Connection", "close")
@@ -817,22 +935,12 @@ func doSubscribePatch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	svcKeyDesc := SUBSCRIBER_KEY_SVC + SUBSCRIBER_KEYCAT_DELIM
-
 	for _, kv := range skvlist {
-		toks := strings.Split(kv.Key, SUBSCRIBER_KEY_DELIM)
-		svcKey := toks[SUBSCRIBER_TOKNUM_XNAME]
-
 		//Find the service token, if any, match with jdata.Subscriber
 
-		ix := strings.Index(kv.Key, svcKeyDesc)
-		if ix > 0 {
-			iy := strings.Index(kv.Key[ix:], SUBSCRIBER_KEY_DELIM)
-			if iy == -1 {
-				svcKey = kv.Key[ix+len(svcKeyDesc):] + SUBSCRIBER_SVC_DELIM + svcKey
-			} else {
-				svcKey = kv.Key[ix+len(svcKeyDesc):iy-1] + SUBSCRIBER_SVC_DELIM + svcKey
-			}
+		svcKey, svcAgent := parseSubscriptionKey(kv.Key)
+		if svcAgent != "" {
+			svcKey = svcAgent + SUBSCRIBER_SVC_DELIM + svcKey
 		}
 
 		//Read the key's value and match the Url
@@ -855,10 +963,6 @@ func doSubscribePatch(w http.ResponseWriter, r *http.Request) {
 			//just replace the contents (key val).  If not, delete this key
 			//and make a new one.
 
-			var newSD SubData
-			newSD.Url = jdata.Url
-			newSD.ScnNodes = jdata.Components
-
 			exKey := makeSubscriptionKey_V1(jdata)
 			if exKey != kv.Key {
 				if app_params.Debug > 1 {
@@ -882,6 +986,10 @@ func doSubscribePatch(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 			makeSubscriptionEntry(jdata.Components, jdata.Url, exKey)
+			if exKey != kv.Key {
+				forgetSubscriptionGeneration(kv.Key)
+			}
+			cancelStaleSends(kv.Key)
 			break
 		}
 	}
@@ -954,17 +1062,16 @@ func doSubscribeDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ncan := 0
+
 	for _, sub := range skvlist {
 		//Get the service name from the key.  It can be a simple XName or svc@XName.
 		//Gotta get the XName token (always first after sub), then get optional
 		//service name (defined by svc.xxx in the key)
 
-		toks := strings.Split(sub.Key, SUBSCRIBER_KEY_DELIM)
-		subsvc := toks[SUBSCRIBER_TOKNUM_XNAME] //first assume a plain XName
-		ix := strings.Index(sub.Key, SUBSCRIBER_KEY_SVC)
-		if ix > 0 {
-			tt := strings.Split(sub.Key[(ix+len(SUBSCRIBER_KEY_SVC)+1):], SUBSCRIBER_KEY_DELIM)
-			subsvc = tt[0] + SUBSCRIBER_SVC_DELIM + toks[SUBSCRIBER_TOKNUM_XNAME]
+		subsvc, subAgent := parseSubscriptionKey(sub.Key)
+		if subAgent != "" {
+			subsvc = subAgent + SUBSCRIBER_SVC_DELIM + subsvc
 		}
 		if app_params.Debug > 1 {
 			log.Printf("Found subscriber key: '%s'\n", subsvc)
@@ -992,15 +1099,21 @@ func doSubscribeDelete(w http.ResponseWriter, r *http.Request) {
 				if err != nil {
 					log.Println("WARNING, key not deleted:", sub.Key, ":", err)
 				} else {
-					//Put this in the pruning map to prevent stuff in the Q
-					//destined for this node from getting sent.
-					prunemap_mutex.Lock()
-					prunemap[subsvc] = true
-					prunemap_mutex.Unlock()
+					//Cancel what's queued for this subscription, and put
+					//it in the pruning map to prevent anything else in the
+					//Q destined for this node from getting sent.
+					forgetSubscriptionGeneration(sub.Key)
+					ncan += cancelStaleSends(sub.Key)
+					trigger := r.Method + " " + r.URL.Path
+					markPruneLocked(subsvc, PRUNE_REASON_API_DELETE, trigger)
+					logPrune(newPruneRecord(sub.Key, sub.Value,
+						pruneCause{Reason: PRUNE_REASON_API_DELETE,
+							Trigger: trigger}, PRUNE_ACTION_DELETED))
 				}
 			}
 		}
 	}
+	setCancelledHeader(w, ncan)
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -1033,6 +1146,17 @@ func getSCNAttrs(jdata Scn) []string {
 	return scnAttrs
 }
 
+// Check if a subscription key matches any of an SCN's attributes.
+
+func scnAttrMatch(key string, scnAttrs []string) bool {
+	for _, attr := range scnAttrs {
+		if keyHasAttr(key, attr) {
+			return true
+		}
+	}
+	return false
+}
+
 /////////////////////////////////////////////////////////////////////////////
 // Create a subscription ETCD key based on a subscription request.
 //
@@ -1242,13 +1366,26 @@ func scnCacheEqual(jdp *Scn) bool {
 	return true
 }
 
+// Set how often the SCN cache is checked.  checkSCNCache() keeps its own
+// copy of Scn_cache_delay, since the parameters can be changed by a PATCH
+// while it runs.
+
+func setScnCacheDelay(secs int) {
+	scnCacheDelayMutex.Lock()
+	scnCacheDelay = secs
+	scnCacheDelayMutex.Unlock()
+}
+
 // Goroutine that checks the SCN cache periodically.  If the cache is not
 // empty, it will get put into the SCN processing Q.  This prevents the cache
 // from sitting there if no SCNs are inbound.
 
 func checkSCNCache() {
 	for {
-		time.Sleep(time.Duration(app_params.Scn_cache_delay) * time.Second)
+		scnCacheDelayMutex.Lock()
+		delay := scnCacheDelay
+		scnCacheDelayMutex.Unlock()
+		time.Sleep(time.Duration(delay) * time.Second)
 
 		jdcMutex.Lock()
 		if len(jdCache.Components) > 0 {
@@ -1261,12 +1398,17 @@ func checkSCNCache() {
 	}
 }
 
-// Process the Q of SCNs to be sent to subscribers.
+// Process the Q of SCNs to be sent to subscribers.  If segmented fanout is
+// in effect, the other replicas get a copy of each SCN and deliver it to
+// the subscribers they own.
 
 func handleSCNs() {
 	for {
 		scn := <-scnQ
-		sendToTelemetryBus(scn)
+		if !scn.Reconciled {
+			sendToTelemetryBus(scn)
+		}
+		distributeScn(scn)
 		doScn(scn)
 		if app_params.Debug > 0 {
 			log.Printf("Remaining in Q: %d", len(scnQ))
@@ -1274,34 +1416,81 @@ func handleSCNs() {
 	}
 }
 
-// Do the dirty work of sending SCNs to subscribers.
+// Do the dirty work of sending SCNs to subscribers owned by this replica.
 
 func doScn(jdata Scn) {
+	publishStreamScn(jdata)
+	doScnSegment(jdata, serviceName)
+}
+
+// Handle an SCN for the subscribers owned by the specified replica: do what
+// is done once per SCN, then send it to those subscribers.  Normally this
+// is this replica.
+
+func doScnSegment(jdata Scn, replica string) {
 	var jdata_lc Scn
-	var prunemap_copy = make(map[string]bool)
 
 	jdata_lc = jdata
 	scnToLower(&jdata_lc)
 
+	//Cached component states used for initial snapshots are now stale.
+
+	snapshotCacheInvalidate(jdata_lc.Components)
+	reconcileStateUpdate(jdata_lc)
+
 	//Perform a prune operation if this state shows nodes/targets becoming
-	//unavailable.  No sense sending anything to a down node.
+	//unavailable.  No sense sending anything to a down node.  Add all nodes
+	//in this SCN into the prune map.  Eventually we'll clean out the ETCD
+	//keys as well, which will reduce ETCD overhead.
 
-	prune := isStateUnavailable(jdata)
-	if prune {
-		//Add all nodes in this SCN into the prune map.  Use this map within this
-		//func to avoid sending to unavailable targets.  Eventually we'll clean
-		//out the ETCD keys as well, which will reduce ETCD overhead.
+	if isStateUnavailable(jdata) {
 		prunemap_mutex.Lock()
 		for ix := 0; ix < len(jdata_lc.Components); ix++ {
-			prunemap[jdata_lc.Components[ix]] = true
+			markPrune(jdata_lc.Components[ix], PRUNE_REASON_UNAVAILABLE,
+				scnTrigger(jdata))
 		}
-		//Make a copy of the prunemap in case it gets processed/deleted between
-		//when we read the KVs from ETCD and when we process them.  Unlikely but
-		//possible.
+		prunemap_mutex.Unlock()
+	}
+
+	planScnSegment(jdata, replica)
+}
+
+// Send an SCN to the subscribers owned by the specified replica.  Normally
+// this is this replica; it can be another one if that one couldn't be
+// handed the SCN, in which case doScnSegment() was already done for it
+// here, and is not done again.
+
+func planScnSegment(jdata Scn, replica string) {
+	var jdata_lc Scn
+	var prunemap_copy = make(map[string]bool)
+	var containers map[string]bool
+	var plans = make(map[string]*JobSCNSend)
+	var planOrder []*JobSCNSend
+
+	jdata_lc = jdata
+	scnToLower(&jdata_lc)
+
+	prune := isStateUnavailable(jdata)
+	if prune {
+		//Use a copy of the prune map within this func to avoid sending to
+		//unavailable targets, in case it gets processed/deleted between
+		//when we read the KVs from ETCD and when we process them.  Unlikely
+		//but possible.
+		prunemap_mutex.Lock()
 		for k, v := range prunemap {
 			prunemap_copy[k] = v
 		}
 		prunemap_mutex.Unlock()
+		containers = containerSet(jdata_lc.Components)
+	}
+
+	//Suspended durable subscriptions of subscribers now Ready are resumed.
+
+	readymap := make(map[string]bool)
+	if strings.EqualFold(jdata_lc.State, base.StateReady.String()) {
+		for _, comp := range jdata_lc.Components {
+			readymap[comp] = true
+		}
 	}
 
 	//Make a list of SCN attributes
@@ -1319,15 +1508,7 @@ func doScn(jdata Scn) {
 	}
 
 	for _, sub := range kvlist {
-		attrMatch := false
-
-		for _, attr := range scnAttrs {
-			if strings.Contains(sub.Key, attr) {
-				//match!
-				attrMatch = true
-				break
-			}
-		}
+		attrMatch := scnAttrMatch(sub.Key, scnAttrs)
 
 		//Split the key to get the subscriber/xname.
 		//The key's value will be the list of nodes this node
@@ -1335,10 +1516,41 @@ func doScn(jdata Scn) {
 
 		toks := strings.Split(sub.Key, SUBSCRIBER_KEY_DELIM)
 		subxname := toks[SUBSCRIBER_TOKNUM_XNAME]
+		subscriber := subxname
+		if _, agent := parseSubscriptionKey(sub.Key); agent != "" {
+			subscriber = agent + SUBSCRIBER_SVC_DELIM + subxname
+		}
+
+		//With segmented fanout, subscribers owned by other replicas are
+		//handled by those replicas.
+
+		if !isSegmentOwner(subxname, replica) {
+			continue
+		}
+
+		if readymap[subxname] {
+			sub.Value, _ = resumeSubscription(sub.Key, sub.Value,
+				"subscriber Ready")
+		}
+
+		//Subscribers in an unavailable container are pruned along with it,
+		//as the prune policy says for their type.
+
+		contained := false
+		if parent := unavailableContainer(subxname, containers); parent != "" {
+			action := containmentAction(subxname)
+			if action != CONTAIN_ACTION_IGNORE {
+				prunemap_mutex.Lock()
+				markPruneCause(subxname, containedCause(parent,
+					pruneCause{Trigger: scnTrigger(jdata)}, action))
+				contained = prunemap[subxname]
+				prunemap_mutex.Unlock()
+			}
+		}
 
 		//Fan out the SCN if this subscriber hasn't been pruned.
 
-		if attrMatch && !(prune && prunemap_copy[subxname]) {
+		if attrMatch && !(prune && prunemap_copy[subxname]) && !contained {
 			//The SCN matches a subscriber's SCN request.  We'll need to
 			//to send them a JSON payload with the new state and all of
 			//the components which match the ones in the subscriber's
@@ -1356,14 +1568,22 @@ func doScn(jdata Scn) {
 			sendData.SoftwareStatus = jdata.SoftwareStatus
 			sendData.State = jdata.State
 			sendData.Timestamp = jdata.Timestamp
+			sendData.Reconciled = jdata.Reconciled
 			//Skip components for now, need to do an intersection first.
 
 			umerr := json.Unmarshal([]byte(sub.Value), &nsdata)
 			if umerr != nil {
 				log.Printf("ERROR: Problem unmarshalling ETCD key '%s': %v",
 					sub.Key, umerr)
-				return
+				continue
+			}
+
+			//Nothing goes to a suspended subscription.
+
+			if nsdata.Suspended {
+				continue
 			}
+			noteSubscriptionGeneration(sub.Key, nsdata.Generation)
 
 			//Now intersect the list of nodes subscriber is interested in
 			//with the nodes in the SCN
@@ -1385,54 +1605,62 @@ func doScn(jdata Scn) {
 					}
 				}
 
-				//Send the SCN via the worker pool.  Note the infinite for
-				//loop -- this should never block for very long, but even if
-				//it does, we're in our own goroutine here, so it won't
-				//block anything else.  If for whatever reason it blocks
-				//forever, something is horribly wrong and we have bigger
-				//fish to fry.
-
-				//TODO: we may want to make a "jobValid" map to indicate
-				//jobs that are queued, which gets cleared when the
-				//job executes.  If a DELETE or prune operation occurs before
-				//the job executes, then the job sees the entry is empty
-				//and drops the job on the floor.  This addresses the end
-				//case where an SCN is queued for fanout to an endpoint which
-				//gets deleted/pruned before the SCN queue executes the job,
-				//and prevents the SCN from being delivered.
-
-				jj := NewJobSCNSend(sendData, subxname, nsdata.Url)
-				for {
-					rv := scnWorkPool.Queue(jj)
-					if rv == 0 {
-						break
-					}
-					log.Printf("WARNING: SCN send '%s' blocked due to full Q.\n",
-						subxname)
-					time.Sleep(500 * time.Millisecond)
+				//A subscriber with several subscriptions matching this
+				//SCN for the same URL gets it once, for all of them.
+
+				dest := subscriber + "|" + nsdata.Url
+				if jj, ok := plans[dest]; ok {
+					jj.addSub(sub.Key, nsdata.Generation, sendData.Components)
+				} else {
+					jj = NewJobSCNSendSub(sendData, subscriber, nsdata.Url,
+						sub.Key, nsdata.Generation, nsdata.sendOpts()).(*JobSCNSend)
+					plans[dest] = jj
+					planOrder = append(planOrder, jj)
 				}
+			}
+		}
+	}
 
-				//If we're in testing/fanout sync mode, wait for this SCN
-				//send to finish before doing the next one.
+	for _, jj := range planOrder {
+		//Send the SCN via the worker pool.  Note the infinite for
+		//loop -- this should never block for very long, but even if
+		//it does, we're in our own goroutine here, so it won't
+		//block anything else.  If for whatever reason it blocks
+		//forever, something is horribly wrong and we have bigger
+		//fish to fry.
 
-				if fanoutSyncMode != 0 {
-					if app_params.Debug > 2 {
-						log.Printf("INFO: In fanout-sync mode, waiting for SCN send to complete.\n")
-					}
-					for {
-						time.Sleep(500 * time.Microsecond)
-						jstat, _ := jj.GetStatus()
-						if (jstat == base.JSTAT_COMPLETE) ||
-							(jstat == base.JSTAT_ERROR) ||
-							(jstat == base.JSTAT_CANCELLED) {
-							break
-						}
-					}
-					if app_params.Debug > 2 {
-						log.Printf("INFO: SCN sent.\n")
-					}
+		//Queued jobs are tracked, and cancelled if the subscriber
+		//is deleted or pruned, on this or any other replica,
+		//before the job runs.
+
+		//A new subscription waiting for its initial snapshot gets
+		//this SCN after the snapshot.
+
+		if snapshotHoldScn(jj.SCNData, jj.Subscriber, jj.Url) {
+			continue
+		}
+
+		queueScnSend(jj, jj.Subscriber)
+
+		//If we're in testing/fanout sync mode, wait for this SCN
+		//send to finish before doing the next one.
+
+		if fanoutSyncMode != 0 {
+			if app_params.Debug > 2 {
+				log.Printf("INFO: In fanout-sync mode, waiting for SCN send to complete.\n")
+			}
+			for {
+				time.Sleep(500 * time.Microsecond)
+				jstat, _ := jj.GetStatus()
+				if (jstat == base.JSTAT_COMPLETE) ||
+					(jstat == base.JSTAT_ERROR) ||
+					(jstat == base.JSTAT_CANCELLED) {
+					break
 				}
 			}
+			if app_params.Debug > 2 {
+				log.Printf("INFO: SCN sent.\n")
+			}
 		}
 	}
 }
@@ -1531,6 +1759,35 @@ func paramsGet(w http.ResponseWriter, r *http.Request) {
 	w.Write(rparams)
 }
 
+/////////////////////////////////////////////////////////////////////////////
+// Make the identifier sent in SCNs for a subscription from its key.  It
+// matches the subscription as listed by the subscriptions API.
+//
+// key(in): Subscription key.
+// Return:  Subscription identifier.
+/////////////////////////////////////////////////////////////////////////////
+
+func scnSubscription(key string) ScnSubscription {
+	var subinfo ScnSubscribe
+
+	toks := strings.Split(key, SUBSCRIBER_KEY_DELIM)
+	if len(toks) <= SUBSCRIBER_TOKNUM_XNAME {
+		return ScnSubscription{}
+	}
+	subinfo.Subscriber = toks[SUBSCRIBER_TOKNUM_XNAME]
+	for ix := SUBSCRIBER_TOKNUM_XNAME + 1; ix < len(toks); ix++ {
+		tt := strings.Split(toks[ix], SUBSCRIBER_KEYCAT_DELIM)
+		populateSubinfo(toks[SUBSCRIBER_TOKNUM_XNAME], tt, &subinfo)
+	}
+	return ScnSubscription{Subscriber: subinfo.Subscriber,
+		States:         subinfo.States,
+		SoftwareStatus: subinfo.SoftwareStatus,
+		Enabled:        subinfo.Enabled,
+		Roles:          subinfo.Roles,
+		SubRoles:       subinfo.SubRoles,
+	}
+}
+
 func populateSubinfo(xname string, tt []string, subinfo *ScnSubscribe) {
 	switch tt[0] {
 	case SUBSCRIBER_KEY_HWS:
@@ -1560,7 +1817,12 @@ func populateSubinfo(xname string, tt []string, subinfo *ScnSubscribe) {
 		break
 	case SUBSCRIBER_KEY_SVC:
 		subinfo.Subscriber = tt[1] + SUBSCRIBER_SVC_DELIM + xname
-		subinfo.SubscriberComponent = xname
+		if isServiceSubscriber(xname) {
+			subinfo.SubscriberService = strings.TrimPrefix(xname,
+				SUBSCRIBER_SERVICE_PREFIX)
+		} else {
+			subinfo.SubscriberComponent = xname
+		}
 		subinfo.SubscriberAgent = tt[1]
 		break
 	}
@@ -1636,6 +1898,12 @@ func subscriptionsHandler(w http.ResponseWriter, r *http.Request) {
 
 		subinfo.Components = subkeydata.ScnNodes
 		subinfo.Url = subkeydata.Url
+		subinfo.Durable = subkeydata.Durable
+		subinfo.Suspended = subkeydata.Suspended
+		subinfo.LeaseSeconds = subkeydata.LeaseSeconds
+		subinfo.LeaseExpires = subkeydata.LeaseExpires
+		subinfo.Delivery = subkeydata.Delivery
+		subinfo.Auth = subkeydata.AuthInfo
 		sublist.SubscriptionList = append(sublist.SubscriptionList, subinfo)
 	}
 
@@ -1771,6 +2039,33 @@ func generateRoutes() Routes {
 			v2Ubase + URL_SUBSCRIPTIONS,
 			subscriptionsHandler,
 		},
+		//Service routes go ahead of the XName ones, which would otherwise
+		//match some of them.
+		Route{"servicesGetHandler",
+			strings.ToUpper("Get"),
+			v2Ubase + URL_SUBSCRIPTIONS + "/" + URL_SERVICES + "/{service}",
+			servicesGetHandler,
+		},
+		Route{"servicesAgentPostHandler",
+			strings.ToUpper("Post"),
+			v2Ubase + URL_SUBSCRIPTIONS + "/" + URL_SERVICES + "/{service}/agents/{agent}",
+			servicesAgentPostHandler,
+		},
+		Route{"servicesAgentPatchHandler",
+			strings.ToUpper("Patch"),
+			v2Ubase + URL_SUBSCRIPTIONS + "/" + URL_SERVICES + "/{service}/agents/{agent}",
+			servicesAgentPatchHandler,
+		},
+		Route{"servicesAgentDeleteHandler",
+			strings.ToUpper("Delete"),
+			v2Ubase + URL_SUBSCRIPTIONS + "/" + URL_SERVICES + "/{service}/agents/{agent}",
+			servicesAgentDeleteHandler,
+		},
+		Route{"servicesDeleteHandler",
+			strings.ToUpper("Delete"),
+			v2Ubase + URL_SUBSCRIPTIONS + "/" + URL_SERVICES + "/{service}/agents",
+			servicesDeleteHandler,
+		},
 		Route{"subscriptionsXNameGetHandler",
 			strings.ToUpper("Get"),
 			v2Ubase + URL_SUBSCRIPTIONS + "/{xname}",
@@ -1801,5 +2096,35 @@ func generateRoutes() Routes {
 			v2Ubase + URL_SCN,
 			scnHandler,
 		},
+		Route{"fanoutHandler",
+			strings.ToUpper("Post"),
+			v2Ubase + URL_FANOUT,
+			fanoutHandler,
+		},
+		Route{"prunesGetHandler",
+			strings.ToUpper("Get"),
+			v2Ubase + URL_PRUNES,
+			prunesGetHandler,
+		},
+		Route{"streamHandler",
+			strings.ToUpper("Get"),
+			v2Ubase + URL_STREAM,
+			streamHandler,
+		},
+		Route{"deadLettersGetHandler",
+			strings.ToUpper("Get"),
+			v2Ubase + URL_DEADLETTERS,
+			deadLettersGetHandler,
+		},
+		Route{"deadLettersRedriveHandler",
+			strings.ToUpper("Post"),
+			v2Ubase + URL_DEADLETTERS + "/redrive",
+			deadLettersRedriveHandler,
+		},
+		Route{"deadLetterRedriveHandler",
+			strings.ToUpper("Post"),
+			v2Ubase + URL_DEADLETTERS + "/{id}/redrive",
+			deadLetterRedriveHandler,
+		},
 	}
 }
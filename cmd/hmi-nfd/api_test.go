@@ -1,6 +1,6 @@
 // MIT License
 //
-// (C) Copyright [2019,2021,2023] Hewlett Packard Enterprise Development LP
+// (C) Copyright [2019,2021,2023,2026] Hewlett Packard Enterprise Development LP
 //
 // Permission is hereby granted, free of charge, to any person obtaining a
 // copy of this software and associated documentation files (the "Software"),
@@ -31,7 +31,10 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -41,6 +44,90 @@ import (
 
 var gofuncsRunning = false
 var scnsRcv []Scn
+var scnsRcvMutex sync.Mutex
+
+//The in-memory KV store doesn't lock GetRange(), and each Open() gets its
+//own lock on the shared storage.  Background goroutines from one test can
+//still be using the KV store when the next test starts, so all tests share
+//one handle, with its data operations serialized.
+
+var testKVLock sync.Mutex
+var testKV hmetcd.Kvi
+
+type lockedKV struct {
+	hmetcd.Kvi
+}
+
+func (kv lockedKV) Store(key string, value string) error {
+	testKVLock.Lock()
+	defer testKVLock.Unlock()
+	return kv.Kvi.Store(key, value)
+}
+
+func (kv lockedKV) TempKey(key string) error {
+	testKVLock.Lock()
+	defer testKVLock.Unlock()
+	return kv.Kvi.TempKey(key)
+}
+
+func (kv lockedKV) Get(key string) (string, bool, error) {
+	testKVLock.Lock()
+	defer testKVLock.Unlock()
+	return kv.Kvi.Get(key)
+}
+
+func (kv lockedKV) GetRange(keystart string, keyend string) ([]hmetcd.Kvi_KV, error) {
+	testKVLock.Lock()
+	defer testKVLock.Unlock()
+	return kv.Kvi.GetRange(keystart, keyend)
+}
+
+func (kv lockedKV) Delete(key string) error {
+	testKVLock.Lock()
+	defer testKVLock.Unlock()
+	return kv.Kvi.Delete(key)
+}
+
+func (kv lockedKV) Transaction(key, op, value, thenkey, thenval, elsekey, elseval string) (bool, error) {
+	testKVLock.Lock()
+	defer testKVLock.Unlock()
+	return kv.Kvi.Transaction(key, op, value, thenkey, thenval, elsekey, elseval)
+}
+
+func (kv lockedKV) TAS(key string, testval string, setval string) (bool, error) {
+	testKVLock.Lock()
+	defer testKVLock.Unlock()
+	return kv.Kvi.TAS(key, testval, setval)
+}
+
+//Point kvHandle at the shared test KV store, opening it the first time.
+
+func openTestKV() error {
+	if testKV == nil {
+		kvi, err := hmetcd.Open("mem:", "")
+		if err != nil {
+			return err
+		}
+		testKV = lockedKV{kvi}
+	}
+	if kvHandle != testKV {
+		kvHandle = testKV
+	}
+	return nil
+}
+
+//Put back the app_params fields a test changed.  Background goroutines
+//keep reading app_params between tests, so the others are left alone.
+
+func restoreAppParams(saved opParams) {
+	cur := reflect.ValueOf(&app_params).Elem()
+	sv := reflect.ValueOf(saved)
+	for ix := 0; ix < cur.NumField(); ix++ {
+		if !reflect.DeepEqual(cur.Field(ix).Interface(), sv.Field(ix).Interface()) {
+			cur.Field(ix).Set(sv.Field(ix))
+		}
+	}
+}
 
 func kvPurge(t *testing.T) {
 	// make sure something is here to work with
@@ -72,7 +159,7 @@ func TestScnSubscribeHandler(t *testing.T) {
 
 	//Set up ETCD
 
-	kvHandle, kverr = hmetcd.Open("mem:", "")
+	kverr = openTestKV()
 	if kverr != nil {
 		t.Fatal("KV/ETCD open failed:", kverr)
 	}
@@ -248,7 +335,7 @@ func TestScnHandler(t *testing.T) {
 	//those subscriptions, so that the scn_rcv() function won't try to send
 	//to any actual endpoint.
 
-	kvHandle, kverr = hmetcd.Open("mem:", "")
+	kverr = openTestKV()
 	if kverr != nil {
 		t.Fatal("KV/ETCD open failed:", kverr)
 	}
@@ -353,7 +440,9 @@ func subscriberSCNHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	scnsRcvMutex.Lock()
 	scnsRcv = append(scnsRcv, jdata)
+	scnsRcvMutex.Unlock()
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -445,7 +534,7 @@ func TestScnHandler2(t *testing.T) {
 	//those subscriptions, so that the scn_rcv() function won't try to send
 	//to any actual endpoint.
 
-	kvHandle, kverr = hmetcd.Open("mem:", "")
+	kverr = openTestKV()
 	if kverr != nil {
 		t.Fatal("KV/ETCD open failed:", kverr)
 	}
@@ -472,14 +561,17 @@ func TestScnHandler2(t *testing.T) {
 	//Sync the scn consumer as best we can by changing the period to 1 second
 	//and waiting a while, then changing it to the target frequency.
 
-	app_params.Scn_cache_delay = 1
+	setScnCacheDelay(1)
+	defer setScnCacheDelay(app_params.Scn_cache_delay)
 	app_params.Scn_max_cache = 4
 	time.Sleep(10)
-	app_params.Scn_cache_delay = 10
+	setScnCacheDelay(10)
 
 	//1. 2 SCNs of the same type, wait for the cache send
 
+	scnsRcvMutex.Lock()
 	scnsRcv = []Scn{}
+	scnsRcvMutex.Unlock()
 	scnList = []Scn{}
 	hsmscn.Components = []string{}
 	scnList = append(scnList, Scn{State: "Ready"})
@@ -491,7 +583,9 @@ func TestScnHandler2(t *testing.T) {
 		sendScn(t, hsmscn)
 	}
 	time.Sleep(12 * time.Second)
+	scnsRcvMutex.Lock()
 	cmpStr = scnCompare(scnList, scnsRcv)
+	scnsRcvMutex.Unlock()
 	if cmpStr != "" {
 		t.Errorf("SCN Miscompare: %s", cmpStr)
 	}
@@ -499,7 +593,9 @@ func TestScnHandler2(t *testing.T) {
 	//2. 5 SCNs of the same type, cache (of 4) send, then single cached send.
 
 	hsmscn.Components = []string{}
+	scnsRcvMutex.Lock()
 	scnsRcv = []Scn{}
+	scnsRcvMutex.Unlock()
 	scnList = []Scn{}
 	scnList = append(scnList, Scn{State: "Ready"})
 	for ix := 0; ix < 5; ix++ {
@@ -520,7 +616,9 @@ func TestScnHandler2(t *testing.T) {
 	hsmscn.State = "Ready"
 	sendScn(t, hsmscn)
 	time.Sleep(10 * time.Second)
+	scnsRcvMutex.Lock()
 	cmpStr = scnCompare(scnList, scnsRcv)
+	scnsRcvMutex.Unlock()
 	if cmpStr != "" {
 		t.Errorf("SCN Miscompare: %s", cmpStr)
 	}
@@ -529,7 +627,9 @@ func TestScnHandler2(t *testing.T) {
 	//   then single cached send.
 
 	hsmscn.Components = []string{}
+	scnsRcvMutex.Lock()
 	scnsRcv = []Scn{}
+	scnsRcvMutex.Unlock()
 	scnList = []Scn{}
 	scnList = append(scnList, Scn{State: "Ready"})
 	for ix := 0; ix < 2; ix++ {
@@ -545,7 +645,9 @@ func TestScnHandler2(t *testing.T) {
 	scnList[1].Components = []string{"x10c0s0b0n0"}
 	sendScn(t, hsmscn)
 	time.Sleep(10 * time.Second)
+	scnsRcvMutex.Lock()
 	cmpStr = scnCompare(scnList, scnsRcv)
+	scnsRcvMutex.Unlock()
 	if cmpStr != "" {
 		t.Errorf("SCN Miscompare: %s", cmpStr)
 	}
@@ -553,6 +655,132 @@ func TestScnHandler2(t *testing.T) {
 	nwpServer.Close()
 }
 
+func TestMergedFanout(t *testing.T) {
+	var kverr error
+	var mutex sync.Mutex
+	rcv := make(map[string][]Scn)
+	bodies := make(map[string]string)
+
+	disable_logs()
+	if scnWorkPool == nil {
+		scnWorkPool = base.NewWorkerPool(10, 10)
+		scnWorkPool.Run()
+	}
+	if htrans.transport == nil {
+		htrans.transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		htrans.client = &http.Client{Transport: htrans.transport,
+			Timeout: 5 * time.Second,
+		}
+	}
+	kverr = openTestKV()
+	if kverr != nil {
+		t.Fatal("KV/ETCD open failed:", kverr)
+	}
+	defer kvPurge(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var scn Scn
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &scn)
+		mutex.Lock()
+		rcv[r.URL.Path] = append(rcv[r.URL.Path], scn)
+		bodies[r.URL.Path] = string(body)
+		mutex.Unlock()
+	}))
+	defer srv.Close()
+
+	//Two overlapping subscriptions to one URL, one to another.
+
+	subs := []ScnSubscribe{
+		{Components: []string{"x1000c0s0b0n0", "x1000c0s0b0n1"},
+			States: []string{"ready"}, Url: srv.URL + "/a"},
+		{Components: []string{"x1000c0s0b0n1", "x1000c0s0b0n2"},
+			States: []string{"ready", "off"}, Url: srv.URL + "/a"},
+		{Components: []string{"x1000c0s0b0n2"},
+			States: []string{"ready", "on"}, Url: srv.URL + "/b"},
+	}
+	for _, sub := range subs {
+		key := makeSubscriptionKey_V2(sub, "x1000c0s1b0n0", "pcs")
+		err := storeSubscriptionEntry(key, SubData{Url: sub.Url,
+			ScnNodes: sub.Components, Generation: newSubscriptionGeneration()})
+		if err != nil {
+			t.Fatal("ERROR storing subscription:", err)
+		}
+	}
+
+	doScn(Scn{Components: []string{"x1000c0s0b0n0", "x1000c0s0b0n1",
+		"x1000c0s0b0n2", "x1000c0s0b0n3"}, State: "Ready"})
+	start := time.Now()
+	for time.Since(start) < 10*time.Second {
+		mutex.Lock()
+		ndone := len(rcv["/a"]) + len(rcv["/b"])
+		mutex.Unlock()
+		if ndone >= 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitSubQueues(t)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(rcv["/a"]) != 1 {
+		t.Fatalf("ERROR, expected 1 SCN to merged URL, got %d", len(rcv["/a"]))
+	}
+	comps := rcv["/a"][0].Components
+	sort.Strings(comps)
+	if fmt.Sprint(comps) != "[x1000c0s0b0n0 x1000c0s0b0n1 x1000c0s0b0n2]" {
+		t.Errorf("ERROR, merged SCN components: %v", comps)
+	}
+	var msubs []string
+	for _, sub := range rcv["/a"][0].Subscriptions {
+		msubs = append(msubs, fmt.Sprint(sub.Subscriber, sub.States))
+	}
+	sort.Strings(msubs)
+	if fmt.Sprint(msubs) != "[pcs@x1000c0s1b0n0[ready off] pcs@x1000c0s1b0n0[ready]]" {
+		t.Errorf("ERROR, merged SCN subscriptions: %v", msubs)
+	}
+	if (len(rcv["/b"]) != 1) ||
+		(fmt.Sprint(rcv["/b"][0].Components) != "[x1000c0s0b0n2]") {
+		t.Errorf("ERROR, bad SCNs to other URL: %v", rcv["/b"])
+	}
+
+	//Subscriptions are identified as the subscriptions API lists them,
+	//never by their ETCD keys.
+
+	exp := `"Subscriptions":[{"Subscriber":"pcs@x1000c0s1b0n0","States":["ready","on"]}]`
+	if !strings.Contains(bodies["/b"], exp) {
+		t.Errorf("ERROR, SCN payload subscriptions: %s, exp %s", bodies["/b"], exp)
+	}
+	for url, body := range bodies {
+		if strings.Contains(body, SUBSCRIBER_KEY_PREFIX+SUBSCRIBER_KEY_DELIM) {
+			t.Errorf("ERROR, subscription key in SCN payload to '%s': %s", url, body)
+		}
+	}
+}
+
+func TestScnSubscription(t *testing.T) {
+	tests := []struct {
+		key string
+		exp string
+	}{
+		{"sub#x0c1s2b0n3#hs.ready.off#roles.compute#svc.handler",
+			`{"Subscriber":"handler@x0c1s2b0n3","States":["ready","off"],"Roles":["compute"]}`},
+		{"sub#x0c1s2b0n3#ss.adminup#enbl.enbl#subroles.worker",
+			`{"Subscriber":"x0c1s2b0n3","SoftwareStatus":["adminup"],"Enabled":true,"SubRoles":["worker"]}`},
+		{"sub#" + serviceSubscriberID("pcs") + "#hs.on#svc.power",
+			`{"Subscriber":"power@` + serviceSubscriberID("pcs") + `","States":["on"]}`},
+		{"sub", `{"Subscriber":""}`},
+	}
+	for _, tt := range tests {
+		ba, _ := json.Marshal(scnSubscription(tt.key))
+		if string(ba) != tt.exp {
+			t.Errorf("ERROR, '%s' expected %s, got %s", tt.key, tt.exp, string(ba))
+		}
+	}
+}
+
 func TestSubscriptionsHandler(t *testing.T) {
 	var key string
 	var kverr error
@@ -564,7 +792,7 @@ func TestSubscriptionsHandler(t *testing.T) {
 	//Shortcut: stuff the ETCD KV with subscriptions, then use the func to
 	//read them out.
 
-	kvHandle, kverr = hmetcd.Open("mem:", "")
+	kverr = openTestKV()
 	if kverr != nil {
 		t.Fatal("KV/ETCD open failed:", kverr)
 	}
@@ -770,7 +998,8 @@ func TestPrune(t *testing.T) {
 
 	disable_logs()
 
-	//Make sure the pruning loop is running.
+	//Make sure the pruning loop is running.  Only the leader prunes.
+	setLeader(true)
 	go prune()
 	if !gofuncsRunning {
 		go handleSCNs()
@@ -780,11 +1009,12 @@ func TestPrune(t *testing.T) {
 	//Shortcut: stuff the ETCD KV with subscriptions, then use the func to
 	//read them out.
 
-	kvHandle, kverr = hmetcd.Open("mem:", "")
+	kverr = openTestKV()
 	if kverr != nil {
 		t.Fatal("KV/ETCD open failed:", kverr)
 	}
 	defer kvPurge(t)
+	defer func() { prune_stop <- true }()
 
 	subdata.Url = "a.b.c.d"
 	subdata.ScnNodes = []string{"x1c1s1b0n1"}
@@ -1,6 +1,6 @@
 // MIT License
 //
-// (C) Copyright [2019-2021,2023] Hewlett Packard Enterprise Development LP
+// (C) Copyright [2019-2021,2023,2026] Hewlett Packard Enterprise Development LP
 //
 // Permission is hereby granted, free of charge, to any person obtaining a
 // copy of this software and associated documentation files (the "Software"),
@@ -52,6 +52,20 @@ func subscriptionsAgentDeleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	deleteAgentSubscription(w, r, xname, agent)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Delete a subscriber agent's subscriptions.
+//
+// w(in):     HTTP response writer.
+// r(in):     HTTP request.
+// xname(in): Subscriber ID, an XName or a service subscriber ID.
+// agent(in): Subscriber agent.
+// Return:    None.
+/////////////////////////////////////////////////////////////////////////////
+
+func deleteAgentSubscription(w http.ResponseWriter, r *http.Request, xname string, agent string) {
 	log.Printf("Received a subscription DELETE request.\n")
 
 	skvlist, serr := kvHandle.GetRange(SUBSCRIBER_KEYRANGE_START, SUBSCRIBER_KEYRANGE_END)
@@ -66,21 +80,17 @@ func subscriptionsAgentDeleteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	matched := false
+	ncan := 0
 
 	for _, sub := range skvlist {
 		//Get the service name from the key.  It can be a simple XName or svc@XName.
 		//Gotta get the XName token (always first after sub), then get optional
 		//service name (defined by svc.xxx in the key)
 
-		toks := strings.Split(sub.Key, SUBSCRIBER_KEY_DELIM)
-		subXName := toks[SUBSCRIBER_TOKNUM_XNAME]
-		subAgent := ""
+		subXName, subAgent := parseSubscriptionKey(sub.Key)
 		subsvc := subXName
-		ix := strings.Index(sub.Key, SUBSCRIBER_KEY_SVC)
-		if ix > 0 {
-			tt := strings.Split(sub.Key[(ix+len(SUBSCRIBER_KEY_SVC)+1):], SUBSCRIBER_KEY_DELIM)
-			subAgent = tt[0]
-			subsvc = tt[0] + SUBSCRIBER_SVC_DELIM + subXName
+		if subAgent != "" {
+			subsvc = subAgent + SUBSCRIBER_SVC_DELIM + subXName
 		}
 
 		if app_params.Debug > 1 {
@@ -96,11 +106,16 @@ func subscriptionsAgentDeleteHandler(w http.ResponseWriter, r *http.Request) {
 			if err != nil {
 				log.Println("WARNING, key not deleted:", sub.Key, ":", err)
 			} else {
-				//Put this in the pruning map to prevent stuff in the Q
-				//destined for this node from getting sent.
-				prunemap_mutex.Lock()
-				prunemap[subsvc] = true
-				prunemap_mutex.Unlock()
+				//Cancel what's queued for this subscription, and put it in
+				//the pruning map to prevent anything else in the Q destined
+				//for this node from getting sent.
+				forgetSubscriptionGeneration(sub.Key)
+				ncan += cancelStaleSends(sub.Key)
+				trigger := r.Method + " " + r.URL.Path
+				markPruneLocked(subsvc, PRUNE_REASON_API_DELETE, trigger)
+				logPrune(newPruneRecord(sub.Key, sub.Value,
+					pruneCause{Reason: PRUNE_REASON_API_DELETE,
+						Trigger: trigger}, PRUNE_ACTION_DELETED))
 			}
 		}
 	}
@@ -116,6 +131,7 @@ func subscriptionsAgentDeleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	setCancelledHeader(w, ncan)
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -135,6 +151,19 @@ func subscriptionsXNameDeleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	deleteSubscriberSubscriptions(w, r, xname)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Delete all of a subscriber's subscriptions.
+//
+// w(in):     HTTP response writer.
+// r(in):     HTTP request.
+// xname(in): Subscriber ID, an XName or a service subscriber ID.
+// Return:    None.
+/////////////////////////////////////////////////////////////////////////////
+
+func deleteSubscriberSubscriptions(w http.ResponseWriter, r *http.Request, xname string) {
 	log.Printf("Received a subscription DELETE request.\n")
 
 	skvlist, serr := kvHandle.GetRange(SUBSCRIBER_KEYRANGE_START, SUBSCRIBER_KEYRANGE_END)
@@ -148,20 +177,16 @@ func subscriptionsXNameDeleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ncan := 0
 	for _, sub := range skvlist {
 		//Get the service name from the key.  It can be a simple XName or svc@XName.
 		//Gotta get the XName token (always first after sub), then get optional
 		//service name (defined by svc.xxx in the key)
 
-		toks := strings.Split(sub.Key, SUBSCRIBER_KEY_DELIM)
-		subXName := toks[SUBSCRIBER_TOKNUM_XNAME]
-		subAgent := ""
+		subXName, subAgent := parseSubscriptionKey(sub.Key)
 		subsvc := subXName
-		ix := strings.Index(sub.Key, SUBSCRIBER_KEY_SVC)
-		if ix > 0 {
-			tt := strings.Split(sub.Key[(ix+len(SUBSCRIBER_KEY_SVC)+1):], SUBSCRIBER_KEY_DELIM)
-			subAgent = tt[0]
-			subsvc = tt[0] + SUBSCRIBER_SVC_DELIM + subXName
+		if subAgent != "" {
+			subsvc = subAgent + SUBSCRIBER_SVC_DELIM + subXName
 		}
 
 		if app_params.Debug > 1 {
@@ -176,20 +201,24 @@ func subscriptionsXNameDeleteHandler(w http.ResponseWriter, r *http.Request) {
 			if err != nil {
 				log.Println("WARNING, key not deleted:", sub.Key, ":", err)
 			} else {
-				//Put this in the pruning map to prevent stuff in the Q
-				//destined for this node from getting sent.
-				prunemap_mutex.Lock()
-				prunemap[subsvc] = true
-				prunemap_mutex.Unlock()
+				//Cancel what's queued for this subscription, and put it in
+				//the pruning map to prevent anything else in the Q destined
+				//for this node from getting sent.
+				forgetSubscriptionGeneration(sub.Key)
+				ncan += cancelStaleSends(sub.Key)
+				trigger := r.Method + " " + r.URL.Path
+				markPruneLocked(subsvc, PRUNE_REASON_API_DELETE, trigger)
+				logPrune(newPruneRecord(sub.Key, sub.Value,
+					pruneCause{Reason: PRUNE_REASON_API_DELETE,
+						Trigger: trigger}, PRUNE_ACTION_DELETED))
 			}
 		}
 	}
+	setCancelledHeader(w, ncan)
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func subscriptionsAgentPostHandler(w http.ResponseWriter, r *http.Request) {
-	var jdata ScnSubscribe
-
 	// /subscriptions/{xname}/agents/{agent}
 	uvars := mux.Vars(r)
 	xn, _ := uvars["xname"]
@@ -206,6 +235,34 @@ func subscriptionsAgentPostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if xnametypes.GetHMSType(xname) == xnametypes.HMSTypeInvalid {
+		//This is not a valid XName.  We can't accept this, since it will
+		//make pruning not work.
+		log.Printf("Invalid subscriber XName: '%s'.\n", xname)
+		pdet := base.NewProblemDetails("about:blank",
+			"Invalid Request",
+			"Subcriber is not a valid XName",
+			r.URL.Path, http.StatusBadRequest)
+		base.SendProblemDetails(w, pdet, 0)
+		return
+	}
+
+	postAgentSubscription(w, r, xname, agent)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Create a subscriber agent's subscription.
+//
+// w(in):     HTTP response writer.
+// r(in):     HTTP request.
+// xname(in): Subscriber ID, an XName or a service subscriber ID.
+// agent(in): Subscriber agent.
+// Return:    None.
+/////////////////////////////////////////////////////////////////////////////
+
+func postAgentSubscription(w http.ResponseWriter, r *http.Request, xname string, agent string) {
+	var jdata ScnSubscribe
+
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		log.Println("Error on message read:", err)
@@ -222,10 +279,33 @@ func subscriptionsAgentPostHandler(w http.ResponseWriter, r *http.Request) {
 		handleSubscribePostError(r.URL.Path, w, body)
 		return
 	}
+	creds, err := getSubscriptionCreds(body)
+	if err != nil {
+		pdet := base.NewProblemDetails("about:blank",
+			"Invalid Request",
+			"Invalid data type in Secret or Auth field.",
+			r.URL.Path, http.StatusBadRequest)
+		base.SendProblemDetails(w, pdet, 0)
+		return
+	}
 
 	//Make sure all mandatory fields are present.
 
+	var secret, auth string
+	var authInfo *SubscriptionAuth
 	err = checkSubscription_v2(jdata)
+	if err == nil {
+		err = checkSubscriptionLease(jdata, xname)
+	}
+	if err == nil {
+		err = checkSubscriptionDelivery(jdata.Delivery)
+	}
+	if err == nil {
+		secret, err = checkSubscriptionSecret(creds.Secret)
+	}
+	if err == nil {
+		auth, authInfo, err = checkSubscriptionAuth(creds.Auth)
+	}
 	if err != nil {
 		log.Println("Missing subscription payload fields:", err)
 		pdet := base.NewProblemDetails("about:blank",
@@ -238,19 +318,7 @@ func subscriptionsAgentPostHandler(w http.ResponseWriter, r *http.Request) {
 
 	if app_params.Debug > 0 {
 		log.Printf("Received a subscription POST request, payload '%s'.\n",
-			string(body))
-	}
-
-	if xnametypes.GetHMSType(xname) == xnametypes.HMSTypeInvalid {
-		//This is not a valid XName.  We can't accept this, since it will
-		//make pruning not work.
-		log.Printf("Invalid subscriber XName: '%s'.\n", xname)
-		pdet := base.NewProblemDetails("about:blank",
-			"Invalid Request",
-			"Subcriber is not a valid XName",
-			r.URL.Path, http.StatusBadRequest)
-		base.SendProblemDetails(w, pdet, 0)
-		return
+			redactSubscriptionBody(body, creds))
 	}
 
 	//Construct the subscription ETCD key and see if it already exists.
@@ -285,10 +353,24 @@ func subscriptionsAgentPostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//No existing key.  Make one.
+	//No existing key.  Make one.  If an initial snapshot was asked for,
+	//hold live SCNs for it until the snapshot goes out.
+
+	subscriber := agent + SUBSCRIBER_SVC_DELIM + xname
+	newSD := SubData{Url: jdata.Url, ScnNodes: jdata.Components,
+		Durable: jdata.Durable, Generation: newSubscriptionGeneration(),
+		Delivery: jdata.Delivery, Secret: secret, Auth: auth,
+		AuthInfo: authInfo}
+	setSubscriptionLease(&newSD, jdata.LeaseSeconds)
+	if jdata.InitialSnapshot {
+		snapshotHoldStart(subscriber, jdata.Url, newSD.sendOpts())
+	}
 
-	err = makeSubscriptionEntry(jdata.Components, jdata.Url, subKey)
+	err = storeSubscriptionEntry(subKey, newSD)
 	if err != nil {
+		if jdata.InitialSnapshot {
+			snapshotHoldRelease(subscriber, jdata.Url)
+		}
 		pdet := base.NewProblemDetails("about:blank",
 			"Internal Server Error",
 			err.Error(),
@@ -296,8 +378,14 @@ func subscriptionsAgentPostHandler(w http.ResponseWriter, r *http.Request) {
 		base.SendProblemDetails(w, pdet, 0)
 		return
 	}
+	noteSubscriptionGeneration(subKey, newSD.Generation)
+	clearPruneDecisions(parseSubscriptionKey(subKey))
 	hsmsub_chan <- jdata //subscribe to SCN from HSM
 
+	if jdata.InitialSnapshot {
+		go deliverInitialSnapshot(jdata, subscriber, newSD.sendOpts())
+	}
+
 	w.Header().Add("Connection", "close")
 	w.WriteHeader(http.StatusOK)
 }
@@ -312,8 +400,6 @@ func subscriptionsAgentPostHandler(w http.ResponseWriter, r *http.Request) {
 /////////////////////////////////////////////////////////////////////////////
 
 func subscriptionsAgentPatchHandler(w http.ResponseWriter, r *http.Request) {
-	var jdata ScnSubscribe
-
 	// /subscriptions/{xname}/agents/{agent}
 	uvars := mux.Vars(r)
 	xn, _ := uvars["xname"]
@@ -330,6 +416,22 @@ func subscriptionsAgentPatchHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	patchAgentSubscription(w, r, xname, agent)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Replace a subscriber agent's subscription.
+//
+// w(in):     HTTP response writer.
+// r(in):     HTTP request.
+// xname(in): Subscriber ID, an XName or a service subscriber ID.
+// agent(in): Subscriber agent.
+// Return:    None.
+/////////////////////////////////////////////////////////////////////////////
+
+func patchAgentSubscription(w http.ResponseWriter, r *http.Request, xname string, agent string) {
+	var jdata ScnSubscribe
+
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		log.Println("Error on message read:", err)
@@ -346,10 +448,41 @@ func subscriptionsAgentPatchHandler(w http.ResponseWriter, r *http.Request) {
 		handleSubscribePostError(r.URL.Path, w, body)
 		return
 	}
+	creds, err := getSubscriptionCreds(body)
+	if err != nil {
+		pdet := base.NewProblemDetails("about:blank",
+			"Invalid Request",
+			"Invalid data type in Secret or Auth field.",
+			r.URL.Path, http.StatusBadRequest)
+		base.SendProblemDetails(w, pdet, 0)
+		return
+	}
 
 	if app_params.Debug > 0 {
 		log.Printf("Received a subscription PATCH request, payload: '%s'\n",
-			string(body))
+			redactSubscriptionBody(body, creds))
+	}
+
+	var secret, auth string
+	var authInfo *SubscriptionAuth
+	err = checkSubscriptionLease(jdata, xname)
+	if err == nil {
+		err = checkSubscriptionDelivery(jdata.Delivery)
+	}
+	if err == nil {
+		secret, err = checkSubscriptionSecret(creds.Secret)
+	}
+	if err == nil {
+		auth, authInfo, err = checkSubscriptionAuth(creds.Auth)
+	}
+	if err != nil {
+		log.Println("Invalid subscription payload fields:", err)
+		pdet := base.NewProblemDetails("about:blank",
+			"Invalid Request",
+			err.Error(),
+			r.URL.Path, http.StatusBadRequest)
+		base.SendProblemDetails(w, pdet, 0)
+		return
 	}
 
 	subscriber_xname := jdata.Subscriber
@@ -372,24 +505,10 @@ func subscriptionsAgentPatchHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	svcKeyDesc := SUBSCRIBER_KEY_SVC + SUBSCRIBER_KEYCAT_DELIM
-
 	for _, kv := range skvlist {
-		toks := strings.Split(kv.Key, SUBSCRIBER_KEY_DELIM)
-		svcXName := toks[SUBSCRIBER_TOKNUM_XNAME]
-		svcAgent := ""
-
 		//Find the service token, if any, match with jdata.Subscriber
 
-		ix := strings.Index(kv.Key, svcKeyDesc)
-		if ix > 0 {
-			iy := strings.Index(kv.Key[ix:], SUBSCRIBER_KEY_DELIM)
-			if iy == -1 {
-				svcAgent = kv.Key[ix+len(svcKeyDesc):]
-			} else {
-				svcAgent = kv.Key[ix+len(svcKeyDesc) : iy-1]
-			}
-		}
+		svcXName, svcAgent := parseSubscriptionKey(kv.Key)
 
 		//Read the key's value and match the Url
 
@@ -414,6 +533,13 @@ func subscriptionsAgentPatchHandler(w http.ResponseWriter, r *http.Request) {
 			var newSD SubData
 			newSD.Url = jdata.Url
 			newSD.ScnNodes = jdata.Components
+			newSD.Durable = jdata.Durable
+			newSD.Delivery = jdata.Delivery
+			newSD.Secret = secret
+			newSD.Auth = auth
+			newSD.AuthInfo = authInfo
+			newSD.Generation = newSubscriptionGeneration()
+			setSubscriptionLease(&newSD, jdata.LeaseSeconds)
 
 			exKey := makeSubscriptionKey_V2(jdata, xname, agent)
 			if exKey != kv.Key {
@@ -437,7 +563,13 @@ func subscriptionsAgentPatchHandler(w http.ResponseWriter, r *http.Request) {
 						kv.Key)
 				}
 			}
-			makeSubscriptionEntry(jdata.Components, jdata.Url, exKey)
+			if storeSubscriptionEntry(exKey, newSD) == nil {
+				noteSubscriptionGeneration(exKey, newSD.Generation)
+			}
+			if exKey != kv.Key {
+				forgetSubscriptionGeneration(kv.Key)
+			}
+			cancelStaleSends(kv.Key)
 			break
 		}
 	}
@@ -455,8 +587,6 @@ func subscriptionsAgentPatchHandler(w http.ResponseWriter, r *http.Request) {
 /////////////////////////////////////////////////////////////////////////////
 
 func subscriptionsXNameGetHandler(w http.ResponseWriter, r *http.Request) {
-	var sublist SubscriptionList
-
 	if r.Method != "GET" {
 		log.Printf("ERROR: request is not a GET.\n")
 		pdet := base.NewProblemDetails("about:blank",
@@ -482,6 +612,21 @@ func subscriptionsXNameGetHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	getSubscriberSubscriptions(w, r, xname)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get a subscriber's subscriptions.
+//
+// w(in):     HTTP response writer.
+// r(in):     HTTP request.
+// xname(in): Subscriber ID, an XName or a service subscriber ID.
+// Return:    None.
+/////////////////////////////////////////////////////////////////////////////
+
+func getSubscriberSubscriptions(w http.ResponseWriter, r *http.Request, xname string) {
+	var sublist SubscriptionList
+
 	//Formulate a JSON payload from our subscription data.  Get all
 	//subscription keys from the KV store, iterate over them, and
 	//build up the JSON data.
@@ -532,6 +677,12 @@ func subscriptionsXNameGetHandler(w http.ResponseWriter, r *http.Request) {
 
 		subinfo.Components = subkeydata.ScnNodes
 		subinfo.Url = subkeydata.Url
+		subinfo.Durable = subkeydata.Durable
+		subinfo.Suspended = subkeydata.Suspended
+		subinfo.LeaseSeconds = subkeydata.LeaseSeconds
+		subinfo.LeaseExpires = subkeydata.LeaseExpires
+		subinfo.Delivery = subkeydata.Delivery
+		subinfo.Auth = subkeydata.AuthInfo
 		sublist.SubscriptionList = append(sublist.SubscriptionList, subinfo)
 	}
 
@@ -30,8 +30,6 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
-
-	"github.com/Cray-HPE/hms-hmetcd"
 )
 
 type subStuff struct {
@@ -52,7 +50,7 @@ func TestScnSubscribeHandler_v2(t *testing.T) {
 
 	//Set up ETCD
 
-	kvHandle, kverr = hmetcd.Open("mem:", "")
+	kverr = openTestKV()
 	if kverr != nil {
 		t.Fatal("KV/ETCD open failed:", kverr)
 	}
@@ -215,7 +213,7 @@ func TestSubscriptionsHandler_v2(t *testing.T) {
 	//Shortcut: stuff the ETCD KV with subscriptions, then use the func to
 	//read them out.
 
-	kvHandle, kverr = hmetcd.Open("mem:", "")
+	kverr = openTestKV()
 	if kverr != nil {
 		t.Fatal("KV/ETCD open failed:", kverr)
 	}
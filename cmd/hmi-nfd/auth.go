@@ -0,0 +1,315 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A note about outbound subscription auth:
+//
+// Some subscribers sit behind a gateway which wants a bearer token or an
+// API key header.  A v2 subscription can have an "Auth" with any of:
+//
+//   BearerToken: sent as "Authorization: Bearer <token>".
+//   TokenFile:   name of a file in the token directory holding the bearer
+//                token.
+//                It is re-read when it changes, so it can be rotated (e.g.
+//                a mounted Kubernetes secret) without touching the
+//                subscription.
+//   Headers:     other headers to send, e.g. an API key.
+//
+// Only one of BearerToken and TokenFile can be given.  Token files must be
+// in the token directory, which is only set at startup, so that a subscription
+// can't have hmnfd send it any other file.  Like subscription secrets, the
+// Auth is stored encrypted in ETCD (so a secret key file is needed), and
+// the token and header values are redacted wherever it is shown or logged.
+
+/////////////////////////////////////////////////////////////////////////////
+// Constants
+/////////////////////////////////////////////////////////////////////////////
+
+const (
+	AUTH_MAX_HEADERS    = 20
+	AUTH_MAX_VALUE_LEN  = 4096
+	AUTH_REDACTED       = "<redacted>"
+	AUTH_TOKEN_FILE_MAX = 16384
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Data structures
+/////////////////////////////////////////////////////////////////////////////
+
+// Outbound auth for a subscription's SCN deliveries.
+
+type SubscriptionAuth struct {
+	BearerToken string            `json:"BearerToken,omitempty"`
+	TokenFile   string            `json:"TokenFile,omitempty"`
+	Headers     map[string]string `json:"Headers,omitempty"`
+}
+
+// A token file's contents, kept until the file changes.
+
+type tokenFileEntry struct {
+	modTime time.Time
+	size    int64
+	token   string
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Global variables
+/////////////////////////////////////////////////////////////////////////////
+
+var tokenDir string
+var tokenFiles = make(map[string]*tokenFileEntry)
+var tokenFiles_mutex sync.Mutex
+
+// HTTP header field names are RFC 7230 tokens.
+
+var authHeaderRE = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+
+// Headers hmnfd sets itself, which a subscription can't.
+
+var authReservedHeaders = []string{"Connection", "Content-Length",
+	"Content-Type", "Host", "Transfer-Encoding", "User-Agent",
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Set the directory subscription token files are read from.
+//
+// dir(in): Token directory.
+// Return:  nil on success, error string if it isn't a directory.
+/////////////////////////////////////////////////////////////////////////////
+
+func setTokenDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("'%s' is not a directory", dir)
+	}
+	tokenDir = filepath.Clean(dir)
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get the path of a subscription's token file.
+//
+// name(in): Token file name, relative to the token directory.
+// Return:   Full path; nil on success, error string if it isn't allowed.
+/////////////////////////////////////////////////////////////////////////////
+
+func tokenFilePath(name string) (string, error) {
+	if tokenDir == "" {
+		return "", fmt.Errorf("token files are not enabled, no token directory is set")
+	}
+	if (name == "") || filepath.IsAbs(name) ||
+		(filepath.Clean(name) != name) || strings.HasPrefix(name, "..") {
+		return "", fmt.Errorf("TokenFile '%s' must be a plain name in the token directory",
+			name)
+	}
+	return filepath.Join(tokenDir, name), nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Read the bearer token in a token file.  The file is only read again when
+// its modification time or size changes.
+//
+// name(in): Token file name, relative to the token directory.
+// Return:   Token; nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func readTokenFile(name string) (string, error) {
+	path, err := tokenFilePath(name)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	tokenFiles_mutex.Lock()
+	defer tokenFiles_mutex.Unlock()
+	tfe, ok := tokenFiles[path]
+	if ok && tfe.modTime.Equal(fi.ModTime()) && (tfe.size == fi.Size()) {
+		return tfe.token, nil
+	}
+
+	if fi.Size() > AUTH_TOKEN_FILE_MAX {
+		return "", fmt.Errorf("token file '%s' is too large", name)
+	}
+	ba, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(ba))
+	if token == "" {
+		return "", fmt.Errorf("token file '%s' is empty", name)
+	}
+	tokenFiles[path] = &tokenFileEntry{modTime: fi.ModTime(), size: fi.Size(),
+		token: token}
+	if ok && (app_params.Debug > 0) {
+		log.Printf("INFO: Reloaded token file '%s'.\n", path)
+	}
+	return token, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Check a subscription's outbound auth.
+//
+// auth(in): Outbound auth, may be nil.
+// Return:   nil if OK, else error describing the problem.
+/////////////////////////////////////////////////////////////////////////////
+
+func verifySubscriptionAuth(auth *SubscriptionAuth) error {
+	if (auth.BearerToken != "") && (auth.TokenFile != "") {
+		return fmt.Errorf("Auth can't have both BearerToken and TokenFile")
+	}
+	if (len(auth.BearerToken) > AUTH_MAX_VALUE_LEN) ||
+		strings.ContainsAny(auth.BearerToken, "\r\n") {
+		return fmt.Errorf("Auth BearerToken is invalid")
+	}
+	if auth.TokenFile != "" {
+		if _, err := tokenFilePath(auth.TokenFile); err != nil {
+			return err
+		}
+	}
+
+	if len(auth.Headers) > AUTH_MAX_HEADERS {
+		return fmt.Errorf("Auth has %d Headers, max is %d", len(auth.Headers),
+			AUTH_MAX_HEADERS)
+	}
+	for name, val := range auth.Headers {
+		if !authHeaderRE.MatchString(name) {
+			return fmt.Errorf("Auth header name '%s' is invalid", name)
+		}
+		cname := http.CanonicalHeaderKey(name)
+		if inListFold(authReservedHeaders, cname) ||
+			strings.HasPrefix(cname, "X-Hmnfd-") {
+			return fmt.Errorf("Auth header '%s' is set by hmnfd", name)
+		}
+		if (cname == "Authorization") &&
+			((auth.BearerToken != "") || (auth.TokenFile != "")) {
+			return fmt.Errorf("Auth header 'Authorization' conflicts with the bearer token")
+		}
+		if (len(val) > AUTH_MAX_VALUE_LEN) || strings.ContainsAny(val, "\r\n") {
+			return fmt.Errorf("Auth header '%s' value is invalid", name)
+		}
+	}
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get a copy of a subscription's outbound auth that is safe to show, with
+// its token and header values redacted.
+//
+// auth(in): Outbound auth.
+// Return:   Redacted outbound auth.
+/////////////////////////////////////////////////////////////////////////////
+
+func redactSubscriptionAuth(auth *SubscriptionAuth) *SubscriptionAuth {
+	ra := &SubscriptionAuth{TokenFile: auth.TokenFile}
+	if auth.BearerToken != "" {
+		ra.BearerToken = AUTH_REDACTED
+	}
+	if len(auth.Headers) > 0 {
+		ra.Headers = make(map[string]string)
+		for name := range auth.Headers {
+			ra.Headers[name] = AUTH_REDACTED
+		}
+	}
+	return ra
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Check a subscription's outbound auth, and encrypt it for storage.
+//
+// auth(in): Outbound auth from the request, may be nil.
+// Return:   Encrypted outbound auth, "" if none; redacted outbound auth to
+//           show, nil if none; nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func checkSubscriptionAuth(auth *SubscriptionAuth) (string, *SubscriptionAuth, error) {
+	if (auth == nil) || ((auth.BearerToken == "") && (auth.TokenFile == "") &&
+		(len(auth.Headers) == 0)) {
+		return "", nil, nil
+	}
+	if err := verifySubscriptionAuth(auth); err != nil {
+		return "", nil, err
+	}
+	ba, err := json.Marshal(auth)
+	if err != nil {
+		return "", nil, err
+	}
+	enc, err := encryptSecret(string(ba))
+	if err != nil {
+		return "", nil, err
+	}
+	return enc, redactSubscriptionAuth(auth), nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get the headers to send for a subscription's outbound auth.
+//
+// enc(in): Encrypted outbound auth, from checkSubscriptionAuth().
+// Return:  Headers to set on SCN delivery requests; nil on success, error
+//          string if the auth or its token file can't be read.
+/////////////////////////////////////////////////////////////////////////////
+
+func subscriptionAuthHeaders(enc string) (http.Header, error) {
+	var auth SubscriptionAuth
+
+	plain, err := decryptSecret(enc)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal([]byte(plain), &auth); err != nil {
+		return nil, fmt.Errorf("invalid stored Auth: %v", err)
+	}
+
+	hdrs := make(http.Header)
+	for name, val := range auth.Headers {
+		hdrs.Set(name, val)
+	}
+	token := auth.BearerToken
+	if auth.TokenFile != "" {
+		if token, err = readTokenFile(auth.TokenFile); err != nil {
+			return nil, err
+		}
+	}
+	if token != "" {
+		hdrs.Set("Authorization", "Bearer "+token)
+	}
+	return hdrs, nil
+}
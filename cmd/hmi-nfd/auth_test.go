@@ -0,0 +1,288 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Set up a test token directory.
+
+func testTokenDir(t *testing.T) string {
+	saved := tokenDir
+	t.Cleanup(func() { tokenDir = saved })
+	dir := t.TempDir()
+	if err := setTokenDir(dir); err != nil {
+		t.Fatal("ERROR setting token directory:", err)
+	}
+	return dir
+}
+
+// Write a test token file, with a given modification time.
+
+func writeTokenFile(t *testing.T, fname, token string, mtime time.Time) {
+	if err := os.WriteFile(fname, []byte(token+"\n"), 0600); err != nil {
+		t.Fatal("Can't write token file:", err)
+	}
+	if err := os.Chtimes(fname, mtime, mtime); err != nil {
+		t.Fatal("Can't set token file time:", err)
+	}
+}
+
+func TestVerifySubscriptionAuth(t *testing.T) {
+	testTokenDir(t)
+	good := []SubscriptionAuth{
+		{BearerToken: "abc"},
+		{TokenFile: "pcs.token"},
+		{Headers: map[string]string{"X-Api-Key": "k", "Authorization": "Basic eA=="}},
+		{BearerToken: "abc", Headers: map[string]string{"x-api-key": "k"}},
+	}
+	bad := []SubscriptionAuth{
+		{BearerToken: "abc", TokenFile: "pcs.token"},
+		{BearerToken: "a\r\nX-Evil: 1"},
+		{TokenFile: "/etc/passwd"},
+		{TokenFile: "../pcs.token"},
+		{TokenFile: "a/../../pcs.token"},
+		{Headers: map[string]string{"Bad Name": "k"}},
+		{Headers: map[string]string{"content-type": "text/plain"}},
+		{Headers: map[string]string{"Host": "h"}},
+		{Headers: map[string]string{"X-HMNFD-Signature": "s"}},
+		{Headers: map[string]string{"X-Api-Key": "k\nX-Evil: 1"}},
+		{BearerToken: "abc", Headers: map[string]string{"authorization": "x"}},
+		{Headers: map[string]string{"X-Api-Key": strings.Repeat("k", AUTH_MAX_VALUE_LEN+1)}},
+	}
+	many := SubscriptionAuth{Headers: make(map[string]string)}
+	for ix := 0; ix <= AUTH_MAX_HEADERS; ix++ {
+		many.Headers[strings.Repeat("h", ix+1)] = "v"
+	}
+	bad = append(bad, many)
+
+	for ix := range good {
+		if err := verifySubscriptionAuth(&good[ix]); err != nil {
+			t.Errorf("ERROR, good auth %d failed: %v", ix, err)
+		}
+	}
+	for ix := range bad {
+		if err := verifySubscriptionAuth(&bad[ix]); err == nil {
+			t.Errorf("ERROR, bad auth %d passed.", ix)
+		}
+	}
+
+	tokenDir = ""
+	if err := verifySubscriptionAuth(&good[1]); err == nil {
+		t.Errorf("ERROR, token file accepted with no token directory.")
+	}
+	if err := setTokenDir("/nonexistent/tokens"); err == nil {
+		t.Errorf("ERROR, missing token directory accepted.")
+	}
+}
+
+func TestReadTokenFile(t *testing.T) {
+	dir := testTokenDir(t)
+	fname := dir + "/pcs.token"
+	now := time.Now().Add(-time.Minute)
+
+	if _, err := readTokenFile("pcs.token"); err == nil {
+		t.Errorf("ERROR, missing token file read.")
+	}
+	writeTokenFile(t, fname, "Token-One", now)
+	if tok, err := readTokenFile("pcs.token"); (err != nil) || (tok != "Token-One") {
+		t.Errorf("ERROR, read token '%s', %v", tok, err)
+	}
+
+	//Changed: re-read.  Same size and time as what's cached: not re-read.
+
+	writeTokenFile(t, fname, "Token-Two", now.Add(time.Second))
+	if tok, _ := readTokenFile("pcs.token"); tok != "Token-Two" {
+		t.Errorf("ERROR, token file not reloaded, got '%s'", tok)
+	}
+	writeTokenFile(t, fname, "Token-Xyz", now.Add(time.Second))
+	if tok, _ := readTokenFile("pcs.token"); tok != "Token-Two" {
+		t.Errorf("ERROR, unchanged token file reloaded, got '%s'", tok)
+	}
+
+	writeTokenFile(t, fname, "  ", now.Add(2*time.Second))
+	if _, err := readTokenFile("pcs.token"); err == nil {
+		t.Errorf("ERROR, empty token file read.")
+	}
+}
+
+func TestRedactSubscriptionAuth(t *testing.T) {
+	body := []byte(`{"Url":"http://x/scn","Auth":{"BearerToken":"Tok-123",` +
+		`"Headers":{"X-Api-Key":"Key-456"}}}`)
+	creds, err := getSubscriptionCreds(body)
+	if err != nil {
+		t.Fatal("ERROR getting creds:", err)
+	}
+	rb := redactSubscriptionBody(body, creds)
+	if strings.Contains(rb, "Tok-123") || strings.Contains(rb, "Key-456") ||
+		!strings.Contains(rb, "X-Api-Key") {
+		t.Errorf("ERROR, auth not redacted: '%s'", rb)
+	}
+
+	ra := redactSubscriptionAuth(creds.Auth)
+	if (ra.BearerToken != AUTH_REDACTED) || (ra.Headers["X-Api-Key"] != AUTH_REDACTED) {
+		t.Errorf("ERROR, bad redacted auth: %v", ra)
+	}
+}
+
+func TestAuthDelivery(t *testing.T) {
+	var kverr error
+	var hdrs []http.Header
+
+	disable_logs()
+	kverr = openTestKV()
+	if kverr != nil {
+		t.Fatal("KV/ETCD open failed:", kverr)
+	}
+	defer kvPurge(t)
+	if htrans.transport == nil {
+		htrans.transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		htrans.client = &http.Client{Transport: htrans.transport,
+			Timeout: 5 * time.Second,
+		}
+	}
+	saved := app_params
+	savedKey := secretKey
+	app_params.Scn_retries = 1
+	app_params.Scn_breaker_threshold = 0
+	defer func() {
+		waitSubQueues(t)
+		restoreAppParams(saved)
+		secretKey = savedKey
+	}()
+	dir := testTokenDir(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hdrs = append(hdrs, r.Header.Clone())
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	router := newRouter(generateRoutes())
+	subUrl := "http://localhost:8080/hmi/v2/subscriptions/x1000c0s1b0n0/agents/pcs"
+	subKey := "sub#x1000c0s1b0n0#hs.ready#svc.pcs"
+	payload := `{"Components":["x1000c0s0b0n0"],"States":["Ready"],"Url":"` +
+		srv.URL + `","Auth":{"BearerToken":"Bearer-Tok-ABC",` +
+		`"Headers":{"X-Api-Key":"Api-Key-XYZ"}}}`
+
+	post := func(method string, pl string) int {
+		req, _ := http.NewRequest(method, subUrl, bytes.NewBufferString(pl))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	send := func(sd SubData) bool {
+		j := NewJobSCNSendSub(Scn{Components: []string{"x1000c0s0b0n0"}, State: "Ready"},
+			"pcs@x1000c0s1b0n0", srv.URL, subKey, sd.Generation,
+			sd.sendOpts()).(*JobSCNSend)
+		return sendSCNToSubscriber(j)
+	}
+
+	//Needs a secret key; bad auth is rejected.
+
+	secretKey = nil
+	if code := post("POST", payload); code != http.StatusBadRequest {
+		t.Errorf("ERROR, auth accepted with no key, returned %d", code)
+	}
+	testSecretKey(t, "the-secret-key")
+	if code := post("POST", strings.Replace(payload, `"BearerToken"`,
+		`"TokenFile":"x.token","BearerToken"`, 1)); code != http.StatusBadRequest {
+		t.Errorf("ERROR, token and token file accepted, returned %d", code)
+	}
+	if code := post("POST", payload); code != http.StatusOK {
+		t.Fatalf("ERROR, POST with auth returned %d", code)
+	}
+
+	//Stored encrypted, listed redacted.
+
+	val, _, _ := kvHandle.Get(subKey)
+	if strings.Contains(strings.ToLower(val), "bearer-tok-abc") ||
+		strings.Contains(strings.ToLower(val), "api-key-xyz") {
+		t.Errorf("ERROR, auth stored in the clear: %s", val)
+	}
+	req, _ := http.NewRequest("GET", "http://localhost:8080/hmi/v2/subscriptions/x1000c0s1b0n0", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if strings.Contains(rr.Body.String(), "Tok-ABC") ||
+		strings.Contains(rr.Body.String(), "Key-XYZ") ||
+		!strings.Contains(rr.Body.String(), `"X-Api-Key":`) {
+		t.Errorf("ERROR, bad subscription list: %s", rr.Body.String())
+	}
+
+	//Deliveries carry the token and headers, with their case intact.
+
+	sd, _ := getSubData(t, subKey)
+	if send(sd) || (len(hdrs) != 1) {
+		t.Fatalf("ERROR, delivery with auth failed.")
+	}
+	if (hdrs[0].Get("Authorization") != "Bearer Bearer-Tok-ABC") ||
+		(hdrs[0].Get("X-Api-Key") != "Api-Key-XYZ") ||
+		(hdrs[0].Get("Content-Type") != "application/json") {
+		t.Errorf("ERROR, bad delivery headers: %v", hdrs[0])
+	}
+
+	//Token file: read on delivery, and re-read when rotated.
+
+	now := time.Now().Add(-time.Minute)
+	writeTokenFile(t, dir+"/pcs.token", "File-Token-1", now)
+	if code := post("PATCH", `{"Components":["x1000c0s0b0n0"],"States":["Ready"],"Url":"`+
+		srv.URL+`","Auth":{"TokenFile":"pcs.token"}}`); code != http.StatusNoContent {
+		t.Fatalf("ERROR, PATCH with token file returned %d", code)
+	}
+	sd, _ = getSubData(t, subKey)
+	send(sd)
+	writeTokenFile(t, dir+"/pcs.token", "File-Token-2", now.Add(time.Second))
+	send(sd)
+	if (len(hdrs) != 3) || (hdrs[1].Get("Authorization") != "Bearer File-Token-1") ||
+		(hdrs[2].Get("Authorization") != "Bearer File-Token-2") ||
+		(hdrs[2].Get("X-Api-Key") != "") {
+		t.Errorf("ERROR, bad token file deliveries: %v", hdrs)
+	}
+
+	//Token file gone: not sent, kept as a dead letter without the auth
+	//showing.
+
+	os.Remove(dir + "/pcs.token")
+	if send(sd) || (len(hdrs) != 3) {
+		t.Errorf("ERROR, SCN sent without its token.")
+	}
+	var dlist DeadLetterList
+	req, _ = http.NewRequest("GET", "http://localhost:8080/hmi/v2/deadletters", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	json.Unmarshal(rr.Body.Bytes(), &dlist)
+	if (len(dlist.DeadLetters) != 1) || (dlist.DeadLetters[0].Auth != "") {
+		t.Errorf("ERROR, bad dead letters: %s", rr.Body.String())
+	}
+}
@@ -0,0 +1,256 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/Cray-HPE/hms-base/v2"
+)
+
+// A note about batched deliveries:
+//
+// A subscriber matching many SCNs in a row, like a workload manager
+// subscribed to all nodes, normally gets one POST per SCN.  A subscription
+// can instead have its SCNs batched, with these Delivery settings:
+//
+//   BatchWindowMs: how long to wait, after an SCN is queued, for more to
+//                  send along with it.  0 means don't wait, just send what
+//                  is already queued.
+//   BatchMaxScns:  the most SCNs sent in one POST.  Once this many are
+//                  queued they are sent without waiting out the window.
+//                  0 means DELIVERY_DEF_BATCH_SCNS.
+//
+// If either is set, the subscription's SCNs are always POSTed as a JSON
+// array, even if there is only one, and each SCN in it has a Sequence,
+// given when it is queued.  Sequences increase, so subscribers can put SCNs
+// in order and spot duplicates; a batch that is retried keeps them.  They
+// are unique per replica, and since they're timestamps, are close to in
+// order across replicas.
+//
+// Batches are made by the subscriber's queue, from SCNs at its head going
+// to the same URL with the same send options.  The batch is sent, retried
+// and dead-lettered as a unit, except that SCNs in it whose subscription is
+// deleted or changed, or that are cancelled, are left out when it is sent.
+
+/////////////////////////////////////////////////////////////////////////////
+// Constants and Global Data
+/////////////////////////////////////////////////////////////////////////////
+
+const (
+	DELIVERY_MAX_BATCH_WINDOW = 10000
+	DELIVERY_MAX_BATCH_SCNS   = 1000
+	DELIVERY_DEF_BATCH_SCNS   = 100
+)
+
+var lastScnSeq int64
+var lastScnSeq_mutex sync.Mutex
+
+// Check if a subscription's SCNs are batched.
+
+func deliveryBatched(dp *DeliveryPolicy) bool {
+	return (dp != nil) && ((dp.BatchWindowMs > 0) || (dp.BatchMaxScns > 0))
+}
+
+// Get the most SCNs to send in one batch for a subscription.
+
+func deliveryBatchMax(dp *DeliveryPolicy) int {
+	if (dp != nil) && (dp.BatchMaxScns > 0) {
+		return dp.BatchMaxScns
+	}
+	return DELIVERY_DEF_BATCH_SCNS
+}
+
+// Get how long to wait for more SCNs to batch for a subscription.
+
+func deliveryBatchWindow(dp *DeliveryPolicy) time.Duration {
+	if dp == nil {
+		return 0
+	}
+	return time.Duration(dp.BatchWindowMs) * time.Millisecond
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Make a new batched SCN sequence number.  Sequences are timestamps, never
+// repeated by this replica.
+//
+// Args:   None.
+// Return: New sequence number.
+/////////////////////////////////////////////////////////////////////////////
+
+func newScnSequence() int64 {
+	lastScnSeq_mutex.Lock()
+	defer lastScnSeq_mutex.Unlock()
+	seq := time.Now().UnixNano()
+	if seq <= lastScnSeq {
+		seq = lastScnSeq + 1
+	}
+	lastScnSeq = seq
+	return seq
+}
+
+// Check if a queued SCN send job can go in the same batch as another.
+
+func scnBatchable(j *JobSCNSend, o *JobSCNSend) bool {
+	return (o.Url == j.Url) && !o.batched && o.RetryAt.IsZero() &&
+		reflect.DeepEqual(o.scnSendOpts, j.scnSendOpts)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Count the SCNs which could be batched with the one at the head of a
+// subscriber's queue.  Must be called with subqueues_mutex held.
+//
+// q(in):  Subscriber's queue, not empty.
+// Return: Number of SCNs, including the head one, up to the batch maximum.
+/////////////////////////////////////////////////////////////////////////////
+
+func scnBatchSize(q *subQueue) int {
+	j := q.jobs[0]
+	bmax := deliveryBatchMax(j.Delivery)
+	n := 1
+	for _, o := range q.jobs[1:] {
+		if n >= bmax {
+			break
+		}
+		if jstat, _ := o.GetStatus(); jstat == base.JSTAT_CANCELLED {
+			continue
+		}
+		if !scnBatchable(j, o) {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get how long to wait before sending a batch from the head of a
+// subscriber's queue.  Must be called with subqueues_mutex held.
+//
+// q(in):  Subscriber's queue, not empty, with a batched SCN at its head.
+// Return: Time to wait, 0 or less if the batch is to be sent now.
+/////////////////////////////////////////////////////////////////////////////
+
+func scnBatchWait(q *subQueue) time.Duration {
+	j := q.jobs[0]
+	if scnBatchSize(q) >= deliveryBatchMax(j.Delivery) {
+		return 0
+	}
+	return time.Until(j.queuedAt.Add(deliveryBatchWindow(j.Delivery)))
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Make a batch from the SCNs at the head of a subscriber's queue.  The SCNs
+// after the head one which can go with it are taken off the queue and put
+// in its batch.  Must be called with subqueues_mutex held.
+//
+// q(in):  Subscriber's queue, not empty, with a batched SCN at its head.
+// Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func takeScnBatch(q *subQueue) {
+	j := q.jobs[0]
+	n := scnBatchSize(q)
+	ix := 1
+	for ; (ix < len(q.jobs)) && (len(j.batch)+1 < n); ix++ {
+		o := q.jobs[ix]
+		if jstat, _ := o.GetStatus(); jstat == base.JSTAT_CANCELLED {
+			continue
+		}
+		j.batch = append(j.batch, o)
+	}
+	j.batched = true
+	q.jobs = append([]*JobSCNSend{j}, q.jobs[ix:]...)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get the SCNs in a batched SCN send job which are still to be sent, taking
+// out those whose subscriptions have been deleted or changed, or which have
+// been cancelled.
+//
+// Args:   None.
+// Return: true if nothing is left to send.
+/////////////////////////////////////////////////////////////////////////////
+
+func (j *JobSCNSend) trimStaleBatch() bool {
+	j.batchScns = nil
+	for _, o := range append([]*JobSCNSend{j}, j.batch...) {
+		if jstat, _ := o.GetStatus(); (o != j) && (jstat == base.JSTAT_CANCELLED) {
+			continue
+		}
+		if o.trimStaleSubs() {
+			continue
+		}
+		j.batchScns = append(j.batchScns, o.SCNData)
+	}
+	return len(j.batchScns) == 0
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Finish the other SCN send jobs in a batch, once it has been sent or
+// given up on.
+//
+// Args,Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func (j *JobSCNSend) finishBatch() {
+	for _, o := range j.batch {
+		if jstat, _ := o.GetStatus(); jstat != base.JSTAT_CANCELLED {
+			o.SetStatus(base.JSTAT_COMPLETE, nil)
+		}
+		untrackScnSend(o)
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get the SCNs an SCN send job sends: its own, or for a batched one, the
+// ones in its batch still to be sent.
+//
+// Args:   None.
+// Return: SCNs sent.
+/////////////////////////////////////////////////////////////////////////////
+
+func (j *JobSCNSend) sentScns() []Scn {
+	if !deliveryBatched(j.Delivery) || (j.batchScns == nil) {
+		return []Scn{j.SCNData}
+	}
+	return j.batchScns
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Make the request body for an SCN send job: the SCN, or for a batched
+// subscription, a JSON array of its SCNs.
+//
+// Args:   None.
+// Return: Request body; nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func (j *JobSCNSend) payload() ([]byte, error) {
+	if !deliveryBatched(j.Delivery) {
+		return json.Marshal(j.SCNData)
+	}
+	return json.Marshal(j.sentScns())
+}
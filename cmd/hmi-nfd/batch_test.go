@@ -0,0 +1,175 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Cray-HPE/hms-base/v2"
+)
+
+// Wait for an SCN send job to be done.
+
+func waitScnSend(t *testing.T, j base.Job) {
+	start := time.Now()
+	for time.Since(start) < 10*time.Second {
+		if jstat, _ := j.GetStatus(); (jstat == base.JSTAT_COMPLETE) ||
+			(jstat == base.JSTAT_ERROR) || (jstat == base.JSTAT_CANCELLED) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("ERROR, SCN send job not done.")
+}
+
+func TestScnSequence(t *testing.T) {
+	last := newScnSequence()
+	for ix := 0; ix < 100; ix++ {
+		seq := newScnSequence()
+		if seq <= last {
+			t.Fatalf("ERROR, sequence not increasing: %d, %d", last, seq)
+		}
+		last = seq
+	}
+}
+
+func TestScnPayload(t *testing.T) {
+	j := NewJobSCNSend(Scn{State: "Ready", Components: []string{"x1"}},
+		"wlm@x3000c0s1b0n0", "http://a.b/scn").(*JobSCNSend)
+	ba, _ := j.payload()
+	if ba[0] != '{' {
+		t.Errorf("ERROR, unbatched payload isn't an object: %s", string(ba))
+	}
+
+	j.Delivery = &DeliveryPolicy{BatchMaxScns: 5}
+	ba, _ = j.payload()
+	var scns []Scn
+	if err := json.Unmarshal(ba, &scns); (err != nil) || (len(scns) != 1) {
+		t.Errorf("ERROR, batched payload isn't an array of 1: %s", string(ba))
+	}
+}
+
+func TestBatchedDelivery(t *testing.T) {
+	var kverr error
+	var mutex sync.Mutex
+	var posts [][]Scn
+
+	disable_logs()
+	if htrans.transport == nil {
+		htrans.transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		htrans.client = &http.Client{Transport: htrans.transport,
+			Timeout: 5 * time.Second,
+		}
+	}
+	if scnWorkPool == nil {
+		scnWorkPool = base.NewWorkerPool(10, 10)
+		scnWorkPool.Run()
+	}
+	kverr = openTestKV()
+	if kverr != nil {
+		t.Fatal("KV/ETCD open failed:", kverr)
+	}
+	defer kvPurge(t)
+	saved := app_params
+	app_params.Scn_breaker_threshold = 0
+	defer func() {
+		waitSubQueues(t)
+		restoreAppParams(saved)
+	}()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var scns []Scn
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &scns); err != nil {
+			t.Errorf("ERROR, batched payload isn't an array: %s", string(body))
+		}
+		mutex.Lock()
+		posts = append(posts, scns)
+		mutex.Unlock()
+		if r.URL.Path == "/bad" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	//5 SCNs, max 3 per batch: the first 3 go as soon as they're queued, the
+	//other 2 when the window is up.
+
+	subscriber := "wlm@x3000c0s1b0n0"
+	opts := scnSendOpts{Delivery: &DeliveryPolicy{BatchWindowMs: 300, BatchMaxScns: 3}}
+	var last base.Job
+	start := time.Now()
+	for ix := 0; ix < 5; ix++ {
+		last = NewJobSCNSendSub(Scn{State: "Ready", Components: []string{"x1"}},
+			subscriber, srv.URL+"/ok", "", 0, opts)
+		queueScnSend(last, subscriber)
+	}
+	waitScnSend(t, last)
+	if time.Since(start) < 300*time.Millisecond {
+		t.Errorf("ERROR, partial batch sent before its window was up.")
+	}
+
+	mutex.Lock()
+	if (len(posts) != 2) || (len(posts[0]) != 3) || (len(posts[1]) != 2) {
+		t.Fatalf("ERROR, expected batches of 3 and 2, got %v", posts)
+	}
+	var seq int64
+	for _, batch := range posts {
+		for _, scn := range batch {
+			if scn.Sequence <= seq {
+				t.Errorf("ERROR, sequences not increasing: %v", posts)
+			}
+			seq = scn.Sequence
+		}
+	}
+	posts = nil
+	mutex.Unlock()
+
+	//A failed batch is one dead letter per SCN.
+
+	opts.Delivery = &DeliveryPolicy{BatchMaxScns: 2}
+	for ix := 0; ix < 2; ix++ {
+		last = NewJobSCNSendSub(Scn{State: "Off", Components: []string{"x2"}},
+			subscriber, srv.URL+"/bad", "", 0, opts)
+		queueScnSend(last, subscriber)
+	}
+	waitScnSend(t, last)
+	mutex.Lock()
+	if len(posts) != 1 {
+		t.Errorf("ERROR, expected 1 failed batch, got %v", posts)
+	}
+	mutex.Unlock()
+	dls, _ := getDeadLetters(subscriber, 0)
+	if (len(dls) != 2) || (dls[0].Scn.Sequence == dls[1].Scn.Sequence) {
+		t.Errorf("ERROR, expected 2 dead letters, got %v", dls)
+	}
+}
@@ -0,0 +1,216 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// A note about circuit breakers:
+//
+// A subscriber host which is down or hanging makes every SCN send to it
+// take up a worker for SM_timeout seconds per attempt.  Enough of them can
+// tie up the whole worker pool.  So each destination host (host:port of the
+// subscriber URL) has a circuit breaker:
+//
+//   Closed:   SCNs are sent.  After Scn_breaker_threshold failed sends in a
+//             row, the breaker opens.
+//   Open:     SCNs aren't sent; they wait on their queues.  After
+//             Scn_breaker_cooldown seconds, the breaker half-opens.
+//   HalfOpen: One SCN is sent as a probe while others still wait.  If it
+//             gets through, the breaker closes; if not, it opens again.
+//
+// An SCN held up by a breaker hasn't been tried, so it doesn't use up an
+// attempt, and never counts towards RetriesExhausted, pruning or dead
+// letters; only real sends, such as the probes, do.  Only hosts with
+// failures have a breaker entry.  Scn_breaker_threshold of 0 turns the
+// breakers off.
+
+/////////////////////////////////////////////////////////////////////////////
+// Constants and Global Data
+/////////////////////////////////////////////////////////////////////////////
+
+const (
+	SCN_BREAKER_THRESHOLD = 5
+	SCN_BREAKER_COOLDOWN  = 30
+	SCN_BREAKER_RECHECK   = 1 //seconds to wait while a probe is in flight
+)
+
+const (
+	BREAKER_CLOSED    = "Closed"
+	BREAKER_OPEN      = "Open"
+	BREAKER_HALF_OPEN = "HalfOpen"
+)
+
+// One destination host's circuit breaker.
+
+type circuitBreaker struct {
+	state     string
+	failures  int       //failed sends in a row
+	openUntil time.Time //when an open breaker half-opens
+	probing   bool      //half-open probe in flight
+}
+
+var breakers = make(map[string]*circuitBreaker)
+var breakers_mutex sync.Mutex
+
+/////////////////////////////////////////////////////////////////////////////
+// Get the circuit breaker key for a subscriber URL: its host:port.
+//
+// surl(in): Subscriber URL.
+// Return:   Breaker key; the URL itself if it can't be parsed.
+/////////////////////////////////////////////////////////////////////////////
+
+func breakerHost(surl string) string {
+	u, err := url.Parse(surl)
+	if (err != nil) || (u.Host == "") {
+		return surl
+	}
+	return u.Host
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Check if an SCN may be sent to a host.  An open breaker whose cooldown
+// is over half-opens, letting this send through as its probe.  Every send
+// allowed must be followed by breakerResult().
+//
+// host(in): Breaker key, from breakerHost().
+// Return:   true if the SCN may be sent.
+/////////////////////////////////////////////////////////////////////////////
+
+func breakerAllow(host string) bool {
+	if app_params.Scn_breaker_threshold <= 0 {
+		return true
+	}
+
+	breakers_mutex.Lock()
+	defer breakers_mutex.Unlock()
+
+	cb, ok := breakers[host]
+	if !ok {
+		return true
+	}
+	switch cb.state {
+	case BREAKER_OPEN:
+		if time.Now().Before(cb.openUntil) {
+			return false
+		}
+		log.Printf("INFO: Circuit breaker for '%s' half-open, probing.\n", host)
+		cb.state = BREAKER_HALF_OPEN
+		cb.probing = true
+		return true
+	case BREAKER_HALF_OPEN:
+		if cb.probing {
+			return false
+		}
+		cb.probing = true
+		return true
+	}
+	return true
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get when an SCN held up by a host's breaker should be tried again: when
+// an open breaker half-opens, or shortly if a probe is in flight.
+//
+// host(in): Breaker key, from breakerHost().
+// Return:   Time to try again.
+/////////////////////////////////////////////////////////////////////////////
+
+func breakerRetryAt(host string) time.Time {
+	recheck := time.Now().Add(SCN_BREAKER_RECHECK * time.Second)
+
+	breakers_mutex.Lock()
+	defer breakers_mutex.Unlock()
+
+	cb, ok := breakers[host]
+	if ok && (cb.state == BREAKER_OPEN) && cb.openUntil.After(recheck) {
+		return cb.openUntil
+	}
+	return recheck
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Record the result of sending an SCN to a host.  A success closes its
+// breaker; failures open it.
+//
+// host(in): Breaker key, from breakerHost().
+// ok(in):   true if the SCN was sent.
+// Return:   None.
+/////////////////////////////////////////////////////////////////////////////
+
+func breakerResult(host string, ok bool) {
+	if app_params.Scn_breaker_threshold <= 0 {
+		return
+	}
+
+	breakers_mutex.Lock()
+	defer breakers_mutex.Unlock()
+
+	cb, exists := breakers[host]
+	if ok {
+		if exists && (cb.state != BREAKER_CLOSED) {
+			log.Printf("INFO: Circuit breaker for '%s' closed.\n", host)
+		}
+		delete(breakers, host)
+		return
+	}
+
+	if !exists {
+		cb = &circuitBreaker{state: BREAKER_CLOSED}
+		breakers[host] = cb
+	}
+	cb.failures++
+	cb.probing = false
+	if (cb.state == BREAKER_HALF_OPEN) ||
+		((cb.state == BREAKER_CLOSED) &&
+			(cb.failures >= app_params.Scn_breaker_threshold)) {
+		log.Printf("WARNING: Circuit breaker for '%s' open after %d failures.\n",
+			host, cb.failures)
+		cb.state = BREAKER_OPEN
+		cb.openUntil = time.Now().Add(time.Duration(app_params.Scn_breaker_cooldown) *
+			time.Second)
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get the number of circuit breakers which aren't closed.
+//
+// Args:   None.
+// Return: Number of open or half-open breakers.
+/////////////////////////////////////////////////////////////////////////////
+
+func breakerStats() int {
+	breakers_mutex.Lock()
+	defer breakers_mutex.Unlock()
+	nopen := 0
+	for _, cb := range breakers {
+		if cb.state != BREAKER_CLOSED {
+			nopen++
+		}
+	}
+	return nopen
+}
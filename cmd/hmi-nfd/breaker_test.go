@@ -0,0 +1,158 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreakerHost(t *testing.T) {
+	tests := []struct {
+		url  string
+		host string
+	}{
+		{"https://x3000c0s1b0n0:8080/scn", "x3000c0s1b0n0:8080"},
+		{"http://10.1.2.3/scn", "10.1.2.3"},
+		{"not a url", "not a url"},
+	}
+	for _, tt := range tests {
+		if host := breakerHost(tt.url); host != tt.host {
+			t.Errorf("ERROR, '%s' expected host '%s', got '%s'", tt.url,
+				tt.host, host)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	disable_logs()
+	savedThreshold := app_params.Scn_breaker_threshold
+	savedCooldown := app_params.Scn_breaker_cooldown
+	app_params.Scn_breaker_threshold = 2
+	app_params.Scn_breaker_cooldown = 30
+	defer func() {
+		app_params.Scn_breaker_threshold = savedThreshold
+		app_params.Scn_breaker_cooldown = savedCooldown
+		breakers_mutex.Lock()
+		breakers = make(map[string]*circuitBreaker)
+		breakers_mutex.Unlock()
+	}()
+
+	host := "x3000c0s1b0n0:8080"
+	expire := func() {
+		breakers_mutex.Lock()
+		breakers[host].openUntil = time.Now()
+		breakers_mutex.Unlock()
+	}
+
+	//Closed until the threshold is hit.
+
+	if !breakerAllow(host) {
+		t.Errorf("ERROR, new breaker not closed.")
+	}
+	breakerResult(host, false)
+	if !breakerAllow(host) {
+		t.Errorf("ERROR, breaker open below threshold.")
+	}
+	breakerResult(host, false)
+	if breakerAllow(host) {
+		t.Errorf("ERROR, breaker not open at threshold.")
+	}
+	if breakerStats() != 1 {
+		t.Errorf("ERROR, expected 1 open breaker, got %d", breakerStats())
+	}
+
+	//Half-open lets one probe through; its failure opens it again.
+
+	expire()
+	if !breakerAllow(host) {
+		t.Errorf("ERROR, half-open breaker didn't allow probe.")
+	}
+	if breakerAllow(host) {
+		t.Errorf("ERROR, half-open breaker allowed a second probe.")
+	}
+	breakerResult(host, false)
+	if breakerAllow(host) {
+		t.Errorf("ERROR, breaker not open after failed probe.")
+	}
+
+	//A good probe closes it.
+
+	expire()
+	if !breakerAllow(host) {
+		t.Errorf("ERROR, half-open breaker didn't allow probe.")
+	}
+	breakerResult(host, true)
+	if !breakerAllow(host) || (breakerStats() != 0) {
+		t.Errorf("ERROR, breaker not closed after good probe.")
+	}
+
+	//Off with a threshold of 0.
+
+	app_params.Scn_breaker_threshold = 0
+	for ix := 0; ix < 5; ix++ {
+		breakerResult(host, false)
+	}
+	if !breakerAllow(host) || (breakerStats() != 0) {
+		t.Errorf("ERROR, breaker opened while turned off.")
+	}
+}
+
+func TestBreakerHold(t *testing.T) {
+	disable_logs()
+	savedThreshold := app_params.Scn_breaker_threshold
+	savedRetries := app_params.Scn_retries
+	app_params.Scn_breaker_threshold = 1
+	app_params.Scn_retries = 1
+	defer func() {
+		app_params.Scn_breaker_threshold = savedThreshold
+		app_params.Scn_retries = savedRetries
+		breakers_mutex.Lock()
+		breakers = make(map[string]*circuitBreaker)
+		breakers_mutex.Unlock()
+	}()
+
+	host := "x3000c0s9b0n0:8080"
+	breakerResult(host, false)
+
+	//SCNs held up by the open breaker wait for it, no matter how many
+	//times, without using up attempts or being pruned.
+
+	j := NewJobSCNSend(Scn{State: "Ready", Components: []string{"x1"}},
+		"hbtd@x3000c0s9b0n0", "http://"+host+"/scn").(*JobSCNSend)
+	for ix := 0; ix < 3; ix++ {
+		if !sendSCNToSubscriber(j) {
+			t.Fatalf("ERROR, SCN held up by breaker not kept for later.")
+		}
+	}
+	if j.Attempts != 0 {
+		t.Errorf("ERROR, SCN held up by breaker used %d attempts.", j.Attempts)
+	}
+	if time.Until(j.RetryAt) < (time.Duration(app_params.Scn_breaker_cooldown-1) * time.Second) {
+		t.Errorf("ERROR, SCN held up by breaker not kept until it half-opens: %v",
+			j.RetryAt)
+	}
+	if subscriberPruned(j.Subscriber) {
+		t.Errorf("ERROR, subscriber pruned for an open breaker.")
+	}
+}
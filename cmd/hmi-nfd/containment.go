@@ -0,0 +1,221 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Cray-HPE/hms-xname/xnametypes"
+)
+
+// A note about containment:
+//
+// When a chassis, slot or other container component goes Off or Empty, HSM
+// may only send an SCN for the container, not for the nodes in it.  So
+// subscribers contained in an unavailable container are also pruned, both
+// when the SCN comes in (so nothing more is sent to them) and when the
+// leader prunes subscriptions.  Containment is worked out from the XName
+// hierarchy; only container types (cabinets, chassis, slots, enclosures and
+// HSN boards) count as parents.
+//
+// What is done with contained subscribers depends on their type, as set by
+// the Containment map in the prune policy: "Prune" prunes them (durable
+// subscriptions are suspended, as usual), "Suspend" suspends them whether
+// they are durable or not, and "Ignore", or a type not in the map, leaves
+// them be.
+
+/////////////////////////////////////////////////////////////////////////////
+// Constants
+/////////////////////////////////////////////////////////////////////////////
+
+const (
+	CONTAIN_ACTION_PRUNE   = "Prune"
+	CONTAIN_ACTION_SUSPEND = "Suspend"
+	CONTAIN_ACTION_IGNORE  = "Ignore"
+)
+
+var containActions = []string{CONTAIN_ACTION_PRUNE, CONTAIN_ACTION_SUSPEND,
+	CONTAIN_ACTION_IGNORE,
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Verify a prune policy Containment map, normalizing its types and actions.
+//
+// cmap(in): Containment map, HMS type -> action.
+// Return:   Normalized map; nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func verifyContainment(cmap map[string]string) (map[string]string, error) {
+	if cmap == nil {
+		return nil, nil
+	}
+	nmap := make(map[string]string)
+	for ctype, action := range cmap {
+		ntype := xnametypes.VerifyNormalizeType(ctype)
+		if ntype == "" {
+			return nil, fmt.Errorf("invalid component type '%s'", ctype)
+		}
+		naction := ""
+		for _, ca := range containActions {
+			if strings.EqualFold(action, ca) {
+				naction = ca
+				break
+			}
+		}
+		if naction == "" {
+			return nil, fmt.Errorf("invalid containment action '%s'", action)
+		}
+		nmap[ntype] = naction
+	}
+	return nmap, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get the containment action for a subscriber, per the prune policy.
+//
+// xname(in): Subscriber XName.
+// Return:    CONTAIN_ACTION_xxx.
+/////////////////////////////////////////////////////////////////////////////
+
+func containmentAction(xname string) string {
+	ctype := xnametypes.GetHMSType(xname)
+	if ctype == xnametypes.HMSTypeInvalid {
+		return CONTAIN_ACTION_IGNORE
+	}
+	action, ok := prunePolicy().Containment[ctype.String()]
+	if !ok {
+		return CONTAIN_ACTION_IGNORE
+	}
+	return action
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get the container components an XName is in, nearest first.
+//
+// xname(in): Component XName.
+// Return:    Containing XNames, empty if none or not an XName.
+/////////////////////////////////////////////////////////////////////////////
+
+func xnameContainers(xname string) []string {
+	var parents []string
+
+	if xnametypes.GetHMSType(xname) == xnametypes.HMSTypeInvalid {
+		return parents
+	}
+	for pp := xnametypes.GetHMSCompParent(xname); pp != ""; pp = xnametypes.GetHMSCompParent(pp) {
+		ptype := xnametypes.GetHMSType(pp)
+		if ptype == xnametypes.HMSTypeInvalid {
+			break
+		}
+		if xnametypes.IsHMSTypeContainer(ptype) {
+			parents = append(parents, pp)
+		}
+	}
+	return parents
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Find the nearest container of a subscriber which is in a set of
+// unavailable components.
+//
+// xname(in):   Subscriber XName.
+// unavail(in): Unavailable components.
+// Return:      Unavailable container XName, or "" if none.
+/////////////////////////////////////////////////////////////////////////////
+
+func unavailableContainer(xname string, unavail map[string]bool) string {
+	if len(unavail) == 0 {
+		return ""
+	}
+	for _, pp := range xnameContainers(xname) {
+		if unavail[pp] {
+			return pp
+		}
+	}
+	return ""
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Make the prune cause for a subscriber pruned because of its container.
+//
+// parent(in): Unavailable container XName.
+// pcause(in): Why the container was pruned.
+// action(in): Containment action, CONTAIN_ACTION_PRUNE or _SUSPEND.
+// Return:     Prune cause.
+/////////////////////////////////////////////////////////////////////////////
+
+func containedCause(parent string, pcause pruneCause, action string) pruneCause {
+	cause := pruneCause{Reason: PRUNE_REASON_PARENT_UNAVAILABLE,
+		Trigger: "Parent " + parent,
+		Replica: pcause.Replica,
+		Suspend: (action == CONTAIN_ACTION_SUSPEND),
+	}
+	if pcause.Trigger != "" {
+		cause.Trigger += ": " + pcause.Trigger
+	}
+	if cause.Replica == "" {
+		cause.Replica = serviceName
+	}
+	return cause
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Make a set of the container components in a list of unavailable ones.
+//
+// comps(in): Unavailable component XNames.
+// Return:    Set of the container XNames.
+/////////////////////////////////////////////////////////////////////////////
+
+func containerSet(comps []string) map[string]bool {
+	cset := make(map[string]bool)
+	for _, comp := range comps {
+		if xnametypes.IsHMSTypeContainer(xnametypes.GetHMSType(comp)) {
+			cset[comp] = true
+		}
+	}
+	return cset
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get the set of containers in the prune map which were pruned for being
+// unavailable.  Must be called with prunemap_mutex held.
+//
+// Args:   None.
+// Return: Set of pruned container XNames.
+/////////////////////////////////////////////////////////////////////////////
+
+func prunedContainers() map[string]bool {
+	var comps []string
+	for pm, val := range prunemap {
+		if !val {
+			continue
+		}
+		switch prunecauses[pm].Reason {
+		case PRUNE_REASON_UNAVAILABLE, PRUNE_REASON_DEAD_SWEEP,
+			PRUNE_REASON_UNKNOWN, "":
+			comps = append(comps, pm)
+		}
+	}
+	return containerSet(comps)
+}
@@ -0,0 +1,208 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestXnameContainers(t *testing.T) {
+	tests := []struct {
+		xname string
+		exp   []string
+	}{
+		{"x3000c0s1b0n0", []string{"x3000c0s1", "x3000c0", "x3000"}},
+		{"x3000c0s1b0", []string{"x3000c0s1", "x3000c0", "x3000"}},
+		{"x3000c0", []string{"x3000"}},
+		{"x3000", nil},
+		{"service.cray-power-control", nil},
+		{"bad_sub", nil},
+	}
+
+	for _, tc := range tests {
+		got := xnameContainers(tc.xname)
+		if !reflect.DeepEqual(got, tc.exp) {
+			t.Errorf("ERROR, containers of '%s', exp: %v, got: %v",
+				tc.xname, tc.exp, got)
+		}
+	}
+
+	unavail := map[string]bool{"x3000c0": true, "x3000": true}
+	if pp := unavailableContainer("x3000c0s1b0n0", unavail); pp != "x3000c0" {
+		t.Errorf("ERROR, expected nearest container x3000c0, got '%s'", pp)
+	}
+	if pp := unavailableContainer("x1000c0s1b0n0", unavail); pp != "" {
+		t.Errorf("ERROR, expected no unavailable container, got '%s'", pp)
+	}
+}
+
+func TestVerifyContainment(t *testing.T) {
+	cmap, err := verifyContainment(map[string]string{"node": "suspend",
+		"NODEBMC": "IGNORE"})
+	if err != nil {
+		t.Fatal("ERROR verifying containment map:", err)
+	}
+	exp := map[string]string{"Node": CONTAIN_ACTION_SUSPEND,
+		"NodeBMC": CONTAIN_ACTION_IGNORE}
+	if !reflect.DeepEqual(cmap, exp) {
+		t.Errorf("ERROR, containment map mismatch, exp: %v, got: %v", exp, cmap)
+	}
+
+	_, err = verifyContainment(map[string]string{"Widget": "Prune"})
+	if err == nil {
+		t.Errorf("ERROR, bad component type was accepted.")
+	}
+	_, err = verifyContainment(map[string]string{"Node": "Delete"})
+	if err == nil {
+		t.Errorf("ERROR, bad containment action was accepted.")
+	}
+
+	//Default policy prunes nodes only.
+
+	if act := containmentAction("x3000c0s1b0n0"); act != CONTAIN_ACTION_PRUNE {
+		t.Errorf("ERROR, expected node action Prune, got '%s'", act)
+	}
+	if act := containmentAction("x3000c0s1b0"); act != CONTAIN_ACTION_IGNORE {
+		t.Errorf("ERROR, expected NodeBMC action Ignore, got '%s'", act)
+	}
+	if act := containmentAction("service.pcs"); act != CONTAIN_ACTION_IGNORE {
+		t.Errorf("ERROR, expected service action Ignore, got '%s'", act)
+	}
+}
+
+func TestContainmentPrune(t *testing.T) {
+	var kverr error
+
+	disable_logs()
+	savedNosm := app_params.Nosm
+	app_params.Nosm = 1
+	defer func() { app_params.Nosm = savedNosm }()
+
+	kverr = openTestKV()
+	if kverr != nil {
+		t.Fatal("KV/ETCD open failed:", kverr)
+	}
+	defer kvPurge(t)
+	defer func() {
+		app_params.Prune_policy = nil
+		prunedec_mutex.Lock()
+		prunedecisions = make(map[string]int64)
+		prunedec_mutex.Unlock()
+	}()
+
+	policy := defaultPrunePolicy()
+	policy.Containment["NodeBMC"] = CONTAIN_ACTION_SUSPEND
+	app_params.Prune_policy = policy
+
+	subs := []string{"x3000c0s1b0n0", "x3000c0s1b0", "x3000c1s1b0n0"}
+	var keys []string
+	for _, xname := range subs {
+		sub := ScnSubscribe{Subscriber: xname, Components: []string{xname},
+			States: []string{"ready"}, Url: "http://" + xname + "/scn"}
+		key := makeSubscriptionKey_V2(sub, xname, "hbtd")
+		err := storeSubscriptionEntry(key, SubData{Url: sub.Url,
+			ScnNodes: sub.Components})
+		if err != nil {
+			t.Fatal("ERROR storing subscription:", err)
+		}
+		keys = append(keys, key)
+	}
+
+	//An Off SCN for just the chassis marks the subscribers in it.
+
+	doScnSegment(Scn{Components: []string{"x3000c0"}, State: "Off",
+		Timestamp: "2026-10-18T00:00:00Z"}, serviceName)
+
+	prunemap_mutex.Lock()
+	cause := prunecauses["x3000c0s1b0n0"]
+	marked := prunemap["x3000c0s1b0n0"] && prunemap["x3000c0s1b0"] &&
+		!prunemap["x3000c1s1b0n0"]
+	prunemap_mutex.Unlock()
+	if !marked {
+		t.Fatalf("ERROR, contained subscribers not marked for pruning.")
+	}
+	expTrigger := "Parent x3000c0: SCN State: Off, Timestamp: 2026-10-18T00:00:00Z"
+	if (cause.Reason != PRUNE_REASON_PARENT_UNAVAILABLE) ||
+		(cause.Trigger != expTrigger) || cause.Suspend {
+		t.Errorf("ERROR, contained prune cause mismatch: %v", cause)
+	}
+
+	prunemap_mutex.Lock()
+	subPrune()
+	for pm := range prunemap {
+		unmarkPrune(pm)
+	}
+	prunemap_mutex.Unlock()
+
+	if _, ok := getSubData(t, keys[0]); ok {
+		t.Errorf("ERROR, contained node subscription not deleted.")
+	}
+	sd, ok := getSubData(t, keys[1])
+	if !ok || !sd.Suspended {
+		t.Errorf("ERROR, contained NodeBMC subscription not suspended: %v", sd)
+	}
+	if _, ok := getSubData(t, keys[2]); !ok {
+		t.Errorf("ERROR, uncontained subscription was pruned.")
+	}
+
+	//The leader also catches contained subscribers when only the chassis
+	//made it into the prune map.
+
+	prunemap_mutex.Lock()
+	markPrune("x3000c1", PRUNE_REASON_UNAVAILABLE, "HSM State: Empty")
+	subPrune()
+	for pm := range prunemap {
+		unmarkPrune(pm)
+	}
+	prunemap_mutex.Unlock()
+
+	if _, ok := getSubData(t, keys[2]); ok {
+		t.Errorf("ERROR, contained subscription not deleted by subPrune.")
+	}
+
+	prunes, err := getPruneRecords(pruneFilter{})
+	if err != nil {
+		t.Fatal("ERROR fetching prune log:", err)
+	}
+	if len(prunes) != 3 {
+		t.Fatalf("ERROR, expected 3 prune records, got %d: %v", len(prunes), prunes)
+	}
+	for _, rec := range prunes {
+		if rec.Reason != PRUNE_REASON_PARENT_UNAVAILABLE {
+			t.Errorf("ERROR, unexpected prune reason: %v", rec)
+		}
+	}
+
+	//Nothing is marked in dry run mode.
+
+	policy.DryRun = true
+	doScnSegment(Scn{Components: []string{"x3000c0"}, State: "Off"},
+		serviceName)
+	prunemap_mutex.Lock()
+	marked = prunemap["x3000c0s1b0"]
+	prunemap_mutex.Unlock()
+	if marked {
+		t.Errorf("ERROR, contained subscriber marked in dry run mode.")
+	}
+}
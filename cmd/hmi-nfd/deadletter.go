@@ -0,0 +1,463 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Cray-HPE/hms-base/v2"
+	"github.com/Cray-HPE/hms-hmetcd"
+	"github.com/gorilla/mux"
+)
+
+// A note about dead letters:
+//
+// When an SCN can't be delivered -- its retries run out, or the subscriber
+// refuses the connection and is pruned -- the SCN is kept as a dead letter
+// along with the subscriber, URL, last error and number of attempts, rather
+// than being lost.  Like the prune log, each dead letter is its own ETCD key
+// sorting by time, so any replica can add one.  The store is bounded: every
+// DEAD_LETTER_TRIM_EVERY dead letters a replica adds, and whenever the
+// leader prunes, the oldest are trimmed so about DEAD_LETTER_MAX are kept.
+//
+// Dead letters can be listed with GET /deadletters, and redriven (sent
+// again) one at a time, for one subscriber, or all at once.  Redriving
+// removes the dead letter and queues the SCN on the subscriber's queue as
+// it was; if it fails again, it becomes a new dead letter.  Dead letters for
+// a subscriber which is still pruned are not redriven.
+
+/////////////////////////////////////////////////////////////////////////////
+// Data Structures
+/////////////////////////////////////////////////////////////////////////////
+
+// One undeliverable SCN.
+
+type DeadLetter struct {
+	ID         string `json:"ID"`
+	Subscriber string `json:"Subscriber"` //[agent@]xname
+	Url        string `json:"Url"`
+	Scn        Scn    `json:"Scn"`
+	LastError  string `json:"LastError"`
+	Attempts   int    `json:"Attempts"`
+	Time       string `json:"Time"`    //RFC3339
+	Replica    string `json:"Replica"` //replica that gave up on it
+
+	Delivery *DeliveryPolicy `json:"Delivery,omitempty"` //for redrives
+	Secret   string          `json:"Secret,omitempty"`   //encrypted, not shown
+	Auth     string          `json:"Auth,omitempty"`     //encrypted, not shown
+}
+
+// Dead letters returned by /deadletters
+
+type DeadLetterList struct {
+	DeadLetters []DeadLetter `json:"DeadLetters"`
+}
+
+// Result of a redrive.
+
+type DeadLetterRedrive struct {
+	Redriven int `json:"Redriven"`
+	Skipped  int `json:"Skipped"` //subscriber still pruned
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Constants and Global Data
+/////////////////////////////////////////////////////////////////////////////
+
+const (
+	DEAD_LETTER_KEY_PREFIX     = "deadletter#"
+	DEAD_LETTER_KEYRANGE_START = "deadletter#"
+	DEAD_LETTER_KEYRANGE_END   = "deadletter#~"
+	DEAD_LETTER_MAX            = 10000
+	DEAD_LETTER_TRIM_EVERY     = 100
+)
+
+var deadLetterSeq uint32
+
+/////////////////////////////////////////////////////////////////////////////
+// Keep an undeliverable SCN as a dead letter.  Each SCN of a batch is kept
+// as its own dead letter.
+//
+// j(in):  SCN send job which couldn't be delivered, with its last error
+//         and number of attempts.
+// Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func storeDeadLetter(j *JobSCNSend) {
+	for _, scn := range j.sentScns() {
+		storeDeadLetterScn(j, scn)
+	}
+}
+
+// Keep one SCN of an undeliverable SCN send job as a dead letter.
+
+func storeDeadLetterScn(j *JobSCNSend, scn Scn) {
+	subscriber, url := j.Subscriber, j.Url
+	seq := atomic.AddUint32(&deadLetterSeq, 1)
+	dl := DeadLetter{ID: fmt.Sprintf("%020d-%s-%d", time.Now().UnixNano(),
+		serviceName, seq),
+		Subscriber: subscriber,
+		Url:        url,
+		Scn:        scn,
+		LastError:  j.LastErr,
+		Attempts:   j.Attempts,
+		Time:       time.Now().Format(time.RFC3339),
+		Replica:    serviceName,
+		Delivery:   j.Delivery,
+		Secret:     j.Secret,
+		Auth:       j.Auth,
+	}
+
+	ba, err := json.Marshal(dl)
+	if err != nil {
+		log.Println("ERROR marshaling dead letter:", err)
+		return
+	}
+	err = kvHandle.Store(DEAD_LETTER_KEY_PREFIX+dl.ID, string(ba))
+	if err != nil {
+		log.Printf("ERROR storing dead letter for '%s': %v", subscriber, err)
+		return
+	}
+	log.Printf("INFO: SCN for '%s'/'%s' kept as dead letter '%s'.\n",
+		subscriber, url, dl.ID)
+
+	if seq%DEAD_LETTER_TRIM_EVERY == 0 {
+		trimDeadLetters()
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get the dead letter keys, oldest first.  Not every KV store returns a
+// range in key order.
+//
+// Args:   None.
+// Return: Dead letter keys and values; nil on success, error on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func deadLetterKeys() ([]hmetcd.Kvi_KV, error) {
+	kvlist, kverr := kvHandle.GetRange(DEAD_LETTER_KEYRANGE_START,
+		DEAD_LETTER_KEYRANGE_END)
+	if kverr != nil {
+		return nil, kverr
+	}
+	sort.Slice(kvlist, func(i, j int) bool { return kvlist[i].Key < kvlist[j].Key })
+	return kvlist, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Trim the dead letters down to DEAD_LETTER_MAX, oldest first.
+//
+// Args, Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func trimDeadLetters() {
+	kvlist, kverr := deadLetterKeys()
+	if kverr != nil {
+		log.Println("ERROR fetching dead letter keys:", kverr)
+		return
+	}
+
+	for ix := 0; ix < len(kvlist)-DEAD_LETTER_MAX; ix++ {
+		err := kvHandle.Delete(kvlist[ix].Key)
+		if err != nil {
+			log.Printf("WARNING, dead letter key '%s' not deleted: %v",
+				kvlist[ix].Key, err)
+		}
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get the dead letters, oldest first.
+//
+// subscriber(in): Only this subscriber's, [agent@]xname; an xname matches
+//                 all of its agents.  "" for all.
+// limit(in):      Return only the most recent N; 0 for all.
+// Return:         Dead letters; nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func getDeadLetters(subscriber string, limit int) ([]DeadLetter, error) {
+	var dls []DeadLetter
+
+	kvlist, kverr := deadLetterKeys()
+	if kverr != nil {
+		return nil, kverr
+	}
+
+	for _, kv := range kvlist {
+		var dl DeadLetter
+		if json.Unmarshal([]byte(kv.Value), &dl) != nil {
+			log.Printf("WARNING: Invalid dead letter '%s'.\n", kv.Key)
+			continue
+		}
+		if subscriber != "" {
+			xname, _ := splitSubscriber(dl.Subscriber)
+			if (subscriber != dl.Subscriber) && (subscriber != xname) {
+				continue
+			}
+		}
+		dls = append(dls, dl)
+	}
+
+	if (limit > 0) && (len(dls) > limit) {
+		dls = dls[len(dls)-limit:]
+	}
+	return dls, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Check if a subscriber is pruned, here or by another replica.
+//
+// subscriber(in): Subscriber, [agent@]xname.
+// Return:         true if pruned.
+/////////////////////////////////////////////////////////////////////////////
+
+func subscriberPruned(subscriber string) bool {
+	subxname, _ := splitSubscriber(subscriber)
+	prunemap_mutex.Lock()
+	prune := prunemap[subxname] || prunemap[subscriber]
+	prunemap_mutex.Unlock()
+	return prune || pruneDecided(subscriber)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Redrive dead letters: remove them and queue their SCNs to be sent again.
+// Dead letters for subscribers still pruned are skipped.
+//
+// dls(in): Dead letters.
+// Return:  Redrive counts.
+/////////////////////////////////////////////////////////////////////////////
+
+func redriveDeadLetters(dls []DeadLetter) DeadLetterRedrive {
+	var rd DeadLetterRedrive
+
+	for _, dl := range dls {
+		if subscriberPruned(dl.Subscriber) {
+			rd.Skipped++
+			continue
+		}
+		err := kvHandle.Delete(DEAD_LETTER_KEY_PREFIX + dl.ID)
+		if err != nil {
+			log.Printf("WARNING, dead letter '%s' not deleted, not redriven: %v",
+				dl.ID, err)
+			rd.Skipped++
+			continue
+		}
+		j := NewJobSCNSend(dl.Scn, dl.Subscriber, dl.Url).(*JobSCNSend)
+		j.scnSendOpts = scnSendOpts{Delivery: dl.Delivery, Secret: dl.Secret,
+			Auth: dl.Auth}
+		queueScnSend(j, dl.Subscriber)
+		rd.Redriven++
+	}
+	if rd.Redriven > 0 {
+		log.Printf("INFO: Redriving %d dead letters, %d skipped.\n",
+			rd.Redriven, rd.Skipped)
+	}
+	return rd
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Send a JSON response.
+//
+// w(in):       HTTP response writer.
+// errinst(in): URL path, for errors.
+// data(in):    Data to marshal and send.
+// Return:      None.
+/////////////////////////////////////////////////////////////////////////////
+
+func sendDeadLetterJson(w http.ResponseWriter, errinst string, data interface{}) {
+	ba, baerr := json.Marshal(data)
+	if baerr != nil {
+		log.Println("ERROR marshaling dead letter response:", baerr)
+		pdet := base.NewProblemDetails("about:blank",
+			"Internal Server Error",
+			"JSON marshal error",
+			errinst, http.StatusInternalServerError)
+		base.SendProblemDetails(w, pdet, 0)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(ba)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Parse the dead letter filters in a request's query parameters:
+//
+//   subscriber: xname or agent@xname; an xname matches all of its agents
+//   limit:      only the most recent N dead letters
+//
+// r(in):  HTTP request.
+// Return: Subscriber; limit; nil on success, error string on bad filters.
+/////////////////////////////////////////////////////////////////////////////
+
+func parseDeadLetterFilter(r *http.Request) (string, int, error) {
+	var err error
+
+	qv := r.URL.Query()
+	limit := 0
+	if qv.Get("limit") != "" {
+		limit, err = strconv.Atoi(qv.Get("limit"))
+		if (err != nil) || (limit < 0) {
+			return "", 0, fmt.Errorf("Invalid 'limit', must be a non-negative integer")
+		}
+	}
+	return strings.ToLower(qv.Get("subscriber")), limit, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get dead letters.  Query parameters filter them; see
+// parseDeadLetterFilter().
+//
+// w(in):  HTTP response writer
+// r(in):  HTTP request
+// Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func deadLettersGetHandler(w http.ResponseWriter, r *http.Request) {
+	var dlist DeadLetterList
+
+	errinst := "/" + URL_DEADLETTERS
+
+	subscriber, limit, err := parseDeadLetterFilter(r)
+	if err != nil {
+		log.Println("ERROR: Bad dead letter filter:", err)
+		pdet := base.NewProblemDetails("about:blank",
+			"Invalid Request",
+			err.Error(),
+			errinst, http.StatusBadRequest)
+		base.SendProblemDetails(w, pdet, 0)
+		return
+	}
+
+	dls, err := getDeadLetters(subscriber, limit)
+	if err != nil {
+		log.Println("ERROR fetching dead letters:", err)
+		pdet := base.NewProblemDetails("about:blank",
+			"Internal Server Error",
+			"KV fetch error",
+			errinst, http.StatusInternalServerError)
+		base.SendProblemDetails(w, pdet, 0)
+		return
+	}
+
+	for ix := range dls {
+		dls[ix].Secret = ""
+		dls[ix].Auth = ""
+	}
+	dlist.DeadLetters = dls
+	if dlist.DeadLetters == nil {
+		dlist.DeadLetters = []DeadLetter{}
+	}
+	sendDeadLetterJson(w, errinst, dlist)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Redrive dead letters in bulk: all of them, or only a subscriber's if the
+// 'subscriber' query parameter is given.
+//
+// w(in):  HTTP response writer
+// r(in):  HTTP request
+// Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func deadLettersRedriveHandler(w http.ResponseWriter, r *http.Request) {
+	errinst := "/" + URL_DEADLETTERS + "/redrive"
+
+	subscriber, limit, err := parseDeadLetterFilter(r)
+	if err != nil {
+		log.Println("ERROR: Bad dead letter filter:", err)
+		pdet := base.NewProblemDetails("about:blank",
+			"Invalid Request",
+			err.Error(),
+			errinst, http.StatusBadRequest)
+		base.SendProblemDetails(w, pdet, 0)
+		return
+	}
+
+	dls, err := getDeadLetters(subscriber, limit)
+	if err != nil {
+		log.Println("ERROR fetching dead letters:", err)
+		pdet := base.NewProblemDetails("about:blank",
+			"Internal Server Error",
+			"KV fetch error",
+			errinst, http.StatusInternalServerError)
+		base.SendProblemDetails(w, pdet, 0)
+		return
+	}
+
+	sendDeadLetterJson(w, errinst, redriveDeadLetters(dls))
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Redrive one dead letter.
+//
+// w(in):  HTTP response writer
+// r(in):  HTTP request
+// Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func deadLetterRedriveHandler(w http.ResponseWriter, r *http.Request) {
+	var dl DeadLetter
+
+	id := mux.Vars(r)["id"]
+	errinst := "/" + URL_DEADLETTERS + "/" + id + "/redrive"
+
+	val, ok, err := kvHandle.Get(DEAD_LETTER_KEY_PREFIX + id)
+	if err != nil {
+		log.Printf("ERROR fetching dead letter '%s': %v", id, err)
+		pdet := base.NewProblemDetails("about:blank",
+			"Internal Server Error",
+			"KV fetch error",
+			errinst, http.StatusInternalServerError)
+		base.SendProblemDetails(w, pdet, 0)
+		return
+	}
+	if !ok || (json.Unmarshal([]byte(val), &dl) != nil) {
+		pdet := base.NewProblemDetails("about:blank",
+			"Not Found",
+			"No such dead letter",
+			errinst, http.StatusNotFound)
+		base.SendProblemDetails(w, pdet, 0)
+		return
+	}
+
+	if subscriberPruned(dl.Subscriber) {
+		pdet := base.NewProblemDetails("about:blank",
+			"Conflict",
+			"Subscriber is still pruned",
+			errinst, http.StatusConflict)
+		base.SendProblemDetails(w, pdet, 0)
+		return
+	}
+
+	sendDeadLetterJson(w, errinst, redriveDeadLetters([]DeadLetter{dl}))
+}
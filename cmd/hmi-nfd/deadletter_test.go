@@ -0,0 +1,249 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Cray-HPE/hms-base/v2"
+)
+
+func TestDeadLetters(t *testing.T) {
+	var kverr error
+	var mutex sync.Mutex
+	var got []string
+	fail := true
+
+	disable_logs()
+	kverr = openTestKV()
+	if kverr != nil {
+		t.Fatal("KV/ETCD open failed:", kverr)
+	}
+	defer kvPurge(t)
+	if htrans.transport == nil {
+		htrans.transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		htrans.client = &http.Client{Transport: htrans.transport,
+			Timeout: 5 * time.Second,
+		}
+	}
+	if scnWorkPool == nil {
+		scnWorkPool = base.NewWorkerPool(10, 10)
+		scnWorkPool.Run()
+	}
+
+	savedRetries, savedBackoff := app_params.Scn_retries, app_params.Scn_backoff
+	savedThreshold := app_params.Scn_breaker_threshold
+	app_params.Scn_retries = 2
+	app_params.Scn_backoff = 0
+	app_params.Scn_breaker_threshold = 0
+	defer func() {
+		waitSubQueues(t)
+		app_params.Scn_retries, app_params.Scn_backoff = savedRetries, savedBackoff
+		app_params.Scn_breaker_threshold = savedThreshold
+		prunemap_mutex.Lock()
+		unmarkPrune("x3000c0s1b0n0")
+		unmarkPrune("x3000c0s2b0n0")
+		prunemap_mutex.Unlock()
+	}()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var scn Scn
+		json.NewDecoder(r.Body).Decode(&scn)
+		mutex.Lock()
+		defer mutex.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		got = append(got, scn.State)
+	}))
+	defer srv.Close()
+
+	//Undeliverable SCNs become dead letters, and their subscribers are
+	//pruned.
+
+	sendScnNow(Scn{State: "Ready", Components: []string{"x3000c0s1b0n0"}},
+		"hbtd@x3000c0s1b0n0", srv.URL)
+	sendScnNow(Scn{State: "Off", Components: []string{"x3000c0s1b0n0"}},
+		"hbtd@x3000c0s2b0n0", srv.URL)
+	sendScnNow(Scn{State: "On", Components: []string{"x3000c0s1b0n0"}},
+		"hbtd@x3000c0s2b0n0", srv.URL)
+
+	dls, err := getDeadLetters("", 0)
+	if err != nil {
+		t.Fatal("ERROR fetching dead letters:", err)
+	}
+	if len(dls) != 2 {
+		t.Fatalf("ERROR, expected 2 dead letters, got %d: %v", len(dls), dls)
+	}
+	dl := dls[0]
+	if (dl.Subscriber != "hbtd@x3000c0s1b0n0") || (dl.Url != srv.URL) ||
+		(dl.Scn.State != "Ready") || (dl.Attempts != 2) ||
+		(dl.LastError != "Status code 500") || (dl.ID == "") || (dl.Time == "") {
+		t.Errorf("ERROR, dead letter mismatch: %v", dls)
+	}
+
+	//The second subscriber's SCN wasn't sent at all once it was pruned.
+	//Unprune it and send again so it has two.
+
+	prunemap_mutex.Lock()
+	unmarkPrune("x3000c0s2b0n0")
+	prunemap_mutex.Unlock()
+	sendScnNow(Scn{State: "On", Components: []string{"x3000c0s1b0n0"}},
+		"hbtd@x3000c0s2b0n0", srv.URL)
+
+	routes := generateRoutes()
+	router := newRouter(routes)
+
+	tests := []struct {
+		query string
+		code  int
+		count int
+	}{
+		{"", http.StatusOK, 3},
+		{"?subscriber=x3000c0s2b0n0", http.StatusOK, 2},
+		{"?subscriber=hbtd@x3000c0s1b0n0", http.StatusOK, 1},
+		{"?subscriber=other@x3000c0s1b0n0", http.StatusOK, 0},
+		{"?limit=1", http.StatusOK, 1},
+		{"?limit=x", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/hmi/v2/deadletters"+tt.query, nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != tt.code {
+			t.Errorf("ERROR, '%s' expected %d, got %d", tt.query, tt.code, rr.Code)
+			continue
+		}
+		if tt.code != http.StatusOK {
+			continue
+		}
+		var dlist DeadLetterList
+		if err := json.Unmarshal(rr.Body.Bytes(), &dlist); err != nil {
+			t.Errorf("ERROR unmarshaling '%s' response: %v", tt.query, err)
+			continue
+		}
+		if len(dlist.DeadLetters) != tt.count {
+			t.Errorf("ERROR, '%s' expected %d dead letters, got %d", tt.query,
+				tt.count, len(dlist.DeadLetters))
+		}
+	}
+
+	redrive := func(path string, code int) DeadLetterRedrive {
+		var rd DeadLetterRedrive
+		req := httptest.NewRequest("POST", "/hmi/v2/deadletters"+path, nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != code {
+			t.Errorf("ERROR, redrive '%s' expected %d, got %d", path, code, rr.Code)
+		} else if code == http.StatusOK {
+			json.Unmarshal(rr.Body.Bytes(), &rd)
+		}
+		return rd
+	}
+
+	//Still pruned, so nothing is redriven.
+
+	redrive("/"+dl.ID+"/redrive", http.StatusConflict)
+	redrive("/nosuchid/redrive", http.StatusNotFound)
+	rd := redrive("/redrive?subscriber=x3000c0s1b0n0", http.StatusOK)
+	if (rd.Redriven != 0) || (rd.Skipped != 1) {
+		t.Errorf("ERROR, expected 0 redriven/1 skipped, got %v", rd)
+	}
+
+	//Healthy again: one entry, then the rest in bulk.
+
+	mutex.Lock()
+	fail = false
+	mutex.Unlock()
+	prunemap_mutex.Lock()
+	unmarkPrune("x3000c0s1b0n0")
+	unmarkPrune("x3000c0s2b0n0")
+	prunemap_mutex.Unlock()
+
+	rd = redrive("/"+dl.ID+"/redrive", http.StatusOK)
+	if (rd.Redriven != 1) || (rd.Skipped != 0) {
+		t.Errorf("ERROR, expected 1 redriven, got %v", rd)
+	}
+	redrive("/"+dl.ID+"/redrive", http.StatusNotFound)
+	rd = redrive("/redrive", http.StatusOK)
+	if (rd.Redriven != 2) || (rd.Skipped != 0) {
+		t.Errorf("ERROR, expected 2 redriven, got %v", rd)
+	}
+
+	start := time.Now()
+	for time.Since(start) < 10*time.Second {
+		mutex.Lock()
+		ngot := len(got)
+		mutex.Unlock()
+		if ngot == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mutex.Lock()
+	if len(got) != 3 {
+		t.Errorf("ERROR, expected 3 redriven SCNs delivered, got %v", got)
+	}
+	mutex.Unlock()
+	if dls, _ = getDeadLetters("", 0); len(dls) != 0 {
+		t.Errorf("ERROR, expected no dead letters after redrive, got %v", dls)
+	}
+}
+
+func TestTrimDeadLetters(t *testing.T) {
+	var kverr error
+
+	disable_logs()
+	kverr = openTestKV()
+	if kverr != nil {
+		t.Fatal("KV/ETCD open failed:", kverr)
+	}
+	defer kvPurge(t)
+
+	for ix := 0; ix < DEAD_LETTER_MAX+5; ix++ {
+		j := NewJobSCNSend(Scn{State: "Off"}, "hbtd@x3000c0s1b0n0",
+			"http://x3000c0s1b0n0/scn").(*JobSCNSend)
+		j.LastErr, j.Attempts = "Status code 500", 3
+		storeDeadLetter(j)
+	}
+	trimDeadLetters()
+	dls, err := getDeadLetters("", 0)
+	if err != nil {
+		t.Fatal("ERROR fetching dead letters:", err)
+	}
+	if len(dls) != DEAD_LETTER_MAX {
+		t.Errorf("ERROR, expected %d dead letters, got %d", DEAD_LETTER_MAX, len(dls))
+	}
+	if dls, _ = getDeadLetters("", 10); len(dls) != 10 {
+		t.Errorf("ERROR, expected 10 dead letters with limit, got %d", len(dls))
+	}
+}
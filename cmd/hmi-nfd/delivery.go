@@ -0,0 +1,372 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A note about delivery error classes:
+//
+// A failed SCN send is put in a class by looking at the error itself, not
+// its text, or at the HTTP status class of the response:
+//
+//   ConnectionRefused: ECONNREFUSED; nothing is listening.
+//   Timeout:           the connection or request timed out.
+//   DNSFailure:        the subscriber's host name didn't resolve.
+//   TLSError:          TLS handshake or certificate failure.
+//   NetworkError:      any other transport error.
+//   ClientError:       4xx other than 429; the subscriber won't take it.
+//   Throttled:         429.
+//   ServerError:       5xx.
+//
+// Any 2xx response is success.  What is done for each class is set two
+// ways.  A class in the prune policy's DeliveryErrors prunes the subscriber
+// right away.  Otherwise, a class in Scn_retry_errors is retried, with
+// backoff, until Scn_retries attempts have been made, and then the
+// subscriber is pruned if the policy has RetriesExhausted.  A class that
+// isn't retried is dropped after the one attempt.  Either way the SCN is
+// kept as a dead letter.  By default everything but ClientError and
+// TLSError is retried, since those won't go away by trying again.
+// Throttled and ServerError responses with a Retry-After header aren't
+// retried before it says, up to SCN_RETRY_AFTER_MAX seconds.
+//
+// A subscription can have its own Delivery settings, which override the
+// global ones for its SCNs:
+//
+//   MaxAttempts:    attempts before giving up, instead of Scn_retries.
+//   TimeoutSeconds: per-attempt timeout, instead of SM_timeout.
+//   BackoffSeconds: first retry backoff, instead of Scn_backoff.  It is
+//                   doubled as usual, up to Scn_backoff_max or itself,
+//                   whichever is larger.
+//   SuccessCodes:   HTTP status codes which are success, instead of any
+//                   2xx.  A 2xx which isn't listed is a ServerError.
+//   BatchWindowMs,
+//   BatchMaxScns:   send SCNs in batches; see batch.go.
+//
+// Zero or empty fields use the global setting.  Each is limited by the
+// DELIVERY_MAX_xxx constants, so one subscriber can't tie up its queue
+// (and a worker) for long.
+
+/////////////////////////////////////////////////////////////////////////////
+// Constants
+/////////////////////////////////////////////////////////////////////////////
+
+const (
+	SCN_RETRY_AFTER_MAX = 300
+
+	DELIVERY_MAX_ATTEMPTS      = 20
+	DELIVERY_MAX_TIMEOUT       = 120
+	DELIVERY_MAX_BACKOFF       = 300
+	DELIVERY_MAX_SUCCESS_CODES = 20
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Data structures
+/////////////////////////////////////////////////////////////////////////////
+
+// Per-subscription delivery settings.  Zero values use the global ones.
+
+type DeliveryPolicy struct {
+	MaxAttempts    int   `json:"MaxAttempts,omitempty"`
+	TimeoutSeconds int   `json:"TimeoutSeconds,omitempty"`
+	BackoffSeconds int   `json:"BackoffSeconds,omitempty"`
+	SuccessCodes   []int `json:"SuccessCodes,omitempty"`
+	BatchWindowMs  int   `json:"BatchWindowMs,omitempty"`
+	BatchMaxScns   int   `json:"BatchMaxScns,omitempty"`
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get the default Scn_retry_errors: all but ClientError, TLSError and
+// RetriesExhausted.
+//
+// Args:   None.
+// Return: Delivery error classes which are retried.
+/////////////////////////////////////////////////////////////////////////////
+
+func defaultRetryErrors() []string {
+	return []string{DELIVERY_ERR_CONN_REFUSED, DELIVERY_ERR_TIMEOUT,
+		DELIVERY_ERR_DNS, DELIVERY_ERR_NETWORK, DELIVERY_ERR_THROTTLED,
+		DELIVERY_ERR_SERVER,
+	}
+}
+
+// Get the delivery error classes which are retried.
+
+func retryErrors() []string {
+	if app_params.Scn_retry_errors == nil {
+		return defaultRetryErrors()
+	}
+	return app_params.Scn_retry_errors
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Check if a delivery error class is retried.
+//
+// class(in): Delivery error class, DELIVERY_ERR_xxx.
+// Return:    true if retried.
+/////////////////////////////////////////////////////////////////////////////
+
+func retryOnDeliveryError(class string) bool {
+	return inListFold(retryErrors(), class)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Verify and normalize a list of retried delivery error classes.
+//
+// classes(in): Delivery error classes, any case.
+// Return:      Normalized classes; nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func verifyRetryErrors(classes []string) ([]string, error) {
+	rclasses := []string{}
+	for _, class := range classes {
+		dc := verifyDeliveryErrorClass(strings.TrimSpace(class))
+		if (dc == "") || (dc == DELIVERY_ERR_RETRIES) {
+			return nil, fmt.Errorf("invalid delivery error class '%s'", class)
+		}
+		rclasses = append(rclasses, dc)
+	}
+	return rclasses, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Set the retried delivery error classes from the command line or
+// environment, as a comma separated list.
+//
+// src(in):  Option or env variable it came from, for error messages.
+// list(in): Comma separated delivery error classes, any case.
+// Return:   None.
+/////////////////////////////////////////////////////////////////////////////
+
+func setRetryErrors(src string, list string) {
+	var classes []string
+	if strings.TrimSpace(list) != "" {
+		classes = strings.Split(list, ",")
+	}
+	rclasses, err := verifyRetryErrors(classes)
+	if err != nil {
+		log.Printf("ERROR: invalid %s value '%s': %v\n", src, list, err)
+		return
+	}
+	app_params.Scn_retry_errors = rclasses
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Classify an error from sending an SCN.
+//
+// err(in): Error from the HTTP client.
+// Return:  Delivery error class, DELIVERY_ERR_xxx.
+/////////////////////////////////////////////////////////////////////////////
+
+func classifySendError(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var recErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	var authErr x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	var certErr x509.CertificateInvalidError
+
+	switch {
+	case errors.As(err, &dnsErr):
+		return DELIVERY_ERR_DNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return DELIVERY_ERR_CONN_REFUSED
+	case errors.As(err, &recErr), errors.As(err, &alertErr),
+		errors.As(err, &verifyErr), errors.As(err, &authErr),
+		errors.As(err, &hostErr), errors.As(err, &certErr):
+		return DELIVERY_ERR_TLS
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return DELIVERY_ERR_TIMEOUT
+	}
+	return DELIVERY_ERR_NETWORK
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Classify the HTTP status of an SCN send response.
+//
+// code(in): HTTP status code.
+// Return:   Delivery error class, DELIVERY_ERR_xxx, or "" for success.
+/////////////////////////////////////////////////////////////////////////////
+
+func classifySendStatus(code int) string {
+	switch {
+	case (code >= 200) && (code < 300):
+		return ""
+	case code == http.StatusTooManyRequests:
+		return DELIVERY_ERR_THROTTLED
+	case (code >= 400) && (code < 500):
+		return DELIVERY_ERR_CLIENT
+	case code >= 500:
+		return DELIVERY_ERR_SERVER
+	}
+	//1xx and 3xx (redirects are followed by the client) aren't expected.
+	return DELIVERY_ERR_NETWORK
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get how long a response's Retry-After header says to wait.  Only used
+// for Throttled and ServerError responses.
+//
+// rsp(in): HTTP response.
+// Return:  Time to wait, up to SCN_RETRY_AFTER_MAX seconds; 0 if none.
+/////////////////////////////////////////////////////////////////////////////
+
+func retryAfter(rsp *http.Response) time.Duration {
+	var wait time.Duration
+
+	ra := strings.TrimSpace(rsp.Header.Get("Retry-After"))
+	if ra == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(ra); err == nil {
+		wait = time.Duration(secs) * time.Second
+	} else if when, err := http.ParseTime(ra); err == nil {
+		wait = time.Until(when)
+	}
+	if wait < 0 {
+		return 0
+	}
+	if wait > SCN_RETRY_AFTER_MAX*time.Second {
+		return SCN_RETRY_AFTER_MAX * time.Second
+	}
+	return wait
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Check a subscription's delivery settings against the server's limits.
+//
+// dp(in): Delivery settings, may be nil.
+// Return: nil if OK, else error describing the problem.
+/////////////////////////////////////////////////////////////////////////////
+
+func checkSubscriptionDelivery(dp *DeliveryPolicy) error {
+	if dp == nil {
+		return nil
+	}
+	if (dp.MaxAttempts < 0) || (dp.MaxAttempts > DELIVERY_MAX_ATTEMPTS) {
+		return fmt.Errorf("Delivery MaxAttempts %d out of range, must be 0-%d",
+			dp.MaxAttempts, DELIVERY_MAX_ATTEMPTS)
+	}
+	if (dp.TimeoutSeconds < 0) || (dp.TimeoutSeconds > DELIVERY_MAX_TIMEOUT) {
+		return fmt.Errorf("Delivery TimeoutSeconds %d out of range, must be 0-%d",
+			dp.TimeoutSeconds, DELIVERY_MAX_TIMEOUT)
+	}
+	if (dp.BackoffSeconds < 0) || (dp.BackoffSeconds > DELIVERY_MAX_BACKOFF) {
+		return fmt.Errorf("Delivery BackoffSeconds %d out of range, must be 0-%d",
+			dp.BackoffSeconds, DELIVERY_MAX_BACKOFF)
+	}
+	if len(dp.SuccessCodes) > DELIVERY_MAX_SUCCESS_CODES {
+		return fmt.Errorf("Delivery SuccessCodes has %d entries, max is %d",
+			len(dp.SuccessCodes), DELIVERY_MAX_SUCCESS_CODES)
+	}
+	for _, code := range dp.SuccessCodes {
+		if (code < 100) || (code > 599) {
+			return fmt.Errorf("Delivery SuccessCodes entry %d is not an HTTP status code",
+				code)
+		}
+	}
+	if (dp.BatchWindowMs < 0) || (dp.BatchWindowMs > DELIVERY_MAX_BATCH_WINDOW) {
+		return fmt.Errorf("Delivery BatchWindowMs %d out of range, must be 0-%d",
+			dp.BatchWindowMs, DELIVERY_MAX_BATCH_WINDOW)
+	}
+	if (dp.BatchMaxScns < 0) || (dp.BatchMaxScns > DELIVERY_MAX_BATCH_SCNS) {
+		return fmt.Errorf("Delivery BatchMaxScns %d out of range, must be 0-%d",
+			dp.BatchMaxScns, DELIVERY_MAX_BATCH_SCNS)
+	}
+	return nil
+}
+
+// Get the maximum number of send attempts for a subscription.
+
+func deliveryMaxAttempts(dp *DeliveryPolicy) int {
+	if (dp != nil) && (dp.MaxAttempts > 0) {
+		return dp.MaxAttempts
+	}
+	return app_params.Scn_retries
+}
+
+// Get the first retry backoff, in seconds, for a subscription.
+
+func deliveryBackoff(dp *DeliveryPolicy) int {
+	if (dp != nil) && (dp.BackoffSeconds > 0) {
+		return dp.BackoffSeconds
+	}
+	return app_params.Scn_backoff
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get the HTTP client to send a subscription's SCNs with.  It uses the
+// shared delivery transport (and its pooled connections), with the
+// subscription's timeout if it has one, otherwise SM_timeout.
+//
+// dp(in): Delivery settings, may be nil.
+// Return: HTTP client.
+/////////////////////////////////////////////////////////////////////////////
+
+func deliveryClient(dp *DeliveryPolicy) *http.Client {
+	timeout := app_params.SM_timeout
+	if (dp != nil) && (dp.TimeoutSeconds > 0) {
+		timeout = dp.TimeoutSeconds
+	}
+	return &http.Client{Transport: deliveryTransport(),
+		Timeout: time.Duration(timeout) * time.Second,
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Classify the HTTP status of an SCN send response, using a subscription's
+// success codes if it has them.
+//
+// dp(in):   Delivery settings, may be nil.
+// code(in): HTTP status code.
+// Return:   Delivery error class, DELIVERY_ERR_xxx, or "" for success.
+/////////////////////////////////////////////////////////////////////////////
+
+func classifyDeliveryStatus(dp *DeliveryPolicy, code int) string {
+	if (dp == nil) || (len(dp.SuccessCodes) == 0) {
+		return classifySendStatus(code)
+	}
+	for _, scode := range dp.SuccessCodes {
+		if scode == code {
+			return ""
+		}
+	}
+	class := classifySendStatus(code)
+	if class == "" {
+		return DELIVERY_ERR_SERVER
+	}
+	return class
+}
@@ -0,0 +1,242 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// A note about the delivery HTTP client:
+//
+// SCNs are sent to subscribers with their own transport, not the one used
+// for HSM and replica requests.  Connections are kept alive and pooled per
+// subscriber host (up to Scn_idle_conns idle ones, closed after
+// Scn_idle_timeout seconds idle), and HTTP/2 is used when the subscriber
+// offers it, so HTTPS subscribers don't pay for a TLS handshake on every
+// SCN.  Up to SCN_RSP_DRAIN_MAX bytes of a response body are read so its
+// connection can be reused; a subscriber sending more than that just gets
+// its connection closed.
+//
+// Server certificates are verified, against the CA bundle in Scn_tls_ca if
+// set, otherwise the system's roots.  Scn_tls_insecure turns verification
+// off.  If Scn_tls_cert and Scn_tls_key are set, that client certificate is
+// presented for mutual TLS.  These are only set at startup.  Changing the
+// idle connection settings through /params builds a new transport; the old
+// one's idle connections are closed, and requests in flight on it finish.
+//
+// Older releases didn't verify subscriber certificates at all, so HTTPS
+// subscribers with self-signed or private CA certificates start failing
+// with TLSError after an upgrade.  The first such failure logs a warning
+// saying how to fix it: set Scn_tls_ca to their CA bundle, or set
+// Scn_tls_insecure to go back to not verifying.
+
+/////////////////////////////////////////////////////////////////////////////
+// Constants
+/////////////////////////////////////////////////////////////////////////////
+
+const (
+	SCN_IDLE_CONNS     = 4
+	SCN_IDLE_TIMEOUT   = 90
+	SCN_DIAL_TIMEOUT   = 10
+	SCN_TLS_HS_TIMEOUT = 10
+	SCN_RSP_DRAIN_MAX  = 64 * 1024 //response body bytes read and discarded
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Global variables
+/////////////////////////////////////////////////////////////////////////////
+
+var dtrans *http.Transport
+var dtrans_mutex sync.Mutex
+var certVerifyWarned bool //protected by dtrans_mutex
+
+/////////////////////////////////////////////////////////////////////////////
+// Build a delivery transport from operating parameters.
+//
+// p(in):  Operating parameters to use.
+// Return: Transport; nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func newDeliveryTransport(p *opParams) (*http.Transport, error) {
+	tcfg := &tls.Config{MinVersion: tls.VersionTLS12,
+		InsecureSkipVerify: (p.Scn_tls_insecure != 0),
+	}
+
+	if p.Scn_tls_ca != "" {
+		pem, err := os.ReadFile(p.Scn_tls_ca)
+		if err != nil {
+			return nil, fmt.Errorf("can't read CA bundle '%s': %v",
+				p.Scn_tls_ca, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle '%s'",
+				p.Scn_tls_ca)
+		}
+		tcfg.RootCAs = pool
+	}
+
+	if (p.Scn_tls_cert != "") || (p.Scn_tls_key != "") {
+		if (p.Scn_tls_cert == "") || (p.Scn_tls_key == "") {
+			return nil, fmt.Errorf("client certificate and key must both be set")
+		}
+		cert, err := tls.LoadX509KeyPair(p.Scn_tls_cert, p.Scn_tls_key)
+		if err != nil {
+			return nil, fmt.Errorf("can't load client certificate '%s': %v",
+				p.Scn_tls_cert, err)
+		}
+		tcfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if (p.Scn_idle_conns < 0) || (p.Scn_idle_timeout < 0) {
+		return nil, fmt.Errorf("idle connection settings can't be negative")
+	}
+
+	tr := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   SCN_DIAL_TIMEOUT * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tcfg,
+		TLSHandshakeTimeout: SCN_TLS_HS_TIMEOUT * time.Second,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: p.Scn_idle_conns,
+		IdleConnTimeout:     time.Duration(p.Scn_idle_timeout) * time.Second,
+	}
+	if p.Scn_idle_conns == 0 {
+		tr.DisableKeepAlives = true
+	}
+	return tr, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Set up the delivery transport from the current operating parameters.
+// If they're bad, the error is logged and a transport which verifies
+// against the system's roots is used, so that a bad CA bundle or client
+// certificate doesn't turn verification off.
+//
+// Args, Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func setupDeliveryTransport() {
+	tr, err := newDeliveryTransport(&app_params)
+	if err != nil {
+		log.Printf("ERROR setting up SCN delivery transport: %v\n", err)
+		p := app_params
+		p.Scn_tls_ca, p.Scn_tls_cert, p.Scn_tls_key = "", "", ""
+		p.Scn_tls_insecure = 0
+		if (p.Scn_idle_conns < 0) || (p.Scn_idle_timeout < 0) {
+			p.Scn_idle_conns, p.Scn_idle_timeout = SCN_IDLE_CONNS, SCN_IDLE_TIMEOUT
+		}
+		tr, _ = newDeliveryTransport(&p)
+	}
+	setDeliveryTransport(tr)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Replace the delivery transport.  The old one's idle connections are
+// closed.
+//
+// tr(in): New transport.
+// Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func setDeliveryTransport(tr *http.Transport) {
+	dtrans_mutex.Lock()
+	old := dtrans
+	dtrans = tr
+	dtrans_mutex.Unlock()
+
+	if old != nil {
+		old.CloseIdleConnections()
+	}
+}
+
+// Get the delivery transport, setting it up on first use.
+
+func deliveryTransport() *http.Transport {
+	dtrans_mutex.Lock()
+	tr := dtrans
+	dtrans_mutex.Unlock()
+
+	if tr == nil {
+		setupDeliveryTransport()
+		dtrans_mutex.Lock()
+		tr = dtrans
+		dtrans_mutex.Unlock()
+	}
+	return tr
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Warn about the first subscriber certificate which can't be verified, with
+// how to fix it, since subscribers which worked before verification was
+// turned on fail this way.  Only logged once.
+//
+// url(in): Subscriber URL the SCN was sent to.
+// err(in): Error from the HTTP client.
+// Return:  None.
+/////////////////////////////////////////////////////////////////////////////
+
+func warnCertVerifyFailure(url string, err error) {
+	var verifyErr *tls.CertificateVerificationError
+	var authErr x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	var certErr x509.CertificateInvalidError
+
+	if !errors.As(err, &verifyErr) && !errors.As(err, &authErr) &&
+		!errors.As(err, &hostErr) && !errors.As(err, &certErr) {
+		return
+	}
+
+	dtrans_mutex.Lock()
+	warned := certVerifyWarned
+	certVerifyWarned = true
+	dtrans_mutex.Unlock()
+	if warned {
+		return
+	}
+
+	log.Printf("WARNING: Can't verify the TLS certificate of subscriber '%s': %v.  Subscriber certificates are verified as of HMNFD 1.44.0.  For subscribers with self-signed or private CA certificates, set Scn_tls_ca (--scn_tls_ca or HMNFD_SCN_TLS_CA) to their CA bundle, or set Scn_tls_insecure (--scn_tls_insecure or HMNFD_SCN_TLS_INSECURE=1) to not verify them, as before.  This is only logged once.",
+		url, err)
+}
+
+// Check if a parameter change needs a new delivery transport.
+
+func deliveryTransportChanged(p1 *opParams, p2 *opParams) bool {
+	return (p1.Scn_tls_ca != p2.Scn_tls_ca) ||
+		(p1.Scn_tls_cert != p2.Scn_tls_cert) ||
+		(p1.Scn_tls_key != p2.Scn_tls_key) ||
+		(p1.Scn_tls_insecure != p2.Scn_tls_insecure) ||
+		(p1.Scn_idle_conns != p2.Scn_idle_conns) ||
+		(p1.Scn_idle_timeout != p2.Scn_idle_timeout)
+}
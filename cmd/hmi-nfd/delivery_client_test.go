@@ -0,0 +1,261 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Write a PEM file in the test's temp dir.
+
+func writePem(t *testing.T, name string, ptype string, der []byte) string {
+	fname := t.TempDir() + "/" + name
+	ba := pem.EncodeToMemory(&pem.Block{Type: ptype, Bytes: der})
+	if err := os.WriteFile(fname, ba, 0600); err != nil {
+		t.Fatal("Can't write PEM file:", err)
+	}
+	return fname
+}
+
+// Make a self-signed client certificate; returns its cert and key files.
+
+func makeClientCert(t *testing.T) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Can't generate key:", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cray-hmnfd"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("Can't create certificate:", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal("Can't marshal key:", err)
+	}
+	return cert, writePem(t, "client.pem", "CERTIFICATE", der),
+		writePem(t, "client.key", "EC PRIVATE KEY", kder)
+}
+
+func TestNewDeliveryTransport(t *testing.T) {
+	disable_logs()
+	_, certFile, keyFile := makeClientCert(t)
+	junkFile := writePem(t, "junk.pem", "JUNK", []byte("junk"))
+
+	p := app_params
+	p.Scn_idle_conns, p.Scn_idle_timeout = 8, 60
+	tr, err := newDeliveryTransport(&p)
+	if err != nil {
+		t.Fatal("ERROR building default transport:", err)
+	}
+	if tr.TLSClientConfig.InsecureSkipVerify || !tr.ForceAttemptHTTP2 ||
+		(tr.MaxIdleConnsPerHost != 8) || (tr.IdleConnTimeout != 60*time.Second) ||
+		tr.DisableKeepAlives {
+		t.Errorf("ERROR, bad default transport settings.")
+	}
+
+	p.Scn_tls_cert, p.Scn_tls_key = certFile, keyFile
+	if tr, err = newDeliveryTransport(&p); (err != nil) ||
+		(len(tr.TLSClientConfig.Certificates) != 1) {
+		t.Errorf("ERROR, client certificate not loaded: %v", err)
+	}
+
+	p.Scn_idle_conns = 0
+	if tr, err = newDeliveryTransport(&p); (err != nil) || !tr.DisableKeepAlives {
+		t.Errorf("ERROR, keep-alives not disabled: %v", err)
+	}
+
+	bad := []opParams{p, p, p, p}
+	bad[0].Scn_tls_ca = junkFile
+	bad[1].Scn_tls_key = ""
+	bad[2].Scn_tls_key = certFile
+	bad[3].Scn_idle_timeout = -1
+	for ix := range bad {
+		if _, err = newDeliveryTransport(&bad[ix]); err == nil {
+			t.Errorf("ERROR, bad transport params %d accepted.", ix)
+		}
+	}
+}
+
+func TestDeliveryTLS(t *testing.T) {
+	var nconns, nh2 int32
+	var clientCN atomic.Value
+
+	disable_logs()
+	saved := app_params
+	defer func() {
+		restoreAppParams(saved)
+		setDeliveryTransport(nil)
+	}()
+
+	ccert, certFile, keyFile := makeClientCert(t)
+	cpool := x509.NewCertPool()
+	cpool.AddCert(ccert)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 {
+			atomic.AddInt32(&nh2, 1)
+		}
+		if len(r.TLS.PeerCertificates) > 0 {
+			clientCN.Store(r.TLS.PeerCertificates[0].Subject.CommonName)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.EnableHTTP2 = true
+	srv.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: cpool}
+	srv.Config.ConnState = func(c net.Conn, cs http.ConnState) {
+		if cs == http.StateNew {
+			atomic.AddInt32(&nconns, 1)
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	caFile := writePem(t, "ca.pem", "CERTIFICATE", srv.Certificate().Raw)
+
+	post := func() error {
+		rsp, err := deliveryClient(nil).Post(srv.URL, "application/json",
+			bytes.NewBufferString(`{"State":"On"}`))
+		if err == nil {
+			rsp.Body.Close()
+		}
+		return err
+	}
+
+	//Not trusted without the CA bundle.
+
+	app_params.SM_timeout = 5
+	app_params.Scn_idle_conns, app_params.Scn_idle_timeout = 4, 90
+	setupDeliveryTransport()
+	err := post()
+	if (err == nil) || (classifySendError(err) != DELIVERY_ERR_TLS) {
+		t.Errorf("ERROR, untrusted subscriber certificate accepted: %v", err)
+	}
+
+	//Only certificate verification failures get the upgrade warning.
+
+	dtrans_mutex.Lock()
+	certVerifyWarned = false
+	dtrans_mutex.Unlock()
+	warnCertVerifyFailure(srv.URL, tls.AlertError(40))
+	dtrans_mutex.Lock()
+	if certVerifyWarned {
+		t.Errorf("ERROR, TLS alert warned about certificate verification.")
+	}
+	dtrans_mutex.Unlock()
+	warnCertVerifyFailure(srv.URL, err)
+	dtrans_mutex.Lock()
+	if !certVerifyWarned {
+		t.Errorf("ERROR, no warning for unverified subscriber certificate.")
+	}
+	dtrans_mutex.Unlock()
+
+	//Trusted with it; HTTP/2, keep-alive, and the client cert for mTLS.
+
+	app_params.Scn_tls_ca = caFile
+	app_params.Scn_tls_cert, app_params.Scn_tls_key = certFile, keyFile
+	setupDeliveryTransport()
+	atomic.StoreInt32(&nconns, 0)
+	for ix := 0; ix < 3; ix++ {
+		if err := post(); err != nil {
+			t.Fatalf("ERROR, send %d to trusted subscriber failed: %v", ix, err)
+		}
+	}
+	if n := atomic.LoadInt32(&nconns); n != 1 {
+		t.Errorf("ERROR, expected 1 connection for 3 sends, got %d", n)
+	}
+	if n := atomic.LoadInt32(&nh2); n != 3 {
+		t.Errorf("ERROR, expected 3 HTTP/2 sends, got %d", n)
+	}
+	if cn, _ := clientCN.Load().(string); cn != "cray-hmnfd" {
+		t.Errorf("ERROR, client certificate not presented, got CN '%s'", cn)
+	}
+
+	//A bad bundle at startup leaves verification on.
+
+	app_params.Scn_tls_ca = "/nonexistent/ca.pem"
+	setupDeliveryTransport()
+	if tr := deliveryTransport(); tr.TLSClientConfig.InsecureSkipVerify {
+		t.Errorf("ERROR, bad CA bundle turned off verification.")
+	}
+}
+
+func TestDeliveryResponseDrain(t *testing.T) {
+	disable_logs()
+	saved := app_params
+	defer func() {
+		restoreAppParams(saved)
+		setDeliveryTransport(nil)
+	}()
+
+	//A subscriber which never stops sending its response.
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		chunk := make([]byte, 64*1024)
+		for {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	app_params.SM_timeout = 30
+	app_params.Scn_breaker_threshold = 0
+	setupDeliveryTransport()
+
+	j := NewJobSCNSend(Scn{State: "Ready", Components: []string{"x1"}},
+		"hbtd@x3000c0s1b0n0", srv.URL+"/scn").(*JobSCNSend)
+	start := time.Now()
+	if sendSCNToSubscriber(j) {
+		t.Errorf("ERROR, SCN send retried: %s", j.LastErr)
+	}
+	if time.Since(start) > (5 * time.Second) {
+		t.Errorf("ERROR, reading the response took %s.", time.Since(start))
+	}
+}
@@ -0,0 +1,460 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// A net.Error which timed out.
+
+type timeoutErr struct{}
+
+func (e timeoutErr) Error() string   { return "i/o timeout" }
+func (e timeoutErr) Timeout() bool   { return true }
+func (e timeoutErr) Temporary() bool { return true }
+
+func TestClassifySendError(t *testing.T) {
+	wrap := func(err error) error {
+		return &url.Error{Op: "Post", URL: "http://x3000c0s1b0n0/scn",
+			Err: &net.OpError{Op: "dial", Net: "tcp", Err: err}}
+	}
+
+	tests := []struct {
+		err   error
+		class string
+	}{
+		{wrap(os.NewSyscallError("connect", syscall.ECONNREFUSED)), DELIVERY_ERR_CONN_REFUSED},
+		{wrap(&net.DNSError{Err: "no such host", Name: "x3000c0s1b0n0", IsNotFound: true}),
+			DELIVERY_ERR_DNS},
+		{wrap(timeoutErr{}), DELIVERY_ERR_TIMEOUT},
+		{wrap(x509.UnknownAuthorityError{}), DELIVERY_ERR_TLS},
+		{wrap(x509.HostnameError{Host: "x3000c0s1b0n0"}), DELIVERY_ERR_TLS},
+		{wrap(tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}),
+			DELIVERY_ERR_TLS},
+		{wrap(os.NewSyscallError("read", syscall.ECONNRESET)), DELIVERY_ERR_NETWORK},
+		{errors.New("connection refused, but only in the text"), DELIVERY_ERR_NETWORK},
+	}
+	for _, tt := range tests {
+		if class := classifySendError(tt.err); class != tt.class {
+			t.Errorf("ERROR, '%v' expected class '%s', got '%s'", tt.err,
+				tt.class, class)
+		}
+	}
+}
+
+func TestClassifySendStatus(t *testing.T) {
+	tests := []struct {
+		code  int
+		class string
+	}{
+		{http.StatusOK, ""},
+		{http.StatusAccepted, ""},
+		{http.StatusNoContent, ""},
+		{http.StatusBadRequest, DELIVERY_ERR_CLIENT},
+		{http.StatusNotFound, DELIVERY_ERR_CLIENT},
+		{http.StatusTooManyRequests, DELIVERY_ERR_THROTTLED},
+		{http.StatusInternalServerError, DELIVERY_ERR_SERVER},
+		{http.StatusServiceUnavailable, DELIVERY_ERR_SERVER},
+	}
+	for _, tt := range tests {
+		if class := classifySendStatus(tt.code); class != tt.class {
+			t.Errorf("ERROR, status %d expected class '%s', got '%s'", tt.code,
+				tt.class, class)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		hdr string
+		min time.Duration
+		max time.Duration
+	}{
+		{"", 0, 0},
+		{"5", 5 * time.Second, 5 * time.Second},
+		{"-5", 0, 0},
+		{"junk", 0, 0},
+		{"100000", SCN_RETRY_AFTER_MAX * time.Second, SCN_RETRY_AFTER_MAX * time.Second},
+		{time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat),
+			28 * time.Second, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		rsp := &http.Response{Header: http.Header{}}
+		if tt.hdr != "" {
+			rsp.Header.Set("Retry-After", tt.hdr)
+		}
+		if wait := retryAfter(rsp); (wait < tt.min) || (wait > tt.max) {
+			t.Errorf("ERROR, Retry-After '%s' expected %s-%s, got %s", tt.hdr,
+				tt.min, tt.max, wait)
+		}
+	}
+}
+
+func TestVerifyRetryErrors(t *testing.T) {
+	rclasses, err := verifyRetryErrors([]string{"timeout", " THROTTLED"})
+	if (err != nil) || (fmt.Sprint(rclasses) != "[Timeout Throttled]") {
+		t.Errorf("ERROR, expected [Timeout Throttled], got %v, %v", rclasses, err)
+	}
+	for _, bad := range []string{"Bogus", DELIVERY_ERR_RETRIES} {
+		if _, err = verifyRetryErrors([]string{bad}); err == nil {
+			t.Errorf("ERROR, '%s' not rejected as a retried class.", bad)
+		}
+	}
+}
+
+func TestDeliveryErrorHandling(t *testing.T) {
+	var kverr error
+	var code int
+	var hdr string
+
+	disable_logs()
+	kverr = openTestKV()
+	if kverr != nil {
+		t.Fatal("KV/ETCD open failed:", kverr)
+	}
+	defer kvPurge(t)
+	if htrans.transport == nil {
+		htrans.transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		htrans.client = &http.Client{Transport: htrans.transport,
+			Timeout: 5 * time.Second,
+		}
+	}
+
+	saved := app_params
+	app_params.Scn_retries = 3
+	app_params.Scn_backoff = 0
+	app_params.Scn_breaker_threshold = 0
+	app_params.Prune_policy = defaultPrunePolicy()
+	defer func() {
+		waitSubQueues(t)
+		restoreAppParams(saved)
+		prunemap_mutex.Lock()
+		unmarkPrune("x3000c0s1b0n0")
+		prunemap_mutex.Unlock()
+	}()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hdr != "" {
+			w.Header().Set("Retry-After", hdr)
+		}
+		w.WriteHeader(code)
+	}))
+	defer srv.Close()
+
+	send := func() (*JobSCNSend, bool) {
+		j := NewJobSCNSend(Scn{State: "On"}, "hbtd@x3000c0s1b0n0", srv.URL).(*JobSCNSend)
+		return j, sendSCNToSubscriber(j)
+	}
+	pruned := func() bool {
+		prunemap_mutex.Lock()
+		defer prunemap_mutex.Unlock()
+		p := prunemap["x3000c0s1b0n0"]
+		unmarkPrune("x3000c0s1b0n0")
+		return p
+	}
+
+	//Any 2xx is success.
+
+	for _, code = range []int{http.StatusOK, http.StatusAccepted, http.StatusNoContent} {
+		if j, retry := send(); retry || (j.LastErr != "") {
+			t.Errorf("ERROR, status %d not a success: %s", code, j.LastErr)
+		}
+	}
+
+	//4xx is dropped after one attempt, and not pruned by default.
+
+	code = http.StatusBadRequest
+	if j, retry := send(); retry || (j.Attempts != 1) || pruned() {
+		t.Errorf("ERROR, 400 retried or pruned: %v/%d", retry, j.Attempts)
+	}
+
+	//5xx and 429 are retried, honoring Retry-After.
+
+	code = http.StatusServiceUnavailable
+	if j, retry := send(); !retry || (time.Until(j.RetryAt) > time.Second) {
+		t.Errorf("ERROR, 503 not retried right away: %v/%s", retry, j.RetryAt)
+	}
+	code, hdr = http.StatusTooManyRequests, "20"
+	if j, retry := send(); !retry || (time.Until(j.RetryAt) < 19*time.Second) {
+		t.Errorf("ERROR, 429 Retry-After not honored: %v/%s", retry, j.RetryAt)
+	}
+	hdr = ""
+
+	//Retry behavior per class is configurable, and so is pruning.
+
+	app_params.Scn_retry_errors = []string{DELIVERY_ERR_CLIENT}
+	code = http.StatusNotFound
+	if _, retry := send(); !retry {
+		t.Errorf("ERROR, 404 not retried with ClientError in Scn_retry_errors.")
+	}
+	code = http.StatusInternalServerError
+	if _, retry := send(); retry {
+		t.Errorf("ERROR, 500 retried without ServerError in Scn_retry_errors.")
+	}
+	app_params.Prune_policy.Components.DeliveryErrors = []string{DELIVERY_ERR_SERVER}
+	if _, retry := send(); retry || !pruned() {
+		t.Errorf("ERROR, 500 not pruned with ServerError in DeliveryErrors.")
+	}
+
+	dls, _ := getDeadLetters("", 0)
+	if len(dls) != 3 {
+		t.Errorf("ERROR, expected 3 dead letters, got %d", len(dls))
+	}
+}
+
+func TestCheckSubscriptionDelivery(t *testing.T) {
+	good := []*DeliveryPolicy{
+		nil,
+		{},
+		{MaxAttempts: DELIVERY_MAX_ATTEMPTS, TimeoutSeconds: DELIVERY_MAX_TIMEOUT,
+			BackoffSeconds: DELIVERY_MAX_BACKOFF, SuccessCodes: []int{200, 409}},
+		{BatchWindowMs: DELIVERY_MAX_BATCH_WINDOW, BatchMaxScns: DELIVERY_MAX_BATCH_SCNS},
+	}
+	bad := []*DeliveryPolicy{
+		{MaxAttempts: -1},
+		{MaxAttempts: DELIVERY_MAX_ATTEMPTS + 1},
+		{TimeoutSeconds: DELIVERY_MAX_TIMEOUT + 1},
+		{BackoffSeconds: -5},
+		{BackoffSeconds: DELIVERY_MAX_BACKOFF + 1},
+		{SuccessCodes: []int{200, 600}},
+		{SuccessCodes: make([]int, DELIVERY_MAX_SUCCESS_CODES+1)},
+		{BatchWindowMs: -1},
+		{BatchWindowMs: DELIVERY_MAX_BATCH_WINDOW + 1},
+		{BatchMaxScns: DELIVERY_MAX_BATCH_SCNS + 1},
+	}
+
+	for ix, dp := range good {
+		if err := checkSubscriptionDelivery(dp); err != nil {
+			t.Errorf("ERROR, good policy %d rejected: %v", ix, err)
+		}
+	}
+	for ix, dp := range bad {
+		if err := checkSubscriptionDelivery(dp); err == nil {
+			t.Errorf("ERROR, bad policy %d accepted: %+v", ix, *dp)
+		}
+	}
+}
+
+func TestClassifyDeliveryStatus(t *testing.T) {
+	dp := &DeliveryPolicy{SuccessCodes: []int{http.StatusAccepted, http.StatusConflict}}
+	tests := []struct {
+		dp   *DeliveryPolicy
+		code int
+		exp  string
+	}{
+		{nil, http.StatusOK, ""},
+		{&DeliveryPolicy{}, http.StatusNoContent, ""},
+		{dp, http.StatusAccepted, ""},
+		{dp, http.StatusConflict, ""},
+		{dp, http.StatusOK, DELIVERY_ERR_SERVER},
+		{dp, http.StatusNotFound, DELIVERY_ERR_CLIENT},
+		{dp, http.StatusTooManyRequests, DELIVERY_ERR_THROTTLED},
+	}
+
+	for _, tt := range tests {
+		if class := classifyDeliveryStatus(tt.dp, tt.code); class != tt.exp {
+			t.Errorf("ERROR, status %d expected class '%s', got '%s'",
+				tt.code, tt.exp, class)
+		}
+	}
+}
+
+func TestDeliveryPolicy(t *testing.T) {
+	var kverr error
+	var code int
+	var delay time.Duration
+
+	disable_logs()
+	kverr = openTestKV()
+	if kverr != nil {
+		t.Fatal("KV/ETCD open failed:", kverr)
+	}
+	defer kvPurge(t)
+	if htrans.transport == nil {
+		htrans.transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		htrans.client = &http.Client{Transport: htrans.transport,
+			Timeout: 5 * time.Second,
+		}
+	}
+
+	saved := app_params
+	app_params.Scn_retries = 5
+	app_params.Scn_backoff = 0
+	app_params.Scn_backoff_jitter = 0
+	app_params.Scn_breaker_threshold = 0
+	app_params.Prune_policy = defaultPrunePolicy()
+	defer func() {
+		waitSubQueues(t)
+		restoreAppParams(saved)
+		prunemap_mutex.Lock()
+		unmarkPrune("x3000c0s1b0n0")
+		prunemap_mutex.Unlock()
+	}()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.WriteHeader(code)
+	}))
+	defer srv.Close()
+
+	send := func(dp *DeliveryPolicy) (*JobSCNSend, bool) {
+		j := NewJobSCNSend(Scn{State: "On"}, "hbtd@x3000c0s1b0n0", srv.URL).(*JobSCNSend)
+		j.Delivery = dp
+		return j, sendSCNToSubscriber(j)
+	}
+
+	//Success codes replace "any 2xx".
+
+	dp := &DeliveryPolicy{SuccessCodes: []int{http.StatusConflict}}
+	code = http.StatusConflict
+	if j, retry := send(dp); retry || (j.LastErr != "") {
+		t.Errorf("ERROR, listed success code failed: %s", j.LastErr)
+	}
+	code = http.StatusOK
+	if j, retry := send(dp); !retry || (j.LastErr == "") {
+		t.Errorf("ERROR, unlisted 2xx was a success.")
+	}
+
+	//Backoff is the subscription's.
+
+	dp = &DeliveryPolicy{BackoffSeconds: 10}
+	code = http.StatusServiceUnavailable
+	if j, retry := send(dp); !retry || (time.Until(j.RetryAt) < 9*time.Second) {
+		t.Errorf("ERROR, subscription backoff not used: %v/%s", retry, j.RetryAt)
+	}
+
+	//Max attempts is the subscription's, not Scn_retries.
+
+	dp = &DeliveryPolicy{MaxAttempts: 2}
+	j := NewJobSCNSend(Scn{State: "On"}, "hbtd@x3000c0s1b0n0", srv.URL).(*JobSCNSend)
+	j.Delivery = dp
+	for sendSCNToSubscriber(j) {
+	}
+	if j.Attempts != 2 {
+		t.Errorf("ERROR, expected 2 attempts, got %d", j.Attempts)
+	}
+	prunemap_mutex.Lock()
+	unmarkPrune("x3000c0s1b0n0")
+	prunemap_mutex.Unlock()
+
+	//Per-attempt timeout is the subscription's.
+
+	dp = &DeliveryPolicy{TimeoutSeconds: 1, MaxAttempts: 1}
+	code, delay = http.StatusOK, 1500*time.Millisecond
+	if j, _ := send(dp); j.LastErr == "" {
+		t.Errorf("ERROR, subscription timeout not used.")
+	}
+	if j, _ := send(nil); j.LastErr != "" {
+		t.Errorf("ERROR, global timeout not used: %s", j.LastErr)
+	}
+}
+
+func TestSubscriptionDelivery(t *testing.T) {
+	var kverr error
+
+	disable_logs()
+	kverr = openTestKV()
+	if kverr != nil {
+		t.Fatal("KV/ETCD open failed:", kverr)
+	}
+	defer kvPurge(t)
+
+	router := newRouter(generateRoutes())
+	subUrl := "http://localhost:8080/hmi/v2/subscriptions/x1000c0s1b0n0/agents/pcs"
+	subKey := "sub#x1000c0s1b0n0#hs.ready#svc.pcs"
+	payload := `{"Components":["x1000c0s0b0n0"],"States":["Ready"],"Url":"http://x1000c0s1b0n0/scn",`
+	good := payload + `"Delivery":{"MaxAttempts":4,"TimeoutSeconds":10,"BackoffSeconds":2,"SuccessCodes":[200,202]}}`
+
+	tests := []struct {
+		method  string
+		payload string
+		code    int
+	}{
+		{"POST", payload + `"Delivery":{"MaxAttempts":1000}}`, http.StatusBadRequest},
+		{"POST", payload + `"Delivery":{"SuccessCodes":[42]}}`, http.StatusBadRequest},
+		{"POST", good, http.StatusOK},
+		{"PATCH", payload + `"Delivery":{"TimeoutSeconds":-1}}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, subUrl, bytes.NewBufferString(tt.payload))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != tt.code {
+			t.Errorf("ERROR, %s '%s' returned %d, exp %d", tt.method,
+				tt.payload, rr.Code, tt.code)
+		}
+	}
+
+	sd, ok := getSubData(t, subKey)
+	if !ok {
+		t.Fatalf("ERROR, subscription key '%s' not created.", subKey)
+	}
+	if (sd.Delivery == nil) || (sd.Delivery.MaxAttempts != 4) ||
+		(sd.Delivery.TimeoutSeconds != 10) || (sd.Delivery.BackoffSeconds != 2) ||
+		(len(sd.Delivery.SuccessCodes) != 2) {
+		t.Fatalf("ERROR, delivery settings not stored: %+v", sd.Delivery)
+	}
+
+	//Listed with the subscription.
+
+	var sublist SubscriptionList
+	req, _ := http.NewRequest("GET", "http://localhost:8080/hmi/v2/subscriptions/x1000c0s1b0n0", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	json.Unmarshal(rr.Body.Bytes(), &sublist)
+	if (len(sublist.SubscriptionList) != 1) ||
+		(sublist.SubscriptionList[0].Delivery == nil) ||
+		(sublist.SubscriptionList[0].Delivery.MaxAttempts != 4) {
+		t.Errorf("ERROR, delivery settings not listed: %s", rr.Body.String())
+	}
+
+	//A PATCH without them goes back to the global settings.
+
+	req, _ = http.NewRequest("PATCH", subUrl, bytes.NewBufferString(payload+`"Durable":false}`))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("ERROR, PATCH returned %d", rr.Code)
+	}
+	if sd, _ = getSubData(t, subKey); sd.Delivery != nil {
+		t.Errorf("ERROR, delivery settings not cleared: %+v", sd.Delivery)
+	}
+}
@@ -1,6 +1,6 @@
 // MIT License
 //
-// (C) Copyright [2019-2021,2023] Hewlett Packard Enterprise Development LP
+// (C) Copyright [2019-2021,2023,2026] Hewlett Packard Enterprise Development LP
 //
 // Permission is hereby granted, free of charge, to any person obtaining a
 // copy of this software and associated documentation files (the "Software"),
@@ -26,18 +26,24 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
-	"os"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	base "github.com/Cray-HPE/hms-base/v2"
+	"github.com/Cray-HPE/hms-hmnfd/pkg/scnsign"
 )
 
-// Used for subscription tracking to insure we don't send > 1
-// subscription to HSM for any given thing.
+// Used to collect the union of subscription attributes, which make up
+// the HSM subscription.
 
 type subTracker struct {
 	hwStates map[string]bool
@@ -47,8 +53,8 @@ type subTracker struct {
 	enabled  bool
 }
 
-// This is the data stored in the HSM subscription key in ETCD,
-// used for auto-discovery on startup.
+// This is the data stored in the HSM subscription key in ETCD.  It holds
+// the HSM subscription last applied, and is picked up on startup.
 
 type hsmSubscriptionInfo struct {
 	HWStates []string `json:"HWStates,omitempty"`
@@ -58,106 +64,571 @@ type hsmSubscriptionInfo struct {
 	Enabled  bool     `json:"Enabled,omitempty"`
 }
 
-type hsmStateOnly struct {
-	Flag  string `json:"Flag"`
-	ID    string `json:"ID"`
-	Type  string `json:"Type"`
-	State string `json:"State"`
+// HSM's representation of an SCN subscription, used when reading, creating
+// and replacing our subscription in HSM.
+
+type hsmScnSubscription struct {
+	ID             int64    `json:"ID,omitempty"`
+	Subscriber     string   `json:"Subscriber"`
+	Enabled        *bool    `json:"Enabled,omitempty"`
+	Roles          []string `json:"Roles,omitempty"`
+	SubRoles       []string `json:"SubRoles,omitempty"`
+	SoftwareStatus []string `json:"SoftwareStatus,omitempty"`
+	States         []string `json:"States,omitempty"`
+	Url            string   `json:"Url"`
 }
 
-type hsmStateArray struct {
-	Components []hsmStateOnly
+type hsmScnSubscriptionList struct {
+	SubscriptionList []hsmScnSubscription `json:"SubscriptionList"`
 }
 
-var __hsm_scn_subscription_ix int = 1
-var hostName string
+// Subscriber name used for hmnfd's single HSM subscription.  This stays the
+// same across restarts and pod churn so the subscription can be found and
+// updated rather than added to.
+
+const HSM_SCN_SUBSCRIBER = URL_APPNAME
+
+// Seconds between HSM subscription reconcile retries after an error, and
+// between checks that HSM still holds our subscription.
+
+const (
+	HSM_SUBS_RETRY           = 5
+	HSM_SUBS_VERIFY_INTERVAL = 60
+)
+
+// Seconds to wait before retrying a failed dead subscriber sweep.
+
+const PRUNE_SWEEP_RETRY = 30
+
+// ETCD key holding the HSM subscription status, so every replica can
+// report it.
+
+const HSM_SUBS_STATUS_KEY = "hsmsubs_status"
+
+type hsmSubsStatus struct {
+	Degraded bool   `json:"Degraded"`
+	Reason   string `json:"Reason,omitempty"`
+	Since    string `json:"Since,omitempty"`
+	Repaired bool   `json:"Repaired,omitempty"` //re-posted, not yet confirmed
+	Repairs  int    `json:"Repairs"`            //times the leader re-posted it
+}
+
+// Older versions of hmnfd subscribed as 'podname_N' each time a new
+// attribute was seen, where the pod name is the deployment's
+// (cray-hmnfd-<replicaset hash>-<suffix>), or 'hmnfd<nanoseconds>' if the
+// host name couldn't be had.  These are recognized and cleaned up; other
+// services' subscriptions which just mention hmnfd are left alone.
+
+var legacyHsmSubscriber = regexp.MustCompile(`^(cray-` + URL_APPNAME +
+	`-[0-9a-z]{1,10}-[0-9a-z]{5}|` + URL_APPNAME + `[0-9]+)_[0-9]+$`)
+
+// The HSM subscription most recently applied, and whether it needs to be
+// verified against HSM.
+
+var hsmSubsApplied *hsmSubscriptionInfo
+var hsmSubsVerify = false
+var hsmSubsMutex = &sync.Mutex{}
+
+// Set while HSM has lost our subscription and it hasn't been repaired.
+
+var hsmSubsLost hsmSubsStatus
+var hsmSubsLostMutex = &sync.Mutex{}
+
+// Dead subscriber sweep schedule.  A zero pruneSweepNext means none is
+// scheduled yet.
+
+var pruneSweepLast time.Time
+var pruneSweepNext time.Time
+var pruneSweepMutex = &sync.Mutex{}
 
 /////////////////////////////////////////////////////////////////////////////
-// Send subscription to the State Manager for State Change Notification.
+// Send a request to HSM.  The caller must close the response body.
 //
-// scn(in):  SCN subscription data.
-// Return:   nil on success, error string on error.
+// method(in):  HTTP method.
+// url(in):     Full URL.
+// payload(in): Request body, or nil.
+// Return:      HTTP response; nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func hsmRequest(method string, url string, payload []byte) (*http.Response, error) {
+	var body io.Reader
+
+	if payload != nil {
+		body = bytes.NewBuffer(payload)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	base.SetHTTPUserAgent(req, serviceName)
+
+	if app_params.Debug > 1 {
+		log.Printf("Sending %s to State Mgr URL: %s Data: %s",
+			method, url, string(payload))
+	}
+
+	rsp, err := htrans.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if (rsp.StatusCode != http.StatusOK) &&
+		(rsp.StatusCode != http.StatusNoContent) &&
+		(rsp.StatusCode != http.StatusCreated) &&
+		(rsp.StatusCode != http.StatusAccepted) {
+		io.Copy(ioutil.Discard, rsp.Body)
+		rsp.Body.Close()
+		return nil, fmt.Errorf("ERROR response from State Manager: %s, Error code: %d",
+			rsp.Status, rsp.StatusCode)
+	}
+	return rsp, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Send a request to the HSM SCN subscription API.
+//
+// method(in):  HTTP method.
+// url(in):     Full URL.
+// payload(in): Request body, or nil.
+// Return:      Response body; nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func hsmSubscriptionRequest(method string, url string, payload []byte) ([]byte, error) {
+	rsp, err := hsmRequest(method, url, payload)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	rbody, _ := ioutil.ReadAll(rsp.Body)
+	return rbody, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get all SCN subscriptions currently held by HSM.
+//
+// Args:   None.
+// Return: Array of HSM subscriptions; nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func getHsmScnSubscriptions() ([]hsmScnSubscription, error) {
+	var slist hsmScnSubscriptionList
+
+	smURL := app_params.SM_url + URL_DELIM + SM_SCN_SUB
+	body, err := hsmSubscriptionRequest(http.MethodGet, smURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(body, &slist)
+	if err != nil {
+		return nil, err
+	}
+	return slist.SubscriptionList, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Determine if an HSM SCN subscription belongs to hmnfd.
+//
+// sub(in): HSM subscription.
+// Return:  true if it's an hmnfd subscription.
+/////////////////////////////////////////////////////////////////////////////
+
+func isHmnfdHsmSubscription(sub hsmScnSubscription) bool {
+	if sub.Subscriber == HSM_SCN_SUBSCRIBER {
+		return true
+	}
+	if (app_params.Scn_in_url != "") && (sub.Url == app_params.Scn_in_url) {
+		return true
+	}
+	return legacyHsmSubscriber.MatchString(sub.Subscriber)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Determine if an HSM subscription has the same attributes as the desired
+// subscription.
+//
+// sub(in):  HSM subscription.
+// hsi(in):  Desired subscription attributes.
+// Return:   true if they match.
+/////////////////////////////////////////////////////////////////////////////
+
+func hsmSubscriptionMatches(sub hsmScnSubscription, hsi hsmSubscriptionInfo) bool {
+	enbl := (sub.Enabled != nil) && *sub.Enabled
+	if (sub.Url != app_params.Scn_in_url) || (enbl != hsi.Enabled) {
+		return false
+	}
+
+	return strSetEqual(sub.States, hsi.HWStates) &&
+		strSetEqual(sub.SoftwareStatus, hsi.SWStatus) &&
+		strSetEqual(sub.Roles, hsi.Roles) &&
+		strSetEqual(sub.SubRoles, hsi.SubRoles)
+}
+
+// Case-insensitive comparison of two string arrays as sets.
+
+func strSetEqual(a, b []string) bool {
+	am := make(map[string]bool)
+	bm := make(map[string]bool)
+	for _, s := range a {
+		am[strings.ToLower(s)] = true
+	}
+	for _, s := range b {
+		bm[strings.ToLower(s)] = true
+	}
+	if len(am) != len(bm) {
+		return false
+	}
+	for s := range am {
+		if !bm[s] {
+			return false
+		}
+	}
+	return true
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Figure out the minimal HSM subscription needed to cover the mandatory
+// SCNs plus every stored subscription.
+//
+// Args:   None.
+// Return: Desired HSM subscription attributes; nil on success, error
+//         string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func desiredHsmSubs() (hsmSubscriptionInfo, error) {
+	var tracker = subTracker{hwStates: make(map[string]bool),
+		swStatus: make(map[string]bool),
+		roles:    make(map[string]bool),
+		subroles: make(map[string]bool),
+		enabled:  false,
+	}
+
+	_, tracker = needHSMSubs(mandatoryScnSubscription(), tracker)
+
+	kvlist, kverr := kvHandle.GetRange(SUBSCRIBER_KEYRANGE_START,
+		SUBSCRIBER_KEYRANGE_END)
+	if kverr != nil {
+		return hsmSubscriptionInfo{}, kverr
+	}
+
+	for _, item := range kvlist {
+		var subinfo ScnSubscribe
+		toks := strings.Split(item.Key, SUBSCRIBER_KEY_DELIM)
+		for ix := SUBSCRIBER_TOKNUM_XNAME + 1; ix < len(toks); ix++ {
+			tt := strings.Split(toks[ix], SUBSCRIBER_KEYCAT_DELIM)
+			populateSubinfo(toks[SUBSCRIBER_TOKNUM_XNAME], tt, &subinfo)
+		}
+		_, tracker = needHSMSubs(subinfo, tracker)
+	}
+
+	return trackerToHSMSubInfo(&tracker), nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Make HSM hold exactly one hmnfd SCN subscription matching the desired
+// attributes.  It is created if missing, replaced if it differs, and any
+// other hmnfd subscriptions (e.g. from older versions) are deleted.
+//
+// If the subscription HSM should already have is given, HSM's copy is
+// checked against it first.  If HSM has no hmnfd subscription at all, or
+// ours was changed behind our back, HSM lost it (e.g. its database was
+// reset or restored).
+//
+// hsi(in):      Desired subscription attributes.
+// expected(in): Subscription HSM should already have, or nil.
+// Return:       Description of how HSM lost the subscription, "" if it
+//               didn't; nil on success, error string on error.
 /////////////////////////////////////////////////////////////////////////////
 
-func sendHsmScnSubscription(scn ScnSubscribe) error {
+func applyHsmSubs(hsi hsmSubscriptionInfo, expected *hsmSubscriptionInfo) (string, error) {
+	var keep *hsmScnSubscription
+	var lost string
+
 	smURL := app_params.SM_url + URL_DELIM + SM_SCN_SUB
 
-	//Remove the Components from the struct, as HSM doesn't
-	//use them.  Also, change the Subscriber and URL to hmnfd's.
+	subs, err := getHsmScnSubscriptions()
+	if err != nil {
+		return "", err
+	}
 
-	scn.Components = nil
+	enbl := hsi.Enabled
+	want := hsmScnSubscription{Subscriber: HSM_SCN_SUBSCRIBER,
+		Roles:          hsi.Roles,
+		SubRoles:       hsi.SubRoles,
+		SoftwareStatus: hsi.SWStatus,
+		States:         hsi.HWStates,
+		Url:            app_params.Scn_in_url,
+	}
+	if enbl {
+		want.Enabled = &enbl
+	}
+	ba, err := json.Marshal(want)
+	if err != nil {
+		return "", err
+	}
 
-	//Use a unique subscriber ID.  It needs to contain the pod instance
-	//name plus an offset.
+	nours := 0
+	for ix := range subs {
+		if !isHmnfdHsmSubscription(subs[ix]) {
+			continue
+		}
+		nours++
+		if (keep == nil) && (subs[ix].Subscriber == HSM_SCN_SUBSCRIBER) {
+			keep = &subs[ix]
+			continue
+		}
+		log.Printf("INFO: Deleting stale HSM SCN subscription '%s' (ID %d).\n",
+			subs[ix].Subscriber, subs[ix].ID)
+		_, err = hsmSubscriptionRequest(http.MethodDelete,
+			fmt.Sprintf("%s/%d", smURL, subs[ix].ID), nil)
+		if err != nil {
+			log.Printf("ERROR deleting stale HSM SCN subscription %d: %v",
+				subs[ix].ID, err)
+		}
+	}
 
-	if hostName == "" {
-		var herr error
-		hostName, herr = os.Hostname()
-		if herr != nil {
-			log.Printf("Error getting host name: %v -- using random number.",
-				herr)
-			hostName = fmt.Sprintf("%s%d", URL_APPNAME, time.Now().Nanosecond())
+	if expected != nil {
+		if nours == 0 {
+			lost = "HSM SCN subscription is missing"
+		} else if (keep != nil) && !hsmSubscriptionMatches(*keep, *expected) {
+			lost = "HSM SCN subscription was changed"
 		}
 	}
-	scn.Subscriber = fmt.Sprintf("%s_%d", hostName, __hsm_scn_subscription_ix)
-	__hsm_scn_subscription_ix++
-	scn.Url = app_params.Scn_in_url
 
-	barr, err := json.Marshal(scn)
+	if keep == nil {
+		log.Printf("Creating HSM SCN subscription: %s\n", string(ba))
+		_, err = hsmSubscriptionRequest(http.MethodPost, smURL, ba)
+		return lost, err
+	}
+
+	if !hsmSubscriptionMatches(*keep, hsi) {
+		log.Printf("Updating HSM SCN subscription %d: %s\n", keep.ID, string(ba))
+		_, err = hsmSubscriptionRequest(http.MethodPut,
+			fmt.Sprintf("%s/%d", smURL, keep.ID), ba)
+		return lost, err
+	}
+
+	return lost, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Reconcile the HSM SCN subscription with the stored subscriptions.  HSM is
+// only contacted if the desired subscription changed since it was last
+// applied, or if the last applied subscription needs to be verified.
+//
+// If HSM turns out to have lost the subscription, the service is marked
+// degraded until the subscription is repaired and a later check against HSM
+// finds it intact.
+//
+// Args:   None.
+// Return: nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func reconcileHsmSubs() error {
+	hsi, err := desiredHsmSubs()
 	if err != nil {
-		log.Println("INTERNAL ERROR marshalling SM subscription req info:", err)
 		return err
 	}
 
-	if app_params.Debug > 1 {
-		log.Println("Sending POST to State Mgr URL:", smURL,
-			"Data:", string(barr))
+	hsmSubsMutex.Lock()
+	defer hsmSubsMutex.Unlock()
+
+	if !hsmSubsVerify && (hsmSubsApplied != nil) &&
+		reflect.DeepEqual(*hsmSubsApplied, hsi) {
+		return nil
 	}
 
-	//Don't actually send anything to the SM if we're in "--nosm" mode.
+	verified := hsmSubsVerify
+	if app_params.Nosm == 0 {
+		var expected *hsmSubscriptionInfo
+		if verified {
+			expected = hsmSubsApplied
+		}
+		lost, aerr := applyHsmSubs(hsi, expected)
+		if lost != "" {
+			setHsmSubsLost(lost)
+		}
+		if aerr != nil {
+			return aerr
+		}
+		if lost != "" {
+			//Re-posted; stay degraded until the next pass confirms it.
+			setHsmSubsRepaired()
+			hsmSubsApplied = &hsi
+			hsmSubsVerify = true
+			return nil
+		}
+	}
+	hsmSubsApplied = &hsi
+	hsmSubsVerify = false
+	if verified {
+		clearHsmSubsLost()
+	}
 
-	if app_params.Nosm != 0 {
+	//Update an ETCD key with current subscription info.
+
+	jstr, err := json.Marshal(hsi)
+	if err != nil {
+		log.Println("ERROR! Can't marshal HSM SCN subscription tracking data:", err)
 		return nil
 	}
+	kerr := kvHandle.Store(HSM_SUBS_KEY, string(jstr))
+	if kerr != nil {
+		log.Println("ERROR storing SCN subscription indicator in ETCD:", kerr)
+	}
+	return nil
+}
 
-	// Make POST request
+/////////////////////////////////////////////////////////////////////////////
+// Ask the HSM subscription thread to reconcile.  If verify is set, the HSM
+// subscription is checked against HSM even if nothing changed locally.
+// This never blocks.
+//
+// verify(in): Verify against HSM.
+// Return:     None.
+/////////////////////////////////////////////////////////////////////////////
 
-	req, qerr := http.NewRequest("POST", smURL, bytes.NewBuffer(barr))
-	if qerr != nil {
-		log.Println("ERROR opening POST request to SM:", qerr)
-		return qerr
+func hsmSubsReconcileNow(verify bool) {
+	if verify {
+		hsmSubsMutex.Lock()
+		hsmSubsVerify = true
+		hsmSubsMutex.Unlock()
 	}
-	defer req.Body.Close()
-	req.Header.Set("Content-Type", "application/json")
-	base.SetHTTPUserAgent(req, serviceName)
+	select {
+	case hsmsub_chan <- ScnSubscribe{}:
+	default:
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Mark the HSM subscription as lost.  The first time, an alert service
+// event is placed on the telemetry bus.  The status is stored in ETCD so
+// that every replica can report it.
+//
+// reason(in): How the subscription was lost.
+// Return:     None.
+/////////////////////////////////////////////////////////////////////////////
 
-	rsp, rerr := htrans.client.Do(req)
+func setHsmSubsLost(reason string) {
+	hsmSubsLostMutex.Lock()
+	first := !hsmSubsLost.Degraded
+	hsmSubsLost.Degraded = true
+	hsmSubsLost.Reason = reason
+	hsmSubsLost.Repaired = false
+	if first {
+		hsmSubsLost.Since = time.Now().Format(time.RFC3339)
+	}
+	status := hsmSubsLost
+	hsmSubsLostMutex.Unlock()
 
-	if rerr != nil {
-		log.Println("ERROR sending POST to SM:", rerr)
-		//TODO: what now?
-		return rerr
-	} else {
-		defer rsp.Body.Close()
-		if (rsp.StatusCode == http.StatusOK) ||
-			(rsp.StatusCode == http.StatusNoContent) ||
-			(rsp.StatusCode == http.StatusAccepted) {
-			//Read back the response.
+	if !first {
+		storeHsmSubsStatus(status)
+		return
+	}
 
-			//TODO: Successfully did the POST, but did SM response show some
-			//kind of operational error?  Is this possible?
+	log.Printf("ERROR: %s, SCNs are not being received.  Repairing.\n", reason)
+	sendServiceEvent(base.FlagAlert.String())
+	storeHsmSubsStatus(status)
+}
 
-			if app_params.Debug > 0 {
-				log.Println("SUCCESS sending POST to SM, response:", rsp)
-			}
-		} else {
-			lerr := fmt.Errorf("ERROR response from State Manager: %s, Error code: %d\n",
-				rsp.Status, rsp.StatusCode)
-			return lerr
-		}
+/////////////////////////////////////////////////////////////////////////////
+// Note that a lost HSM subscription was re-posted.  It stays degraded until
+// a later check against HSM confirms HSM kept it.
+//
+// Args, Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func setHsmSubsRepaired() {
+	hsmSubsLostMutex.Lock()
+	hsmSubsLost.Repaired = true
+	hsmSubsLost.Repairs++
+	status := hsmSubsLost
+	hsmSubsLostMutex.Unlock()
+
+	log.Printf("INFO: HSM SCN subscription re-posted (repair %d), will verify.\n",
+		status.Repairs)
+	storeHsmSubsStatus(status)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Clear the HSM subscription lost status after a check against HSM found
+// the subscription intact.  The stored status is always rewritten, in case
+// it was left behind by a previous leader.  The repair count is kept.
+//
+// Args, Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func clearHsmSubsLost() {
+	hsmSubsLostMutex.Lock()
+	wasLost := hsmSubsLost.Degraded
+	hsmSubsLost = hsmSubsStatus{Repairs: hsmSubsLost.Repairs}
+	status := hsmSubsLost
+	hsmSubsLostMutex.Unlock()
+
+	if wasLost {
+		log.Printf("INFO: HSM SCN subscription repaired and verified.\n")
+		sendServiceEvent(base.FlagOK.String())
 	}
+	storeHsmSubsStatus(status)
+}
 
-	return nil
+// Put an event about hmnfd itself on the telemetry bus.  These have no
+// components; Service says which service they're about.
+
+func sendServiceEvent(flag string) {
+	sendToTelemetryBus(Scn{Components: []string{},
+		Service:   URL_APPNAME,
+		Flag:      flag,
+		Timestamp: time.Now().Format(time.RFC3339Nano),
+	})
+}
+
+// Get the local HSM subscription lost status.
+
+func getHsmSubsLost() hsmSubsStatus {
+	hsmSubsLostMutex.Lock()
+	defer hsmSubsLostMutex.Unlock()
+	return hsmSubsLost
+}
+
+// Pick up the HSM subscription repair count a previous leader stored, so
+// it keeps counting across leader changes.
+
+func loadHsmSubsRepairs() {
+	var stored hsmSubsStatus
+
+	if kvHandle == nil {
+		return
+	}
+	val, ok, err := kvHandle.Get(HSM_SUBS_STATUS_KEY)
+	if (err != nil) || !ok || (json.Unmarshal([]byte(val), &stored) != nil) {
+		return
+	}
+	hsmSubsLostMutex.Lock()
+	if stored.Repairs > hsmSubsLost.Repairs {
+		hsmSubsLost.Repairs = stored.Repairs
+	}
+	hsmSubsLostMutex.Unlock()
+}
+
+// Store the HSM subscription status in ETCD.
+
+func storeHsmSubsStatus(status hsmSubsStatus) {
+	if kvHandle == nil {
+		return
+	}
+	ba, err := json.Marshal(status)
+	if err != nil {
+		log.Println("ERROR marshalling HSM subscription status:", err)
+		return
+	}
+	err = kvHandle.Store(HSM_SUBS_STATUS_KEY, string(ba))
+	if err != nil {
+		log.Println("ERROR storing HSM subscription status in ETCD:", err)
+	}
 }
 
 /////////////////////////////////////////////////////////////////////////////
@@ -216,18 +687,14 @@ func needHSMSubs(sub ScnSubscribe, tracker subTracker) (bool, subTracker) {
 }
 
 /////////////////////////////////////////////////////////////////////////////
-// Given our HSM subscription tracking data, create a subscription request
-// for the HSM.  Note that this will always be additive over the previous
-// subscription; therefore it is important that the HSM coalesce/dedup the
-// subscriptions it maintains so that we only get one SCN delivered at a
-// time.
+// Given our HSM subscription tracking data, create the HSM subscription
+// attributes.  The lists are sorted so that they can be compared.
 //
 // tracker(in): HSM subscription tracking data.
-// Return:      JSON string to send to HSM for subscription; nil on success,
-//                 error message on error (marshal error)
+// Return:      HSM subscription attributes.
 /////////////////////////////////////////////////////////////////////////////
 
-func makeHSMSubInfo(tracker *subTracker) (string, error) {
+func trackerToHSMSubInfo(tracker *subTracker) hsmSubscriptionInfo {
 	var hsi hsmSubscriptionInfo
 
 	for key, _ := range tracker.hwStates {
@@ -244,74 +711,72 @@ func makeHSMSubInfo(tracker *subTracker) (string, error) {
 	}
 	hsi.Enabled = tracker.enabled
 
-	jstr, err := json.Marshal(hsi)
-	if err != nil {
-		return "", err
-	}
-
-	return string(jstr), nil
+	sort.Strings(hsi.HWStates)
+	sort.Strings(hsi.SWStatus)
+	sort.Strings(hsi.Roles)
+	sort.Strings(hsi.SubRoles)
+	return hsi
 }
 
 /////////////////////////////////////////////////////////////////////////////
-// Time based loop to handle State Manager SCN subscriptions.  This is used
-// to batch subscriptions up and to prevent duplicates/noise.
+// Thread func which keeps hmnfd's HSM SCN subscription in line with the
+// stored subscriptions.  Subscription requests arriving on the subscription
+// channel trigger a reconcile; the leader also triggers them periodically,
+// which catches subscriptions made via other replicas as well as deleted
+// ones.  Only the leader reconciles.  Returns when told to via hsmsub_stop.
 //
 // Args, Return: None.
 /////////////////////////////////////////////////////////////////////////////
 
 func subscribeToHsmScn() {
-	var tracker = subTracker{hwStates: make(map[string]bool),
-		swStatus: make(map[string]bool),
-		roles:    make(map[string]bool),
-		subroles: make(map[string]bool),
-		enabled:  false,
-	}
+	var retry <-chan time.Time
 
 	log.Printf("Subscriber loop started.\n")
 
+	//Pick up what was last applied, so a restart doesn't cause needless
+	//HSM updates.
+
+	if kvHandle != nil {
+		val, ok, err := kvHandle.Get(HSM_SUBS_KEY)
+		if (err == nil) && ok {
+			var hsi hsmSubscriptionInfo
+			if json.Unmarshal([]byte(val), &hsi) == nil {
+				hsmSubsMutex.Lock()
+				hsmSubsApplied = &hsi
+				hsmSubsMutex.Unlock()
+			}
+		}
+	}
+
 	for {
 		select {
-		case sub := <-hsmsub_chan:
-			needSub, tracker_tmp := needHSMSubs(sub, tracker)
-			if !needSub {
-				continue
-			}
-			if app_params.Nosm == 0 {
-				log.Println("Sending SCN subscription to HSM:", sub)
-
-				//This is new, send SCN subscription req to HSM
-				err := sendHsmScnSubscription(sub)
-				if err != nil {
-					log.Println("ERROR sending HSM SCN subscription:", err, "retrying.")
-					time.Sleep(time.Second)
-					hsmsub_chan <- sub
-					continue
-				}
-				log.Printf("HSM subscription sent.\n")
+		case <-hsmsub_chan:
+			//Coalesce a burst of requests into one reconcile.
+			for len(hsmsub_chan) > 0 {
+				<-hsmsub_chan
 			}
+		case <-retry:
+		case <-hsmsub_stop:
+			return
+		}
+		retry = nil
 
-			tracker = tracker_tmp
-
-			//Update an ETCD key with current subscription info.
-
-			for ix := 1; ix < 3; ix++ {
-				jstr, err := makeHSMSubInfo(&tracker)
-				if err != nil {
-					log.Println("ERROR! Can't marshal HSM SCN subscription tracking data:", err)
-				} else {
-					kerr := kvHandle.Store(HSM_SUBS_KEY, jstr)
-					if kerr != nil {
-						log.Println("ERROR storing SCN subscription indicator in ETCD:",
-							kerr, "(attempt", ix, ")")
-					}
-				}
-			}
+		if !isLeader() {
+			continue
+		}
+
+		err := reconcileHsmSubs()
+		if err != nil {
+			log.Println("ERROR reconciling HSM SCN subscription:", err, "retrying.")
+			retry = time.After(HSM_SUBS_RETRY * time.Second)
+			continue
 		}
 	}
 }
 
 /////////////////////////////////////////////////////////////////////////////
-// Convenience function to create a subscription key/value in ETCD.
+// Convenience function to create a subscription key/value in ETCD, with a
+// new subscription generation.
 //
 // complist(in):  Component list, from SCN subscription.
 // url(in):       URL to send SCN to, from SCN subscription.
@@ -323,7 +788,25 @@ func makeSubscriptionEntry(complist []string, url string, key string) error {
 	var sd SubData
 	sd.Url = url
 	sd.ScnNodes = complist
+	sd.Generation = newSubscriptionGeneration()
 
+	err := storeSubscriptionEntry(key, sd)
+	if err != nil {
+		return err
+	}
+	noteSubscriptionGeneration(key, sd.Generation)
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Store a subscription key/value in ETCD.
+//
+// key(in):  Subscription key to use in ETCD to store this info.
+// sd(in):   Subscription data to store as the key's value.
+// Return:   nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func storeSubscriptionEntry(key string, sd SubData) error {
 	//Marshal
 	jstr, jerr := json.Marshal(sd)
 	if jerr != nil {
@@ -340,202 +823,395 @@ func makeSubscriptionEntry(complist []string, url string, key string) error {
 	return nil
 }
 
-func pauseIf(startTime time.Time) {
-	dur := time.Since(startTime).Seconds()
-	if int(dur) == 0 {
-		time.Sleep(time.Duration(app_params.Scn_backoff) * time.Second)
+/////////////////////////////////////////////////////////////////////////////
+// Get how long to wait before retrying an SCN send.  The backoff starts at
+// the initial backoff (Scn_backoff, or the subscription's own) and doubles
+// with each attempt, up to Scn_backoff_max seconds or the initial backoff,
+// whichever is larger.  Up to Scn_backoff_jitter percent of it is then
+// taken off at random, so that retries to many subscribers don't all land
+// at once.
+//
+// attempt(in): Number of attempts made so far.
+// initial(in): Initial backoff, seconds.
+// Return:      Time to wait before the next attempt.
+/////////////////////////////////////////////////////////////////////////////
+
+func scnBackoff(attempt int, initial int) time.Duration {
+	backoff := time.Duration(initial) * time.Second
+	bmax := time.Duration(app_params.Scn_backoff_max) * time.Second
+	if (bmax > 0) && (bmax < backoff) {
+		bmax = backoff
+	}
+	for ix := 1; ix < attempt; ix++ {
+		if (bmax > 0) && (backoff >= bmax) {
+			break
+		}
+		backoff *= 2
 	}
+	if (bmax > 0) && (backoff > bmax) {
+		backoff = bmax
+	}
+
+	jitter := app_params.Scn_backoff_jitter
+	if (jitter > 0) && (backoff > 0) {
+		if jitter > 100 {
+			jitter = 100
+		}
+		backoff -= time.Duration(rand.Int63n(int64(backoff)*int64(jitter)/100 + 1))
+	}
+	return backoff
 }
 
 /////////////////////////////////////////////////////////////////////////////
-// Send an SCN to a subscriber.  This is called by the worker pool -- don't
-// call directly!  This function will attempt a few times, and if it
-// consistently fails, the subscription will be pruned.
+// Make one attempt at sending an SCN to a subscriber.  This is called by
+// the subscriber's queue -- don't call directly!  If the attempt fails and
+// is to be retried, the job's RetryAt is set and the queue sends it again
+// then, rather than a worker sleeping on it.  What is done for a failure
+// depends on its delivery error class; see failScnSend().  Nothing is sent
+// if the subscriber or its XName has been pruned here or by another
+// replica.  If the circuit breaker for the URL's host is open, the SCN waits
+// for it without using up an attempt.
 //
-// sd(in):         SCN data to send.
-// subscriber(in): Subscriber XName to send to.
-// url(in):        URL to send SCN to.
-// Return:         None.
+// j(in):  SCN send job.
+// Return: true if the SCN is to be retried at j.RetryAt.
 /////////////////////////////////////////////////////////////////////////////
 
-func sendSCNToSubscriber(sd Scn, subscriber string, url string) {
-	var retry int
-	var prune bool = false
+func sendSCNToSubscriber(j *JobSCNSend) bool {
+	reached := false //host answered, for its circuit breaker
+	subscriber, url := j.Subscriber, j.Url
+	j.RetryAt = time.Time{}
 
 	//For testing purposes.
 	if url == "" {
-		return
+		return false
 	}
 
 	//Don't send if we've been pruned.
 
-	prunemap_mutex.Lock()
-	prune = prunemap[subscriber]
-	prunemap_mutex.Unlock()
-	if prune {
+	subxname, _ := splitSubscriber(subscriber)
+	if subscriberPruned(subscriber) {
 		if app_params.Debug > 0 {
 			log.Printf("Not sending SCN to '%s'/'%s', node has been pruned.\n",
 				subscriber, url)
 		}
-		return
+		return false
 	}
 
-	ba, berr := json.Marshal(sd)
+	ba, berr := j.payload()
 	if berr != nil {
 		log.Println("ERROR marshaling json data:", berr)
-		return
+		return false
 	}
 
-	//TODO: this connection should be kept open, not sent each time if we
-	//have to use HTTPS, which has expensive overhead with each new connection.
+	//Sign it if the subscription has a secret.  If the secret can't be
+	//decrypted (the secret key changed?), it isn't sent unsigned; it's kept
+	//as a dead letter to be redriven once that's fixed.
+
+	var secret []byte
+	if j.Secret != "" {
+		plain, serr := decryptSecret(j.Secret)
+		if serr != nil {
+			log.Printf("ERROR getting signing secret for '%s'/'%s': %v\n",
+				subscriber, url, serr)
+			j.LastErr = serr.Error()
+			storeDeadLetter(j)
+			return false
+		}
+		secret = []byte(plain)
+	}
 
-	for retry = 1; retry <= app_params.Scn_retries; retry++ {
-		start := time.Now()
-		req, err := http.NewRequest("POST", url, bytes.NewBuffer(ba))
-		if err != nil {
-			log.Println("ERROR creating HTTP POST request to url:", url, ":", err)
-			pauseIf(start)
-			continue
+	//Same for the subscription's outbound auth, also if its token file
+	//can't be read.
+
+	var authHdrs http.Header
+	if j.Auth != "" {
+		var aerr error
+		authHdrs, aerr = subscriptionAuthHeaders(j.Auth)
+		if aerr != nil {
+			log.Printf("ERROR getting outbound auth for '%s'/'%s': %v\n",
+				subscriber, url, aerr)
+			j.LastErr = aerr.Error()
+			storeDeadLetter(j)
+			return false
 		}
-		req.Header.Set("Content-Type", "application/json")
-		base.SetHTTPUserAgent(req, serviceName)
-		req.Close = true
-		rsp, err := htrans.client.Do(req)
+	}
 
-		if err != nil {
-			//This is hokey, but there's no other way to get the type of
-			//error.  ECONNREFUSED means the client is gone.  Prune it.
-			estr := strings.ToLower(err.Error())
-			if strings.Contains(estr, "connection refused") {
-				log.Printf("Connection refused for '%s', dropping.", url)
-				prunemap_mutex.Lock()
-				prunemap[subscriber] = true
-				prunemap_mutex.Unlock()
-				return
-			}
+	//Held up by the host's circuit breaker: not an attempt, just wait.
 
-			log.Printf("ERROR sending SCN (attempt #%d), to '%s': %s",
-				retry, url, err.Error())
-			pauseIf(start)
-			continue
+	host := breakerHost(url)
+	if !breakerAllow(host) {
+		if app_params.Debug > 0 {
+			log.Printf("Not sending SCN to '%s', circuit breaker open.\n", url)
 		}
+		j.RetryAt = breakerRetryAt(host)
+		return true
+	}
+	defer func() { breakerResult(host, reached) }()
 
-		rsp.Body.Close()
+	j.Attempts++
 
-		//Check response code, should be 200
-		if rsp.StatusCode == http.StatusOK {
-			if retry > 1 {
-				log.Printf("INFO: SCN send to '%s' succeeded (attempt #%d).",
-					url, retry)
-			}
-			break
-		} else {
-			log.Printf("ERROR response sending SCN (attempt #%d), to '%s', status code %d:",
-				retry, url, rsp.StatusCode)
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(ba))
+	if err != nil {
+		log.Println("ERROR creating HTTP POST request to url:", url, ":", err)
+		return failScnSend(j, subxname, DELIVERY_ERR_NETWORK, err.Error(), 0)
+	}
+	for name, vals := range authHdrs {
+		req.Header[name] = vals
+	}
+	req.Header.Set("Content-Type", "application/json")
+	base.SetHTTPUserAgent(req, serviceName)
+	if secret != nil {
+		scnsign.SignRequest(req, secret, ba, time.Now())
+	}
+	rsp, err := deliveryClient(j.Delivery).Do(req)
+
+	if err != nil {
+		class := classifySendError(err)
+		log.Printf("ERROR sending SCN (attempt #%d), to '%s', %s: %s",
+			j.Attempts, url, class, err.Error())
+		if class == DELIVERY_ERR_TLS {
+			warnCertVerifyFailure(url, err)
 		}
-		pauseIf(start)
+		return failScnSend(j, subxname, class, err.Error(), 0)
+	}
+
+	//Read the body so the connection can be reused, but not forever.
+
+	io.Copy(ioutil.Discard, io.LimitReader(rsp.Body, SCN_RSP_DRAIN_MAX))
+	rsp.Body.Close()
+
+	//Any 2xx, or one of the subscription's success codes, is success.  A
+	//4xx means the host is up, it just won't take the SCN.
+
+	class := classifyDeliveryStatus(j.Delivery, rsp.StatusCode)
+	reached = (class == "") || (class == DELIVERY_ERR_CLIENT) ||
+		((rsp.StatusCode >= 200) && (rsp.StatusCode < 300))
+	if class != "" {
+		log.Printf("ERROR response sending SCN (attempt #%d), to '%s', status code %d:",
+			j.Attempts, url, rsp.StatusCode)
+		return failScnSend(j, subxname, class,
+			fmt.Sprintf("Status code %d", rsp.StatusCode), retryAfter(rsp))
 	}
 
-	if retry > app_params.Scn_retries {
-		log.Printf("Maximum retries exhausted, dropping subscription for '%s'/'%s'\n",
+	if j.Attempts > 1 {
+		log.Printf("INFO: SCN send to '%s' succeeded (attempt #%d).",
+			url, j.Attempts)
+	} else if app_params.Debug > 1 {
+		log.Printf("Sent SCN to subscriber '%s' at '%s'\n",
 			subscriber, url)
-		//Prune this subscriber
-		prunemap_mutex.Lock()
-		prunemap[subscriber] = true
-		prunemap_mutex.Unlock()
-	} else {
-		if app_params.Debug > 1 {
-			log.Printf("Sent SCN to subscriber '%s' at '%s'\n",
-				subscriber, url)
-		}
 	}
+	return false
 }
 
-// This is run on startup.  Grab the subscription keys, then grab all of
-// the node components from HSM.  Any HSM components in an unavailable state
-// will have their subscriptions pruned.
+/////////////////////////////////////////////////////////////////////////////
+// Handle a failed SCN send attempt by its delivery error class.  If the
+// prune policy prunes on the class, the subscriber's XName is pruned now.
+// If the class isn't retried, the SCN is dropped.  Otherwise it's retried;
+// see retryScnSend().  Dropped SCNs are kept as dead letters.
+//
+// j(in):        SCN send job.
+// subxname(in): Subscriber's XName.
+// class(in):    Delivery error class, DELIVERY_ERR_xxx.
+// lastErr(in):  Error or status.
+// after(in):    Retry-After time from the response, 0 if none.
+// Return:       true if the SCN is to be retried at j.RetryAt.
+/////////////////////////////////////////////////////////////////////////////
+
+func failScnSend(j *JobSCNSend, subxname string, class string, lastErr string, after time.Duration) bool {
+	j.LastErr = lastErr
+	if pruneOnDeliveryError(j.Subscriber, class) {
+		log.Printf("%s for '%s', dropping.", class, j.Url)
+		markPruneLocked(subxname, class, lastErr)
+		storeDeadLetter(j)
+		return false
+	}
+	if !retryOnDeliveryError(class) {
+		log.Printf("%s is not retried, dropping SCN for '%s'/'%s'\n",
+			class, j.Subscriber, j.Url)
+		storeDeadLetter(j)
+		return false
+	}
+	return retryScnSend(j, subxname, after)
+}
 
-func pruneDeadWood() {
-	var jdata hsmStateArray
+/////////////////////////////////////////////////////////////////////////////
+// Retry a failed SCN send attempt.  If there are attempts left (Scn_retries,
+// or the subscription's MaxAttempts), sets when to try again: after the
+// backoff, or the Retry-After time if that's later.  Otherwise the SCN is kept as a dead letter and, per the prune
+// policy, the subscriber's XName is pruned.
+//
+// j(in):        SCN send job.
+// subxname(in): Subscriber's XName.
+// after(in):    Retry-After time from the response, 0 if none.
+// Return:       true if the SCN is to be retried at j.RetryAt.
+/////////////////////////////////////////////////////////////////////////////
 
-	if app_params.Nosm != 0 {
-		return
+func retryScnSend(j *JobSCNSend, subxname string, after time.Duration) bool {
+	if j.Attempts < deliveryMaxAttempts(j.Delivery) {
+		backoff := scnBackoff(j.Attempts, deliveryBackoff(j.Delivery))
+		if after > backoff {
+			backoff = after
+		}
+		j.RetryAt = time.Now().Add(backoff)
+		return true
 	}
 
-	badMap := make(map[string]bool)
-	smURL := app_params.SM_url + URL_DELIM + SM_STATEDATA
+	storeDeadLetter(j)
+	if !pruneOnDeliveryError(j.Subscriber, DELIVERY_ERR_RETRIES) {
+		log.Printf("Maximum retries exhausted, dropping SCN for '%s'/'%s'\n",
+			j.Subscriber, j.Url)
+		return false
+	}
+	log.Printf("Maximum retries exhausted, dropping subscription for '%s'/'%s'\n",
+		j.Subscriber, j.Url)
+	//Prune this subscriber
+	markPruneLocked(subxname, PRUNE_REASON_RETRIES,
+		fmt.Sprintf("%d attempts, last error: %s", j.Attempts, j.LastErr))
+	return false
+}
 
-	//Get HSM states of all nodes
+/////////////////////////////////////////////////////////////////////////////
+// Determine if a component is dead, meaning its subscriptions should be
+// pruned per the prune policy.
+//
+// comp(in): Component state from HSM.
+// Return:   true if the component is dead.
+/////////////////////////////////////////////////////////////////////////////
 
-	for {
-		req, err := http.NewRequest("GET", smURL, nil)
-		if err != nil {
-			log.Printf("ERROR creating HTTP POST request to url '%s': %v",
-				smURL, err)
-			time.Sleep(2 * time.Second)
-			continue
-		}
+func isComponentDead(comp hsmComponent) bool {
+	return prunePolicy().Components.matchComponent(comp.State,
+		comp.SoftwareStatus, comp.Flag, comp.Enabled)
+}
 
-		q := req.URL.Query()
-		q.Add("type", "Node")
-		q.Add("state", "Off")
-		q.Add("state", "Empty")
-		q.Add("state", "Halt")
-		q.Add("stateonly", "true")
-		req.URL.RawQuery = q.Encode()
-		req.Close = true
-		base.SetHTTPUserAgent(req, serviceName)
-
-		rsp, rerr := htrans.client.Do(req)
-		if rerr != nil {
-			log.Printf("ERROR sending GET to HSM for node states: %v", rerr)
-			time.Sleep(2 * time.Second)
-			continue
-		}
+/////////////////////////////////////////////////////////////////////////////
+// Get the list of all subscriber XNames.  Service subscribers are left out,
+// since they aren't components.
+//
+// Args:   None.
+// Return: List of subscriber XNames; nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
 
-		body, berr := ioutil.ReadAll(rsp.Body)
-		if berr != nil {
-			log.Printf("ERROR reading HSM response for node states: %v", berr)
-			time.Sleep(2 * time.Second)
-			continue
-		}
+func subscriberXNames() ([]string, error) {
+	var xnames []string
 
-		err = json.Unmarshal(body, &jdata)
-		if err != nil {
-			log.Printf("ERROR unmarshalling HSM response for node states: %v", err)
-			time.Sleep(2 * time.Second)
+	kvlist, kverr := kvHandle.GetRange(SUBSCRIBER_KEYRANGE_START,
+		SUBSCRIBER_KEYRANGE_END)
+	if kverr != nil {
+		return nil, kverr
+	}
+
+	xnMap := make(map[string]bool)
+	for _, sub := range kvlist {
+		xname, _ := parseSubscriptionKey(sub.Key)
+		if (xname == "") || isServiceSubscriber(xname) {
 			continue
 		}
+		xnMap[xname] = true
+	}
+	for xname := range xnMap {
+		xnames = append(xnames, xname)
+	}
+	sort.Strings(xnames)
+	return xnames, nil
+}
 
-		//Make a map of bad-state component xnames
+/////////////////////////////////////////////////////////////////////////////
+// Sweep the subscriptions for dead subscribers.  The HSM states of all
+// subscribers, of any component type, are fetched a page at a time, and
+// any subscriber which is off, empty, halted or disabled is pruned.
+//
+// Args:   None.
+// Return: nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
 
-		for _, sdata := range jdata.Components {
-			badMap[sdata.ID] = true
-		}
-		break
+func pruneDeadWood() error {
+	if app_params.Nosm != 0 {
+		return nil
 	}
 
-	//Now iterate the list of subscription keys and prune any matches.
+	xnames, err := subscriberXNames()
+	if err != nil {
+		return fmt.Errorf("can't get subscription keys: %v", err)
+	}
 
-	kvlist, kverr := kvHandle.GetRange(SUBSCRIBER_KEYRANGE_START,
-		SUBSCRIBER_KEYRANGE_END)
+	npruned := 0
+	err = queryComponentPages(xnames, func(comps []hsmComponent) error {
+		for _, comp := range comps {
+			if !isComponentDead(comp) {
+				continue
+			}
+			xname := strings.ToLower(comp.ID)
+			log.Printf("INFO: Pruning dead subscriber '%s' (State: %s)",
+				xname, comp.State)
+			trigger := "HSM State: " + comp.State
+			if (comp.Enabled != nil) && !*comp.Enabled {
+				trigger += ", Enabled: false"
+			}
+			markPruneLocked(xname, PRUNE_REASON_DEAD_SWEEP, trigger)
+			npruned++
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("can't get subscriber states from HSM: %v", err)
+	}
 
-	if kverr != nil {
-		log.Println("ERROR retrieving SCN key list:", kverr)
-		return
+	if app_params.Debug > 0 {
+		log.Printf("INFO: Dead subscriber sweep checked %d subscribers, pruned %d.\n",
+			len(xnames), npruned)
 	}
+	return nil
+}
 
-	var match bool
+/////////////////////////////////////////////////////////////////////////////
+// Schedule a dead subscriber sweep right away.  Used when becoming leader.
+//
+// Args, Return: None.
+/////////////////////////////////////////////////////////////////////////////
 
-	for _, sub := range kvlist {
-		toks := strings.Split(sub.Key, SUBSCRIBER_KEY_DELIM)
-		xname := toks[SUBSCRIBER_TOKNUM_XNAME]
-		_, match = badMap[xname]
-		if match {
-			log.Printf("INFO: Pruning  dead node subscription for '%s'", xname)
-			prunemap_mutex.Lock()
-			prunemap[xname] = true
-			prunemap_mutex.Unlock()
+func pruneSweepNow() {
+	pruneSweepMutex.Lock()
+	pruneSweepNext = time.Now()
+	pruneSweepMutex.Unlock()
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Thread func for dead subscriber sweeps.  Only the leader sweeps, once
+// when it takes over and then every Prune_interval seconds.  A failed
+// sweep is retried sooner.
+//
+// Args, Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func pruneSweeper() {
+	for Running {
+		time.Sleep(time.Second)
+
+		if (app_params.Nosm != 0) || !isLeader() {
+			continue
+		}
+
+		pruneSweepMutex.Lock()
+		if pruneSweepNext.IsZero() && (app_params.Prune_interval > 0) {
+			pruneSweepNext = pruneSweepLast.Add(time.Duration(app_params.Prune_interval) *
+				time.Second)
+		}
+		due := !pruneSweepNext.IsZero() && !time.Now().Before(pruneSweepNext)
+		pruneSweepMutex.Unlock()
+		if !due {
+			continue
+		}
+
+		err := pruneDeadWood()
+
+		pruneSweepMutex.Lock()
+		if err != nil {
+			log.Printf("ERROR sweeping for dead subscribers: %v", err)
+			pruneSweepNext = time.Now().Add(PRUNE_SWEEP_RETRY * time.Second)
+		} else {
+			pruneSweepLast = time.Now()
+			pruneSweepNext = time.Time{}
 		}
+		pruneSweepMutex.Unlock()
 	}
 }
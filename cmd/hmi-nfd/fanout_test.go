@@ -1,6 +1,6 @@
 // MIT License
 //
-// (C) Copyright [2019,2021,2023] Hewlett Packard Enterprise Development LP
+// (C) Copyright [2019,2021,2023,2026] Hewlett Packard Enterprise Development LP
 //
 // Permission is hereby granted, free of charge, to any person obtaining a
 // copy of this software and associated documentation files (the "Software"),
@@ -23,8 +23,15 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
-	"github.com/Cray-HPE/hms-hmetcd"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -38,6 +45,51 @@ func saContains(sa []string, comp string) bool {
 	return false
 }
 
+// Send an SCN to a subscriber, making all of its attempts right away
+// rather than waiting out the backoff.
+
+func sendScnNow(sd Scn, subscriber string, url string) {
+	j := NewJobSCNSend(sd, subscriber, url).(*JobSCNSend)
+	for sendSCNToSubscriber(j) {
+	}
+}
+
+func TestScnBackoff(t *testing.T) {
+	saved := app_params
+	defer func() { restoreAppParams(saved) }()
+
+	app_params.Scn_backoff = 1
+	app_params.Scn_backoff_max = 10
+	app_params.Scn_backoff_jitter = 0
+	exp := []int{1, 2, 4, 8, 10, 10}
+	for ix, secs := range exp {
+		if bo := scnBackoff(ix+1, 1); bo != time.Duration(secs)*time.Second {
+			t.Errorf("ERROR, attempt %d expected backoff %ds, got %s", ix+1,
+				secs, bo)
+		}
+	}
+
+	app_params.Scn_backoff_max = 0
+	if bo := scnBackoff(8, 1); bo != 128*time.Second {
+		t.Errorf("ERROR, uncapped backoff expected 128s, got %s", bo)
+	}
+
+	app_params.Scn_backoff_max = 10
+	app_params.Scn_backoff_jitter = 50
+	for ix := 0; ix < 100; ix++ {
+		if bo := scnBackoff(5, 1); (bo < 5*time.Second) || (bo > 10*time.Second) {
+			t.Fatalf("ERROR, jittered backoff out of range: %s", bo)
+		}
+	}
+
+	//A subscription's initial backoff larger than the cap is the cap.
+
+	app_params.Scn_backoff_jitter = 0
+	if bo := scnBackoff(3, 20); bo != 20*time.Second {
+		t.Errorf("ERROR, subscription backoff expected 20s, got %s", bo)
+	}
+}
+
 //Note that most of fanout.go is tested by other stuff.  This test doesn't
 //do anything much of any value other than cover lines of code.
 
@@ -51,18 +103,20 @@ func TestSubscribeToHsmScn(t *testing.T) {
 	//connect the KV store, purge, reopen.  This clears the slate
 	//for our testing.
 
-	kvHandle, kvherr := hmetcd.Open("mem:", "")
+	kvherr := openTestKV()
 	if kvherr != nil {
 		t.Fatal("KV/ETCD open failed:", kvherr)
 	}
 	kvPurge(t)
-	kvHandle, kvherr = hmetcd.Open("mem:", "")
+	kvherr = openTestKV()
 	if kvherr != nil {
 		t.Fatal("KV/ETCD open failed:", kvherr)
 	}
 	defer kvPurge(t)
 
+	setLeader(true) //only the leader subscribes with HSM
 	go subscribeToHsmScn()
+	defer func() { hsmsub_stop <- true }()
 
 	//Submit a subscription to the subscription chan.  Note that the KV store
 	//is not initialized yet, so this will fail, and retry.
@@ -75,7 +129,17 @@ func TestSubscribeToHsmScn(t *testing.T) {
 	subdata.SoftwareStatus = []string{"AdminDown", "AdminUp"}
 	subdata.Roles = []string{"Compute", "Service"}
 
-	//This is what should end up in the ETCD key value
+	//The HSM subscription is made from the stored subscriptions, so store
+	//this one like the subscription handlers do.
+
+	err := makeSubscriptionEntry(subdata.Components, subdata.Url,
+		makeSubscriptionKey_V1(subdata))
+	if err != nil {
+		t.Fatal("ERROR storing subscription:", err)
+	}
+
+	//This is what should end up in the ETCD key value, along with the
+	//mandatory subscription attributes.
 
 	hsmsubinfo.HWStates = []string{"ready", "standby"}
 	hsmsubinfo.SWStatus = []string{"admindown", "adminup"}
@@ -97,7 +161,7 @@ func TestSubscribeToHsmScn(t *testing.T) {
 
 	//Unmarshal the key's value
 
-	err := json.Unmarshal([]byte(kv), &hkv)
+	err = json.Unmarshal([]byte(kv), &hkv)
 	if err != nil {
 		t.Errorf("ERROR unmarshalling HSM subscription data '%s'.\n", kv)
 	}
@@ -105,9 +169,10 @@ func TestSubscribeToHsmScn(t *testing.T) {
 	//Compare.  Unfortunately we have to manually search, as ETCD key data
 	//is not guaranteed in any particular order.
 
-	if len(hkv.HWStates) != 2 {
-		t.Errorf("ERROR, subscription key HWStates should have 2 values, has %d\n",
-			len(hkv.HWStates))
+	nstates := len(mandatoryScnSubscription().States)
+	if len(hkv.HWStates) != nstates {
+		t.Errorf("ERROR, subscription key HWStates should have %d values, has %d\n",
+			nstates, len(hkv.HWStates))
 	}
 	if !saContains(hkv.HWStates, "ready") {
 		t.Errorf("ERROR, subscription key HWStates missing 'ready' entry.\n")
@@ -139,3 +204,474 @@ func TestSubscribeToHsmScn(t *testing.T) {
 		t.Errorf("ERROR, subscription key Enabled should be 'true', is 'false'.\n")
 	}
 }
+
+// Fake HSM SCN subscription API.
+
+type fakeHsmSubs struct {
+	sync.Mutex
+	subs     map[int64]hsmScnSubscription
+	nextID   int64
+	posts    int
+	puts     int
+	dels     int
+	failPost bool
+}
+
+func (fh *fakeHsmSubs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fh.Lock()
+	defer fh.Unlock()
+
+	toks := strings.Split(strings.TrimSuffix(r.URL.Path, "/"), "/")
+	id, iderr := strconv.ParseInt(toks[len(toks)-1], 10, 64)
+
+	switch r.Method {
+	case http.MethodGet:
+		var sl hsmScnSubscriptionList
+		for _, sub := range fh.subs {
+			sl.SubscriptionList = append(sl.SubscriptionList, sub)
+		}
+		ba, _ := json.Marshal(sl)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(ba)
+		return
+	case http.MethodPost:
+		var sub hsmScnSubscription
+		if fh.failPost {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &sub)
+		sub.ID = fh.nextID
+		fh.nextID++
+		fh.subs[sub.ID] = sub
+		fh.posts++
+	case http.MethodPut:
+		var sub hsmScnSubscription
+		if _, ok := fh.subs[id]; (iderr != nil) || !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &sub)
+		sub.ID = id
+		fh.subs[id] = sub
+		fh.puts++
+	case http.MethodDelete:
+		if _, ok := fh.subs[id]; (iderr != nil) || !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(fh.subs, id)
+		fh.dels++
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Return the hmnfd-owned subscriptions held by the fake HSM.
+
+func (fh *fakeHsmSubs) ours() []hsmScnSubscription {
+	var rl []hsmScnSubscription
+	fh.Lock()
+	defer fh.Unlock()
+	for _, sub := range fh.subs {
+		if isHmnfdHsmSubscription(sub) {
+			rl = append(rl, sub)
+		}
+	}
+	return rl
+}
+
+func TestReconcileHsmSubs(t *testing.T) {
+	var kverr error
+
+	disable_logs()
+
+	fh := &fakeHsmSubs{subs: make(map[int64]hsmScnSubscription), nextID: 1}
+	fh.subs[1] = hsmScnSubscription{ID: 1, Subscriber: "cray-hmnfd-7d9c5b8f4-x2k9q_1",
+		States: []string{"Ready"}, Url: "http://10.32.0.9:28600/hmi/v2/scn"}
+	fh.subs[2] = hsmScnSubscription{ID: 2, Subscriber: "hmnfd483920111_2",
+		Roles: []string{"Compute"}, Url: "http://10.32.0.9:28600/hmi/v2/scn"}
+	fh.subs[3] = hsmScnSubscription{ID: 3, Subscriber: "someone-else",
+		States: []string{"Off"}, Url: "http://someone.else/scn"}
+	fh.subs[4] = hsmScnSubscription{ID: 4, Subscriber: "cray-hmnfd-exporter_1",
+		States: []string{"Off"}, Url: "http://exporter/scn"}
+	fh.subs[5] = hsmScnSubscription{ID: 5, Subscriber: "my-hmnfd-watcher_7",
+		States: []string{"On"}, Url: "http://watcher/scn"}
+	fh.nextID = 6
+	srv := httptest.NewServer(fh)
+	defer srv.Close()
+
+	if htrans.transport == nil {
+		htrans.transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		htrans.client = &http.Client{Transport: htrans.transport,
+			Timeout: 5 * time.Second,
+		}
+	}
+
+	savedSM := app_params.SM_url
+	savedInUrl := app_params.Scn_in_url
+	app_params.SM_url = srv.URL
+	app_params.Scn_in_url = "http://cray-hmnfd/hmi/v2/scn"
+	app_params.Nosm = 0
+	defer func() {
+		app_params.SM_url = savedSM
+		app_params.Scn_in_url = savedInUrl
+		app_params.Nosm = 1
+		hsmSubsApplied = nil
+	}()
+
+	kverr = openTestKV()
+	if kverr != nil {
+		t.Fatal("KV/ETCD open failed:", kverr)
+	}
+	defer kvPurge(t)
+
+	sub := ScnSubscribe{Subscriber: "handler@x1c2s3b0n4",
+		Url:            "http://a.b.c.d/scn",
+		SoftwareStatus: []string{"AdminDown"},
+		SubRoles:       []string{"Worker"},
+	}
+	subKey := makeSubscriptionKey_V1(sub)
+	err := makeSubscriptionEntry(sub.Components, sub.Url, subKey)
+	if err != nil {
+		t.Fatal("ERROR storing subscription:", err)
+	}
+
+	//First pass: legacy subscriptions are removed, a single one is created.
+
+	hsmSubsApplied = nil
+	err = reconcileHsmSubs()
+	if err != nil {
+		t.Fatal("ERROR reconciling HSM subscriptions:", err)
+	}
+
+	ours := fh.ours()
+	if len(ours) != 1 {
+		t.Fatalf("ERROR, expected 1 hmnfd HSM subscription, got %d", len(ours))
+	}
+	fh.Lock()
+	for _, id := range []int64{4, 5} {
+		if _, ok := fh.subs[id]; !ok {
+			t.Errorf("ERROR, another service's HSM subscription %d was deleted.", id)
+		}
+	}
+	fh.Unlock()
+	if ours[0].Subscriber != HSM_SCN_SUBSCRIBER {
+		t.Errorf("ERROR, HSM subscriber mismatch, exp: '%s', got: '%s'",
+			HSM_SCN_SUBSCRIBER, ours[0].Subscriber)
+	}
+	if !saContains(ours[0].SoftwareStatus, "admindown") ||
+		!saContains(ours[0].SubRoles, "worker") ||
+		!saContains(ours[0].States, "ready") {
+		t.Errorf("ERROR, HSM subscription missing attributes: %v", ours[0])
+	}
+	if _, ok := fh.subs[3]; !ok {
+		t.Errorf("ERROR, non-hmnfd HSM subscription was deleted.")
+	}
+	if (fh.posts != 1) || (fh.dels != 2) {
+		t.Errorf("ERROR, expected 1 POST and 2 DELETEs, got %d and %d",
+			fh.posts, fh.dels)
+	}
+
+	//Nothing changed, so HSM should not be touched.
+
+	err = reconcileHsmSubs()
+	if err != nil {
+		t.Fatal("ERROR reconciling HSM subscriptions:", err)
+	}
+	if (fh.posts != 1) || (fh.puts != 0) {
+		t.Errorf("ERROR, HSM subscription changed with no stored changes.")
+	}
+
+	//Delete the stored subscription; the HSM subscription must shrink, and
+	//be replaced in place.
+
+	kvHandle.Delete(subKey)
+	err = reconcileHsmSubs()
+	if err != nil {
+		t.Fatal("ERROR reconciling HSM subscriptions:", err)
+	}
+	ours = fh.ours()
+	if (len(ours) != 1) || (fh.puts != 1) || (fh.posts != 1) {
+		t.Fatalf("ERROR, expected 1 subscription updated in place, got %d subs, %d PUTs, %d POSTs",
+			len(ours), fh.puts, fh.posts)
+	}
+	if (len(ours[0].SoftwareStatus) != 0) || (len(ours[0].SubRoles) != 0) {
+		t.Errorf("ERROR, HSM subscription did not shrink: %v", ours[0])
+	}
+
+	//Verify mode notices when HSM has lost the subscription.
+
+	fh.Lock()
+	delete(fh.subs, ours[0].ID)
+	fh.Unlock()
+	hsmSubsApplied = nil
+	err = reconcileHsmSubs()
+	if err != nil {
+		t.Fatal("ERROR reconciling HSM subscriptions:", err)
+	}
+	if len(fh.ours()) != 1 {
+		t.Errorf("ERROR, lost HSM subscription was not re-created.")
+	}
+
+	kv, ok, _ := kvHandle.Get(HSM_SUBS_KEY)
+	if !ok {
+		t.Errorf("ERROR, HSM subscription key not stored.")
+	}
+	if strings.Contains(kv, "admindown") {
+		t.Errorf("ERROR, stale HSM subscription key contents: %s", kv)
+	}
+}
+
+func TestLostHsmSubs(t *testing.T) {
+	var kverr error
+
+	disable_logs()
+
+	fh := &fakeHsmSubs{subs: make(map[int64]hsmScnSubscription), nextID: 1}
+	srv := httptest.NewServer(fh)
+	defer srv.Close()
+
+	if htrans.transport == nil {
+		htrans.transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		htrans.client = &http.Client{Transport: htrans.transport,
+			Timeout: 5 * time.Second,
+		}
+	}
+
+	savedSM := app_params.SM_url
+	savedInUrl := app_params.Scn_in_url
+	app_params.SM_url = srv.URL
+	app_params.Scn_in_url = "http://cray-hmnfd/hmi/v2/scn"
+	app_params.Nosm = 0
+	app_params.Use_telemetry = 1
+	defer func() {
+		app_params.SM_url = savedSM
+		app_params.Scn_in_url = savedInUrl
+		app_params.Nosm = 1
+		app_params.Use_telemetry = 0
+		hsmSubsApplied = nil
+		hsmSubsVerify = false
+		hsmSubsLostMutex.Lock()
+		hsmSubsLost = hsmSubsStatus{}
+		hsmSubsLostMutex.Unlock()
+	}()
+
+	kverr = openTestKV()
+	if kverr != nil {
+		t.Fatal("KV/ETCD open failed:", kverr)
+	}
+	defer kvPurge(t)
+	kvHandle.Store("HMNFD_HEALTH_KEY", "HMNFD_OK")
+	defer kvHandle.Delete("HMNFD_HEALTH_KEY")
+
+	hsmSubsApplied = nil
+	err := reconcileHsmSubs()
+	if err != nil {
+		t.Fatal("ERROR reconciling HSM subscriptions:", err)
+	}
+	if len(fh.ours()) != 1 {
+		t.Fatalf("ERROR, HSM subscription was not created.")
+	}
+
+	//A verify pass with nothing wrong stores an OK status.
+
+	hsmSubsVerify = true
+	err = reconcileHsmSubs()
+	if err != nil {
+		t.Fatal("ERROR verifying HSM subscriptions:", err)
+	}
+	if getHsmSubsLost().Degraded {
+		t.Errorf("ERROR, degraded with an intact HSM subscription.")
+	}
+	if _, ok, _ := kvHandle.Get(HSM_SUBS_STATUS_KEY); !ok {
+		t.Errorf("ERROR, HSM subscription status not stored after verify.")
+	}
+
+	//HSM loses the subscription, and can't take it back right away.
+
+	fh.Lock()
+	fh.subs = make(map[int64]hsmScnSubscription)
+	fh.failPost = true
+	fh.Unlock()
+
+	hsmSubsVerify = true
+	err = reconcileHsmSubs()
+	if err == nil {
+		t.Errorf("ERROR, expected error re-creating HSM subscription.")
+	}
+	hss := getHsmSubsLost()
+	if !hss.Degraded || (hss.Reason == "") {
+		t.Errorf("ERROR, lost HSM subscription not detected: %v", hss)
+	}
+	if ev := telemetryServiceEvent(t); ev.Flag != "Alert" {
+		t.Errorf("ERROR, expected an Alert service event, got %v", ev)
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080/hmi/v1/readiness", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(readinessHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("ERROR, readiness returned %d while degraded.", rr.Code)
+	}
+
+	var stored hsmSubsStatus
+	val, _, _ := kvHandle.Get(HSM_SUBS_STATUS_KEY)
+	json.Unmarshal([]byte(val), &stored)
+	if !stored.Degraded {
+		t.Errorf("ERROR, degraded status not stored: '%s'", val)
+	}
+
+	//HSM recovers; the retry repairs the subscription, but it stays
+	//degraded until the next pass finds HSM kept it.
+
+	fh.Lock()
+	fh.failPost = false
+	fh.Unlock()
+
+	err = reconcileHsmSubs()
+	if err != nil {
+		t.Fatal("ERROR repairing HSM subscriptions:", err)
+	}
+	if len(fh.ours()) != 1 {
+		t.Errorf("ERROR, lost HSM subscription was not re-created.")
+	}
+	hss = getHsmSubsLost()
+	if !hss.Degraded || !hss.Repaired || (hss.Repairs != 1) {
+		t.Errorf("ERROR, expected degraded and repaired once, got %v", hss)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(readinessHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("ERROR, readiness returned %d before the repair was verified.", rr.Code)
+	}
+
+	err = reconcileHsmSubs()
+	if err != nil {
+		t.Fatal("ERROR verifying repaired HSM subscriptions:", err)
+	}
+	hss = getHsmSubsLost()
+	if hss.Degraded || (hss.Repairs != 1) {
+		t.Errorf("ERROR, expected verified with 1 repair, got %v", hss)
+	}
+	if ev := telemetryServiceEvent(t); ev.Flag != "OK" {
+		t.Errorf("ERROR, expected an OK service event, got %v", ev)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(readinessHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("ERROR, readiness returned %d after repair.", rr.Code)
+	}
+	stored = hsmSubsStatus{}
+	val, _, _ = kvHandle.Get(HSM_SUBS_STATUS_KEY)
+	json.Unmarshal([]byte(val), &stored)
+	if stored.Degraded || (stored.Repairs != 1) {
+		t.Errorf("ERROR, degraded status not cleared: '%s'", val)
+	}
+}
+
+// Pull the next service event off the telemetry queue, skipping anything
+// else.
+
+func telemetryServiceEvent(t *testing.T) Scn {
+	for {
+		select {
+		case str := <-kq_chan:
+			var ev Scn
+			if json.Unmarshal([]byte(str), &ev) != nil {
+				t.Errorf("ERROR, bad telemetry payload: '%s'", str)
+				continue
+			}
+			if ev.Service == "" {
+				continue
+			}
+			if (ev.Service != URL_APPNAME) || (len(ev.Components) != 0) {
+				t.Errorf("ERROR, bad service event: '%s'", str)
+			}
+			return ev
+		default:
+			t.Errorf("ERROR, no service event on the telemetry queue.")
+			return Scn{}
+		}
+	}
+}
+
+func TestPruneDeadWood(t *testing.T) {
+	var kverr error
+
+	disable_logs()
+
+	dsbl := false
+	fh := &fakeHsmStates{comps: map[string]hsmComponent{
+		"x0c0s0b0n0":   {ID: "x0c0s0b0n0", Type: "Node", State: "Off"},
+		"x0c0s0b0n1":   {ID: "x0c0s0b0n1", Type: "Node", State: "Ready", Enabled: &dsbl},
+		"x0c0s0b0n2":   {ID: "x0c0s0b0n2", Type: "Node", State: "Ready"},
+		"x0c0s0b0n3v0": {ID: "x0c0s0b0n3v0", Type: "VirtualNode", State: "Halt"},
+		"x0c0s1b0":     {ID: "x0c0s1b0", Type: "NodeBMC", State: "Empty"},
+		"x0c0s2b0":     {ID: "x0c0s2b0", Type: "NodeBMC", State: "Ready"},
+	}}
+	hsrv := httptest.NewServer(fh)
+	defer hsrv.Close()
+
+	if htrans.transport == nil {
+		htrans.transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		htrans.client = &http.Client{Transport: htrans.transport,
+			Timeout: 5 * time.Second,
+		}
+	}
+
+	kverr = openTestKV()
+	if kverr != nil {
+		t.Fatal("KV/ETCD open failed:", kverr)
+	}
+	defer kvPurge(t)
+
+	savedSM := app_params.SM_url
+	app_params.SM_url = hsrv.URL
+	app_params.Nosm = 0
+	defer func() {
+		app_params.SM_url = savedSM
+		app_params.Nosm = 1
+	}()
+
+	sd := SubData{Url: "", ScnNodes: []string{"x0c0s0b0n9"}}
+	ba, _ := json.Marshal(sd)
+	for xname := range fh.comps {
+		kvHandle.Store("sub#"+xname+"#hs.ready", string(ba))
+	}
+
+	//Enough unknown subscribers to need more than one page.
+
+	for ix := 0; ix < HSM_QUERY_PAGE_SIZE; ix++ {
+		kvHandle.Store(fmt.Sprintf("sub#x1c%ds0b0n0#hs.ready", ix), string(ba))
+	}
+
+	err := pruneDeadWood()
+	if err != nil {
+		t.Fatal("ERROR sweeping for dead subscribers:", err)
+	}
+	if fh.queries != 2 {
+		t.Errorf("ERROR, expected 2 paged HSM queries, got %d", fh.queries)
+	}
+
+	prunemap_mutex.Lock()
+	defer prunemap_mutex.Unlock()
+	for _, xname := range []string{"x0c0s0b0n0", "x0c0s0b0n1", "x0c0s0b0n3v0", "x0c0s1b0"} {
+		if !prunemap[xname] {
+			t.Errorf("ERROR, dead subscriber '%s' not pruned.", xname)
+		}
+		delete(prunemap, xname)
+	}
+	for _, xname := range []string{"x0c0s0b0n2", "x0c0s2b0", "x1c0s0b0n0"} {
+		if prunemap[xname] {
+			t.Errorf("ERROR, live subscriber '%s' pruned.", xname)
+		}
+	}
+}
@@ -1,6 +1,6 @@
 // MIT License
 //
-// (C) Copyright [2020-2021,2023] Hewlett Packard Enterprise Development LP
+// (C) Copyright [2020-2021,2023,2026] Hewlett Packard Enterprise Development LP
 //
 // Permission is hereby granted, free of charge, to any person obtaining a
 // copy of this software and associated documentation files (the "Software"),
@@ -27,6 +27,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 
 	"github.com/Cray-HPE/hms-base/v2"
 )
@@ -38,6 +39,10 @@ type HealthResponse struct {
 	HsmSubscriptionStatus string `json:"HsmSubscriptions"`
 	PruneMapStatus        string `json:"PruneMap"`
 	WorkerPoolStatus      string `json:"WorkerPool"`
+	ReplicaStatus         string `json:"Replicas"`
+	LeaderStatus          string `json:"Leader"`
+	HsmSubscriptionCheck  string `json:"HsmSubscriptionCheck"`
+	ReconcileStatus       string `json:"Reconcile"`
 }
 
 // doHealth - returns useful information about the service to the user
@@ -111,6 +116,30 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 		stats.HsmSubscriptionStatus = "KVStore not initialized"
 	}
 
+	// HSM subscription check: go subscribeToHsmScn(), leader only.  Read
+	// from ETCD so every replica can report it.
+	if kvHandle != nil {
+		var hss hsmSubsStatus
+		val, ok, serr := kvHandle.Get(HSM_SUBS_STATUS_KEY)
+		if serr != nil {
+			stats.HsmSubscriptionCheck = fmt.Sprintf("HSM Subscription status key retrieval error:%s", serr.Error())
+		} else if !ok {
+			stats.HsmSubscriptionCheck = "Not checked yet"
+		} else if json.Unmarshal([]byte(val), &hss) != nil {
+			stats.HsmSubscriptionCheck = fmt.Sprintf("Invalid HSM Subscription status:%s", val)
+		} else if hss.Degraded && hss.Repaired {
+			stats.HsmSubscriptionCheck = fmt.Sprintf("DEGRADED: %s since %s, repaired, verifying, Repairs:%d",
+				hss.Reason, hss.Since, hss.Repairs)
+		} else if hss.Degraded {
+			stats.HsmSubscriptionCheck = fmt.Sprintf("DEGRADED: %s since %s, repairing, Repairs:%d",
+				hss.Reason, hss.Since, hss.Repairs)
+		} else {
+			stats.HsmSubscriptionCheck = fmt.Sprintf("OK, Repairs:%d", hss.Repairs)
+		}
+	} else {
+		stats.HsmSubscriptionCheck = "KVStore not initialized"
+	}
+
 	// subscription pruner: go prune()
 	if len(prunemap) > 0 {
 		stats.PruneMapStatus = fmt.Sprintf("Number of items:%d", len(prunemap))
@@ -126,10 +155,33 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 	if scnWorkPool == nil {
 		stats.WorkerPoolStatus = "Worker Pool not started"
 	} else {
-		stats.WorkerPoolStatus = fmt.Sprintf("Workers:%d, Jobs:%d", len(scnWorkPool.Workers),
-			len(scnWorkPool.JobQueue))
+		nq, nscns := subQueueStats()
+		stats.WorkerPoolStatus = fmt.Sprintf("Workers:%d, Jobs:%d, Subscriber queues:%d, Queued SCNs:%d, Open circuit breakers:%d",
+			len(scnWorkPool.Workers), len(scnWorkPool.JobQueue), nq, nscns,
+			breakerStats())
+	}
+
+	// segmented fanout replicas: go replicaHeartbeat()
+	if app_params.Segmented_fanout == 0 {
+		stats.ReplicaStatus = "Segmented fanout disabled"
+	} else {
+		stats.ReplicaStatus = fmt.Sprintf("Active:%t, Replicas:%s",
+			segmentedFanoutActive(), strings.Join(getReplicaNames(), ","))
+	}
+
+	// leader election: go leaderElection()
+	ldr, lerr := getLeader()
+	if lerr != nil {
+		stats.LeaderStatus = fmt.Sprintf("Leader key retrieval error:%s", lerr.Error())
+	} else if ldr == "" {
+		stats.LeaderStatus = "No leader elected"
+	} else {
+		stats.LeaderStatus = fmt.Sprintf("Leader:%s, ThisReplica:%t", ldr, isLeader())
 	}
 
+	// HSM state reconciliation: go reconcileComponents()
+	stats.ReconcileStatus = reconcileStatus()
+
 	// write the output
 	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
@@ -191,6 +243,14 @@ func readinessHandler(w http.ResponseWriter, r *http.Request) {
 		ready = false
 	}
 
+	// HSM lost our SCN subscription.  Only the leader, which found it and
+	// is repairing it, reports this; failing every replica would cut HSM
+	// off from the service entirely.
+	if hss := getHsmSubsLost(); hss.Degraded {
+		log.Printf("ERROR: Readiness check HSM SCN subscription lost: %s", hss.Reason)
+		ready = false
+	}
+
 	// fail if anything determined not ready
 	if ready {
 		w.WriteHeader(http.StatusNoContent)
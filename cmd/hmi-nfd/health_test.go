@@ -29,8 +29,6 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
-
-	"github.com/Cray-HPE/hms-hmetcd"
 )
 
 func TestLiveness(t *testing.T) {
@@ -103,7 +101,7 @@ func TestReadiness(t *testing.T) {
 
 	// start the KV Store and test again
 	var kverr error
-	kvHandle, kverr = hmetcd.Open("mem:", "")
+	kverr = openTestKV()
 	if kverr != nil {
 		t.Fatal("KV/ETCD open failed:", kverr)
 	}
@@ -169,7 +167,7 @@ func TestHealth(t *testing.T) {
 
 	// start the KV Store and test again
 	var kverr error
-	kvHandle, kverr = hmetcd.Open("mem:", "")
+	kverr = openTestKV()
 	if kverr != nil {
 		t.Fatal("KV/ETCD open failed:", kverr)
 	}
@@ -1,6 +1,6 @@
 // MIT License
 //
-// (C) Copyright [2019-2022,2023,2025] Hewlett Packard Enterprise Development LP
+// (C) Copyright [2019-2022,2023,2025-2026] Hewlett Packard Enterprise Development LP
 //
 // Permission is hereby granted, free of charge, to any person obtaining a
 // copy of this software and associated documentation files (the "Software"),
@@ -29,6 +29,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
@@ -63,21 +64,40 @@ type urlDesc struct {
 // Application parameters.
 
 type opParams struct {
-	Debug           int    `json:"Debug"`
-	Help            int    `json:"-"`
-	KV_url          string `json:"KV_url"`
-	Nosm            int    `json:"Nosm"`
-	Port            int    `json:"Port"`
-	Scn_in_url      string `json:"Scn_in_url"`
-	Scn_max_cache   int    `json:"Scn_max_cache"`
-	Scn_cache_delay int    `json:"Scn_cache_delay"`
-	Scn_retries     int    `json:"Scn_retries"`
-	Scn_backoff     int    `json:"Scn_backoff"`
-	SM_retries      int    `json:"SM_retries"`
-	SM_timeout      int    `json:"SM_timeout"`
-	SM_url          string `json:"SM_url"`
-	Telemetry_host  string `json:"Telemetry_host"`
-	Use_telemetry   int    `json:"Use_telemetry"`
+	Debug                 int          `json:"Debug"`
+	Help                  int          `json:"-"`
+	KV_url                string       `json:"KV_url"`
+	Nosm                  int          `json:"Nosm"`
+	Port                  int          `json:"Port"`
+	Prune_interval        int          `json:"Prune_interval"`
+	Prune_policy          *PrunePolicy `json:"Prune_policy,omitempty"`
+	Prune_telemetry       int          `json:"Prune_telemetry"`
+	Reconcile_interval    int          `json:"Reconcile_interval"`
+	Replica_url           string       `json:"Replica_url"`
+	Scn_in_url            string       `json:"Scn_in_url"`
+	Scn_max_cache         int          `json:"Scn_max_cache"`
+	Scn_cache_delay       int          `json:"Scn_cache_delay"`
+	Scn_retries           int          `json:"Scn_retries"`
+	Scn_backoff           int          `json:"Scn_backoff"`
+	Scn_backoff_max       int          `json:"Scn_backoff_max"`
+	Scn_backoff_jitter    int          `json:"Scn_backoff_jitter"`
+	Scn_breaker_threshold int          `json:"Scn_breaker_threshold"`
+	Scn_breaker_cooldown  int          `json:"Scn_breaker_cooldown"`
+	Scn_retry_errors      []string     `json:"Scn_retry_errors"`
+	Scn_queue_depth       int          `json:"Scn_queue_depth"`
+	Scn_queue_overflow    string       `json:"Scn_queue_overflow"`
+	Scn_idle_conns        int          `json:"Scn_idle_conns"`
+	Scn_idle_timeout      int          `json:"Scn_idle_timeout"`
+	Scn_tls_ca            string       `json:"Scn_tls_ca"`
+	Scn_tls_cert          string       `json:"Scn_tls_cert"`
+	Scn_tls_key           string       `json:"Scn_tls_key"`
+	Scn_tls_insecure      int          `json:"Scn_tls_insecure"`
+	Segmented_fanout      int          `json:"Segmented_fanout"`
+	SM_retries            int          `json:"SM_retries"`
+	SM_timeout            int          `json:"SM_timeout"`
+	SM_url                string       `json:"SM_url"`
+	Telemetry_host        string       `json:"Telemetry_host"`
+	Use_telemetry         int          `json:"Use_telemetry"`
 }
 
 // Transport/client for outbound HTTP stuff
@@ -110,10 +130,15 @@ const (
 	URL_SCN           = "scn"
 	URL_SUBSCRIBE     = "subscribe"
 	URL_SUBSCRIPTIONS = "subscriptions"
+	URL_SERVICES      = "services"
 	URL_PARAMS        = "params"
 	URL_LIVENESS      = "liveness"
 	URL_READINESS     = "readiness"
 	URL_HEALTH        = "health"
+	URL_FANOUT        = "fanout"
+	URL_PRUNES        = "prunes"
+	URL_DEADLETTERS   = "deadletters"
+	URL_STREAM        = "stream"
 	URL_DELIM         = "/"
 	URL_PORT_DELIM    = ":"
 )
@@ -124,12 +149,16 @@ const (
 	SM_SCN_SUB      = "Subscriptions/SCN"
 	SM_COMPINFO     = "Component/State"
 	SM_STATEDATA    = "State/Components"
+	SM_STATEQUERY   = "State/Components/Query"
 	SM_TIMEOUT      = 3
 	SM_RETRIES      = 3
 	SCN_MAX_CACHE   = 100
 	SCN_CACHE_DELAY = 5
 	SCN_BACKOFF     = 1
+	SCN_BACKOFF_MAX = 30
+	SCN_JITTER      = 50
 	SCN_RETRIES     = 5
+	PRUNE_INTERVAL  = 300
 )
 
 const (
@@ -148,6 +177,7 @@ const (
 var serviceName string
 var kvHandle hmetcd.Kvi
 var hsmsub_chan = make(chan ScnSubscribe, 50000)
+var hsmsub_stop = make(chan bool) //stops the HSM subscription loop (for testing)
 var scnWorkPool *base.WorkerPool
 var fanoutSyncMode int = 0
 var htrans httpTrans
@@ -155,21 +185,40 @@ var Running = true
 var featureFlag_xnameApiEnable int
 
 var app_params = opParams{
-	Debug:           0,
-	Help:            0,
-	KV_url:          "mem:",
-	Nosm:            0,
-	Port:            URL_PORT,
-	Scn_in_url:      "",
-	Scn_max_cache:   SCN_MAX_CACHE,
-	Scn_cache_delay: SCN_CACHE_DELAY,
-	Scn_backoff:     SCN_BACKOFF,
-	Scn_retries:     SCN_RETRIES,
-	SM_retries:      SM_RETRIES,
-	SM_timeout:      SM_TIMEOUT,
-	SM_url:          "https://localhost:27999/hsm/v2",
-	Telemetry_host:  "",
-	Use_telemetry:   0,
+	Debug:                 0,
+	Help:                  0,
+	KV_url:                "mem:",
+	Nosm:                  0,
+	Port:                  URL_PORT,
+	Prune_interval:        PRUNE_INTERVAL,
+	Prune_policy:          defaultPrunePolicy(),
+	Prune_telemetry:       0,
+	Reconcile_interval:    0,
+	Replica_url:           "",
+	Scn_in_url:            "",
+	Scn_max_cache:         SCN_MAX_CACHE,
+	Scn_cache_delay:       SCN_CACHE_DELAY,
+	Scn_backoff:           SCN_BACKOFF,
+	Scn_backoff_max:       SCN_BACKOFF_MAX,
+	Scn_backoff_jitter:    SCN_JITTER,
+	Scn_breaker_threshold: SCN_BREAKER_THRESHOLD,
+	Scn_breaker_cooldown:  SCN_BREAKER_COOLDOWN,
+	Scn_retry_errors:      defaultRetryErrors(),
+	Scn_retries:           SCN_RETRIES,
+	Scn_queue_depth:       SCN_QUEUE_DEPTH,
+	Scn_queue_overflow:    QUEUE_OVERFLOW_COALESCE,
+	Scn_idle_conns:        SCN_IDLE_CONNS,
+	Scn_idle_timeout:      SCN_IDLE_TIMEOUT,
+	Scn_tls_ca:            "",
+	Scn_tls_cert:          "",
+	Scn_tls_key:           "",
+	Scn_tls_insecure:      0,
+	Segmented_fanout:      0,
+	SM_retries:            SM_RETRIES,
+	SM_timeout:            SM_TIMEOUT,
+	SM_url:                "https://localhost:27999/hsm/v2",
+	Telemetry_host:        "",
+	Use_telemetry:         0,
 }
 
 var server_url = urlDesc{url_prefix: URL_PREFIX, //https://
@@ -206,10 +255,40 @@ func printHelp() {
 	fmt.Printf("  --nosm                  Don't contact State Manager (for debugging).\n")
 	fmt.Printf("  --port=num              HTTPS port to listen on. (Default: %d)\n",
 		URL_PORT)
-	fmt.Printf("  --scn_backoff=num       Seconds between SCN send retries (Default: %d)\n",
+	fmt.Printf("  --prune_interval=num    Seconds between dead subscriber sweeps, 0==takeover only (Default: %d)\n",
+		PRUNE_INTERVAL)
+	fmt.Printf("  --prune_policy_file=f   JSON file holding the prune policy (Default: built-in policy)\n")
+	fmt.Printf("  --prune_telemetry       Inject prune log records onto telemetry bus (Default: no)\n")
+	fmt.Printf("  --reconcile_interval=n  Seconds between HSM state reconciles, 0==off (Default: 0)\n")
+	fmt.Printf("  --replica_url=url       URL other replicas use to hand off SCNs to this one.\n")
+	fmt.Printf("  --scn_backoff=num       Seconds before the first SCN send retry, doubling after each (Default: %d)\n",
 		SCN_BACKOFF)
+	fmt.Printf("  --scn_backoff_max=num   Max seconds between SCN send retries, 0==no limit (Default: %d)\n",
+		SCN_BACKOFF_MAX)
+	fmt.Printf("  --scn_backoff_jitter=n  Percent of SCN send retry backoff to randomize, 0-100 (Default: %d)\n",
+		SCN_JITTER)
+	fmt.Printf("  --scn_breaker_threshold=n Failures in a row to open a host's circuit breaker, 0==off (Default: %d)\n",
+		SCN_BREAKER_THRESHOLD)
+	fmt.Printf("  --scn_breaker_cooldown=n Seconds a circuit breaker stays open before probing (Default: %d)\n",
+		SCN_BREAKER_COOLDOWN)
 	fmt.Printf("  --scn_retries=num       Number of times to retry sending SCNs (Default: %d)\n",
 		SCN_RETRIES)
+	fmt.Printf("  --scn_retry_errors=list Delivery error classes to retry, comma separated (Default: %s)\n",
+		strings.Join(defaultRetryErrors(), ","))
+	fmt.Printf("  --scn_queue_depth=num   Max SCNs queued per subscriber, 0==no limit (Default: %d)\n",
+		SCN_QUEUE_DEPTH)
+	fmt.Printf("  --scn_queue_overflow=p  Full subscriber queue policy: DropOldest, Coalesce or Suspend (Default: %s)\n",
+		QUEUE_OVERFLOW_COALESCE)
+	fmt.Printf("  --scn_idle_conns=num    Idle SCN delivery connections kept per subscriber host, 0==no keep-alive (Default: %d)\n",
+		SCN_IDLE_CONNS)
+	fmt.Printf("  --scn_idle_timeout=num  Seconds an idle SCN delivery connection is kept (Default: %d)\n",
+		SCN_IDLE_TIMEOUT)
+	fmt.Printf("  --scn_tls_ca=file       CA bundle to verify subscriber certificates with (Default: system roots)\n")
+	fmt.Printf("  --scn_tls_cert=file     Client certificate to present to subscribers for mTLS (Default: none)\n")
+	fmt.Printf("  --scn_tls_key=file      Client certificate's private key (Default: none)\n")
+	fmt.Printf("  --scn_tls_insecure      Don't verify subscriber certificates (Default: no)\n")
+	fmt.Printf("  --secret_key_file=f     File holding the key subscription secrets are encrypted with (Default: none, no secrets)\n")
+	fmt.Printf("  --segmented_fanout      Divide SCN fanout among all replicas (Default: no)\n")
 	fmt.Printf("  --sm_retries=num        Number of times to retry on State Manager error. (Default: %d)\n",
 		SM_RETRIES)
 	fmt.Printf("  --sm_timeout=num        Seconds to wait on State Manager accesses. (Default: %d)\n",
@@ -217,6 +296,7 @@ func printHelp() {
 	fmt.Printf("  --sm_url=url            State Manager base URL. (Default: %s)\n",
 		SM_URL_BASE)
 	fmt.Printf("  --telemetry_host=h:p:t  Hostname:port:topic  of telemetry service\n")
+	fmt.Printf("  --token_dir=dir         Directory subscription token files are read from (Default: none, no token files)\n")
 	fmt.Printf("  --use_telemetry         Inject notifications onto telemetry bus (Default: no)\n")
 	fmt.Printf("\n")
 }
@@ -252,15 +332,36 @@ func parseCmdLine() {
 	kv_urlP := flag.String("kv_url", unstr, "Key-Value URL")
 	nosmP := flag.Bool("nosm", false, "Don't contact State Manager")
 	portP := flag.Int("port", unint, "Port to listen on")
+	prune_intervalP := flag.Int("prune_interval", unint, "Seconds between dead subscriber sweeps")
+	prune_policyP := flag.String("prune_policy_file", unstr, "Prune policy JSON file")
+	prune_teleP := flag.Bool("prune_telemetry", false, "Inject prune log records onto telemetry bus")
+	reconcile_intervalP := flag.Int("reconcile_interval", unint, "Seconds between HSM state reconciles")
+	replica_urlP := flag.String("replica_url", unstr, "URL where replica SCN handoffs are received")
 	scn_in_urlP := flag.String("scn_in_url", unstr, "URL where SCNs are received")
 	scn_max_cacheP := flag.Int("scn_max_cache", unint, "Max SCNs to cache")
 	scn_cache_delayP := flag.Int("scn_cache_delay", unint, "Max time to wait incaching SCNs")
-	scn_backoffP := flag.Int("scn_backoff", unint, "Time between SCN send retries")
+	scn_backoffP := flag.Int("scn_backoff", unint, "Time before first SCN send retry")
+	scn_backoff_maxP := flag.Int("scn_backoff_max", unint, "Max time between SCN send retries")
+	scn_jitterP := flag.Int("scn_backoff_jitter", unint, "Percent of SCN send retry backoff to randomize")
+	scn_brk_threshP := flag.Int("scn_breaker_threshold", unint, "Failures in a row to open a circuit breaker")
+	scn_brk_coolP := flag.Int("scn_breaker_cooldown", unint, "Time a circuit breaker stays open")
 	scn_retriesP := flag.Int("scn_retries", unint, "Max number of SCN retries")
+	scn_retry_errsP := flag.String("scn_retry_errors", unstr, "Delivery error classes to retry")
+	scn_qdepthP := flag.Int("scn_queue_depth", unint, "Max SCNs queued per subscriber")
+	scn_qoverflowP := flag.String("scn_queue_overflow", unstr, "Full subscriber queue policy")
+	scn_idle_connsP := flag.Int("scn_idle_conns", unint, "Idle SCN delivery connections per host")
+	scn_idle_timeoutP := flag.Int("scn_idle_timeout", unint, "Time an idle SCN delivery connection is kept")
+	scn_tls_caP := flag.String("scn_tls_ca", unstr, "CA bundle for subscriber certificates")
+	scn_tls_certP := flag.String("scn_tls_cert", unstr, "Client certificate for subscriber mTLS")
+	scn_tls_keyP := flag.String("scn_tls_key", unstr, "Client certificate private key")
+	scn_tls_insecureP := flag.Bool("scn_tls_insecure", false, "Don't verify subscriber certificates")
+	secret_keyP := flag.String("secret_key_file", unstr, "Subscription secret encryption key file")
+	seg_fanoutP := flag.Bool("segmented_fanout", false, "Divide SCN fanout among replicas")
 	sm_retriesP := flag.Int("sm_retries", unint, "Number of times to retry SM on error")
 	sm_timeoutP := flag.Int("sm_timeout", unint, "Seconds to wait on SM response")
 	sm_urlP := flag.String("sm_url", unstr, "State manager base URL")
 	telehostP := flag.String("telemetry_host", unstr, "Telemetry host:port:topic")
+	token_dirP := flag.String("token_dir", unstr, "Subscription token file directory")
 	use_teleP := flag.Bool("use_telemetry", false, "Inject notifications onto telemetry bus")
 
 	flag.Parse()
@@ -290,6 +391,29 @@ func parseCmdLine() {
 		server_url.url_port = *portP
 	}
 
+	if *prune_intervalP != unint {
+		app_params.Prune_interval = *prune_intervalP
+	}
+
+	if *prune_policyP != unstr {
+		err := loadPrunePolicyFile(*prune_policyP)
+		if err != nil {
+			log.Printf("ERROR: invalid prune policy file: %v\n", err)
+		}
+	}
+
+	if *prune_teleP != false {
+		app_params.Prune_telemetry = 1
+	}
+
+	if *reconcile_intervalP != unint {
+		app_params.Reconcile_interval = *reconcile_intervalP
+	}
+
+	if *replica_urlP != unstr {
+		app_params.Replica_url = *replica_urlP
+	}
+
 	if *scn_in_urlP != unstr {
 		app_params.Scn_in_url = *scn_in_urlP
 	}
@@ -306,10 +430,93 @@ func parseCmdLine() {
 		app_params.Scn_backoff = *scn_backoffP
 	}
 
+	if *scn_backoff_maxP != unint {
+		if *scn_backoff_maxP < 0 {
+			log.Printf("ERROR: invalid --scn_backoff_max value %d, can't be negative.\n",
+				*scn_backoff_maxP)
+		} else {
+			app_params.Scn_backoff_max = *scn_backoff_maxP
+		}
+	}
+
+	if *scn_jitterP != unint {
+		app_params.Scn_backoff_jitter = *scn_jitterP
+	}
+
+	if *scn_brk_threshP != unint {
+		if *scn_brk_threshP < 0 {
+			log.Printf("ERROR: invalid --scn_breaker_threshold value %d, can't be negative.\n",
+				*scn_brk_threshP)
+		} else {
+			app_params.Scn_breaker_threshold = *scn_brk_threshP
+		}
+	}
+
+	if *scn_brk_coolP != unint {
+		if *scn_brk_coolP < 0 {
+			log.Printf("ERROR: invalid --scn_breaker_cooldown value %d, can't be negative.\n",
+				*scn_brk_coolP)
+		} else {
+			app_params.Scn_breaker_cooldown = *scn_brk_coolP
+		}
+	}
+
 	if *scn_retriesP != unint {
 		app_params.Scn_retries = *scn_retriesP
 	}
 
+	if *scn_retry_errsP != unstr {
+		setRetryErrors("--scn_retry_errors", *scn_retry_errsP)
+	}
+
+	if *scn_qdepthP != unint {
+		if *scn_qdepthP < 0 {
+			log.Printf("ERROR: invalid --scn_queue_depth value %d, can't be negative.\n",
+				*scn_qdepthP)
+		} else {
+			app_params.Scn_queue_depth = *scn_qdepthP
+		}
+	}
+
+	if *scn_qoverflowP != unstr {
+		setQueueOverflow("--scn_queue_overflow", *scn_qoverflowP)
+	}
+
+	if *scn_idle_connsP != unint {
+		app_params.Scn_idle_conns = *scn_idle_connsP
+	}
+
+	if *scn_idle_timeoutP != unint {
+		app_params.Scn_idle_timeout = *scn_idle_timeoutP
+	}
+
+	if *scn_tls_caP != unstr {
+		app_params.Scn_tls_ca = *scn_tls_caP
+	}
+
+	if *scn_tls_certP != unstr {
+		app_params.Scn_tls_cert = *scn_tls_certP
+	}
+
+	if *scn_tls_keyP != unstr {
+		app_params.Scn_tls_key = *scn_tls_keyP
+	}
+
+	if *scn_tls_insecureP != false {
+		app_params.Scn_tls_insecure = 1
+	}
+
+	if *secret_keyP != unstr {
+		err := loadSecretKeyFile(*secret_keyP)
+		if err != nil {
+			log.Printf("ERROR: invalid secret key file: %v\n", err)
+		}
+	}
+
+	if *seg_fanoutP != false {
+		app_params.Segmented_fanout = 1
+	}
+
 	if *sm_retriesP != unint {
 		app_params.SM_retries = *sm_retriesP
 	}
@@ -326,6 +533,13 @@ func parseCmdLine() {
 		app_params.Telemetry_host = *telehostP
 	}
 
+	if *token_dirP != unstr {
+		err := setTokenDir(*token_dirP)
+		if err != nil {
+			log.Printf("ERROR: invalid token directory: %v\n", err)
+		}
+	}
+
 	if *use_teleP != false {
 		app_params.Use_telemetry = 1
 	}
@@ -400,15 +614,55 @@ func parseEnvVars() {
 	__env_parse_string("HMNFD_KV_URL", &app_params.KV_url)
 	__env_parse_int("HMNFD_NOSM", &app_params.Nosm)
 	__env_parse_int("HMNFD_PORT", &app_params.Port)
+	__env_parse_int("HMNFD_PRUNE_INTERVAL", &app_params.Prune_interval)
+	__env_parse_bool("HMNFD_PRUNE_TELEMETRY", &app_params.Prune_telemetry)
+	if val := os.Getenv("HMNFD_PRUNE_POLICY_FILE"); val != "" {
+		err := loadPrunePolicyFile(val)
+		if err != nil {
+			log.Printf("ERROR: invalid HMNFD_PRUNE_POLICY_FILE: %v\n", err)
+		}
+	}
+	__env_parse_int("HMNFD_RECONCILE_INTERVAL", &app_params.Reconcile_interval)
+	__env_parse_string("HMNFD_REPLICA_URL", &app_params.Replica_url)
 	__env_parse_string("HMNFD_SCN_IN_URL", &app_params.Scn_in_url)
 	__env_parse_int("HMNFD_SCN_MAX_CACHE", &app_params.Scn_max_cache)
 	__env_parse_int("HMNFD_SCN_CACHE_DELAY", &app_params.Scn_cache_delay)
 	__env_parse_int("HMNFD_SCN_BACKOFF", &app_params.Scn_backoff)
+	__env_parse_int("HMNFD_SCN_BACKOFF_MAX", &app_params.Scn_backoff_max)
+	__env_parse_int("HMNFD_SCN_BACKOFF_JITTER", &app_params.Scn_backoff_jitter)
+	__env_parse_int("HMNFD_SCN_BREAKER_THRESHOLD", &app_params.Scn_breaker_threshold)
+	__env_parse_int("HMNFD_SCN_BREAKER_COOLDOWN", &app_params.Scn_breaker_cooldown)
 	__env_parse_int("HMNFD_SCN_RETRIES", &app_params.Scn_retries)
+	if val, ok := os.LookupEnv("HMNFD_SCN_RETRY_ERRORS"); ok {
+		setRetryErrors("HMNFD_SCN_RETRY_ERRORS", val)
+	}
+	__env_parse_int("HMNFD_SCN_QUEUE_DEPTH", &app_params.Scn_queue_depth)
+	if val := os.Getenv("HMNFD_SCN_QUEUE_OVERFLOW"); val != "" {
+		setQueueOverflow("HMNFD_SCN_QUEUE_OVERFLOW", val)
+	}
+	__env_parse_int("HMNFD_SCN_IDLE_CONNS", &app_params.Scn_idle_conns)
+	__env_parse_int("HMNFD_SCN_IDLE_TIMEOUT", &app_params.Scn_idle_timeout)
+	__env_parse_string("HMNFD_SCN_TLS_CA", &app_params.Scn_tls_ca)
+	__env_parse_string("HMNFD_SCN_TLS_CERT", &app_params.Scn_tls_cert)
+	__env_parse_string("HMNFD_SCN_TLS_KEY", &app_params.Scn_tls_key)
+	__env_parse_bool("HMNFD_SCN_TLS_INSECURE", &app_params.Scn_tls_insecure)
+	if val := os.Getenv("HMNFD_SECRET_KEY_FILE"); val != "" {
+		err := loadSecretKeyFile(val)
+		if err != nil {
+			log.Printf("ERROR: invalid HMNFD_SECRET_KEY_FILE: %v\n", err)
+		}
+	}
+	__env_parse_bool("HMNFD_SEGMENTED_FANOUT", &app_params.Segmented_fanout)
 	__env_parse_int("HMNFD_SM_RETRIES", &app_params.SM_retries)
 	__env_parse_int("HMNFD_SM_TIMEOUT", &app_params.SM_timeout)
 	__env_parse_string("HMNFD_SM_URL", &app_params.SM_url)
 	__env_parse_string("HMNFD_TELEMETRY_HOST", &app_params.Telemetry_host)
+	if val := os.Getenv("HMNFD_TOKEN_DIR"); val != "" {
+		err := setTokenDir(val)
+		if err != nil {
+			log.Printf("ERROR: invalid HMNFD_TOKEN_DIR: %v\n", err)
+		}
+	}
 	__env_parse_int("HMNFD_USE_TELEMETRY", &app_params.Use_telemetry)
 
 	//Feature flags
@@ -436,6 +690,7 @@ func parseParamJson(param_json []byte, whence int) error {
 	var errstr string
 
 	unint := -1
+	unneg := math.MinInt32 //for fields which can't be negative, so -1 is seen
 	unstr := "xxx"
 	bad := 0
 	tpd = app_params
@@ -445,11 +700,28 @@ func parseParamJson(param_json []byte, whence int) error {
 	jdata.KV_url = unstr
 	jdata.Nosm = unint
 	jdata.Port = unint
+	jdata.Prune_interval = unint
+	jdata.Prune_telemetry = unint
+	jdata.Reconcile_interval = unint
+	jdata.Replica_url = unstr
 	jdata.Scn_in_url = unstr
 	jdata.Scn_max_cache = unint
 	jdata.Scn_cache_delay = unint
 	jdata.Scn_backoff = unint
+	jdata.Scn_backoff_max = unneg
+	jdata.Scn_backoff_jitter = unneg
+	jdata.Scn_breaker_threshold = unneg
+	jdata.Scn_breaker_cooldown = unneg
 	jdata.Scn_retries = unint
+	jdata.Scn_queue_depth = unneg
+	jdata.Scn_queue_overflow = unstr
+	jdata.Scn_idle_conns = unint
+	jdata.Scn_idle_timeout = unint
+	jdata.Scn_tls_ca = unstr
+	jdata.Scn_tls_cert = unstr
+	jdata.Scn_tls_key = unstr
+	jdata.Scn_tls_insecure = unint
+	jdata.Segmented_fanout = unint
 	jdata.SM_url = unstr
 	jdata.SM_retries = unint
 	jdata.SM_timeout = unint
@@ -494,15 +766,55 @@ func parseParamJson(param_json []byte, whence int) error {
 				fallthrough
 			case "scn_cache_delay":
 				fallthrough
+			case "prune_interval":
+				fallthrough
+			case "prune_telemetry":
+				fallthrough
+			case "reconcile_interval":
+				fallthrough
+			case "scn_queue_depth":
+				fallthrough
+			case "scn_backoff_max":
+				fallthrough
+			case "scn_backoff_jitter":
+				fallthrough
+			case "scn_breaker_threshold":
+				fallthrough
+			case "scn_breaker_cooldown":
+				fallthrough
+			case "scn_idle_conns":
+				fallthrough
+			case "scn_idle_timeout":
+				fallthrough
+			case "scn_tls_insecure":
+				fallthrough
+			case "segmented_fanout":
+				fallthrough
 			case "use_telemetry":
 				_, ok = v[nm].(float64)
 				break
+			case "prune_policy":
+				_, ok = v[nm].(map[string]interface{})
+				break
+			case "scn_retry_errors":
+				_, ok = v[nm].([]interface{})
+				break
 			case "kv_url":
 				fallthrough
 			case "scn_in_url":
 				fallthrough
+			case "replica_url":
+				fallthrough
 			case "sm_url":
 				fallthrough
+			case "scn_queue_overflow":
+				fallthrough
+			case "scn_tls_ca":
+				fallthrough
+			case "scn_tls_cert":
+				fallthrough
+			case "scn_tls_key":
+				fallthrough
 			case "telemetry_host":
 				_, ok = v[nm].(string)
 				break
@@ -530,6 +842,26 @@ func parseParamJson(param_json []byte, whence int) error {
 	if jdata.Nosm != unint {
 		tpd.Nosm = jdata.Nosm
 	}
+	if jdata.Prune_interval != unint {
+		tpd.Prune_interval = jdata.Prune_interval
+	}
+	if jdata.Prune_telemetry != unint {
+		tpd.Prune_telemetry = jdata.Prune_telemetry
+	}
+	if jdata.Prune_policy != nil {
+		perr := verifyPrunePolicy(jdata.Prune_policy)
+		if perr != nil {
+			s := fmt.Sprintf("Invalid Prune_policy: %v; ", perr)
+			log.Printf("%s\n", s)
+			errstr += s
+			bad = 1
+		} else {
+			tpd.Prune_policy = jdata.Prune_policy
+		}
+	}
+	if jdata.Reconcile_interval != unint {
+		tpd.Reconcile_interval = jdata.Reconcile_interval
+	}
 	if jdata.Scn_max_cache != unint {
 		tpd.Scn_max_cache = jdata.Scn_max_cache
 	}
@@ -539,9 +871,96 @@ func parseParamJson(param_json []byte, whence int) error {
 	if jdata.Scn_backoff != unint {
 		tpd.Scn_backoff = jdata.Scn_backoff
 	}
+	if jdata.Scn_backoff_max != unneg {
+		if jdata.Scn_backoff_max < 0 {
+			s := fmt.Sprintf("Invalid Scn_backoff_max: %d, can't be negative; ",
+				jdata.Scn_backoff_max)
+			log.Printf("%s\n", s)
+			errstr += s
+			bad = 1
+		} else {
+			tpd.Scn_backoff_max = jdata.Scn_backoff_max
+		}
+	}
+	if jdata.Scn_backoff_jitter != unneg {
+		if (jdata.Scn_backoff_jitter < 0) || (jdata.Scn_backoff_jitter > 100) {
+			s := fmt.Sprintf("Invalid Scn_backoff_jitter: %d, must be 0-100; ",
+				jdata.Scn_backoff_jitter)
+			log.Printf("%s\n", s)
+			errstr += s
+			bad = 1
+		} else {
+			tpd.Scn_backoff_jitter = jdata.Scn_backoff_jitter
+		}
+	}
+	if jdata.Scn_breaker_threshold != unneg {
+		if jdata.Scn_breaker_threshold < 0 {
+			s := fmt.Sprintf("Invalid Scn_breaker_threshold: %d, can't be negative; ",
+				jdata.Scn_breaker_threshold)
+			log.Printf("%s\n", s)
+			errstr += s
+			bad = 1
+		} else {
+			tpd.Scn_breaker_threshold = jdata.Scn_breaker_threshold
+		}
+	}
+	if jdata.Scn_breaker_cooldown != unneg {
+		if jdata.Scn_breaker_cooldown < 0 {
+			s := fmt.Sprintf("Invalid Scn_breaker_cooldown: %d, can't be negative; ",
+				jdata.Scn_breaker_cooldown)
+			log.Printf("%s\n", s)
+			errstr += s
+			bad = 1
+		} else {
+			tpd.Scn_breaker_cooldown = jdata.Scn_breaker_cooldown
+		}
+	}
 	if jdata.Scn_retries != unint {
 		tpd.Scn_retries = jdata.Scn_retries
 	}
+	if jdata.Scn_retry_errors != nil {
+		rclasses, rerr := verifyRetryErrors(jdata.Scn_retry_errors)
+		if rerr != nil {
+			s := fmt.Sprintf("Invalid Scn_retry_errors: %v; ", rerr)
+			log.Printf("%s\n", s)
+			errstr += s
+			bad = 1
+		} else {
+			tpd.Scn_retry_errors = rclasses
+		}
+	}
+	if jdata.Scn_queue_depth != unneg {
+		if jdata.Scn_queue_depth < 0 {
+			s := fmt.Sprintf("Invalid Scn_queue_depth: %d, can't be negative; ",
+				jdata.Scn_queue_depth)
+			log.Printf("%s\n", s)
+			errstr += s
+			bad = 1
+		} else {
+			tpd.Scn_queue_depth = jdata.Scn_queue_depth
+		}
+	}
+	if jdata.Scn_queue_overflow != unstr {
+		qp := verifyQueueOverflow(jdata.Scn_queue_overflow)
+		if qp == "" {
+			s := fmt.Sprintf("Invalid Scn_queue_overflow: '%s'; ",
+				jdata.Scn_queue_overflow)
+			log.Printf("%s\n", s)
+			errstr += s
+			bad = 1
+		} else {
+			tpd.Scn_queue_overflow = qp
+		}
+	}
+	if jdata.Scn_idle_conns != unint {
+		tpd.Scn_idle_conns = jdata.Scn_idle_conns
+	}
+	if jdata.Scn_idle_timeout != unint {
+		tpd.Scn_idle_timeout = jdata.Scn_idle_timeout
+	}
+	if jdata.Segmented_fanout != unint {
+		tpd.Segmented_fanout = jdata.Segmented_fanout
+	}
 	if jdata.SM_url != unstr {
 		tpd.SM_url = jdata.SM_url
 	}
@@ -580,6 +999,72 @@ func parseParamJson(param_json []byte, whence int) error {
 			tpd.Scn_in_url = jdata.Scn_in_url
 		}
 	}
+	if jdata.Replica_url != unstr {
+		if whence == PARAM_PATCH {
+			s := fmt.Sprintf("Parameter 'replica_url' can't be changed in PATCH operation; ")
+			log.Printf("%s\n", s)
+			errstr += s
+			bad = 1
+		} else {
+			tpd.Replica_url = jdata.Replica_url
+		}
+	}
+	if jdata.Scn_tls_ca != unstr {
+		if whence == PARAM_PATCH {
+			s := fmt.Sprintf("Parameter 'scn_tls_ca' can't be changed in PATCH operation; ")
+			log.Printf("%s\n", s)
+			errstr += s
+			bad = 1
+		} else {
+			tpd.Scn_tls_ca = jdata.Scn_tls_ca
+		}
+	}
+	if jdata.Scn_tls_cert != unstr {
+		if whence == PARAM_PATCH {
+			s := fmt.Sprintf("Parameter 'scn_tls_cert' can't be changed in PATCH operation; ")
+			log.Printf("%s\n", s)
+			errstr += s
+			bad = 1
+		} else {
+			tpd.Scn_tls_cert = jdata.Scn_tls_cert
+		}
+	}
+	if jdata.Scn_tls_key != unstr {
+		if whence == PARAM_PATCH {
+			s := fmt.Sprintf("Parameter 'scn_tls_key' can't be changed in PATCH operation; ")
+			log.Printf("%s\n", s)
+			errstr += s
+			bad = 1
+		} else {
+			tpd.Scn_tls_key = jdata.Scn_tls_key
+		}
+	}
+	if jdata.Scn_tls_insecure != unint {
+		if whence == PARAM_PATCH {
+			s := fmt.Sprintf("Parameter 'scn_tls_insecure' can't be changed in PATCH operation; ")
+			log.Printf("%s\n", s)
+			errstr += s
+			bad = 1
+		} else {
+			tpd.Scn_tls_insecure = jdata.Scn_tls_insecure
+		}
+	}
+
+	//Delivery transport changes are checked by building the new transport,
+	//which is put in place along with the new parameters.
+
+	var dtr *http.Transport
+	if deliveryTransportChanged(&app_params, &tpd) {
+		var derr error
+		dtr, derr = newDeliveryTransport(&tpd)
+		if derr != nil {
+			s := fmt.Sprintf("Invalid SCN delivery TLS/connection parameters: %v; ",
+				derr)
+			log.Printf("%s\n", s)
+			errstr += s
+			bad = 1
+		}
+	}
 
 	if bad != 0 {
 		rerr := fmt.Errorf("%s", errstr)
@@ -587,6 +1072,10 @@ func parseParamJson(param_json []byte, whence int) error {
 	}
 
 	app_params = tpd
+	setScnCacheDelay(app_params.Scn_cache_delay)
+	if dtr != nil {
+		setDeliveryTransport(dtr)
+	}
 	if whence == PARAM_START {
 		server_url.url_port = app_params.Port
 	}
@@ -643,13 +1132,14 @@ func telebusConnect() {
 }
 
 /////////////////////////////////////////////////////////////////////////////
-// Subscribe to important SCNs from the State Manager, used for subscription
-// pruning.
+// Create the subscription for important SCNs from the State Manager, used
+// for subscription pruning.  These are always part of the HSM subscription.
 //
-// Args, Return: None.
+// Args:   None.
+// Return: Mandatory SCN subscription.
 /////////////////////////////////////////////////////////////////////////////
 
-func subscribeMandatoryScn() {
+func mandatoryScnSubscription() ScnSubscribe {
 	//TODO: this should be discoverable from hss/base
 	var scnStates = []string{base.StateEmpty.String(),
 		base.StatePopulated.String(),
@@ -669,8 +1159,7 @@ func subscribeMandatoryScn() {
 		Roles:   scnRoles,
 	}
 
-	log.Printf("Auto-subscribing to SCNs.\n")
-	hsmsub_chan <- scn
+	return scn
 }
 
 /////////////////////////////////////////////////////////////////////////////
@@ -680,18 +1169,39 @@ func subscribeMandatoryScn() {
 /////////////////////////////////////////////////////////////////////////////
 
 func print_app_params() {
-	log.Printf("Debug:          %d\n", app_params.Debug)
-	log.Printf("Nosm:           %d\n", app_params.Nosm)
-	log.Printf("KV_url:         %s\n", app_params.KV_url)
-	log.Printf("Port:           %d\n", app_params.Port)
-	log.Printf("Scn_in_url:     %s\n", app_params.Scn_in_url)
-	log.Printf("Scn_backoff:    %d\n", app_params.Scn_backoff)
-	log.Printf("Scn_retries:    %d\n", app_params.Scn_retries)
-	log.Printf("SM_retries:     %d\n", app_params.SM_retries)
-	log.Printf("SM_timeout:     %d\n", app_params.SM_timeout)
-	log.Printf("SM_url:         %s\n", app_params.SM_url)
-	log.Printf("Telemetry_host: %s\n", app_params.Telemetry_host)
-	log.Printf("Use_telemetry:  %d\n", app_params.Use_telemetry)
+	log.Printf("Debug:            %d\n", app_params.Debug)
+	log.Printf("Nosm:             %d\n", app_params.Nosm)
+	log.Printf("KV_url:           %s\n", app_params.KV_url)
+	log.Printf("Port:             %d\n", app_params.Port)
+	log.Printf("Prune_interval:   %d\n", app_params.Prune_interval)
+	if ba, err := json.Marshal(prunePolicy()); err == nil {
+		log.Printf("Prune_policy:     %s\n", string(ba))
+	}
+	log.Printf("Prune_telemetry:  %d\n", app_params.Prune_telemetry)
+	log.Printf("Reconcile_interval: %d\n", app_params.Reconcile_interval)
+	log.Printf("Replica_url:      %s\n", app_params.Replica_url)
+	log.Printf("Scn_in_url:       %s\n", app_params.Scn_in_url)
+	log.Printf("Scn_backoff:      %d\n", app_params.Scn_backoff)
+	log.Printf("Scn_backoff_max:  %d\n", app_params.Scn_backoff_max)
+	log.Printf("Scn_backoff_jitter: %d\n", app_params.Scn_backoff_jitter)
+	log.Printf("Scn_breaker_threshold: %d\n", app_params.Scn_breaker_threshold)
+	log.Printf("Scn_breaker_cooldown: %d\n", app_params.Scn_breaker_cooldown)
+	log.Printf("Scn_retries:      %d\n", app_params.Scn_retries)
+	log.Printf("Scn_retry_errors: %s\n", strings.Join(retryErrors(), ","))
+	log.Printf("Scn_queue_depth:  %d\n", app_params.Scn_queue_depth)
+	log.Printf("Scn_queue_overflow: %s\n", app_params.Scn_queue_overflow)
+	log.Printf("Scn_idle_conns:   %d\n", app_params.Scn_idle_conns)
+	log.Printf("Scn_idle_timeout: %d\n", app_params.Scn_idle_timeout)
+	log.Printf("Scn_tls_ca:       %s\n", app_params.Scn_tls_ca)
+	log.Printf("Scn_tls_cert:     %s\n", app_params.Scn_tls_cert)
+	log.Printf("Scn_tls_key:      %s\n", app_params.Scn_tls_key)
+	log.Printf("Scn_tls_insecure: %d\n", app_params.Scn_tls_insecure)
+	log.Printf("Segmented_fanout: %d\n", app_params.Segmented_fanout)
+	log.Printf("SM_retries:       %d\n", app_params.SM_retries)
+	log.Printf("SM_timeout:       %d\n", app_params.SM_timeout)
+	log.Printf("SM_url:           %s\n", app_params.SM_url)
+	log.Printf("Telemetry_host:   %s\n", app_params.Telemetry_host)
+	log.Printf("Use_telemetry:    %d\n", app_params.Use_telemetry)
 }
 
 /////////////////////////////////////////////////////////////////////////////
@@ -820,6 +1330,9 @@ func main() {
 	if app_params.Scn_in_url == "" {
 		app_params.Scn_in_url = server_url.full_url + URL_DELIM + URL_SCN
 	}
+	if app_params.Replica_url == "" {
+		app_params.Replica_url = makeReplicaUrl()
+	}
 
 	if app_params.Debug > 2 {
 		log.Println("server_url: ", server_url.full_url)
@@ -840,6 +1353,10 @@ func main() {
 			time.Second),
 	}
 
+	// SCN deliveries to subscribers have their own transport
+
+	setupDeliveryTransport()
+
 	// KV store connection
 
 	openKV()
@@ -850,19 +1367,24 @@ func main() {
 	go subscribeToHsmScn() //HSM subscriber thread
 	go prune()             //subscription prune checker
 	go telemetryBusSend()  //service the telemetry bus send requests
-	go pruneDeadWood()     //check against component states, prune down nodes
 	go handleSCNs()
+	go handleFanoutSCNs()
+	go snapshotBatcher()
+	go reconcileComponents()
+	go pruneSweeper()
+	go suspendResumer()
+	go pruneDecisionPublisher()
+	go pruneDecisionWatcher()
+	setScnCacheDelay(app_params.Scn_cache_delay)
 	go checkSCNCache()
+	go replicaHeartbeat() //segmented fanout replica membership
+	go leaderElection()   //singleton tasks run only in the leader
 
 	//Fire up worker pool
 
 	scnWorkPool = base.NewWorkerPool(500, 10000)
 	scnWorkPool.Run()
 
-	//Subscribe to SCNs from HSM that are mandatory for operation
-
-	subscribeMandatoryScn()
-
 	log.Printf("Listening on port %d", server_url.url_port)
 	log.Printf("URLs:")
 	log.Printf("    %s", URL_DELIM+server_url.url_root+
@@ -886,12 +1408,25 @@ func main() {
 	log.Printf("    %s", URL_DELIM+server_url.url_root+
 		URL_DELIM+server_url.url_version+
 		URL_DELIM+URL_HEALTH)
+	log.Printf("    %s", URL_DELIM+server_url.url_root+
+		URL_DELIM+server_url.url_version+
+		URL_DELIM+URL_FANOUT)
+	log.Printf("    %s", URL_DELIM+server_url.url_root+
+		URL_DELIM+server_url.url_version+
+		URL_DELIM+URL_PRUNES)
+	log.Printf("    %s", URL_DELIM+server_url.url_root+
+		URL_DELIM+server_url.url_version+
+		URL_DELIM+URL_DEADLETTERS)
+	log.Printf("    %s", URL_DELIM+server_url.url_root+
+		URL_DELIM+server_url.url_version+
+		URL_DELIM+URL_STREAM)
 
 	routes := generateRoutes()
 	router := newRouter(routes)
 
 	port := fmt.Sprintf(":%d", server_url.url_port)
 	srv := &http.Server{Addr: port, Handler: router}
+	srv.RegisterOnShutdown(closeStreams) //streams never go idle on their own
 
 	//Set up signal handling for graceful kill
 
@@ -903,6 +1438,11 @@ func main() {
 		<-c
 		Running = false
 
+		//Let the other replicas take over our subscribers and singleton
+		//tasks right away
+		replicaLeave()
+		leaderResign()
+
 		//Gracefully shutdown the HTTP server
 		lerr := srv.Shutdown(context.Background())
 		if lerr != nil {
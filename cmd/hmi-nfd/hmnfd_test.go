@@ -1,6 +1,6 @@
 // MIT License
 //
-// (C) Copyright [2019, 2021] Hewlett Packard Enterprise Development LP
+// (C) Copyright [2019, 2021, 2026] Hewlett Packard Enterprise Development LP
 //
 // Permission is hereby granted, free of charge, to any person obtaining a
 // copy of this software and associated documentation files (the "Software"),
@@ -35,9 +35,22 @@ type ppj struct {
 	errstr string
 }
 
-var param_exp = `{"Debug":1,"KV_url":"a.b.c.d","Nosm":1,"Port":1234,"Scn_in_url":"e.f.g.h","Scn_max_cache":56,"Scn_cache_delay":78,"Scn_retries":6,"Scn_backoff":2,"SM_retries":12,"SM_timeout":34,"SM_url":"e.f.g.h","Telemetry_host":"aaaa:1234:bbbb","Use_telemetry":0}`
+var param_exp = `{"Debug":1,"KV_url":"a.b.c.d","Nosm":1,"Port":1234,"Prune_interval":45,"Prune_policy":{"DryRun":true,"Components":{"States":["Off"],"Flags":["Alert"],"DeliveryErrors":["RetriesExhausted"]},"Services":{"DeliveryErrors":["ConnectionRefused"]}},"Prune_telemetry":1,"Reconcile_interval":90,"Replica_url":"i.j.k.l","Scn_in_url":"e.f.g.h","Scn_max_cache":56,"Scn_cache_delay":78,"Scn_retries":6,"Scn_backoff":2,"Scn_backoff_max":40,"Scn_backoff_jitter":20,"Scn_breaker_threshold":3,"Scn_breaker_cooldown":15,"Scn_retry_errors":["Timeout","ServerError"],"Scn_queue_depth":25,"Scn_queue_overflow":"Suspend","Scn_idle_conns":8,"Scn_idle_timeout":60,"Scn_tls_ca":"","Scn_tls_cert":"","Scn_tls_key":"","Scn_tls_insecure":1,"Segmented_fanout":1,"SM_retries":12,"SM_timeout":34,"SM_url":"e.f.g.h","Telemetry_host":"aaaa:1234:bbbb","Use_telemetry":0}`
 
-var param_inp_patch = `{"Debug":1,"KV_url":"a.b.c.d","Nosm":1,"SM_retries":12,"SM_timeout":34,"SM_url":"e.f.g.h","Scn_max_cache":56,"Scn_cache_delay":78,"Scn_retries":6,"Scn_backoff":2}`
+var policy_inp = `{"DryRun":true,"Components":{"States":["off"],"Flags":["alert"],"DeliveryErrors":["retriesexhausted"]},"Services":{"DeliveryErrors":["ConnectionRefused"]}}`
+
+var param_inp_patch = `{"Debug":1,"KV_url":"a.b.c.d","Nosm":1,"Prune_interval":45,"Prune_policy":{"DryRun":true,"Components":{"States":["off"],"Flags":["ALERT"],"DeliveryErrors":["retriesexhausted"]},"Services":{"DeliveryErrors":["connectionrefused"]}},"Prune_telemetry":1,"Reconcile_interval":90,"SM_retries":12,"SM_timeout":34,"SM_url":"e.f.g.h","Scn_max_cache":56,"Scn_cache_delay":78,"Scn_retries":6,"Scn_backoff":2,"Scn_backoff_max":40,"Scn_backoff_jitter":20,"Scn_breaker_threshold":3,"Scn_breaker_cooldown":15,"Scn_retry_errors":["timeout","SERVERERROR"],"Scn_queue_depth":25,"Scn_queue_overflow":"suspend","Scn_idle_conns":8,"Scn_idle_timeout":60,"Segmented_fanout":1}`
+
+// Write the test prune policy to a file.
+
+func policyFile(t *testing.T) string {
+	fname := t.TempDir() + "/policy.json"
+	err := ioutil.WriteFile(fname, []byte(policy_inp), 0644)
+	if err != nil {
+		t.Fatal("Can't write prune policy file:", err)
+	}
+	return fname
+}
 
 func disable_logs() {
 	log.SetFlags(0)
@@ -55,11 +68,44 @@ func TestGenCurParamJson(t *testing.T) {
 	app_params.KV_url = "a.b.c.d"
 	app_params.Nosm = 1
 	app_params.Port = 1234
+	app_params.Prune_interval = 45
+	app_params.Prune_policy = &PrunePolicy{DryRun: true,
+		Components: PruneRule{States: []string{"Off"}, Flags: []string{"Alert"},
+			DeliveryErrors: []string{"RetriesExhausted"}},
+		Services: PruneRule{DeliveryErrors: []string{"ConnectionRefused"}},
+	}
+	defer func() {
+		app_params.Prune_policy = nil
+		app_params.Scn_queue_depth = SCN_QUEUE_DEPTH
+		app_params.Scn_queue_overflow = QUEUE_OVERFLOW_COALESCE
+		app_params.Scn_backoff_max = SCN_BACKOFF_MAX
+		app_params.Scn_backoff_jitter = SCN_JITTER
+		app_params.Scn_breaker_threshold = SCN_BREAKER_THRESHOLD
+		app_params.Scn_breaker_cooldown = SCN_BREAKER_COOLDOWN
+		app_params.Scn_retry_errors = defaultRetryErrors()
+		app_params.Scn_idle_conns = SCN_IDLE_CONNS
+		app_params.Scn_idle_timeout = SCN_IDLE_TIMEOUT
+		app_params.Scn_tls_insecure = 0
+	}()
+	app_params.Prune_telemetry = 1
+	app_params.Reconcile_interval = 90
+	app_params.Replica_url = "i.j.k.l"
 	app_params.Scn_in_url = "e.f.g.h"
 	app_params.Scn_max_cache = 56
 	app_params.Scn_cache_delay = 78
 	app_params.Scn_backoff = 2
 	app_params.Scn_retries = 6
+	app_params.Scn_backoff_max = 40
+	app_params.Scn_backoff_jitter = 20
+	app_params.Scn_breaker_threshold = 3
+	app_params.Scn_breaker_cooldown = 15
+	app_params.Scn_retry_errors = []string{"Timeout", "ServerError"}
+	app_params.Scn_queue_depth = 25
+	app_params.Scn_queue_overflow = QUEUE_OVERFLOW_SUSPEND
+	app_params.Scn_idle_conns = 8
+	app_params.Scn_idle_timeout = 60
+	app_params.Scn_tls_insecure = 1
+	app_params.Segmented_fanout = 1
 	app_params.SM_retries = 12
 	app_params.SM_timeout = 34
 	app_params.SM_url = "e.f.g.h"
@@ -79,11 +125,31 @@ func TestGenCurParamJson(t *testing.T) {
 func TestParseCmdLine(t *testing.T) {
 	disable_logs()
 	app_params = opParams{} //reset to all 0
+	defer func() {
+		app_params.Prune_policy = nil
+		app_params.Scn_queue_depth = SCN_QUEUE_DEPTH
+		app_params.Scn_queue_overflow = QUEUE_OVERFLOW_COALESCE
+		app_params.Scn_backoff_max = SCN_BACKOFF_MAX
+		app_params.Scn_backoff_jitter = SCN_JITTER
+		app_params.Scn_breaker_threshold = SCN_BREAKER_THRESHOLD
+		app_params.Scn_breaker_cooldown = SCN_BREAKER_COOLDOWN
+		app_params.Scn_retry_errors = defaultRetryErrors()
+		app_params.Scn_idle_conns = SCN_IDLE_CONNS
+		app_params.Scn_idle_timeout = SCN_IDLE_TIMEOUT
+		app_params.Scn_tls_insecure = 0
+	}()
 
 	os.Args = []string{"app", "--debug=1", "--kv_url=a.b.c.d", "--nosm",
-		"--port=1234", "--scn_in_url=e.f.g.h",
-		"--scn_max_cache=56", "--scn_cache_delay=78",
-		"--scn_backoff=2", "--scn_retries=6",
+		"--port=1234", "--prune_interval=45",
+		"--prune_policy_file=" + policyFile(t), "--prune_telemetry",
+		"--reconcile_interval=90", "--replica_url=i.j.k.l",
+		"--scn_in_url=e.f.g.h", "--scn_max_cache=56", "--scn_cache_delay=78",
+		"--scn_backoff=2", "--scn_retries=6", "--scn_backoff_max=40",
+		"--scn_backoff_jitter=20", "--scn_breaker_threshold=3",
+		"--scn_breaker_cooldown=15", "--scn_retry_errors=TIMEOUT, servererror",
+		"--scn_queue_depth=25",
+		"--scn_queue_overflow=SUSPEND", "--scn_idle_conns=8",
+		"--scn_idle_timeout=60", "--scn_tls_insecure", "--segmented_fanout",
 		"--sm_retries=12", "--sm_timeout=34",
 		"--sm_url=e.f.g.h", "--telemetry_host=aaaa:1234:bbbb",
 		"--use_telemetry=0"}
@@ -102,16 +168,46 @@ func TestParseCmdLine(t *testing.T) {
 func TestParseEnvVars(t *testing.T) {
 	disable_logs()
 	app_params = opParams{} //reset to all 0
+	defer func() {
+		app_params.Prune_policy = nil
+		app_params.Scn_queue_depth = SCN_QUEUE_DEPTH
+		app_params.Scn_queue_overflow = QUEUE_OVERFLOW_COALESCE
+		app_params.Scn_backoff_max = SCN_BACKOFF_MAX
+		app_params.Scn_backoff_jitter = SCN_JITTER
+		app_params.Scn_breaker_threshold = SCN_BREAKER_THRESHOLD
+		app_params.Scn_breaker_cooldown = SCN_BREAKER_COOLDOWN
+		app_params.Scn_retry_errors = defaultRetryErrors()
+		app_params.Scn_idle_conns = SCN_IDLE_CONNS
+		app_params.Scn_idle_timeout = SCN_IDLE_TIMEOUT
+		app_params.Scn_tls_insecure = 0
+	}()
+	defer os.Unsetenv("HMNFD_PRUNE_POLICY_FILE")
 
 	os.Setenv("HMNFD_DEBUG", "1")
 	os.Setenv("HMNFD_KV_URL", "a.b.c.d")
 	os.Setenv("HMNFD_NOSM", "1")
 	os.Setenv("HMNFD_PORT", "1234")
+	os.Setenv("HMNFD_PRUNE_INTERVAL", "45")
+	os.Setenv("HMNFD_PRUNE_POLICY_FILE", policyFile(t))
+	os.Setenv("HMNFD_PRUNE_TELEMETRY", "1")
+	os.Setenv("HMNFD_RECONCILE_INTERVAL", "90")
+	os.Setenv("HMNFD_REPLICA_URL", "i.j.k.l")
 	os.Setenv("HMNFD_SCN_IN_URL", "e.f.g.h")
 	os.Setenv("HMNFD_SCN_MAX_CACHE", "56")
 	os.Setenv("HMNFD_SCN_CACHE_DELAY", "78")
 	os.Setenv("HMNFD_SCN_BACKOFF", "2")
 	os.Setenv("HMNFD_SCN_RETRIES", "6")
+	os.Setenv("HMNFD_SCN_BACKOFF_MAX", "40")
+	os.Setenv("HMNFD_SCN_BACKOFF_JITTER", "20")
+	os.Setenv("HMNFD_SCN_BREAKER_THRESHOLD", "3")
+	os.Setenv("HMNFD_SCN_BREAKER_COOLDOWN", "15")
+	os.Setenv("HMNFD_SCN_RETRY_ERRORS", "timeout,ServerError")
+	os.Setenv("HMNFD_SCN_QUEUE_DEPTH", "25")
+	os.Setenv("HMNFD_SCN_QUEUE_OVERFLOW", "suspend")
+	os.Setenv("HMNFD_SCN_IDLE_CONNS", "8")
+	os.Setenv("HMNFD_SCN_IDLE_TIMEOUT", "60")
+	os.Setenv("HMNFD_SCN_TLS_INSECURE", "yes")
+	os.Setenv("HMNFD_SEGMENTED_FANOUT", "1")
 	os.Setenv("HMNFD_SM_RETRIES", "12")
 	os.Setenv("HMNFD_SM_TIMEOUT", "34")
 	os.Setenv("HMNFD_SM_URL", "e.f.g.h")
@@ -131,6 +227,20 @@ func TestParseEnvVars(t *testing.T) {
 
 func TestParseParamJson(t *testing.T) {
 	app_params = opParams{} //reset to all 0
+	defer func() {
+		app_params.Prune_policy = nil
+		app_params.Scn_queue_depth = SCN_QUEUE_DEPTH
+		app_params.Scn_queue_overflow = QUEUE_OVERFLOW_COALESCE
+		app_params.Scn_backoff_max = SCN_BACKOFF_MAX
+		app_params.Scn_backoff_jitter = SCN_JITTER
+		app_params.Scn_breaker_threshold = SCN_BREAKER_THRESHOLD
+		app_params.Scn_breaker_cooldown = SCN_BREAKER_COOLDOWN
+		app_params.Scn_retry_errors = defaultRetryErrors()
+		app_params.Scn_idle_conns = SCN_IDLE_CONNS
+		app_params.Scn_idle_timeout = SCN_IDLE_TIMEOUT
+		app_params.Scn_tls_insecure = 0
+		setDeliveryTransport(nil)
+	}()
 	var ba []byte
 	var err error
 
@@ -159,11 +269,13 @@ func TestParseParamJson(t *testing.T) {
 	app_params.KV_url = "a.b.c.d"
 	app_params.Nosm = 1
 	app_params.Port = 1234
+	app_params.Replica_url = "i.j.k.l"
 	app_params.Scn_in_url = "e.f.g.h"
 	app_params.Scn_max_cache = 56
 	app_params.Scn_cache_delay = 78
 	app_params.Scn_backoff = 2
 	app_params.Scn_retries = 6
+	app_params.Scn_tls_insecure = 1
 	app_params.SM_retries = 12
 	app_params.SM_timeout = 34
 	app_params.SM_url = "e.f.g.h"
@@ -215,6 +327,102 @@ func TestParseParamJson(t *testing.T) {
 			raw:    []byte("{\"Scn_cache_delay\":\"1234\"}"),
 			errstr: "Invalid data type in Scn_cache_delay field. ",
 		},
+		{name: "Replica_url",
+			raw:    []byte("{\"Replica_url\":1234}"),
+			errstr: "Invalid data type in Replica_url field. ",
+		},
+		{name: "Prune_interval",
+			raw:    []byte("{\"Prune_interval\":\"45\"}"),
+			errstr: "Invalid data type in Prune_interval field. ",
+		},
+		{name: "Prune_policy",
+			raw:    []byte("{\"Prune_policy\":\"x\"}"),
+			errstr: "Invalid data type in Prune_policy field. ",
+		},
+		{name: "Prune_telemetry",
+			raw:    []byte("{\"Prune_telemetry\":\"1\"}"),
+			errstr: "Invalid data type in Prune_telemetry field. ",
+		},
+		{name: "Reconcile_interval",
+			raw:    []byte("{\"Reconcile_interval\":\"90\"}"),
+			errstr: "Invalid data type in Reconcile_interval field. ",
+		},
+		{name: "Scn_backoff_max",
+			raw:    []byte("{\"Scn_backoff_max\":\"40\"}"),
+			errstr: "Invalid data type in Scn_backoff_max field. ",
+		},
+		{name: "Scn_backoff_jitter",
+			raw:    []byte("{\"Scn_backoff_jitter\":\"20\"}"),
+			errstr: "Invalid data type in Scn_backoff_jitter field. ",
+		},
+		{name: "Scn_backoff_jitter range",
+			raw:    []byte("{\"Scn_backoff_jitter\":150}"),
+			errstr: "Invalid Scn_backoff_jitter: 150, must be 0-100; ",
+		},
+		{name: "Scn_backoff_max negative",
+			raw:    []byte("{\"Scn_backoff_max\":-1}"),
+			errstr: "Invalid Scn_backoff_max: -1, can't be negative; ",
+		},
+		{name: "Scn_backoff_jitter negative",
+			raw:    []byte("{\"Scn_backoff_jitter\":-1}"),
+			errstr: "Invalid Scn_backoff_jitter: -1, must be 0-100; ",
+		},
+		{name: "Scn_breaker_threshold negative",
+			raw:    []byte("{\"Scn_breaker_threshold\":-1}"),
+			errstr: "Invalid Scn_breaker_threshold: -1, can't be negative; ",
+		},
+		{name: "Scn_breaker_cooldown negative",
+			raw:    []byte("{\"Scn_breaker_cooldown\":-5}"),
+			errstr: "Invalid Scn_breaker_cooldown: -5, can't be negative; ",
+		},
+		{name: "Scn_queue_depth negative",
+			raw:    []byte("{\"Scn_queue_depth\":-1}"),
+			errstr: "Invalid Scn_queue_depth: -1, can't be negative; ",
+		},
+		{name: "Scn_breaker_threshold",
+			raw:    []byte("{\"Scn_breaker_threshold\":\"3\"}"),
+			errstr: "Invalid data type in Scn_breaker_threshold field. ",
+		},
+		{name: "Scn_breaker_cooldown",
+			raw:    []byte("{\"Scn_breaker_cooldown\":\"15\"}"),
+			errstr: "Invalid data type in Scn_breaker_cooldown field. ",
+		},
+		{name: "Scn_retry_errors",
+			raw:    []byte("{\"Scn_retry_errors\":\"Timeout\"}"),
+			errstr: "Invalid data type in Scn_retry_errors field. ",
+		},
+		{name: "Scn_retry_errors class",
+			raw:    []byte("{\"Scn_retry_errors\":[\"Bogus\"]}"),
+			errstr: "Invalid Scn_retry_errors: invalid delivery error class 'Bogus'; ",
+		},
+		{name: "Scn_queue_depth",
+			raw:    []byte("{\"Scn_queue_depth\":\"25\"}"),
+			errstr: "Invalid data type in Scn_queue_depth field. ",
+		},
+		{name: "Scn_queue_overflow",
+			raw:    []byte("{\"Scn_queue_overflow\":1}"),
+			errstr: "Invalid data type in Scn_queue_overflow field. ",
+		},
+		{name: "Scn_idle_conns",
+			raw:    []byte("{\"Scn_idle_conns\":\"8\"}"),
+			errstr: "Invalid data type in Scn_idle_conns field. ",
+		},
+		{name: "Scn_tls_ca",
+			raw:    []byte("{\"Scn_tls_ca\":1}"),
+			errstr: "Invalid data type in Scn_tls_ca field. ",
+		},
+		{name: "Scn_tls_ca file",
+			raw:    []byte("{\"Scn_tls_ca\":\"/nonexistent/ca.pem\"}"),
+			errstr: "Invalid SCN delivery TLS/connection parameters: can't read CA bundle '/nonexistent/ca.pem': open /nonexistent/ca.pem: no such file or directory; ",
+		},
+		{name: "Scn_tls_cert without key",
+			raw:    []byte("{\"Scn_tls_cert\":\"/nonexistent/cert.pem\"}"),
+			errstr: "Invalid SCN delivery TLS/connection parameters: client certificate and key must both be set; ",
+		},
+		{name: "Segmented_fanout",
+			raw:    []byte("{\"Segmented_fanout\":\"1\"}"),
+			errstr: "Invalid data type in Segmented_fanout field. ",
+		},
 		{name: "SM_url",
 			raw:    []byte("{\"SM_url\":1234}"),
 			errstr: "Invalid data type in SM_url field. ",
@@ -236,4 +444,43 @@ func TestParseParamJson(t *testing.T) {
 				vv.name, vv.errstr, err.Error())
 		}
 	}
+
+	//Startup-only parameters can't be PATCHed.
+
+	vectors = []ppj{
+		{name: "Replica_url",
+			raw:    []byte("{\"Replica_url\":\"i.j.k.l\"}"),
+			errstr: "Parameter 'replica_url' can't be changed in PATCH operation; ",
+		},
+		{name: "Scn_tls_ca",
+			raw:    []byte("{\"Scn_tls_ca\":\"/etc/hmnfd/ca.pem\"}"),
+			errstr: "Parameter 'scn_tls_ca' can't be changed in PATCH operation; ",
+		},
+		{name: "Scn_tls_cert",
+			raw:    []byte("{\"Scn_tls_cert\":\"/etc/hmnfd/tls.crt\"}"),
+			errstr: "Parameter 'scn_tls_cert' can't be changed in PATCH operation; ",
+		},
+		{name: "Scn_tls_key",
+			raw:    []byte("{\"Scn_tls_key\":\"/etc/hmnfd/tls.key\"}"),
+			errstr: "Parameter 'scn_tls_key' can't be changed in PATCH operation; ",
+		},
+		{name: "Scn_tls_insecure",
+			raw:    []byte("{\"Scn_tls_insecure\":0}"),
+			errstr: "Parameter 'scn_tls_insecure' can't be changed in PATCH operation; ",
+		},
+	}
+
+	for _, vv := range vectors {
+		err = parseParamJson(vv.raw, PARAM_PATCH)
+		if err == nil {
+			t.Fatalf("Unexpected pass of parseParamJson() PATCH of %s.", vv.name)
+		}
+		if err.Error() != vv.errstr {
+			t.Errorf("Mismatch %s error string, expected: '%s', got: '%s'\n",
+				vv.name, vv.errstr, err.Error())
+		}
+	}
+	if app_params.Scn_tls_insecure != 1 {
+		t.Errorf("Rejected PATCH changed Scn_tls_insecure.")
+	}
 }
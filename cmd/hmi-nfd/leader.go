@@ -0,0 +1,525 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+// A note about leader election:
+//
+// Some background tasks must only run in one hmnfd replica at a time:
+// HSM SCN subscriptions, dead subscriber sweeps, and deletion of pruned
+// subscription records.  One replica is elected leader using an ETCD
+// election, and only the leader runs these tasks.
+//
+// Each candidate's election key is bound to the lease of its own ETCD
+// session, which is kept alive for as long as the replica is running.  If
+// the leader dies or can't reach ETCD, its lease expires, ETCD deletes its
+// key, and the next candidate becomes leader.  The leader watches its
+// session and steps down as soon as it is lost, so two replicas never both
+// act as leader for longer than it takes to notice.  As a backstop, the
+// leader also steps down if the election ever names another replica.
+//
+// A "mem:" KV store means a single replica, which always elects itself.
+//
+// Non-leader replicas still detect subscribers which need pruning.  These
+// are handed to the leader via prune request keys in ETCD.  A non-leader
+// keeps its own prune map entries, and sends nothing to those subscribers,
+// until the leader has acted on the requests and removed them.  Subscription
+// changes made via non-leaders are picked up by the leader's periodic
+// HSM subscription reconcile.
+
+/////////////////////////////////////////////////////////////////////////////
+// Constants
+/////////////////////////////////////////////////////////////////////////////
+
+const (
+	LEADER_KEY               = "hmnfd_leader"
+	LEADER_LOCK_TTL          = 10 //seconds; session lease and campaign timeout
+	LEADER_CHECK_INTERVAL    = 5  //seconds between leadership checks
+	LEADER_RESCAN_INTERVAL   = 10 //seconds between HSM subscription reconciles
+	PRUNE_REQ_KEY_PREFIX     = "prunereq#"
+	PRUNE_REQ_KEYRANGE_START = "prunereq#"
+	PRUNE_REQ_KEYRANGE_END   = "prunereq#~"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Global Variables
+/////////////////////////////////////////////////////////////////////////////
+
+var leaderElect leaderElector //protected by leaderMutex
+var amLeader = false
+var leaderMutex = &sync.RWMutex{}
+var prunerequested = make(map[string]bool) //protected by prunemap_mutex
+var leaderLastScan time.Time
+var leaderLastVerify time.Time
+
+/////////////////////////////////////////////////////////////////////////////
+// Data Structures
+/////////////////////////////////////////////////////////////////////////////
+
+// Leader election backend.
+
+type leaderElector interface {
+	campaign(tosec int) error //become leader, or fail after tosec seconds
+	leader() (string, error)  //current leader, "" if none
+	lost() <-chan struct{}    //closed if leadership is lost
+	resign() error
+}
+
+// ETCD election.  Candidate keys are bound to the session's lease.
+
+type etcdElector struct {
+	client   *clientv3.Client
+	session  *concurrency.Session
+	election *concurrency.Election
+	mutex    sync.Mutex
+}
+
+// Single replica election, for "mem:" KV stores.  The leader is kept in the
+// main KV store so it can be reported.
+
+type memElector struct {
+	lostc chan struct{}
+	mutex sync.Mutex
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Create the leader election backend for a KV store URL.
+//
+// kvurl(in): KV store URL.
+// Return:    Leader election backend; nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func newLeaderElector(kvurl string) (leaderElector, error) {
+	if strings.HasPrefix(kvurl, "mem:") {
+		return &memElector{}, nil
+	}
+	cli, err := clientv3.New(clientv3.Config{Endpoints: []string{kvurl},
+		DialTimeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &etcdElector{client: cli}, nil
+}
+
+// Campaign to become leader, with a new session if the last one was lost.
+
+func (le *etcdElector) campaign(tosec int) error {
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+
+	if le.session != nil {
+		select {
+		case <-le.session.Done():
+			le.session = nil
+		default:
+		}
+	}
+	if le.session == nil {
+		sess, err := concurrency.NewSession(le.client,
+			concurrency.WithTTL(LEADER_LOCK_TTL))
+		if err != nil {
+			return err
+		}
+		le.session = sess
+		le.election = concurrency.NewElection(sess, LEADER_KEY)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(tosec)*time.Second)
+	defer cancel()
+	return le.election.Campaign(ctx, serviceName)
+}
+
+// Get the current leader: the candidate with the oldest key.
+
+func (le *etcdElector) leader() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rsp, err := le.client.Get(ctx, LEADER_KEY+"/", clientv3.WithFirstCreate()...)
+	if err != nil {
+		return "", err
+	}
+	if len(rsp.Kvs) == 0 {
+		return "", nil
+	}
+	return string(rsp.Kvs[0].Value), nil
+}
+
+func (le *etcdElector) lost() <-chan struct{} {
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+	if le.session == nil {
+		return nil
+	}
+	return le.session.Done()
+}
+
+func (le *etcdElector) resign() error {
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+	if le.session == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := le.election.Resign(ctx)
+	le.session.Close()
+	le.session, le.election = nil, nil
+	return err
+}
+
+func (le *memElector) campaign(tosec int) error {
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+	le.lostc = make(chan struct{})
+	return kvHandle.Store(LEADER_KEY, serviceName)
+}
+
+func (le *memElector) leader() (string, error) {
+	val, ok, err := kvHandle.Get(LEADER_KEY)
+	if (err != nil) || !ok {
+		return "", err
+	}
+	return val, nil
+}
+
+func (le *memElector) lost() <-chan struct{} {
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+	return le.lostc
+}
+
+func (le *memElector) resign() error {
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+	le.lostc = nil
+	if val, ok, _ := kvHandle.Get(LEADER_KEY); ok && (val == serviceName) {
+		return kvHandle.Delete(LEADER_KEY)
+	}
+	return nil
+}
+
+// Get the leader election backend, nil if election hasn't started.
+
+func getLeaderElector() leaderElector {
+	leaderMutex.RLock()
+	defer leaderMutex.RUnlock()
+	return leaderElect
+}
+
+// Set the leader election backend.
+
+func setLeaderElector(le leaderElector) {
+	leaderMutex.Lock()
+	leaderElect = le
+	leaderMutex.Unlock()
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Determine if this replica is the current leader.
+//
+// Args:   None.
+// Return: true if this replica is the leader.
+/////////////////////////////////////////////////////////////////////////////
+
+func isLeader() bool {
+	leaderMutex.RLock()
+	defer leaderMutex.RUnlock()
+	return amLeader
+}
+
+// Set this replica's leadership status.
+
+func setLeader(ldr bool) {
+	leaderMutex.Lock()
+	amLeader = ldr
+	leaderMutex.Unlock()
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get the name of the current leader replica.
+//
+// Args:   None.
+// Return: Leader replica name, "" if there is none; nil on success, error
+//         string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func getLeader() (string, error) {
+	le := getLeaderElector()
+	if (le == nil) || (kvHandle == nil) {
+		return "", nil
+	}
+	return le.leader()
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Do the things that only the leader does when it first becomes leader.
+// The HSM subscription is verified against HSM, since another replica may
+// have changed it.
+//
+// Args, Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func becomeLeader() {
+	setLeader(true)
+	log.Printf("INFO: This replica (%s) is now the leader.\n", serviceName)
+
+	pruneSweepNow()
+	loadHsmSubsRepairs()
+	hsmSubsReconcileNow(true)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Give up leadership.
+//
+// Args, Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func stepDown() {
+	setLeader(false)
+
+	//Only the leader can repair a lost HSM subscription; the next leader
+	//will find it if it's still lost.
+	hsmSubsLostMutex.Lock()
+	hsmSubsLost = hsmSubsStatus{}
+	hsmSubsLostMutex.Unlock()
+
+	if le := getLeaderElector(); le != nil {
+		err := le.resign()
+		if err != nil {
+			log.Printf("ERROR resigning leadership: %v", err)
+		}
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Perform one leadership check.  If not the leader, campaign to become
+// leader.  If the leader, make sure leadership hasn't been lost,
+// periodically reconcile the HSM subscription with the stored
+// subscriptions, and less often check that HSM still has it.
+//
+// Args, Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func leaderCheck() {
+	le := getLeaderElector()
+
+	if !isLeader() {
+		err := le.campaign(LEADER_LOCK_TTL)
+		if err != nil {
+			if app_params.Debug > 1 {
+				log.Printf("INFO: Leadership not acquired: %v", err)
+			}
+			return
+		}
+		becomeLeader()
+		leaderLastScan = time.Now()
+		leaderLastVerify = time.Now()
+		return
+	}
+
+	select {
+	case <-le.lost():
+		log.Printf("WARNING: Leader session lost, stepping down.\n")
+		stepDown()
+		return
+	default:
+	}
+
+	ldr, err := getLeader()
+	if err != nil {
+		log.Printf("ERROR fetching leader: %v", err)
+		return
+	}
+	if ldr != serviceName {
+		log.Printf("WARNING: Leadership taken over by '%s', stepping down.\n",
+			ldr)
+		stepDown()
+		return
+	}
+
+	if time.Since(leaderLastVerify) >= (HSM_SUBS_VERIFY_INTERVAL * time.Second) {
+		hsmSubsReconcileNow(true)
+		leaderLastVerify = time.Now()
+		leaderLastScan = time.Now()
+	} else if time.Since(leaderLastScan) >= (LEADER_RESCAN_INTERVAL * time.Second) {
+		hsmSubsReconcileNow(false)
+		leaderLastScan = time.Now()
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Thread func for leader election.  Opens a dedicated ETCD connection for
+// the election, then checks leadership periodically, and right away if the
+// leader's session is lost.
+//
+// Args, Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func leaderElection() {
+	ix := 1
+	for Running {
+		le, err := newLeaderElector(app_params.KV_url)
+		if err == nil {
+			setLeaderElector(le)
+			break
+		}
+		log.Printf("ERROR opening leader election connection (attempt %d): %v",
+			ix, err)
+		ix++
+		time.Sleep(5 * time.Second)
+	}
+
+	for Running {
+		leaderCheck()
+		var lost <-chan struct{}
+		if isLeader() {
+			lost = getLeaderElector().lost()
+		}
+		select {
+		case <-lost:
+		case <-time.After(LEADER_CHECK_INTERVAL * time.Second):
+		}
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Give up leadership during shutdown so another replica can take over right
+// away rather than waiting for the session lease to expire.
+//
+// Args, Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func leaderResign() {
+	if !isLeader() {
+		return
+	}
+	stepDown()
+	log.Printf("INFO: Resigned leadership.\n")
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Hand the local prune map off to the leader.  Each entry is stored once as
+// a prune request key, whose value is why it was pruned.  The entry stays in
+// the local map, so nothing more is sent to the subscriber from here, until
+// the leader has acted on the request and removed its key.
+//
+// Args, Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func publishPruneRequests() {
+	prunemap_mutex.Lock()
+	defer prunemap_mutex.Unlock()
+
+	for pm, val := range prunemap {
+		if !val {
+			unmarkPrune(pm)
+			continue
+		}
+		if prunerequested[pm] {
+			_, ok, err := kvHandle.Get(PRUNE_REQ_KEY_PREFIX + pm)
+			if (err == nil) && !ok {
+				unmarkPrune(pm)
+			}
+			continue
+		}
+		cause, ok := prunecauses[pm]
+		if !ok {
+			cause = pruneCause{Reason: PRUNE_REASON_UNKNOWN,
+				Replica: serviceName}
+		}
+		ba, _ := json.Marshal(cause)
+		err := kvHandle.Store(PRUNE_REQ_KEY_PREFIX+pm, string(ba))
+		if err != nil {
+			log.Printf("ERROR storing prune request for '%s': %v", pm, err)
+			continue
+		}
+		prunerequested[pm] = true
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Merge prune requests from other replicas into the local prune map.  The
+// request keys are removed by clearPruneRequests() once the subscriptions
+// are pruned, which tells the requesting replicas they're done.  Must be
+// called with prunemap_mutex held.
+//
+// Args:   None.
+// Return: Prune request keys merged.
+/////////////////////////////////////////////////////////////////////////////
+
+func collectPruneRequests() []string {
+	var keys []string
+
+	if kvHandle == nil {
+		return nil
+	}
+	kvlist, kverr := kvHandle.GetRange(PRUNE_REQ_KEYRANGE_START,
+		PRUNE_REQ_KEYRANGE_END)
+	if kverr != nil {
+		log.Println("ERROR fetching prune request keys:", kverr)
+		return nil
+	}
+
+	for _, kv := range kvlist {
+		pm := strings.TrimPrefix(kv.Key, PRUNE_REQ_KEY_PREFIX)
+		if pm == "" {
+			continue
+		}
+		//The value is why it was pruned; older replicas just stored
+		//their name.
+		var cause pruneCause
+		if json.Unmarshal([]byte(kv.Value), &cause) != nil {
+			cause = pruneCause{Reason: PRUNE_REASON_UNKNOWN, Replica: kv.Value}
+		}
+		prunemap[pm] = true
+		if _, ok := prunecauses[pm]; !ok {
+			prunecauses[pm] = cause
+		}
+		keys = append(keys, kv.Key)
+	}
+	return keys
+}
+
+// Remove prune request keys which have been acted on.
+
+func clearPruneRequests(keys []string) {
+	for _, key := range keys {
+		err := kvHandle.Delete(key)
+		if err != nil {
+			log.Printf("WARNING, prune request key '%s' not deleted: %v",
+				key, err)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestLeaderCheck(t *testing.T) {
+	var kverr error
+
+	disable_logs()
+	app_params.Nosm = 1 //don't actually contact HSM!
+
+	kverr = openTestKV()
+	if kverr != nil {
+		t.Fatal("KV/ETCD open failed:", kverr)
+	}
+	defer kvPurge(t)
+	le, lerr := newLeaderElector("mem:")
+	if lerr != nil {
+		t.Fatal("Leader election open failed:", lerr)
+	}
+	savedElect := getLeaderElector()
+	setLeaderElector(le)
+	defer setLeaderElector(savedElect)
+
+	savedName := serviceName
+	savedLeader := isLeader()
+	serviceName = "hmnfd-a"
+	setLeader(false)
+	defer func() {
+		serviceName = savedName
+		setLeader(savedLeader)
+	}()
+
+	//Not the leader; should acquire the lock and become leader.
+
+	leaderCheck()
+	if !isLeader() {
+		t.Errorf("ERROR, replica did not become leader.")
+	}
+	ldr, err := getLeader()
+	if err != nil {
+		t.Errorf("ERROR fetching leader key: %v", err)
+	}
+	if ldr != "hmnfd-a" {
+		t.Errorf("ERROR, leader key mismatch, exp: 'hmnfd-a', got: '%s'", ldr)
+	}
+
+	//Another replica took over; should step down.
+
+	kvHandle.Store(LEADER_KEY, "hmnfd-b")
+	leaderCheck()
+	if isLeader() {
+		t.Errorf("ERROR, replica did not step down after losing leadership.")
+	}
+
+	//Leadership is given up as soon as the session is lost.
+
+	leaderCheck()
+	if !isLeader() {
+		t.Errorf("ERROR, replica did not regain leadership.")
+	}
+	close(le.(*memElector).lostc)
+	leaderCheck()
+	if isLeader() {
+		t.Errorf("ERROR, replica did not step down after losing its session.")
+	}
+
+	//Take it back, then resign.
+
+	leaderCheck()
+	if !isLeader() {
+		t.Errorf("ERROR, replica did not regain leadership.")
+	}
+	leaderResign()
+	if isLeader() {
+		t.Errorf("ERROR, replica still leader after resigning.")
+	}
+	ldr, _ = getLeader()
+	if ldr != "" {
+		t.Errorf("ERROR, leader key still present after resigning: '%s'", ldr)
+	}
+}
+
+func TestPruneRequests(t *testing.T) {
+	var kverr error
+
+	disable_logs()
+	kverr = openTestKV()
+	if kverr != nil {
+		t.Fatal("KV/ETCD open failed:", kverr)
+	}
+	defer kvPurge(t)
+
+	savedLeader := isLeader()
+	setLeader(false)
+	defer setLeader(savedLeader)
+
+	//Non-leader hands its prune map off via ETCD.
+
+	prunemap_mutex.Lock()
+	prunemap["x1c2s3b0n4"] = true
+	prunemap["handler@x1c2s3b0n5"] = true
+	prunemap_mutex.Unlock()
+
+	publishPruneRequests()
+	publishPruneRequests() //nothing new
+
+	for _, pm := range []string{"x1c2s3b0n4", "handler@x1c2s3b0n5"} {
+		_, ok, _ := kvHandle.Get(PRUNE_REQ_KEY_PREFIX + pm)
+		if !ok {
+			t.Errorf("ERROR, no prune request key for '%s'.", pm)
+		}
+	}
+
+	//Nothing is sent to them until the leader has pruned them.
+
+	if !subscriberPruned("x1c2s3b0n4") || !subscriberPruned("handler@x1c2s3b0n5") {
+		t.Errorf("ERROR, prune map entries dropped before the leader pruned.")
+	}
+
+	//Leader picks them up, and removes the requests once they're pruned.
+
+	prunemap_mutex.Lock()
+	keys := collectPruneRequests()
+	ok1 := prunemap["x1c2s3b0n4"]
+	ok2 := prunemap["handler@x1c2s3b0n5"]
+	prunemap_mutex.Unlock()
+
+	if !ok1 || !ok2 || (len(keys) != 2) {
+		t.Errorf("ERROR, prune requests not merged into prune map.")
+	}
+	clearPruneRequests(keys)
+	kvlist, _ := kvHandle.GetRange(PRUNE_REQ_KEYRANGE_START, PRUNE_REQ_KEYRANGE_END)
+	if len(kvlist) != 0 {
+		t.Errorf("ERROR, %d prune request keys remain after pruning.",
+			len(kvlist))
+	}
+
+	//The requesting replica then lets its entries go.
+
+	publishPruneRequests()
+	prunemap_mutex.Lock()
+	plen := len(prunemap)
+	prunemap_mutex.Unlock()
+	if plen != 0 {
+		t.Errorf("ERROR, prune map not cleared after the leader pruned, has %d entries.",
+			plen)
+	}
+}
@@ -0,0 +1,413 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Cray-HPE/hms-base/v2"
+)
+
+// A note about prune decisions:
+//
+// The prune map is local to each replica, and subscriptions are only
+// removed from ETCD by the leader's next prune pass.  Until then, other
+// replicas would keep sending to a pruned subscriber, including SCNs they
+// already have queued.  So each prune map entry made is also written to ETCD
+// as a prune decision, which every replica watches.  When a replica sees a
+// new decision it stops sending to that subscriber and cancels any SCN sends
+// it has queued for it.
+//
+// Decisions only need to last until the subscriptions are gone, so they
+// expire after PRUNE_DECISION_TTL seconds.  The KV interface has no per-key
+// TTL, so the expiry time is kept in the value, expired decisions are
+// ignored, and the leader deletes them.  Re-subscribing clears any
+// decisions for the subscriber.
+//
+// Rather than watching the whole decision key range, every write bumps a
+// single generation key, which is watched.  Decisions are also re-read each
+// prune pass in case a watch is missed.
+
+/////////////////////////////////////////////////////////////////////////////
+// Data Structures
+/////////////////////////////////////////////////////////////////////////////
+
+// Prune decision, stored in ETCD.
+
+type pruneDecision struct {
+	Subscriber string `json:"Subscriber"` //prune map key, [agent@]xname
+	pruneCause
+	Expires int64 `json:"Expires"` //Unix time
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Constants
+/////////////////////////////////////////////////////////////////////////////
+
+const (
+	PRUNE_DECISION_KEY_PREFIX     = "prunedec#"
+	PRUNE_DECISION_KEYRANGE_START = "prunedec#"
+	PRUNE_DECISION_KEYRANGE_END   = "prunedec#~"
+	PRUNE_DECISION_GEN_KEY        = "prunedec_gen"
+	PRUNE_DECISION_TTL            = 30
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Global Variables
+/////////////////////////////////////////////////////////////////////////////
+
+var prunedec_chan = make(chan pruneDecision, 10000)
+var prunedecisions = make(map[string]int64) //protected by prunedec_mutex
+var prunedec_mutex = &sync.Mutex{}
+
+// Queued SCN send jobs, by subscriber XName, for cancelling.
+
+var scnSendJobs = make(map[string]map[*JobSCNSend]bool)
+var scnSendJobs_mutex = &sync.Mutex{}
+
+/////////////////////////////////////////////////////////////////////////////
+// Split a subscriber into its XName (or service subscriber ID) and agent.
+//
+// subscriber(in): Subscriber, [agent@]xname.
+// Return:         XName; agent, or empty string if none.
+/////////////////////////////////////////////////////////////////////////////
+
+func splitSubscriber(subscriber string) (string, string) {
+	ix := strings.Index(subscriber, SUBSCRIBER_SVC_DELIM)
+	if ix < 0 {
+		return subscriber, ""
+	}
+	return subscriber[ix+1:], subscriber[:ix]
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Queue a prune decision to be written to ETCD.  Doesn't block; if the
+// queue is full the decision is dropped, and only the prune pass will stop
+// sends to the subscriber.
+//
+// pm(in):    Prune map key, xname or agent@xname.
+// cause(in): Why it was pruned.
+// Return:    None.
+/////////////////////////////////////////////////////////////////////////////
+
+func queuePruneDecision(pm string, cause pruneCause) {
+	dec := pruneDecision{Subscriber: pm, pruneCause: cause}
+	select {
+	case prunedec_chan <- dec:
+	default:
+		log.Printf("WARNING: Prune decision queue full, '%s' not published.\n",
+			pm)
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Write prune decisions to ETCD and bump the generation key so that other
+// replicas see them.  Queued SCN sends on this replica are cancelled first.
+//
+// decs(in): Prune decisions.
+// Return:   None.
+/////////////////////////////////////////////////////////////////////////////
+
+func publishPruneDecisions(decs []pruneDecision) {
+	if len(decs) == 0 {
+		return
+	}
+	expires := time.Now().Add(PRUNE_DECISION_TTL * time.Second).Unix()
+	for _, dec := range decs {
+		cancelScnSends(dec.Subscriber)
+		dec.Expires = expires
+		ba, _ := json.Marshal(dec)
+		err := kvHandle.Store(PRUNE_DECISION_KEY_PREFIX+dec.Subscriber, string(ba))
+		if err != nil {
+			log.Printf("ERROR storing prune decision for '%s': %v",
+				dec.Subscriber, err)
+		}
+	}
+	bumpPruneDecisionGen()
+}
+
+// Bump the prune decision generation key.
+
+func bumpPruneDecisionGen() {
+	err := kvHandle.Store(PRUNE_DECISION_GEN_KEY,
+		fmt.Sprintf("%d#%s", time.Now().UnixNano(), serviceName))
+	if err != nil {
+		log.Println("ERROR storing prune decision generation:", err)
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Thread func which writes queued prune decisions to ETCD, a batch at a
+// time.
+//
+// Args, Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func pruneDecisionPublisher() {
+	for {
+		decs := []pruneDecision{<-prunedec_chan}
+	drain:
+		for {
+			select {
+			case dec := <-prunedec_chan:
+				decs = append(decs, dec)
+			default:
+				break drain
+			}
+		}
+		publishPruneDecisions(decs)
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Clear any prune decisions for a subscriber which is subscribing again, so
+// its new subscription isn't held off until they expire.
+//
+// xname(in): Subscriber XName or service subscriber ID.
+// agent(in): Subscribing agent, or empty string.
+// Return:    None.
+/////////////////////////////////////////////////////////////////////////////
+
+func clearPruneDecisions(xname string, agent string) {
+	pms := []string{xname}
+	if agent != "" {
+		pms = append(pms, agent+SUBSCRIBER_SVC_DELIM+xname)
+	}
+
+	cleared := false
+	prunedec_mutex.Lock()
+	for _, pm := range pms {
+		if _, ok := prunedecisions[pm]; ok {
+			delete(prunedecisions, pm)
+			cleared = true
+		}
+	}
+	prunedec_mutex.Unlock()
+	if !cleared {
+		return
+	}
+
+	for _, pm := range pms {
+		err := kvHandle.Delete(PRUNE_DECISION_KEY_PREFIX + pm)
+		if err != nil {
+			log.Printf("WARNING, prune decision for '%s' not deleted: %v",
+				pm, err)
+		}
+	}
+	bumpPruneDecisionGen()
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Read the prune decisions from ETCD, replacing the local set.  SCN sends
+// queued for subscribers with new decisions are cancelled.
+//
+// Args, Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func applyPruneDecisions() {
+	kvlist, kverr := kvHandle.GetRange(PRUNE_DECISION_KEYRANGE_START,
+		PRUNE_DECISION_KEYRANGE_END)
+	if kverr != nil {
+		log.Println("ERROR fetching prune decisions:", kverr)
+		return
+	}
+
+	now := time.Now().Unix()
+	decmap := make(map[string]int64)
+	var newpms []string
+
+	prunedec_mutex.Lock()
+	for _, kv := range kvlist {
+		var dec pruneDecision
+		if json.Unmarshal([]byte(kv.Value), &dec) != nil {
+			continue
+		}
+		if (dec.Subscriber == "") || (dec.Expires <= now) {
+			continue
+		}
+		if _, ok := prunedecisions[dec.Subscriber]; !ok {
+			newpms = append(newpms, dec.Subscriber)
+		}
+		decmap[dec.Subscriber] = dec.Expires
+	}
+	prunedecisions = decmap
+	prunedec_mutex.Unlock()
+
+	for _, pm := range newpms {
+		if app_params.Debug > 0 {
+			log.Printf("INFO: Prune decision for '%s' received.\n", pm)
+		}
+		cancelScnSends(pm)
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Check if there is a live prune decision for a subscriber.
+//
+// subscriber(in): Subscriber, [agent@]xname.
+// Return:         true if the subscriber has been pruned.
+/////////////////////////////////////////////////////////////////////////////
+
+func pruneDecided(subscriber string) bool {
+	xname, _ := splitSubscriber(subscriber)
+	now := time.Now().Unix()
+
+	prunedec_mutex.Lock()
+	defer prunedec_mutex.Unlock()
+	if exp, ok := prunedecisions[xname]; ok && (exp > now) {
+		return true
+	}
+	if exp, ok := prunedecisions[subscriber]; ok && (exp > now) {
+		return true
+	}
+	return false
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Delete expired prune decisions from ETCD.  Done by the leader.
+//
+// Args, Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func expirePruneDecisions() {
+	kvlist, kverr := kvHandle.GetRange(PRUNE_DECISION_KEYRANGE_START,
+		PRUNE_DECISION_KEYRANGE_END)
+	if kverr != nil {
+		log.Println("ERROR fetching prune decisions:", kverr)
+		return
+	}
+
+	now := time.Now().Unix()
+	for _, kv := range kvlist {
+		var dec pruneDecision
+		if (json.Unmarshal([]byte(kv.Value), &dec) == nil) && (dec.Expires > now) {
+			continue
+		}
+		err := kvHandle.Delete(kv.Key)
+		if err != nil {
+			log.Printf("WARNING, prune decision '%s' not deleted: %v",
+				kv.Key, err)
+		}
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Wait for the prune decision generation key to change, then apply the
+// decisions.  Watch failures are recovered from, since the prune pass will
+// pick up any missed decisions anyway.
+//
+// Args, Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func watchPruneDecisions() {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("ERROR watching prune decisions: %v", r)
+			time.Sleep(time.Second)
+		}
+	}()
+	kvHandle.Watch(PRUNE_DECISION_GEN_KEY)
+	applyPruneDecisions()
+}
+
+// Thread func which applies prune decisions as other replicas make them.
+
+func pruneDecisionWatcher() {
+	for {
+		watchPruneDecisions()
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Track a queued SCN send job so it can be cancelled.
+//
+// j(in):  SCN send job.
+// Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func trackScnSend(j *JobSCNSend) {
+	xname, _ := splitSubscriber(j.Subscriber)
+	scnSendJobs_mutex.Lock()
+	defer scnSendJobs_mutex.Unlock()
+	jobs, ok := scnSendJobs[xname]
+	if !ok {
+		jobs = make(map[*JobSCNSend]bool)
+		scnSendJobs[xname] = jobs
+	}
+	jobs[j] = true
+}
+
+// Stop tracking an SCN send job, once it has been run.
+
+func untrackScnSend(j *JobSCNSend) {
+	xname, _ := splitSubscriber(j.Subscriber)
+	scnSendJobs_mutex.Lock()
+	defer scnSendJobs_mutex.Unlock()
+	if jobs, ok := scnSendJobs[xname]; ok {
+		delete(jobs, j)
+		if len(jobs) == 0 {
+			delete(scnSendJobs, xname)
+		}
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Cancel queued SCN send jobs for a pruned subscriber.  If the prune map
+// key has an agent, only that agent's jobs are cancelled.
+//
+// pm(in): Prune map key, xname or agent@xname.
+// Return: Number of jobs cancelled.
+/////////////////////////////////////////////////////////////////////////////
+
+func cancelScnSends(pm string) int {
+	xname, agent := splitSubscriber(pm)
+	ncan := 0
+
+	scnSendJobs_mutex.Lock()
+	defer scnSendJobs_mutex.Unlock()
+	jobs, ok := scnSendJobs[xname]
+	if !ok {
+		return 0
+	}
+	for j := range jobs {
+		if (agent != "") && (j.Subscriber != pm) {
+			continue
+		}
+		if j.Cancel() == base.JSTAT_CANCELLED {
+			delete(jobs, j)
+			ncan++
+		}
+	}
+	if len(jobs) == 0 {
+		delete(scnSendJobs, xname)
+	}
+	if (ncan > 0) && (app_params.Debug > 0) {
+		log.Printf("INFO: Cancelled %d queued SCN sends for '%s'.\n", ncan, pm)
+	}
+	return ncan
+}
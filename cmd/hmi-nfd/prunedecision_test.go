@@ -0,0 +1,170 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Cray-HPE/hms-base/v2"
+)
+
+// Make a tracked, queued SCN send job.
+
+func queuedJob(subscriber string) *JobSCNSend {
+	j := NewJobSCNSend(Scn{State: "Ready"}, subscriber, "http://a.b/scn").(*JobSCNSend)
+	j.SetStatus(base.JSTAT_QUEUED, nil)
+	trackScnSend(j)
+	return j
+}
+
+func TestPruneDecisions(t *testing.T) {
+	var kverr error
+
+	disable_logs()
+	kverr = openTestKV()
+	if kverr != nil {
+		t.Fatal("KV/ETCD open failed:", kverr)
+	}
+	defer kvPurge(t)
+	defer func() {
+		prunedec_mutex.Lock()
+		prunedecisions = make(map[string]int64)
+		prunedec_mutex.Unlock()
+	}()
+
+	//Marking a prune queues a decision once.
+
+	for len(prunedec_chan) > 0 {
+		<-prunedec_chan
+	}
+	prunemap_mutex.Lock()
+	markPrune("x2000c0s1b0n0", PRUNE_REASON_CONN_REFUSED, "connection refused")
+	markPrune("x2000c0s1b0n0", PRUNE_REASON_RETRIES, "ignored")
+	unmarkPrune("x2000c0s1b0n0")
+	prunemap_mutex.Unlock()
+	if len(prunedec_chan) != 1 {
+		t.Fatalf("ERROR, expected 1 queued prune decision, got %d",
+			len(prunedec_chan))
+	}
+	dec := <-prunedec_chan
+	if (dec.Subscriber != "x2000c0s1b0n0") ||
+		(dec.Reason != PRUNE_REASON_CONN_REFUSED) {
+		t.Errorf("ERROR, bad prune decision: %v", dec)
+	}
+
+	//Another replica's decisions, one of them for a single agent and one
+	//expired.
+
+	j1 := queuedJob("handler@x2000c0s2b0n0")
+	j2 := queuedJob("hbtd@x2000c0s2b0n0")
+	j3 := queuedJob("handler@x2000c0s3b0n0")
+	j4 := queuedJob("x2000c0s4b0n0")
+	defer untrackScnSend(j2)
+	defer untrackScnSend(j4)
+
+	now := time.Now().Unix()
+	for _, dd := range []pruneDecision{
+		{Subscriber: "x2000c0s3b0n0", Expires: now + PRUNE_DECISION_TTL},
+		{Subscriber: "handler@x2000c0s2b0n0", Expires: now + PRUNE_DECISION_TTL},
+		{Subscriber: "x2000c0s4b0n0", Expires: now - 1},
+	} {
+		ba, _ := json.Marshal(dd)
+		kvHandle.Store(PRUNE_DECISION_KEY_PREFIX+dd.Subscriber, string(ba))
+	}
+	applyPruneDecisions()
+
+	for _, tt := range []struct {
+		job *JobSCNSend
+		exp base.JobStatus
+	}{
+		{j1, base.JSTAT_CANCELLED},
+		{j2, base.JSTAT_QUEUED},
+		{j3, base.JSTAT_CANCELLED},
+		{j4, base.JSTAT_QUEUED},
+	} {
+		if st, _ := tt.job.GetStatus(); st != tt.exp {
+			t.Errorf("ERROR, job for '%s' status %s, expected %s",
+				tt.job.Subscriber, base.JStatString[st], base.JStatString[tt.exp])
+		}
+	}
+	for sub, exp := range map[string]bool{"handler@x2000c0s2b0n0": true,
+		"hbtd@x2000c0s2b0n0": false, "x2000c0s3b0n0": true,
+		"handler@x2000c0s3b0n0": true, "x2000c0s4b0n0": false} {
+		if pruneDecided(sub) != exp {
+			t.Errorf("ERROR, pruneDecided('%s') should be %t", sub, exp)
+		}
+	}
+
+	//Nothing is sent to a subscriber with a prune decision.
+
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer srv.Close()
+	sendScnNow(Scn{State: "Ready"}, "handler@x2000c0s3b0n0", srv.URL)
+	if atomic.LoadInt32(&hits) != 0 {
+		t.Errorf("ERROR, SCN sent to subscriber with a prune decision.")
+	}
+
+	//The leader deletes expired decisions.
+
+	expirePruneDecisions()
+	if _, ok, _ := kvHandle.Get(PRUNE_DECISION_KEY_PREFIX + "x2000c0s4b0n0"); ok {
+		t.Errorf("ERROR, expired prune decision not deleted.")
+	}
+	if _, ok, _ := kvHandle.Get(PRUNE_DECISION_KEY_PREFIX + "x2000c0s3b0n0"); !ok {
+		t.Errorf("ERROR, live prune decision deleted.")
+	}
+
+	//Subscribing again clears them.
+
+	clearPruneDecisions("x2000c0s3b0n0", "handler")
+	if pruneDecided("handler@x2000c0s3b0n0") {
+		t.Errorf("ERROR, prune decision not cleared.")
+	}
+	applyPruneDecisions()
+	if pruneDecided("x2000c0s3b0n0") || !pruneDecided("handler@x2000c0s2b0n0") {
+		t.Errorf("ERROR, wrong prune decisions after clearing.")
+	}
+	if _, ok, _ := kvHandle.Get(PRUNE_DECISION_GEN_KEY); !ok {
+		t.Errorf("ERROR, prune decision generation not bumped.")
+	}
+
+	//Published decisions cancel local jobs right away.
+
+	j5 := queuedJob("handler@x2000c0s5b0n0")
+	publishPruneDecisions([]pruneDecision{{Subscriber: "x2000c0s5b0n0"}})
+	if st, _ := j5.GetStatus(); st != base.JSTAT_CANCELLED {
+		t.Errorf("ERROR, local job not cancelled by published decision.")
+	}
+	applyPruneDecisions()
+	if !pruneDecided("handler@x2000c0s5b0n0") {
+		t.Errorf("ERROR, published prune decision not applied.")
+	}
+}
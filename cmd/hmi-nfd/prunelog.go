@@ -0,0 +1,438 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Cray-HPE/hms-base/v2"
+)
+
+// A note about the prune log:
+//
+// Every subscription removed or suspended by pruning, or deleted via the
+// API, is recorded in the prune log along with why it happened.  The reason
+// is noted when the subscriber goes into the prune map, on whichever replica
+// saw it, and travels with the prune map entry (including prune requests
+// handed to the leader) until the subscription is actually pruned.
+//
+// Each record is its own ETCD key, so any replica can add one without
+// stepping on another.  The keys sort by time; the leader trims the oldest
+// ones so the log never holds more than PRUNE_LOG_MAX records.  Records are
+// also put on the telemetry bus if Prune_telemetry is set (along with
+// Use_telemetry).
+
+/////////////////////////////////////////////////////////////////////////////
+// Data Structures
+/////////////////////////////////////////////////////////////////////////////
+
+// One prune log record.
+
+type PruneRecord struct {
+	Subscription string `json:"Subscription"`      //ETCD subscription key
+	Subscriber   string `json:"Subscriber"`        //[agent@]xname
+	Url          string `json:"Url,omitempty"`     //subscription URL
+	Reason       string `json:"Reason"`            //one of PRUNE_REASON_xxx
+	Trigger      string `json:"Trigger,omitempty"` //triggering SCN or error
+	Action       string `json:"Action"`            //Deleted or Suspended
+	Time         string `json:"Time"`              //RFC3339
+	Replica      string `json:"Replica"`           //replica that saw the reason
+}
+
+// Prune log returned by /prunes
+
+type PruneRecordList struct {
+	Prunes []PruneRecord `json:"Prunes"`
+}
+
+// Filters for /prunes queries.
+
+type pruneFilter struct {
+	subscriber string
+	reason     string
+	replica    string
+	since      time.Time
+	limit      int
+}
+
+// Why a prune map entry was made.
+
+type pruneCause struct {
+	Reason  string `json:"Reason"`
+	Trigger string `json:"Trigger,omitempty"`
+	Replica string `json:"Replica"`
+	Suspend bool   `json:"Suspend,omitempty"` //suspend even if not durable
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Constants
+/////////////////////////////////////////////////////////////////////////////
+
+const (
+	PRUNE_REASON_UNAVAILABLE        = "UnavailableState"
+	PRUNE_REASON_CONN_REFUSED       = "ConnectionRefused"
+	PRUNE_REASON_RETRIES            = "RetriesExhausted"
+	PRUNE_REASON_API_DELETE         = "ApiDelete"
+	PRUNE_REASON_DEAD_SWEEP         = "DeadSubscriberSweep"
+	PRUNE_REASON_LEASE              = "LeaseExpired"
+	PRUNE_REASON_PARENT_UNAVAILABLE = "ParentUnavailable"
+	PRUNE_REASON_QUEUE_OVERFLOW     = "QueueOverflow"
+	PRUNE_REASON_TIMEOUT            = "Timeout"
+	PRUNE_REASON_DNS                = "DNSFailure"
+	PRUNE_REASON_TLS                = "TLSError"
+	PRUNE_REASON_NETWORK            = "NetworkError"
+	PRUNE_REASON_CLIENT_ERROR       = "ClientError"
+	PRUNE_REASON_THROTTLED          = "Throttled"
+	PRUNE_REASON_SERVER_ERROR       = "ServerError"
+	PRUNE_REASON_UNKNOWN            = "Unknown"
+
+	PRUNE_ACTION_DELETED   = "Deleted"
+	PRUNE_ACTION_SUSPENDED = "Suspended"
+
+	PRUNE_LOG_KEY_PREFIX     = "prunelog#"
+	PRUNE_LOG_KEYRANGE_START = "prunelog#"
+	PRUNE_LOG_KEYRANGE_END   = "prunelog#~"
+	PRUNE_LOG_MAX            = 10000
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Global Variables
+/////////////////////////////////////////////////////////////////////////////
+
+var prunecauses = make(map[string]pruneCause) //protected by prunemap_mutex
+var pruneLogSeq uint32
+
+/////////////////////////////////////////////////////////////////////////////
+// Put a subscriber into the prune map, noting why.  The first reason given
+// for a subscriber is kept, and is published to the other replicas as a
+// prune decision.  Nothing is done if the prune policy is in dry run mode.
+// Must be called with prunemap_mutex held.
+//
+// pm(in):      Prune map key, xname or agent@xname.
+// reason(in):  Reason, one of PRUNE_REASON_xxx.
+// trigger(in): Triggering SCN or error.
+// Return:      None.
+/////////////////////////////////////////////////////////////////////////////
+
+func markPrune(pm string, reason string, trigger string) {
+	markPruneCause(pm, pruneCause{Reason: reason, Trigger: trigger,
+		Replica: serviceName})
+}
+
+// As above, with the whole cause given.  Must be called with
+// prunemap_mutex held.
+
+func markPruneCause(pm string, cause pruneCause) {
+	if pruneDryRun(pm, cause.Reason, cause.Trigger) {
+		return
+	}
+	prunemap[pm] = true
+	if _, ok := prunecauses[pm]; !ok {
+		prunecauses[pm] = cause
+		queuePruneDecision(pm, cause)
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Convenience func to make a prune map entry, taking prunemap_mutex.
+//
+// pm(in):      Prune map key, xname or agent@xname.
+// reason(in):  Reason, one of PRUNE_REASON_xxx.
+// trigger(in): Triggering SCN or error.
+// Return:      None.
+/////////////////////////////////////////////////////////////////////////////
+
+func markPruneLocked(pm string, reason string, trigger string) {
+	prunemap_mutex.Lock()
+	markPrune(pm, reason, trigger)
+	prunemap_mutex.Unlock()
+}
+
+// Remove a prune map entry and its reason.  Must be called with
+// prunemap_mutex held.
+
+func unmarkPrune(pm string) {
+	delete(prunemap, pm)
+	delete(prunecauses, pm)
+	delete(prunerequested, pm)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Describe an SCN briefly, for use as a prune trigger.  The component list
+// is left out since it can be huge.
+//
+// scn(in): SCN.
+// Return:  SCN description.
+/////////////////////////////////////////////////////////////////////////////
+
+func scnTrigger(scn Scn) string {
+	trig := "SCN State: " + scn.State
+	if scn.Timestamp != "" {
+		trig += ", Timestamp: " + scn.Timestamp
+	}
+	return trig
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Make a prune log record for a subscription.
+//
+// key(in):    Subscription key.
+// value(in):  Subscription key's value.
+// cause(in):  Why it was pruned.
+// action(in): PRUNE_ACTION_DELETED or PRUNE_ACTION_SUSPENDED.
+// Return:     Prune log record.
+/////////////////////////////////////////////////////////////////////////////
+
+func newPruneRecord(key string, value string, cause pruneCause, action string) PruneRecord {
+	var sd SubData
+
+	subscriber, agent := parseSubscriptionKey(key)
+	if agent != "" {
+		subscriber = agent + SUBSCRIBER_SVC_DELIM + subscriber
+	}
+	json.Unmarshal([]byte(value), &sd)
+
+	rec := PruneRecord{Subscription: key,
+		Subscriber: subscriber,
+		Url:        sd.Url,
+		Reason:     cause.Reason,
+		Trigger:    cause.Trigger,
+		Action:     action,
+		Time:       time.Now().Format(time.RFC3339),
+		Replica:    cause.Replica,
+	}
+	if rec.Reason == "" {
+		rec.Reason = PRUNE_REASON_UNKNOWN
+	}
+	if rec.Replica == "" {
+		rec.Replica = serviceName
+	}
+	return rec
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Add a record to the prune log, and put it on the telemetry bus if asked.
+//
+// rec(in): Prune log record.
+// Return:  None.
+/////////////////////////////////////////////////////////////////////////////
+
+func logPrune(rec PruneRecord) {
+	log.Printf("INFO: Pruned subscription '%s' (%s, %s: %s).\n",
+		rec.Subscription, rec.Action, rec.Reason, rec.Trigger)
+
+	ba, err := json.Marshal(rec)
+	if err != nil {
+		log.Println("ERROR marshaling prune record:", err)
+		return
+	}
+
+	key := fmt.Sprintf("%s%020d#%s#%d", PRUNE_LOG_KEY_PREFIX,
+		time.Now().UnixNano(), serviceName, atomic.AddUint32(&pruneLogSeq, 1))
+	err = kvHandle.Store(key, string(ba))
+	if err != nil {
+		log.Printf("ERROR storing prune record '%s': %v", key, err)
+	}
+
+	if (app_params.Prune_telemetry != 0) && (app_params.Use_telemetry != 0) {
+		select {
+		case kq_chan <- string(ba):
+		default:
+			log.Printf("ERROR: Telemetry queue is full, cannot inject...\n")
+		}
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Trim the prune log down to PRUNE_LOG_MAX records, oldest first.  Done by
+// the leader.
+//
+// Args, Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func trimPruneLog() {
+	kvlist, kverr := kvHandle.GetRange(PRUNE_LOG_KEYRANGE_START,
+		PRUNE_LOG_KEYRANGE_END)
+	if kverr != nil {
+		log.Println("ERROR fetching prune log keys:", kverr)
+		return
+	}
+
+	for ix := 0; ix < len(kvlist)-PRUNE_LOG_MAX; ix++ {
+		err := kvHandle.Delete(kvlist[ix].Key)
+		if err != nil {
+			log.Printf("WARNING, prune log key '%s' not deleted: %v",
+				kvlist[ix].Key, err)
+		}
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Parse the prune log filters in a /prunes request's query parameters:
+//
+//   subscriber: xname or agent@xname; an xname matches all of its agents
+//   reason:     PRUNE_REASON_xxx
+//   replica:    replica that saw the reason
+//   since:      RFC3339 time; records at or after it
+//   limit:      return only the most recent N records
+//
+// r(in):  HTTP request.
+// Return: Prune log filter; nil on success, error string on bad filters.
+/////////////////////////////////////////////////////////////////////////////
+
+func parsePruneFilter(r *http.Request) (pruneFilter, error) {
+	var pf pruneFilter
+	var err error
+
+	qv := r.URL.Query()
+	pf.subscriber = strings.ToLower(qv.Get("subscriber"))
+	pf.reason = qv.Get("reason")
+	pf.replica = qv.Get("replica")
+
+	if qv.Get("since") != "" {
+		pf.since, err = time.Parse(time.RFC3339, qv.Get("since"))
+		if err != nil {
+			return pf, fmt.Errorf("Invalid 'since' time, must be RFC3339")
+		}
+	}
+	if qv.Get("limit") != "" {
+		pf.limit, err = strconv.Atoi(qv.Get("limit"))
+		if (err != nil) || (pf.limit < 0) {
+			return pf, fmt.Errorf("Invalid 'limit', must be a non-negative integer")
+		}
+	}
+	return pf, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get the prune log records which pass a filter, oldest first.
+//
+// pf(in): Prune log filter.
+// Return: Matching records; nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func getPruneRecords(pf pruneFilter) ([]PruneRecord, error) {
+	var prunes []PruneRecord
+
+	kvlist, kverr := kvHandle.GetRange(PRUNE_LOG_KEYRANGE_START,
+		PRUNE_LOG_KEYRANGE_END)
+	if kverr != nil {
+		return nil, kverr
+	}
+
+	for _, kv := range kvlist {
+		var rec PruneRecord
+		if json.Unmarshal([]byte(kv.Value), &rec) != nil {
+			log.Printf("WARNING: Invalid prune log record '%s'.\n", kv.Key)
+			continue
+		}
+		if pf.subscriber != "" {
+			xname := rec.Subscriber[strings.Index(rec.Subscriber, SUBSCRIBER_SVC_DELIM)+1:]
+			if (pf.subscriber != rec.Subscriber) && (pf.subscriber != xname) {
+				continue
+			}
+		}
+		if (pf.reason != "") && !strings.EqualFold(pf.reason, rec.Reason) {
+			continue
+		}
+		if (pf.replica != "") && (pf.replica != rec.Replica) {
+			continue
+		}
+		if !pf.since.IsZero() {
+			rt, terr := time.Parse(time.RFC3339, rec.Time)
+			if (terr != nil) || rt.Before(pf.since) {
+				continue
+			}
+		}
+		prunes = append(prunes, rec)
+	}
+
+	if (pf.limit > 0) && (len(prunes) > pf.limit) {
+		prunes = prunes[len(prunes)-pf.limit:]
+	}
+	return prunes, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get the prune log.  Query parameters filter the records; see
+// parsePruneFilter().
+//
+// w(in):  HTTP response writer
+// r(in):  HTTP request
+// Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func prunesGetHandler(w http.ResponseWriter, r *http.Request) {
+	var plist PruneRecordList
+
+	errinst := "/" + URL_PRUNES
+
+	pf, err := parsePruneFilter(r)
+	if err != nil {
+		log.Println("ERROR: Bad prune log filter:", err)
+		pdet := base.NewProblemDetails("about:blank",
+			"Invalid Request",
+			err.Error(),
+			errinst, http.StatusBadRequest)
+		base.SendProblemDetails(w, pdet, 0)
+		return
+	}
+
+	prunes, err := getPruneRecords(pf)
+	if err != nil {
+		log.Println("ERROR fetching prune log:", err)
+		pdet := base.NewProblemDetails("about:blank",
+			"Internal Server Error",
+			"KV fetch error",
+			errinst, http.StatusInternalServerError)
+		base.SendProblemDetails(w, pdet, 0)
+		return
+	}
+
+	plist.Prunes = prunes
+	if plist.Prunes == nil {
+		plist.Prunes = []PruneRecord{}
+	}
+
+	ba, baerr := json.Marshal(plist)
+	if baerr != nil {
+		log.Println("ERROR marshaling prune log:", baerr)
+		pdet := base.NewProblemDetails("about:blank",
+			"Internal Server Error",
+			"JSON marshal error",
+			errinst, http.StatusInternalServerError)
+		base.SendProblemDetails(w, pdet, 0)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(ba)
+}
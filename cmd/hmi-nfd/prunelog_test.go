@@ -0,0 +1,205 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPruneLog(t *testing.T) {
+	var kverr error
+
+	disable_logs()
+	kverr = openTestKV()
+	if kverr != nil {
+		t.Fatal("KV/ETCD open failed:", kverr)
+	}
+	defer kvPurge(t)
+
+	savedName := serviceName
+	serviceName = "hmnfd-a"
+	defer func() { serviceName = savedName }()
+
+	subs := []ScnSubscribe{
+		{Subscriber: "x3000c0s1b0n0", Components: []string{"x3000c0s1b0n0"},
+			States: []string{"off"}, Url: "http://x3000c0s1b0n0/scn"},
+		{Subscriber: "x3000c0s2b0n0", Components: []string{"x3000c0s2b0n0"},
+			States: []string{"off"}, Url: "http://x3000c0s2b0n0/scn", Durable: true},
+		{Subscriber: "x3000c0s3b0n0", Components: []string{"x3000c0s3b0n0"},
+			States: []string{"off"}, Url: "http://x3000c0s3b0n0/scn"},
+	}
+	for _, sub := range subs {
+		key := makeSubscriptionKey_V2(sub, sub.Subscriber, "hbtd")
+		err := storeSubscriptionEntry(key, SubData{Url: sub.Url,
+			ScnNodes: sub.Components, Durable: sub.Durable})
+		if err != nil {
+			t.Fatal("ERROR storing subscription:", err)
+		}
+	}
+
+	//The first reason given is kept.  One reason comes from another
+	//replica via a prune request.
+
+	prunemap_mutex.Lock()
+	markPrune("x3000c0s1b0n0", PRUNE_REASON_UNAVAILABLE,
+		scnTrigger(Scn{State: "Off", Timestamp: "2026-10-18T00:00:00Z"}))
+	markPrune("x3000c0s1b0n0", PRUNE_REASON_RETRIES, "ignored")
+	markPrune("x3000c0s2b0n0", PRUNE_REASON_DEAD_SWEEP, "HSM State: Halt")
+	prunemap_mutex.Unlock()
+
+	ba, _ := json.Marshal(pruneCause{Reason: PRUNE_REASON_CONN_REFUSED,
+		Trigger: "connection refused", Replica: "hmnfd-b"})
+	kvHandle.Store(PRUNE_REQ_KEY_PREFIX+"x3000c0s3b0n0", string(ba))
+
+	prunemap_mutex.Lock()
+	collectPruneRequests()
+	subPrune()
+	for _, pm := range []string{"x3000c0s1b0n0", "x3000c0s2b0n0", "x3000c0s3b0n0"} {
+		unmarkPrune(pm)
+	}
+	prunemap_mutex.Unlock()
+
+	prunes, err := getPruneRecords(pruneFilter{})
+	if err != nil {
+		t.Fatal("ERROR fetching prune log:", err)
+	}
+	if len(prunes) != 3 {
+		t.Fatalf("ERROR, expected 3 prune records, got %d: %v", len(prunes), prunes)
+	}
+
+	exp := map[string]PruneRecord{
+		"hbtd@x3000c0s1b0n0": {Reason: PRUNE_REASON_UNAVAILABLE,
+			Trigger: "SCN State: Off, Timestamp: 2026-10-18T00:00:00Z",
+			Action:  PRUNE_ACTION_DELETED, Replica: "hmnfd-a",
+			Url: "http://x3000c0s1b0n0/scn"},
+		"hbtd@x3000c0s2b0n0": {Reason: PRUNE_REASON_DEAD_SWEEP,
+			Trigger: "HSM State: Halt", Action: PRUNE_ACTION_SUSPENDED,
+			Replica: "hmnfd-a", Url: "http://x3000c0s2b0n0/scn"},
+		"hbtd@x3000c0s3b0n0": {Reason: PRUNE_REASON_CONN_REFUSED,
+			Trigger: "connection refused", Action: PRUNE_ACTION_DELETED,
+			Replica: "hmnfd-b", Url: "http://x3000c0s3b0n0/scn"},
+	}
+	for _, rec := range prunes {
+		er, ok := exp[rec.Subscriber]
+		if !ok {
+			t.Errorf("ERROR, unexpected prune record: %v", rec)
+			continue
+		}
+		if (rec.Reason != er.Reason) || (rec.Trigger != er.Trigger) ||
+			(rec.Action != er.Action) || (rec.Replica != er.Replica) ||
+			(rec.Url != er.Url) || (rec.Time == "") || (rec.Subscription == "") {
+			t.Errorf("ERROR, prune record mismatch, exp: %v, got: %v", er, rec)
+		}
+	}
+
+	//Filters, via the API.
+
+	routes := generateRoutes()
+	router := newRouter(routes)
+
+	tests := []struct {
+		query string
+		code  int
+		count int
+	}{
+		{"", http.StatusOK, 3},
+		{"?subscriber=x3000c0s3b0n0", http.StatusOK, 1},
+		{"?subscriber=hbtd@x3000c0s3b0n0", http.StatusOK, 1},
+		{"?subscriber=other@x3000c0s3b0n0", http.StatusOK, 0},
+		{"?reason=deadsubscribersweep", http.StatusOK, 1},
+		{"?replica=hmnfd-a", http.StatusOK, 2},
+		{"?since=2000-01-01T00:00:00Z", http.StatusOK, 3},
+		{"?since=2999-01-01T00:00:00Z", http.StatusOK, 0},
+		{"?limit=2", http.StatusOK, 2},
+		{"?since=yesterday", http.StatusBadRequest, 0},
+		{"?limit=-1", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		var plist PruneRecordList
+
+		req, _ := http.NewRequest("GET", "http://localhost:8080/hmi/v2/prunes"+tt.query, nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != tt.code {
+			t.Errorf("ERROR, query '%s' returned %d, exp %d", tt.query, rr.Code, tt.code)
+			continue
+		}
+		if tt.code != http.StatusOK {
+			continue
+		}
+		err = json.Unmarshal(rr.Body.Bytes(), &plist)
+		if err != nil {
+			t.Errorf("ERROR unmarshalling query '%s' response: %v", tt.query, err)
+			continue
+		}
+		if len(plist.Prunes) != tt.count {
+			t.Errorf("ERROR, query '%s' returned %d records, exp %d",
+				tt.query, len(plist.Prunes), tt.count)
+		}
+	}
+
+	//API deletes are logged too.
+
+	req, _ := http.NewRequest("DELETE",
+		"http://localhost:8080/hmi/v2/subscriptions/x3000c0s2b0n0/agents/hbtd", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("ERROR, DELETE returned %d", rr.Code)
+	}
+	prunemap_mutex.Lock()
+	unmarkPrune("hbtd@x3000c0s2b0n0")
+	prunemap_mutex.Unlock()
+
+	prunes, _ = getPruneRecords(pruneFilter{reason: PRUNE_REASON_API_DELETE})
+	if (len(prunes) != 1) || (prunes[0].Subscriber != "hbtd@x3000c0s2b0n0") ||
+		(prunes[0].Trigger != "DELETE /hmi/v2/subscriptions/x3000c0s2b0n0/agents/hbtd") {
+		t.Errorf("ERROR, API delete not logged properly: %v", prunes)
+	}
+}
+
+func TestTrimPruneLog(t *testing.T) {
+	var kverr error
+
+	disable_logs()
+	kverr = openTestKV()
+	if kverr != nil {
+		t.Fatal("KV/ETCD open failed:", kverr)
+	}
+	defer kvPurge(t)
+
+	for ix := 0; ix < PRUNE_LOG_MAX+5; ix++ {
+		logPrune(PruneRecord{Subscription: "sub#x3000c0s1b0n0#hs.off",
+			Subscriber: "x3000c0s1b0n0", Reason: PRUNE_REASON_RETRIES})
+	}
+	trimPruneLog()
+
+	kvlist, _ := kvHandle.GetRange(PRUNE_LOG_KEYRANGE_START, PRUNE_LOG_KEYRANGE_END)
+	if len(kvlist) != PRUNE_LOG_MAX {
+		t.Errorf("ERROR, prune log has %d records after trim, exp %d",
+			len(kvlist), PRUNE_LOG_MAX)
+	}
+}
@@ -0,0 +1,326 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/Cray-HPE/hms-base/v2"
+	"github.com/Cray-HPE/hms-xname/xnametypes"
+)
+
+// A note about the prune policy:
+//
+// What prunes a subscriber is set by the prune policy, which is the
+// Prune_policy parameter.  It can be loaded from a JSON file at startup
+// (--prune_policy_file or HMNFD_PRUNE_POLICY_FILE) and changed via /params.
+// If none is given, the default policy matches what HMNFD has always done.
+//
+// There is a rule for each kind of subscriber.  Component subscribers are
+// pruned when an SCN or a dead subscriber sweep shows them in one of the
+// rule's States, SoftwareStatus values or Flags, or disabled if Disabled is
+// set.  Both kinds are pruned when an SCN delivery to them fails with one of
+// the rule's DeliveryErrors classes.  Service subscribers aren't components,
+// so their rule can only have DeliveryErrors.  Subscribers contained in an
+// unavailable component are handled as the Containment map says for their
+// type.
+//
+// In DryRun mode, subscribers the policy would prune are logged, and
+// nothing is pruned or suspended.  Deletes via the API and lease expiries
+// aren't governed by the policy.
+
+/////////////////////////////////////////////////////////////////////////////
+// Data Structures
+/////////////////////////////////////////////////////////////////////////////
+
+// What prunes one kind of subscriber.
+
+type PruneRule struct {
+	States         []string `json:"States,omitempty"`
+	SoftwareStatus []string `json:"SoftwareStatus,omitempty"`
+	Flags          []string `json:"Flags,omitempty"`
+	Disabled       bool     `json:"Disabled,omitempty"` //prune if Enabled=false
+	DeliveryErrors []string `json:"DeliveryErrors,omitempty"`
+}
+
+// Prune policy, the Prune_policy parameter.
+
+type PrunePolicy struct {
+	DryRun      bool              `json:"DryRun"`
+	Components  PruneRule         `json:"Components"`
+	Services    PruneRule         `json:"Services"`
+	Containment map[string]string `json:"Containment,omitempty"` //HMS type -> action
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Constants
+/////////////////////////////////////////////////////////////////////////////
+
+// SCN delivery error classes; see classifySendError() and
+// classifySendStatus().
+
+const (
+	DELIVERY_ERR_CONN_REFUSED = PRUNE_REASON_CONN_REFUSED
+	DELIVERY_ERR_TIMEOUT      = PRUNE_REASON_TIMEOUT
+	DELIVERY_ERR_DNS          = PRUNE_REASON_DNS
+	DELIVERY_ERR_TLS          = PRUNE_REASON_TLS
+	DELIVERY_ERR_NETWORK      = PRUNE_REASON_NETWORK
+	DELIVERY_ERR_CLIENT       = PRUNE_REASON_CLIENT_ERROR //4xx but 429
+	DELIVERY_ERR_THROTTLED    = PRUNE_REASON_THROTTLED    //429
+	DELIVERY_ERR_SERVER       = PRUNE_REASON_SERVER_ERROR //5xx
+	DELIVERY_ERR_RETRIES      = PRUNE_REASON_RETRIES
+)
+
+var deliveryErrorClasses = []string{DELIVERY_ERR_CONN_REFUSED,
+	DELIVERY_ERR_TIMEOUT,
+	DELIVERY_ERR_DNS,
+	DELIVERY_ERR_TLS,
+	DELIVERY_ERR_NETWORK,
+	DELIVERY_ERR_CLIENT,
+	DELIVERY_ERR_THROTTLED,
+	DELIVERY_ERR_SERVER,
+	DELIVERY_ERR_RETRIES,
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Create the default prune policy: components are pruned when Empty, Off,
+// Halt or disabled, and any subscriber is pruned when delivery is refused
+// or runs out of retries.  Nodes and virtual nodes are also pruned when
+// their container is.
+//
+// Args:   None.
+// Return: Default prune policy.
+/////////////////////////////////////////////////////////////////////////////
+
+func defaultPrunePolicy() *PrunePolicy {
+	return &PrunePolicy{
+		Components: PruneRule{
+			States: []string{base.StateEmpty.String(),
+				base.StateOff.String(),
+				base.StateHalt.String(),
+			},
+			Disabled:       true,
+			DeliveryErrors: []string{DELIVERY_ERR_CONN_REFUSED, DELIVERY_ERR_RETRIES},
+		},
+		Services: PruneRule{
+			DeliveryErrors: []string{DELIVERY_ERR_CONN_REFUSED, DELIVERY_ERR_RETRIES},
+		},
+		Containment: map[string]string{
+			xnametypes.Node.String():        CONTAIN_ACTION_PRUNE,
+			xnametypes.VirtualNode.String(): CONTAIN_ACTION_PRUNE,
+		},
+	}
+}
+
+// Get the prune policy in effect.
+
+func prunePolicy() *PrunePolicy {
+	if app_params.Prune_policy == nil {
+		return defaultPrunePolicy()
+	}
+	return app_params.Prune_policy
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Verify a prune rule, normalizing the capitalization of its states, flags
+// and delivery error classes.
+//
+// pr(inout): Prune rule.
+// Return:    nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func verifyPruneRule(pr *PruneRule) error {
+	for ix, state := range pr.States {
+		pr.States[ix] = base.VerifyNormalizeState(state)
+		if pr.States[ix] == "" {
+			return fmt.Errorf("invalid state '%s'", state)
+		}
+	}
+	for ix, flag := range pr.Flags {
+		pr.Flags[ix] = base.VerifyNormalizeFlag(flag)
+		if pr.Flags[ix] == "" {
+			return fmt.Errorf("invalid flag '%s'", flag)
+		}
+	}
+	for ix, swst := range pr.SoftwareStatus {
+		if swst == "" {
+			return fmt.Errorf("empty software status")
+		}
+		pr.SoftwareStatus[ix] = strings.ToLower(swst)
+	}
+	for ix, derr := range pr.DeliveryErrors {
+		pr.DeliveryErrors[ix] = verifyDeliveryErrorClass(derr)
+		if pr.DeliveryErrors[ix] == "" {
+			return fmt.Errorf("invalid delivery error class '%s'", derr)
+		}
+	}
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Verify and normalize a delivery error class.
+//
+// class(in): Delivery error class, any case.
+// Return:    DELIVERY_ERR_xxx, or "" if not valid.
+/////////////////////////////////////////////////////////////////////////////
+
+func verifyDeliveryErrorClass(class string) string {
+	for _, dc := range deliveryErrorClasses {
+		if strings.EqualFold(class, dc) {
+			return dc
+		}
+	}
+	return ""
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Verify a prune policy, normalizing it.
+//
+// pp(inout): Prune policy.
+// Return:    nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func verifyPrunePolicy(pp *PrunePolicy) error {
+	if err := verifyPruneRule(&pp.Components); err != nil {
+		return fmt.Errorf("Prune_policy Components: %v", err)
+	}
+	if (len(pp.Services.States) != 0) || (len(pp.Services.SoftwareStatus) != 0) ||
+		(len(pp.Services.Flags) != 0) || pp.Services.Disabled {
+		return fmt.Errorf("Prune_policy Services: only DeliveryErrors are allowed")
+	}
+	if err := verifyPruneRule(&pp.Services); err != nil {
+		return fmt.Errorf("Prune_policy Services: %v", err)
+	}
+	cmap, err := verifyContainment(pp.Containment)
+	if err != nil {
+		return fmt.Errorf("Prune_policy Containment: %v", err)
+	}
+	pp.Containment = cmap
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Load the prune policy from a JSON file.
+//
+// fname(in): Policy file name.
+// Return:    nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func loadPrunePolicyFile(fname string) error {
+	var pp PrunePolicy
+
+	ba, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(ba, &pp)
+	if err != nil {
+		return fmt.Errorf("can't parse '%s': %v", fname, err)
+	}
+	err = verifyPrunePolicy(&pp)
+	if err != nil {
+		return err
+	}
+	app_params.Prune_policy = &pp
+	return nil
+}
+
+// Case-insensitive string list membership check.
+
+func inListFold(list []string, val string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, val) {
+			return true
+		}
+	}
+	return false
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Check if component state info matches a prune rule.  Empty values don't
+// match anything.
+//
+// pr(in):       Prune rule.
+// state(in):    Component state.
+// swstatus(in): Component software status.
+// flag(in):     Component flag.
+// enabled(in):  Component enabled status, nil if not known.
+// Return:       true if the component should be pruned.
+/////////////////////////////////////////////////////////////////////////////
+
+func (pr *PruneRule) matchComponent(state, swstatus, flag string, enabled *bool) bool {
+	if (state != "") && inListFold(pr.States, state) {
+		return true
+	}
+	if (swstatus != "") && inListFold(pr.SoftwareStatus, swstatus) {
+		return true
+	}
+	if (flag != "") && inListFold(pr.Flags, flag) {
+		return true
+	}
+	if pr.Disabled && (enabled != nil) && !*enabled {
+		return true
+	}
+	return false
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Check if an SCN delivery error class prunes a subscriber, per the prune
+// policy.
+//
+// subscriber(in): Subscriber, [agent@]xname or [agent@]service.name.
+// class(in):      Delivery error class, DELIVERY_ERR_xxx.
+// Return:         true if the subscriber should be pruned.
+/////////////////////////////////////////////////////////////////////////////
+
+func pruneOnDeliveryError(subscriber string, class string) bool {
+	pp := prunePolicy()
+	subID := subscriber[strings.Index(subscriber, SUBSCRIBER_SVC_DELIM)+1:]
+	if isServiceSubscriber(subID) {
+		return inListFold(pp.Services.DeliveryErrors, class)
+	}
+	return inListFold(pp.Components.DeliveryErrors, class)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Check if the prune policy is in dry run mode for a prune reason.  API
+// deletes are always done.  Logs what would have been pruned.
+//
+// pm(in):      Prune map key, xname or agent@xname.
+// reason(in):  Reason, one of PRUNE_REASON_xxx.
+// trigger(in): Triggering SCN or error.
+// Return:      true if the prune should not be done.
+/////////////////////////////////////////////////////////////////////////////
+
+func pruneDryRun(pm string, reason string, trigger string) bool {
+	if (reason == PRUNE_REASON_API_DELETE) || !prunePolicy().DryRun {
+		return false
+	}
+	log.Printf("INFO: Prune policy dry run, would prune '%s' (%s: %s).\n",
+		pm, reason, trigger)
+	return true
+}
@@ -0,0 +1,206 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestVerifyPrunePolicy(t *testing.T) {
+	disable_logs()
+
+	pp := PrunePolicy{Components: PruneRule{States: []string{"off", "HALT"},
+		SoftwareStatus: []string{"AdminDown"}, Flags: []string{"alert"},
+		DeliveryErrors: []string{"connectionrefused"}},
+		Services: PruneRule{DeliveryErrors: []string{"RETRIESEXHAUSTED"}},
+	}
+	if err := verifyPrunePolicy(&pp); err != nil {
+		t.Fatalf("ERROR, valid policy failed verification: %v", err)
+	}
+	if (pp.Components.States[0] != "Off") || (pp.Components.States[1] != "Halt") ||
+		(pp.Components.SoftwareStatus[0] != "admindown") ||
+		(pp.Components.Flags[0] != "Alert") ||
+		(pp.Components.DeliveryErrors[0] != DELIVERY_ERR_CONN_REFUSED) ||
+		(pp.Services.DeliveryErrors[0] != DELIVERY_ERR_RETRIES) {
+		t.Errorf("ERROR, policy not normalized: %v", pp)
+	}
+
+	bad := []PrunePolicy{
+		{Components: PruneRule{States: []string{"sleepy"}}},
+		{Components: PruneRule{Flags: []string{"bogus"}}},
+		{Components: PruneRule{SoftwareStatus: []string{""}}},
+		{Components: PruneRule{DeliveryErrors: []string{"Timeout!"}}},
+		{Services: PruneRule{States: []string{"Off"}}},
+		{Services: PruneRule{Disabled: true}},
+		{Services: PruneRule{DeliveryErrors: []string{"bogus"}}},
+	}
+	for ix := range bad {
+		if err := verifyPrunePolicy(&bad[ix]); err == nil {
+			t.Errorf("ERROR, bad policy %d passed verification.", ix)
+		}
+	}
+}
+
+func TestPrunePolicyMatch(t *testing.T) {
+	disable_logs()
+	defer func() { app_params.Prune_policy = nil }()
+
+	f, tr := false, true
+
+	//Default policy
+
+	app_params.Prune_policy = nil
+	tests := []struct {
+		scn Scn
+		exp bool
+	}{
+		{Scn{State: "Off"}, true},
+		{Scn{State: "empty"}, true},
+		{Scn{State: "Halt"}, true},
+		{Scn{State: "Ready"}, false},
+		{Scn{Enabled: &f}, true},
+		{Scn{Enabled: &tr}, false},
+		{Scn{SoftwareStatus: "AdminDown"}, false},
+		{Scn{Flag: "Alert"}, false},
+	}
+	for ix, tt := range tests {
+		if isStateUnavailable(tt.scn) != tt.exp {
+			t.Errorf("ERROR, default policy test %d: expected %t", ix, tt.exp)
+		}
+	}
+	if !isComponentDead(hsmComponent{State: "Off"}) ||
+		isComponentDead(hsmComponent{State: "On"}) {
+		t.Errorf("ERROR, default policy dead component mismatch.")
+	}
+	if !pruneOnDeliveryError("handler@x0c0s0b0n0", DELIVERY_ERR_CONN_REFUSED) ||
+		!pruneOnDeliveryError("pcs@service.cray-power-control", DELIVERY_ERR_RETRIES) {
+		t.Errorf("ERROR, default policy should prune on delivery errors.")
+	}
+
+	//Custom policy
+
+	app_params.Prune_policy = &PrunePolicy{
+		Components: PruneRule{States: []string{"Off"},
+			SoftwareStatus: []string{"admindown"}, Flags: []string{"Alert"},
+			DeliveryErrors: []string{DELIVERY_ERR_RETRIES}},
+		Services: PruneRule{DeliveryErrors: []string{DELIVERY_ERR_CONN_REFUSED}},
+	}
+	tests = []struct {
+		scn Scn
+		exp bool
+	}{
+		{Scn{State: "Off"}, true},
+		{Scn{State: "Halt"}, false},
+		{Scn{Enabled: &f}, false},
+		{Scn{SoftwareStatus: "AdminDown"}, true},
+		{Scn{Flag: "alert"}, true},
+		{Scn{Flag: "OK"}, false},
+	}
+	for ix, tt := range tests {
+		if isStateUnavailable(tt.scn) != tt.exp {
+			t.Errorf("ERROR, custom policy test %d: expected %t", ix, tt.exp)
+		}
+	}
+	if !isComponentDead(hsmComponent{State: "On", SoftwareStatus: "AdminDown"}) {
+		t.Errorf("ERROR, custom policy dead component mismatch.")
+	}
+	if pruneOnDeliveryError("handler@x0c0s0b0n0", DELIVERY_ERR_CONN_REFUSED) ||
+		!pruneOnDeliveryError("handler@x0c0s0b0n0", DELIVERY_ERR_RETRIES) ||
+		!pruneOnDeliveryError("service.cray-power-control", DELIVERY_ERR_CONN_REFUSED) ||
+		pruneOnDeliveryError("pcs@service.cray-power-control", DELIVERY_ERR_RETRIES) {
+		t.Errorf("ERROR, custom policy delivery error mismatch.")
+	}
+}
+
+func TestPrunePolicyDelivery(t *testing.T) {
+	disable_logs()
+	defer func() { app_params.Prune_policy = nil }()
+
+	if htrans.transport == nil {
+		htrans.transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		htrans.client = &http.Client{Transport: htrans.transport,
+			Timeout: 5 * time.Second,
+		}
+	}
+	savedRetries, savedBackoff := app_params.Scn_retries, app_params.Scn_backoff
+	app_params.Scn_retries = 2
+	app_params.Scn_backoff = 0
+	defer func() {
+		app_params.Scn_retries = savedRetries
+		app_params.Scn_backoff = savedBackoff
+	}()
+
+	//A closed server refuses connections.
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url := srv.URL
+	srv.Close()
+
+	isPruned := func(subscriber string) bool {
+		prunemap_mutex.Lock()
+		defer prunemap_mutex.Unlock()
+		pruned := prunemap[subscriber]
+		unmarkPrune(subscriber)
+		return pruned
+	}
+
+	//Neither delivery error class prunes
+
+	sub := "handler@x1001c0s0b0n0"
+	app_params.Prune_policy = &PrunePolicy{}
+	sendScnNow(Scn{State: "On"}, sub, url)
+	if isPruned("x1001c0s0b0n0") {
+		t.Errorf("ERROR, subscriber pruned with no delivery error classes.")
+	}
+
+	//Retries exhausted prunes
+
+	app_params.Prune_policy.Components.DeliveryErrors = []string{DELIVERY_ERR_RETRIES}
+	sendScnNow(Scn{State: "On"}, sub, url)
+	if !isPruned("x1001c0s0b0n0") {
+		t.Errorf("ERROR, subscriber not pruned when retries exhausted.")
+	}
+
+	//Dry run prunes nothing, except API deletes.
+
+	app_params.Prune_policy = defaultPrunePolicy()
+	app_params.Prune_policy.DryRun = true
+	sendScnNow(Scn{State: "On"}, sub, url)
+	if isPruned("x1001c0s0b0n0") {
+		t.Errorf("ERROR, subscriber pruned in dry run mode.")
+	}
+	markPruneLocked("x1001c0s0b0n0", PRUNE_REASON_DEAD_SWEEP, "HSM State: Off")
+	if isPruned("x1001c0s0b0n0") {
+		t.Errorf("ERROR, dead subscriber pruned in dry run mode.")
+	}
+	markPruneLocked(sub, PRUNE_REASON_API_DELETE, "DELETE")
+	if !isPruned(sub) {
+		t.Errorf("ERROR, API delete not done in dry run mode.")
+	}
+}
@@ -0,0 +1,475 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A note about HSM state reconciliation:
+//
+// SCNs can get lost, for example if hmnfd restarts while holding batched
+// SCNs in its SCN cache.  Subscribers then stay wrong until the next change.
+// When enabled (Reconcile_interval > 0), the leader periodically fetches the
+// states of all subscribed components from HSM and compares them with the
+// last known states.  Each difference results in an SCN marked 'Reconciled',
+// which is delivered like any other SCN (but not put on the telemetry bus).
+//
+// The last known states are the HSM states from the previous pass, updated
+// by SCNs as they are processed.  They are kept in ETCD so that a new leader,
+// or a restarted one, can pick up where the last one left off.  A component
+// changed by an SCN after the HSM fetch started is skipped until the next
+// pass, so a reconcile never goes back in time.  A component an SCN reports
+// before any pass has seen it is recorded with just what the SCN says, and
+// only those attributes are compared on the next pass.
+//
+// Reconciled SCNs share the SCN queue with the ones from HSM, so they never
+// wait for room in it.  They use at most half of it, and at most
+// reconcileMaxScns are sent per pass; for the ones not sent, the components
+// keep their last known values of that attribute, so the next pass picks
+// them up.
+//
+// Without segmented fanout, SCNs handled by other replicas are not seen by
+// the leader, so those changes are sent again as reconciled SCNs.  This is
+// harmless, since a reconciled SCN just states the current state.
+
+/////////////////////////////////////////////////////////////////////////////
+// Data Structures
+/////////////////////////////////////////////////////////////////////////////
+
+// Last known state of a component.
+
+type reconcileState struct {
+	State          string    `json:"State,omitempty"`
+	SoftwareStatus string    `json:"SoftwareStatus,omitempty"`
+	Role           string    `json:"Role,omitempty"`
+	SubRole        string    `json:"SubRole,omitempty"`
+	Enabled        *bool     `json:"Enabled,omitempty"`
+	Partial        bool      `json:"Partial,omitempty"` //only set by SCNs so far
+	updated        time.Time //last changed by an SCN
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Constants
+/////////////////////////////////////////////////////////////////////////////
+
+const RECONCILE_STATE_KEY = "reconcile_state"
+
+/////////////////////////////////////////////////////////////////////////////
+// Global Variables
+/////////////////////////////////////////////////////////////////////////////
+
+var reconcileStates = make(map[string]reconcileState)
+var reconcileLoaded = false
+var reconcileLast time.Time
+var reconcileLastCount = 0
+var reconcileMaxScns = 1000 //reconciled SCNs sent per pass
+var reconcileMutex = &sync.Mutex{}
+
+/////////////////////////////////////////////////////////////////////////////
+// Update the last known states of components from an SCN.  Components not
+// known yet are recorded as partial, with just the SCN's attributes.
+// Reconciled SCNs are skipped, their states are already known.
+//
+// scn(in): SCN, lower case.
+// Return:  None.
+/////////////////////////////////////////////////////////////////////////////
+
+func reconcileStateUpdate(scn Scn) {
+	if (app_params.Reconcile_interval <= 0) || scn.Reconciled {
+		return
+	}
+
+	reconcileMutex.Lock()
+	defer reconcileMutex.Unlock()
+
+	if !reconcileLoaded {
+		return
+	}
+	now := time.Now()
+	for _, comp := range scn.Components {
+		rs, ok := reconcileStates[comp]
+		if !ok {
+			rs.Partial = true
+		}
+		if scn.State != "" {
+			rs.State = scn.State
+		}
+		if scn.SoftwareStatus != "" {
+			rs.SoftwareStatus = scn.SoftwareStatus
+		}
+		if scn.Role != "" {
+			rs.Role = scn.Role
+		}
+		if scn.SubRole != "" {
+			rs.SubRole = scn.SubRole
+		}
+		if scn.Enabled != nil {
+			enbl := *scn.Enabled
+			rs.Enabled = &enbl
+		}
+		rs.updated = now
+		reconcileStates[comp] = rs
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Load the last known component states from ETCD.
+//
+// Args:   None.
+// Return: nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func loadReconcileStates() error {
+	rmap := make(map[string]reconcileState)
+
+	val, ok, err := kvHandle.Get(RECONCILE_STATE_KEY)
+	if err != nil {
+		return err
+	}
+	if ok {
+		err = json.Unmarshal([]byte(val), &rmap)
+		if err != nil {
+			return err
+		}
+	}
+
+	reconcileMutex.Lock()
+	reconcileStates = rmap
+	reconcileLoaded = true
+	reconcileMutex.Unlock()
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get the list of all subscribed components.
+//
+// Args:   None.
+// Return: List of component XNames, lower case; nil on success, error
+//         string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func subscribedComponents() ([]string, error) {
+	var comps []string
+
+	kvlist, kverr := kvHandle.GetRange(SUBSCRIBER_KEYRANGE_START,
+		SUBSCRIBER_KEYRANGE_END)
+	if kverr != nil {
+		return nil, kverr
+	}
+
+	compMap := make(map[string]bool)
+	for _, kv := range kvlist {
+		var sd SubData
+		err := json.Unmarshal([]byte(kv.Value), &sd)
+		if err != nil {
+			log.Printf("ERROR unmarshalling subscription '%s': %v", kv.Key, err)
+			continue
+		}
+		for _, comp := range sd.ScnNodes {
+			compMap[strings.ToLower(comp)] = true
+		}
+	}
+	for comp := range compMap {
+		comps = append(comps, comp)
+	}
+	sort.Strings(comps)
+	return comps, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Compare a component's HSM state with its last known state, and add it
+// to a reconciled SCN for each attribute which differs.
+//
+// xname(in):  Component XName.
+// old(in):    Last known state.
+// comp(in):   HSM state.
+// scns(out):  Map of attribute:value -> reconciled SCN.
+// Return:     None.
+/////////////////////////////////////////////////////////////////////////////
+
+func reconcileDiff(xname string, old reconcileState, comp hsmComponent,
+	scns map[string]*Scn) {
+	add := func(key string, setval func(*Scn)) {
+		scn, ok := scns[key]
+		if !ok {
+			scn = &Scn{Reconciled: true}
+			setval(scn)
+			scns[key] = scn
+		}
+		scn.Components = append(scn.Components, xname)
+	}
+
+	//Only what an SCN set is known about a partial state.
+
+	if old.Partial {
+		if old.State == "" {
+			old.State = strings.ToLower(comp.State)
+		}
+		if old.SoftwareStatus == "" {
+			old.SoftwareStatus = strings.ToLower(comp.SoftwareStatus)
+		}
+		if old.Role == "" {
+			old.Role = strings.ToLower(comp.Role)
+		}
+		if old.SubRole == "" {
+			old.SubRole = strings.ToLower(comp.SubRole)
+		}
+	}
+
+	if (comp.State != "") && (strings.ToLower(comp.State) != old.State) {
+		add("State:"+comp.State, func(scn *Scn) { scn.State = comp.State })
+	}
+	if (comp.SoftwareStatus != "") &&
+		(strings.ToLower(comp.SoftwareStatus) != old.SoftwareStatus) {
+		add("SoftwareStatus:"+comp.SoftwareStatus,
+			func(scn *Scn) { scn.SoftwareStatus = comp.SoftwareStatus })
+	}
+	if (comp.Role != "") && (strings.ToLower(comp.Role) != old.Role) {
+		add("Role:"+comp.Role, func(scn *Scn) { scn.Role = comp.Role })
+	}
+	if (comp.SubRole != "") && (strings.ToLower(comp.SubRole) != old.SubRole) {
+		add("SubRole:"+comp.SubRole, func(scn *Scn) { scn.SubRole = comp.SubRole })
+	}
+	if (comp.Enabled != nil) && (old.Enabled != nil) &&
+		(*comp.Enabled != *old.Enabled) {
+		enbl := *comp.Enabled
+		add(fmt.Sprintf("Enabled:%t", enbl),
+			func(scn *Scn) { scn.Enabled = &enbl })
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Do one reconcile pass.  Fetch the HSM states of all subscribed components,
+// compare them with the last known states, queue reconciled SCNs for any
+// differences, and store the new last known states.  Components keep their
+// last known values of the attributes whose reconciled SCNs couldn't be
+// queued.
+//
+// Args:   None.
+// Return: Reconciled SCNs queued; nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func reconcileWithHsm() ([]Scn, error) {
+	var rscns []Scn
+
+	reconcileMutex.Lock()
+	loaded := reconcileLoaded
+	reconcileMutex.Unlock()
+	if !loaded {
+		err := loadReconcileStates()
+		if err != nil {
+			return nil, fmt.Errorf("can't load last known component states: %v", err)
+		}
+	}
+
+	comps, err := subscribedComponents()
+	if err != nil {
+		return nil, fmt.Errorf("can't get subscribed components: %v", err)
+	}
+
+	start := time.Now()
+	hcomps, err := queryComponentStates(comps)
+	if err != nil {
+		return nil, fmt.Errorf("can't get component states from HSM: %v", err)
+	}
+
+	scnMap := make(map[string]*Scn)
+	newStates := make(map[string]reconcileState)
+	oldStates := make(map[string]reconcileState)
+
+	reconcileMutex.Lock()
+	for _, comp := range hcomps {
+		xname := strings.ToLower(comp.ID)
+		old, ok := reconcileStates[xname]
+		if ok && old.updated.After(start) {
+			newStates[xname] = old
+			continue
+		}
+		if ok {
+			reconcileDiff(xname, old, comp, scnMap)
+			oldStates[xname] = old
+		}
+		newStates[xname] = reconcileState{State: strings.ToLower(comp.State),
+			SoftwareStatus: strings.ToLower(comp.SoftwareStatus),
+			Role:           strings.ToLower(comp.Role),
+			SubRole:        strings.ToLower(comp.SubRole),
+			Enabled:        comp.Enabled,
+		}
+	}
+	reconcileStates = newStates
+	reconcileMutex.Unlock()
+
+	//Queue the reconciled SCNs in a predictable order.
+
+	var keys []string
+	for key := range scnMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var deferred []Scn
+	ts := time.Now().Format(time.RFC3339Nano)
+	for _, key := range keys {
+		scn := *scnMap[key]
+		scn.Timestamp = ts
+		if (len(rscns) < reconcileMaxScns) && queueReconciledScn(scn) {
+			rscns = append(rscns, scn)
+		} else {
+			deferred = append(deferred, scn)
+		}
+	}
+	if len(deferred) > 0 {
+		log.Printf("WARNING: SCN queue busy, %d reconciled SCNs left for the next pass.\n",
+			len(deferred))
+	}
+
+	reconcileMutex.Lock()
+	for _, scn := range deferred {
+		for _, xname := range scn.Components {
+			rs, ok := reconcileStates[xname]
+			if !ok || rs.updated.After(start) {
+				continue
+			}
+			old := oldStates[xname]
+			switch {
+			case scn.State != "":
+				rs.State = old.State
+			case scn.SoftwareStatus != "":
+				rs.SoftwareStatus = old.SoftwareStatus
+			case scn.Role != "":
+				rs.Role = old.Role
+			case scn.SubRole != "":
+				rs.SubRole = old.SubRole
+			case scn.Enabled != nil:
+				rs.Enabled = old.Enabled
+			}
+			reconcileStates[xname] = rs
+		}
+	}
+	ba, err := json.Marshal(reconcileStates)
+	reconcileMutex.Unlock()
+
+	if err != nil {
+		log.Printf("ERROR marshalling last known component states: %v", err)
+	} else {
+		err = kvHandle.Store(RECONCILE_STATE_KEY, string(ba))
+		if err != nil {
+			log.Printf("ERROR storing last known component states: %v", err)
+		}
+	}
+	return rscns, nil
+}
+
+// Put a reconciled SCN on the SCN queue if it's at most half full, leaving
+// the rest for SCNs from HSM.  Never waits.  The queued SCN gets its own
+// copy of the components, since they are lower-cased in place when handled.
+
+func queueReconciledScn(scn Scn) bool {
+	if len(scnQ) >= (cap(scnQ) / 2) {
+		return false
+	}
+	scn.Components = append([]string{}, scn.Components...)
+	select {
+	case scnQ <- scn:
+		return true
+	default:
+		return false
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get a description of the reconciler's status, for /health.
+//
+// Args:   None.
+// Return: Status string.
+/////////////////////////////////////////////////////////////////////////////
+
+func reconcileStatus() string {
+	if app_params.Reconcile_interval <= 0 {
+		return "Disabled"
+	}
+	if !isLeader() {
+		return "Runs on leader"
+	}
+
+	reconcileMutex.Lock()
+	defer reconcileMutex.Unlock()
+	if reconcileLast.IsZero() {
+		return "Not run yet"
+	}
+	return fmt.Sprintf("Last:%s, Components:%d, Reconciled SCNs:%d",
+		reconcileLast.Format(time.RFC3339), len(reconcileStates),
+		reconcileLastCount)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Thread func for HSM state reconciliation.  Only the leader reconciles;
+// a replica which isn't the leader will reload the last known states from
+// ETCD when it becomes the leader.
+//
+// Args, Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func reconcileComponents() {
+	for Running {
+		time.Sleep(time.Second)
+
+		if (app_params.Reconcile_interval <= 0) || (app_params.Nosm != 0) ||
+			!isLeader() {
+			reconcileMutex.Lock()
+			if reconcileLoaded {
+				reconcileLoaded = false
+				reconcileStates = make(map[string]reconcileState)
+			}
+			reconcileMutex.Unlock()
+			continue
+		}
+
+		reconcileMutex.Lock()
+		last := reconcileLast
+		reconcileMutex.Unlock()
+		if time.Since(last) < (time.Duration(app_params.Reconcile_interval) * time.Second) {
+			continue
+		}
+
+		rscns, err := reconcileWithHsm()
+		if err != nil {
+			log.Printf("ERROR reconciling component states with HSM: %v", err)
+		} else if len(rscns) > 0 {
+			log.Printf("INFO: Sent %d reconciled SCNs for missed HSM state changes.\n",
+				len(rscns))
+		}
+
+		reconcileMutex.Lock()
+		reconcileLast = time.Now()
+		reconcileLastCount = len(rscns)
+		reconcileMutex.Unlock()
+	}
+}
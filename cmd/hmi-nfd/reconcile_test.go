@@ -0,0 +1,214 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReconcileWithHsm(t *testing.T) {
+	var kverr error
+
+	disable_logs()
+
+	enbl := true
+	fh := &fakeHsmStates{comps: map[string]hsmComponent{
+		"x0c0s0b0n0": {ID: "x0c0s0b0n0", State: "Ready", Role: "Compute", Enabled: &enbl},
+		"x0c0s0b0n1": {ID: "x0c0s0b0n1", State: "Ready", Role: "Compute", Enabled: &enbl},
+		"x0c0s0b0n2": {ID: "x0c0s0b0n2", State: "Ready", Role: "Compute", Enabled: &enbl},
+	}}
+	hsrv := httptest.NewServer(fh)
+	defer hsrv.Close()
+
+	if htrans.transport == nil {
+		htrans.transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		htrans.client = &http.Client{Transport: htrans.transport,
+			Timeout: 5 * time.Second,
+		}
+	}
+
+	kverr = openTestKV()
+	if kverr != nil {
+		t.Fatal("KV/ETCD open failed:", kverr)
+	}
+	defer kvPurge(t)
+
+	savedSM := app_params.SM_url
+	app_params.SM_url = hsrv.URL
+	app_params.Nosm = 0
+	app_params.Reconcile_interval = 30
+	defer func() {
+		app_params.SM_url = savedSM
+		app_params.Nosm = 1
+		app_params.Reconcile_interval = 0
+		reconcileMutex.Lock()
+		reconcileStates = make(map[string]reconcileState)
+		reconcileLoaded = false
+		reconcileMutex.Unlock()
+	}()
+
+	sd := SubData{Url: "", ScnNodes: []string{"x0c0s0b0n0", "x0c0s0b0n1", "x0c0s0b0n2"}}
+	ba, _ := json.Marshal(sd)
+	kvHandle.Store("sub#x1c2s3b0n4#hs.ready.off#roles.compute.application", string(ba))
+
+	//First pass only learns the states.
+
+	rscns, err := reconcileWithHsm()
+	if err != nil {
+		t.Fatal("ERROR reconciling with HSM:", err)
+	}
+	if len(rscns) != 0 {
+		t.Errorf("ERROR, expected no reconciled SCNs on first pass, got %v", rscns)
+	}
+	if _, ok, _ := kvHandle.Get(RECONCILE_STATE_KEY); !ok {
+		t.Errorf("ERROR, last known states not stored.")
+	}
+
+	//HSM changes; one change is delivered by an SCN, the others are missed.
+
+	fh.Lock()
+	fh.comps["x0c0s0b0n0"] = hsmComponent{ID: "x0c0s0b0n0", State: "Halt",
+		Role: "Compute", Enabled: &enbl}
+	fh.comps["x0c0s0b0n1"] = hsmComponent{ID: "x0c0s0b0n1", State: "Off",
+		Role: "Compute", Enabled: &enbl}
+	fh.comps["x0c0s0b0n2"] = hsmComponent{ID: "x0c0s0b0n2", State: "Ready",
+		Role: "Application", Enabled: &enbl}
+	fh.Unlock()
+	reconcileStateUpdate(Scn{Components: []string{"x0c0s0b0n0"}, State: "halt"})
+
+	rscns, err = reconcileWithHsm()
+	if err != nil {
+		t.Fatal("ERROR reconciling with HSM:", err)
+	}
+	if len(rscns) != 2 {
+		t.Fatalf("ERROR, expected 2 reconciled SCNs, got %d: %v", len(rscns), rscns)
+	}
+	if (rscns[0].Role != "Application") || (len(rscns[0].Components) != 1) ||
+		(rscns[0].Components[0] != "x0c0s0b0n2") || !rscns[0].Reconciled {
+		t.Errorf("ERROR, reconciled Role SCN mismatch: %v", rscns[0])
+	}
+	if (rscns[1].State != "Off") || (len(rscns[1].Components) != 1) ||
+		(rscns[1].Components[0] != "x0c0s0b0n1") || !rscns[1].Reconciled {
+		t.Errorf("ERROR, reconciled State SCN mismatch: %v", rscns[1])
+	}
+
+	//A new leader picks up the last known states from ETCD.
+
+	reconcileMutex.Lock()
+	reconcileStates = make(map[string]reconcileState)
+	reconcileLoaded = false
+	reconcileMutex.Unlock()
+
+	fh.Lock()
+	fh.comps["x0c0s0b0n1"] = hsmComponent{ID: "x0c0s0b0n1", State: "Ready",
+		Role: "Compute", Enabled: &enbl}
+	fh.Unlock()
+
+	rscns, err = reconcileWithHsm()
+	if err != nil {
+		t.Fatal("ERROR reconciling with HSM:", err)
+	}
+	if (len(rscns) != 1) || (rscns[0].State != "Ready") ||
+		(rscns[0].Components[0] != "x0c0s0b0n1") {
+		t.Errorf("ERROR, expected 1 reconciled Ready SCN after reload, got %v", rscns)
+	}
+
+	//Nothing changed, nothing to send.
+
+	rscns, err = reconcileWithHsm()
+	if err != nil {
+		t.Fatal("ERROR reconciling with HSM:", err)
+	}
+	if len(rscns) != 0 {
+		t.Errorf("ERROR, expected no reconciled SCNs, got %v", rscns)
+	}
+
+	//A newly subscribed component's SCN, seen before any pass has seen
+	//the component, isn't sent again as a reconciled SCN.
+
+	fh.Lock()
+	fh.comps["x0c0s0b0n3"] = hsmComponent{ID: "x0c0s0b0n3", State: "Off",
+		Role: "Compute", Enabled: &enbl}
+	fh.Unlock()
+	sd.ScnNodes = append(sd.ScnNodes, "x0c0s0b0n3")
+	ba, _ = json.Marshal(sd)
+	kvHandle.Store("sub#x1c2s3b0n4#hs.ready.off#roles.compute.application", string(ba))
+	reconcileStateUpdate(Scn{Components: []string{"x0c0s0b0n3"}, State: "off"})
+
+	rscns, err = reconcileWithHsm()
+	if err != nil {
+		t.Fatal("ERROR reconciling with HSM:", err)
+	}
+	if len(rscns) != 0 {
+		t.Errorf("ERROR, expected no reconciled SCNs for a new component, got %v", rscns)
+	}
+	rscns, err = reconcileWithHsm()
+	if err != nil {
+		t.Fatal("ERROR reconciling with HSM:", err)
+	}
+	if len(rscns) != 0 {
+		t.Errorf("ERROR, expected no reconciled SCNs on the next pass, got %v", rscns)
+	}
+
+	//Reconciled SCNs over the per-pass limit are left for the next pass.
+
+	reconcileMaxScns = 1
+	defer func() { reconcileMaxScns = 1000 }()
+
+	fh.Lock()
+	fh.comps["x0c0s0b0n0"] = hsmComponent{ID: "x0c0s0b0n0", State: "Ready",
+		Role: "Compute", Enabled: &enbl}
+	fh.comps["x0c0s0b0n3"] = hsmComponent{ID: "x0c0s0b0n3", State: "Ready",
+		Role: "Application", Enabled: &enbl}
+	fh.Unlock()
+
+	rscns, err = reconcileWithHsm()
+	if err != nil {
+		t.Fatal("ERROR reconciling with HSM:", err)
+	}
+	if (len(rscns) != 1) || (rscns[0].Role != "Application") {
+		t.Fatalf("ERROR, expected 1 reconciled Role SCN, got %v", rscns)
+	}
+	rscns, err = reconcileWithHsm()
+	if err != nil {
+		t.Fatal("ERROR reconciling with HSM:", err)
+	}
+	if (len(rscns) != 1) || (rscns[0].State != "Ready") ||
+		(len(rscns[0].Components) != 2) {
+		t.Errorf("ERROR, expected the deferred Ready SCN, got %v", rscns)
+	}
+	rscns, err = reconcileWithHsm()
+	if err != nil {
+		t.Fatal("ERROR reconciling with HSM:", err)
+	}
+	if len(rscns) != 0 {
+		t.Errorf("ERROR, expected no reconciled SCNs after catching up, got %v", rscns)
+	}
+}
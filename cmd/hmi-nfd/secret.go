@@ -0,0 +1,221 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// A note about subscription secrets:
+//
+// A v2 subscription can register a shared Secret.  Each SCN delivered to
+// it is then signed with HMAC-SHA256 over a timestamp and the body, in the
+// X-HMNFD-Signature and X-HMNFD-Timestamp headers; see pkg/scnsign, which
+// subscribers can use to verify them.
+//
+// Secrets are never shown in subscription lists, and are encrypted at rest
+// in ETCD with AES-256-GCM.  The key is the SHA-256 of the contents of the
+// secret key file (--secret_key_file or HMNFD_SECRET_KEY_FILE), which all
+// replicas must share.  If there is no key file, subscriptions with a
+// Secret are rejected.  A stored secret is "v1:" followed by the base64
+// nonce and ciphertext, so the format can change later.
+
+/////////////////////////////////////////////////////////////////////////////
+// Constants
+/////////////////////////////////////////////////////////////////////////////
+
+const (
+	SECRET_MIN_LEN   = 16
+	SECRET_MAX_LEN   = 256
+	SECRET_ENC_V1    = "v1:"
+	SECRET_KEY_BYTES = 32
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Data structures
+/////////////////////////////////////////////////////////////////////////////
+
+// Fields of a subscription request whose values are case sensitive.  The
+// rest of the request is lowercased before unmarshalling, so these are
+// taken from the request body as is.
+
+type subscriptionCreds struct {
+	Secret string            `json:"Secret,omitempty"`
+	Auth   *SubscriptionAuth `json:"Auth,omitempty"`
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Global variables
+/////////////////////////////////////////////////////////////////////////////
+
+var secretKey []byte
+
+/////////////////////////////////////////////////////////////////////////////
+// Load the key used to encrypt subscription secrets.
+//
+// fname(in): Key file.  Any contents will do; it is hashed into a key.
+// Return:    nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func loadSecretKeyFile(fname string) error {
+	ba, err := os.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	kdata := strings.TrimSpace(string(ba))
+	if kdata == "" {
+		return fmt.Errorf("secret key file '%s' is empty", fname)
+	}
+	key := sha256.Sum256([]byte(kdata))
+	secretKey = key[:]
+	return nil
+}
+
+// Get the AES-GCM cipher for subscription secrets.
+
+func secretCipher() (cipher.AEAD, error) {
+	if len(secretKey) != SECRET_KEY_BYTES {
+		return nil, fmt.Errorf("subscription secrets are not enabled, no secret key file is set")
+	}
+	block, err := aes.NewCipher(secretKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Encrypt a subscription secret for storage.
+//
+// secret(in): Secret, plain text.
+// Return:     Encrypted secret; nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func encryptSecret(secret string) (string, error) {
+	gcm, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	ct := gcm.Seal(nonce, nonce, []byte(secret), nil)
+	return SECRET_ENC_V1 + base64.StdEncoding.EncodeToString(ct), nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Decrypt a stored subscription secret.
+//
+// enc(in): Encrypted secret, from encryptSecret().
+// Return:  Secret, plain text; nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func decryptSecret(enc string) (string, error) {
+	if !strings.HasPrefix(enc, SECRET_ENC_V1) {
+		return "", fmt.Errorf("unknown secret encoding")
+	}
+	ct, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(enc, SECRET_ENC_V1))
+	if err != nil {
+		return "", err
+	}
+	gcm, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	if len(ct) < gcm.NonceSize() {
+		return "", fmt.Errorf("encrypted secret is too short")
+	}
+	pt, err := gcm.Open(nil, ct[:gcm.NonceSize()], ct[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("can't decrypt secret: %v", err)
+	}
+	return string(pt), nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get the case sensitive fields of a subscription request.
+//
+// body(in): Request body, as received.
+// Return:   Case sensitive fields; nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func getSubscriptionCreds(body []byte) (subscriptionCreds, error) {
+	var creds subscriptionCreds
+	err := json.Unmarshal(body, &creds)
+	return creds, err
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Check a subscription secret, and encrypt it for storage.
+//
+// secret(in): Secret from the request, plain text.  May be empty.
+// Return:     Encrypted secret, "" if none; nil on success, error string
+//             on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func checkSubscriptionSecret(secret string) (string, error) {
+	if secret == "" {
+		return "", nil
+	}
+	if (len(secret) < SECRET_MIN_LEN) || (len(secret) > SECRET_MAX_LEN) {
+		return "", fmt.Errorf("Secret must be %d-%d characters", SECRET_MIN_LEN,
+			SECRET_MAX_LEN)
+	}
+	return encryptSecret(secret)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get a subscription request body for logging, with its secret and auth
+// token and header values taken out.
+//
+// body(in):  Request body, as received.
+// creds(in): Case sensitive fields from the body.
+// Return:    Body to log.
+/////////////////////////////////////////////////////////////////////////////
+
+func redactSubscriptionBody(body []byte, creds subscriptionCreds) string {
+	vals := []string{creds.Secret}
+	if creds.Auth != nil {
+		vals = append(vals, creds.Auth.BearerToken)
+		for _, val := range creds.Auth.Headers {
+			vals = append(vals, val)
+		}
+	}
+
+	rbody := string(body)
+	for _, val := range vals {
+		if val != "" {
+			rbody = strings.ReplaceAll(rbody, val, AUTH_REDACTED)
+		}
+	}
+	return rbody
+}
@@ -0,0 +1,231 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cray-HPE/hms-hmnfd/pkg/scnsign"
+)
+
+// Set up a test secret key.
+
+func testSecretKey(t *testing.T, kdata string) {
+	fname := t.TempDir() + "/secret.key"
+	if err := os.WriteFile(fname, []byte(kdata+"\n"), 0600); err != nil {
+		t.Fatal("Can't write secret key file:", err)
+	}
+	if err := loadSecretKeyFile(fname); err != nil {
+		t.Fatal("ERROR loading secret key file:", err)
+	}
+}
+
+func TestEncryptSecret(t *testing.T) {
+	saved := secretKey
+	defer func() { secretKey = saved }()
+
+	secretKey = nil
+	if _, err := encryptSecret("MySecretValue1234"); err == nil {
+		t.Errorf("ERROR, secret encrypted with no key.")
+	}
+	if _, err := checkSubscriptionSecret("MySecretValue1234"); err == nil {
+		t.Errorf("ERROR, subscription secret accepted with no key.")
+	}
+
+	testSecretKey(t, "key-one")
+	enc, err := encryptSecret("MySecretValue1234")
+	if err != nil {
+		t.Fatal("ERROR encrypting secret:", err)
+	}
+	if !strings.HasPrefix(enc, SECRET_ENC_V1) || strings.Contains(enc, "MySecretValue1234") {
+		t.Errorf("ERROR, bad encrypted secret '%s'", enc)
+	}
+	if enc2, _ := encryptSecret("MySecretValue1234"); enc2 == enc {
+		t.Errorf("ERROR, encryption is not randomized.")
+	}
+	if plain, err := decryptSecret(enc); (err != nil) || (plain != "MySecretValue1234") {
+		t.Errorf("ERROR, decrypt failed: '%s', %v", plain, err)
+	}
+
+	//Tampered, or a different key, fails.
+
+	bad := []byte(enc)
+	bad[len(bad)-2] ^= 1
+	if _, err = decryptSecret(string(bad)); err == nil {
+		t.Errorf("ERROR, tampered secret decrypted.")
+	}
+	if _, err = decryptSecret("v0:abcd"); err == nil {
+		t.Errorf("ERROR, unknown encoding decrypted.")
+	}
+	testSecretKey(t, "key-two")
+	if _, err = decryptSecret(enc); err == nil {
+		t.Errorf("ERROR, secret decrypted with the wrong key.")
+	}
+
+	//Length limits.
+
+	for _, sec := range []string{"short", strings.Repeat("x", SECRET_MAX_LEN+1)} {
+		if _, err = checkSubscriptionSecret(sec); err == nil {
+			t.Errorf("ERROR, bad secret length %d accepted.", len(sec))
+		}
+	}
+	if enc, err = checkSubscriptionSecret(""); (err != nil) || (enc != "") {
+		t.Errorf("ERROR, empty secret: '%s', %v", enc, err)
+	}
+
+	if err = loadSecretKeyFile("/nonexistent/secret.key"); err == nil {
+		t.Errorf("ERROR, missing secret key file loaded.")
+	}
+}
+
+func TestRedactSubscriptionBody(t *testing.T) {
+	body := []byte(`{"Url":"http://x/scn","Secret":"MySecretValue1234"}`)
+	creds, err := getSubscriptionCreds(body)
+	if err != nil {
+		t.Fatal("ERROR getting creds:", err)
+	}
+	rb := redactSubscriptionBody(body, creds)
+	if strings.Contains(rb, "MySecretValue1234") || !strings.Contains(rb, "<redacted>") {
+		t.Errorf("ERROR, secret not redacted: '%s'", rb)
+	}
+}
+
+func TestSignedDelivery(t *testing.T) {
+	var kverr error
+	var verr error
+	var nrcv int
+
+	disable_logs()
+	kverr = openTestKV()
+	if kverr != nil {
+		t.Fatal("KV/ETCD open failed:", kverr)
+	}
+	defer kvPurge(t)
+	if htrans.transport == nil {
+		htrans.transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		htrans.client = &http.Client{Transport: htrans.transport,
+			Timeout: 5 * time.Second,
+		}
+	}
+	saved := app_params
+	savedKey := secretKey
+	app_params.Scn_retries = 1
+	app_params.Scn_breaker_threshold = 0
+	defer func() {
+		waitSubQueues(t)
+		restoreAppParams(saved)
+		secretKey = savedKey
+	}()
+
+	secret := "Mixed-Case-Secret-0123"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nrcv++
+		_, verr = scnsign.VerifyRequest(r, []byte(secret), scnsign.DefaultTolerance)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	router := newRouter(generateRoutes())
+	subUrl := "http://localhost:8080/hmi/v2/subscriptions/x1000c0s1b0n0/agents/pcs"
+	subKey := "sub#x1000c0s1b0n0#hs.ready#svc.pcs"
+	payload := `{"Components":["x1000c0s0b0n0"],"States":["Ready"],"Url":"` +
+		srv.URL + `","Secret":"` + secret + `"}`
+
+	post := func(method string, pl string) int {
+		req, _ := http.NewRequest(method, subUrl, bytes.NewBufferString(pl))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	//No key, no secrets.
+
+	secretKey = nil
+	if code := post("POST", payload); code != http.StatusBadRequest {
+		t.Errorf("ERROR, secret accepted with no key, returned %d", code)
+	}
+	testSecretKey(t, "the-secret-key")
+
+	if code := post("POST", strings.Replace(payload, secret, "short", 1)); code != http.StatusBadRequest {
+		t.Errorf("ERROR, short secret accepted, returned %d", code)
+	}
+	if code := post("POST", payload); code != http.StatusOK {
+		t.Fatalf("ERROR, POST with secret returned %d", code)
+	}
+
+	//Stored encrypted, with its case intact, and never listed.
+
+	val, _, _ := kvHandle.Get(subKey)
+	if strings.Contains(val, secret) || strings.Contains(val, strings.ToLower(secret)) {
+		t.Errorf("ERROR, secret stored in the clear: %s", val)
+	}
+	sd, ok := getSubData(t, subKey)
+	if !ok {
+		t.Fatalf("ERROR, subscription key '%s' not created.", subKey)
+	}
+	if plain, err := decryptSecret(sd.Secret); (err != nil) || (plain != secret) {
+		t.Errorf("ERROR, stored secret decrypts to '%s', %v", plain, err)
+	}
+	req, _ := http.NewRequest("GET", "http://localhost:8080/hmi/v2/subscriptions/x1000c0s1b0n0", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if strings.Contains(strings.ToLower(rr.Body.String()), "secret") {
+		t.Errorf("ERROR, secret listed: %s", rr.Body.String())
+	}
+
+	//Deliveries are signed.
+
+	j := NewJobSCNSendSub(Scn{Components: []string{"x1000c0s0b0n0"}, State: "Ready"},
+		"pcs@x1000c0s1b0n0", srv.URL, subKey, sd.Generation, sd.sendOpts()).(*JobSCNSend)
+	if sendSCNToSubscriber(j) || (nrcv != 1) || (verr != nil) {
+		t.Errorf("ERROR, signed delivery failed: %d received, %v", nrcv, verr)
+	}
+
+	//Can't decrypt it: not sent, kept as a dead letter without the secret
+	//showing.
+
+	testSecretKey(t, "some-other-key")
+	j = NewJobSCNSendSub(Scn{State: "Ready"}, "pcs@x1000c0s1b0n0", srv.URL,
+		subKey, sd.Generation, sd.sendOpts()).(*JobSCNSend)
+	if sendSCNToSubscriber(j) || (nrcv != 1) {
+		t.Errorf("ERROR, SCN sent without a usable secret.")
+	}
+	var dlist DeadLetterList
+	req, _ = http.NewRequest("GET", "http://localhost:8080/hmi/v2/deadletters", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	json.Unmarshal(rr.Body.Bytes(), &dlist)
+	if (len(dlist.DeadLetters) != 1) || (dlist.DeadLetters[0].Secret != "") {
+		t.Errorf("ERROR, bad dead letters: %s", rr.Body.String())
+	}
+}
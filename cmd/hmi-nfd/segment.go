@@ -0,0 +1,701 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	base "github.com/Cray-HPE/hms-base/v2"
+)
+
+// A note about segmented fanout:
+//
+// Each running hmnfd instance registers itself in ETCD as a replica.  A
+// replica is live for as long as its live key exists; the key is bound to an
+// ETCD lease which the replica keeps alive, so ETCD removes it when the
+// replica dies, and no replica's clock is involved.  The replica's URL is
+// kept in a separate registration key, refreshed periodically.  The set of
+// live replicas is placed on a consistent hash ring, and each subscriber
+// XName is owned by exactly one replica on that ring.
+//
+// When an SCN batch is ready for fanout, the replica that received it from
+// HSM sends it to every other live replica.  Every replica, including the
+// receiving one, then delivers the SCN only to the subscribers it owns.
+// When a replica goes away its live key goes away, it drops off of the
+// ring, and its subscribers get spread across the remaining replicas.
+//
+// Replicas see membership changes at slightly different times, so for a
+// while they may disagree about who owns a subscriber.  Rather than have
+// nobody deliver to it, replicas fail open: for REPLICA_SETTLE seconds after
+// a change, a replica also delivers to the subscribers it owned before the
+// change, and a replica which hasn't been able to read membership for
+// REPLICA_STALE seconds delivers to all subscribers.  Subscribers can get an
+// SCN twice around membership changes, but don't miss any.
+//
+// Each peer replica has one goroutine sending it hand-offs, in the order the
+// SCNs were received, so SCNs about a component reach its owner in order
+// and its subscriber queues keep them that way.  If an SCN can't be handed
+// off to a peer replica, the sending replica delivers that peer's share
+// itself, so nothing is lost while membership catches up.  Only the
+// delivery is done again; what's done once per SCN (prune marking, cached
+// state updates) was already done when the SCN was received.
+//
+// SCN streams (see stream.go) are fed by every replica, so every SCN is
+// handed off to every other replica whether or not fanout is segmented.
+// Without segmented fanout the hand-offs are for streams only, and the
+// peers don't deliver them to subscribers.  A peer which misses hand-offs,
+// because it couldn't be reached or was too far behind, is told so with the
+// next one that gets through, and tells its streams.
+
+/////////////////////////////////////////////////////////////////////////////
+// Data Structures
+/////////////////////////////////////////////////////////////////////////////
+
+// Replica registration info, stored in ETCD as the value of a replica key.
+// Heartbeat is only used by older replicas, which judge liveness by it.
+
+type replicaInfo struct {
+	Name      string `json:"Name"`
+	Url       string `json:"Url"`
+	Heartbeat int64  `json:"Heartbeat"`
+}
+
+// Consistent hash ring.  Each replica has REPLICA_VNODES points on the ring
+// to keep the subscriber distribution reasonably even.
+
+type hashRing struct {
+	points []uint32
+	owners map[uint32]string
+}
+
+// An SCN handed off between replicas.  deliver is false if it is only for
+// streams; missed is true if earlier hand-offs to the peer were lost.
+
+type replicaHandoff struct {
+	ri      replicaInfo
+	scn     Scn
+	ba      []byte
+	deliver bool
+	missed  bool
+}
+
+// A peer replica's hand-off sender.  Its queue is closed when the peer goes
+// away; what's already queued is still handled.
+
+type replicaSender struct {
+	q    chan replicaHandoff
+	lost bool //hand-offs were dropped; protected by replicaSenders_mutex
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Constants
+/////////////////////////////////////////////////////////////////////////////
+
+const (
+	REPLICA_KEY_PREFIX     = "replica#"
+	REPLICA_KEYRANGE_START = "replica#"
+	REPLICA_KEYRANGE_END   = "replica#~"
+	REPLICA_LIVE_PREFIX    = "replicalive#" //lease-bound, one per live replica
+	REPLICA_LIVE_START     = "replicalive#"
+	REPLICA_LIVE_END       = "replicalive#~"
+	REPLICA_HEARTBEAT      = 5  //seconds between registration refreshes
+	REPLICA_STALE          = 15 //seconds w/o a membership read before unsure
+	REPLICA_SETTLE         = 10 //seconds previous owners keep delivering
+	REPLICA_VNODES         = 64
+	REPLICA_SEND_RETRIES   = 2
+	REPLICA_SEND_QUEUE     = 10000 //hand-offs waiting per peer
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Global Variables
+/////////////////////////////////////////////////////////////////////////////
+
+var replicaMap = make(map[string]replicaInfo)
+var replicaRing *hashRing
+var replicaPrevRing *hashRing //ring before the last membership change
+var replicaRingChanged time.Time
+var replicaLastRefresh time.Time
+var replicaMutex = &sync.RWMutex{}
+
+var fanoutQ = make(chan replicaHandoff, 10000)
+
+var replicaSenders = make(map[string]*replicaSender)
+var replicaSenders_mutex sync.Mutex
+
+/////////////////////////////////////////////////////////////////////////////
+// Hash a string onto the ring.
+//
+// key(in): String to hash.
+// Return:  32 bit hash value.
+/////////////////////////////////////////////////////////////////////////////
+
+func ringHash(key string) uint32 {
+	hh := fnv.New32a()
+	hh.Write([]byte(key))
+	return hh.Sum32()
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Create a consistent hash ring from a list of replica names.
+//
+// members(in): Replica names.
+// Return:      Hash ring.
+/////////////////////////////////////////////////////////////////////////////
+
+func newHashRing(members []string) *hashRing {
+	hr := &hashRing{owners: make(map[uint32]string)}
+
+	for _, mm := range members {
+		for ix := 0; ix < REPLICA_VNODES; ix++ {
+			pt := ringHash(fmt.Sprintf("%s#%d", mm, ix))
+			//On the off chance of a collision, lowest name wins so that
+			//all replicas agree.
+			cur, ok := hr.owners[pt]
+			if !ok {
+				hr.points = append(hr.points, pt)
+				hr.owners[pt] = mm
+			} else if mm < cur {
+				hr.owners[pt] = mm
+			}
+		}
+	}
+
+	sort.Slice(hr.points, func(i, j int) bool { return hr.points[i] < hr.points[j] })
+	return hr
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Find the replica which owns a given key.
+//
+// key(in): Key to look up, typically a subscriber XName.
+// Return:  Owning replica name, or "" if the ring is empty.
+/////////////////////////////////////////////////////////////////////////////
+
+func (hr *hashRing) owner(key string) string {
+	if (hr == nil) || (len(hr.points) == 0) {
+		return ""
+	}
+
+	hv := ringHash(key)
+	ix := sort.Search(len(hr.points), func(i int) bool { return hr.points[i] >= hv })
+	if ix == len(hr.points) {
+		ix = 0
+	}
+	return hr.owners[hr.points[ix]]
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Determine if segmented fanout is currently in effect.  It is only used
+// when enabled and there is more than one live replica.
+//
+// Args:   None.
+// Return: true if subscribers are being divided up among replicas.
+/////////////////////////////////////////////////////////////////////////////
+
+func segmentedFanoutActive() bool {
+	if app_params.Segmented_fanout == 0 {
+		return false
+	}
+	replicaMutex.RLock()
+	defer replicaMutex.RUnlock()
+	return len(replicaMap) > 1
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Determine if a given replica is responsible for delivering SCNs to a
+// subscriber.  If segmented fanout is not active, every replica owns every
+// subscriber.  When ownership is uncertain, because membership just changed
+// or can't be read, this errs on the side of delivering.
+//
+// xname(in):   Subscriber XName.
+// replica(in): Replica name.
+// Return:      true if the replica owns the subscriber.
+/////////////////////////////////////////////////////////////////////////////
+
+func isSegmentOwner(xname string, replica string) bool {
+	if !segmentedFanoutActive() {
+		return true
+	}
+
+	replicaMutex.RLock()
+	defer replicaMutex.RUnlock()
+
+	if time.Since(replicaLastRefresh) > (REPLICA_STALE * time.Second) {
+		return true
+	}
+	owner := replicaRing.owner(xname)
+	if (owner == "") || (owner == replica) {
+		return true
+	}
+	return (time.Since(replicaRingChanged) < (REPLICA_SETTLE * time.Second)) &&
+		(replicaPrevRing.owner(xname) == replica)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get the list of live replica names, sorted.
+//
+// Args:   None.
+// Return: Sorted array of replica names.
+/////////////////////////////////////////////////////////////////////////////
+
+func getReplicaNames() []string {
+	var names []string
+
+	replicaMutex.RLock()
+	for nm := range replicaMap {
+		names = append(names, nm)
+	}
+	replicaMutex.RUnlock()
+
+	sort.Strings(names)
+	return names
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Create the default URL peer replicas use to hand off SCNs to this one.
+// Replicas are addressed directly by pod IP if known, since the service
+// name load balances across all of them.
+//
+// Args:   None.
+// Return: Replica fanout URL.
+/////////////////////////////////////////////////////////////////////////////
+
+func makeReplicaUrl() string {
+	host := os.Getenv("POD_IP")
+	if host == "" {
+		host = serviceName
+	}
+	return fmt.Sprintf("http://%s%s%d%s%s%s%s%s%s", host, URL_PORT_DELIM,
+		app_params.Port, URL_DELIM, URL_BASE, URL_DELIM, URL_V2,
+		URL_DELIM, URL_FANOUT)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Store this replica's registration in ETCD, and make its lease-bound live
+// key if it doesn't exist.  The live key is made first, so a replica with a
+// registration and no live key is a dead one.
+//
+// Args:   None.
+// Return: nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func registerReplica() error {
+	_, live, err := kvHandle.Get(REPLICA_LIVE_PREFIX + serviceName)
+	if err != nil {
+		return err
+	}
+	if !live {
+		err = kvHandle.TempKey(REPLICA_LIVE_PREFIX + serviceName)
+		if err != nil {
+			return err
+		}
+	}
+
+	ri := replicaInfo{Name: serviceName,
+		Url:       app_params.Replica_url,
+		Heartbeat: time.Now().Unix(),
+	}
+
+	ba, err := json.Marshal(ri)
+	if err != nil {
+		return err
+	}
+	return kvHandle.Store(REPLICA_KEY_PREFIX+serviceName, string(ba))
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Read the live replicas from ETCD, and rebuild the hash ring if membership
+// changed.  Registrations of replicas with no live key are deleted so that
+// a replica which died doesn't linger.
+//
+// Args:   None.
+// Return: nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func refreshReplicas() error {
+	//Registrations first: a replica's live key is made before its
+	//registration, so it isn't mistaken for a dead one.
+
+	kvlist, kverr := kvHandle.GetRange(REPLICA_KEYRANGE_START, REPLICA_KEYRANGE_END)
+	if kverr != nil {
+		return kverr
+	}
+	livelist, kverr := kvHandle.GetRange(REPLICA_LIVE_START, REPLICA_LIVE_END)
+	if kverr != nil {
+		return kverr
+	}
+
+	newMap := make(map[string]replicaInfo)
+	for _, kv := range livelist {
+		nm := strings.TrimPrefix(kv.Key, REPLICA_LIVE_PREFIX)
+		newMap[nm] = replicaInfo{Name: nm}
+	}
+
+	for _, kv := range kvlist {
+		var ri replicaInfo
+		nm := strings.TrimPrefix(kv.Key, REPLICA_KEY_PREFIX)
+		if _, ok := newMap[nm]; !ok {
+			if app_params.Debug > 0 {
+				log.Printf("INFO: Removing dead replica registration '%s'.\n", nm)
+			}
+			kvHandle.Delete(kv.Key)
+			continue
+		}
+		err := json.Unmarshal([]byte(kv.Value), &ri)
+		if err != nil {
+			log.Printf("ERROR unmarshalling replica key '%s': %v", kv.Key, err)
+			continue
+		}
+		//A live replica with no registration yet has no URL; hand-offs to
+		//it fail, and its share is delivered by the sender.
+		ri.Name = nm
+		newMap[nm] = ri
+	}
+
+	replicaMutex.Lock()
+	changed := len(newMap) != len(replicaMap)
+	if !changed {
+		for nm := range newMap {
+			if _, ok := replicaMap[nm]; !ok {
+				changed = true
+				break
+			}
+		}
+	}
+	replicaMap = newMap
+	replicaLastRefresh = time.Now()
+	if changed {
+		var names []string
+		for nm := range newMap {
+			names = append(names, nm)
+		}
+		sort.Strings(names)
+		replicaPrevRing = replicaRing
+		replicaRing = newHashRing(names)
+		replicaRingChanged = time.Now()
+		log.Printf("INFO: Replica membership changed, now: %s",
+			strings.Join(names, ","))
+	}
+	replicaMutex.Unlock()
+
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Thread func which keeps this replica's registration alive and keeps
+// track of the other replicas.
+//
+// Args, Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func replicaHeartbeat() {
+	for Running {
+		err := registerReplica()
+		if err != nil {
+			log.Printf("ERROR storing replica registration: %v", err)
+		}
+		err = refreshReplicas()
+		if err != nil {
+			log.Printf("ERROR fetching replica registrations: %v", err)
+		}
+		time.Sleep(REPLICA_HEARTBEAT * time.Second)
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Remove this replica's registration, used during shutdown so the other
+// replicas can take over this one's subscribers right away.
+//
+// Args, Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func replicaLeave() {
+	if kvHandle == nil {
+		return
+	}
+	err := kvHandle.Delete(REPLICA_LIVE_PREFIX + serviceName)
+	if err != nil {
+		log.Printf("ERROR removing replica live key: %v", err)
+	}
+	err = kvHandle.Delete(REPLICA_KEY_PREFIX + serviceName)
+	if err != nil {
+		log.Printf("ERROR removing replica registration: %v", err)
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Send an SCN batch to a peer replica for fanout.
+//
+// ri(in):      Peer replica info.
+// ba(in):      Marshalled SCN.
+// deliver(in): false if the SCN is only for the peer's streams.
+// missed(in):  true if earlier hand-offs to the peer were lost.
+// Return:      nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func sendScnToReplica(ri replicaInfo, ba []byte, deliver bool, missed bool) error {
+	var err error
+
+	if ri.Url == "" {
+		return fmt.Errorf("Replica '%s' has no URL", ri.Name)
+	}
+	rurl, err := url.Parse(ri.Url)
+	if err != nil {
+		return fmt.Errorf("Bad URL for replica '%s': %v", ri.Name, err)
+	}
+	qv := rurl.Query()
+	if !deliver {
+		qv.Set("deliver", "false")
+	}
+	if missed {
+		qv.Set("missed", "true")
+	}
+	rurl.RawQuery = qv.Encode()
+
+	for retry := 1; retry <= REPLICA_SEND_RETRIES; retry++ {
+		var req *http.Request
+		var rsp *http.Response
+
+		req, err = http.NewRequest("POST", rurl.String(), bytes.NewBuffer(ba))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		base.SetHTTPUserAgent(req, serviceName)
+
+		rsp, err = htrans.client.Do(req)
+		if err != nil {
+			continue
+		}
+		rsp.Body.Close()
+		if rsp.StatusCode == http.StatusOK {
+			return nil
+		}
+		err = fmt.Errorf("Bad response from replica '%s': %d",
+			ri.Name, rsp.StatusCode)
+	}
+
+	return err
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Send a peer replica its hand-offs, in order.  If one can't be handed off,
+// the peer's share of the SCN is delivered from here, and the next one
+// tells the peer that its streams missed some.  Returns when the peer's
+// queue is closed and empty.
+//
+// rs(in): Peer replica's sender.
+// Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func (rs *replicaSender) run() {
+	for ho := range rs.q {
+		replicaSenders_mutex.Lock()
+		missed := rs.lost
+		rs.lost = false
+		replicaSenders_mutex.Unlock()
+
+		serr := sendScnToReplica(ho.ri, ho.ba, ho.deliver, missed)
+		if serr == nil {
+			continue
+		}
+		replicaSenders_mutex.Lock()
+		rs.lost = true
+		replicaSenders_mutex.Unlock()
+		if !ho.deliver {
+			log.Printf("WARNING: Can't hand off SCN to replica '%s' for its streams: %v",
+				ho.ri.Name, serr)
+			continue
+		}
+		log.Printf("WARNING: Can't hand off SCN to replica '%s' (%v), delivering its share locally.",
+			ho.ri.Name, serr)
+		planScnSegment(ho.scn, ho.ri.Name)
+	}
+}
+
+// Make a hand-off of an SCN.  It gets its own copy of the components, since
+// they are lower-cased in place if it is delivered from here.
+
+func newReplicaHandoff(ri replicaInfo, scn Scn, ba []byte, deliver bool) replicaHandoff {
+	scn.Components = append([]string{}, scn.Components...)
+	return replicaHandoff{ri: ri, scn: scn, ba: ba, deliver: deliver}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Hand off an SCN batch to all other live replicas, for their streams and,
+// with segmented fanout, to deliver to the subscribers they own.  If a peer
+// can't be reached, or is too far behind to queue it for, its share is
+// delivered from here.  Senders of peers which have gone away are stopped.
+//
+// scn(in): SCN to distribute.
+// Return:  None.
+/////////////////////////////////////////////////////////////////////////////
+
+func distributeScn(scn Scn) {
+	var ba []byte
+	var local []string
+	peers := make(map[string]replicaInfo)
+
+	deliver := segmentedFanoutActive()
+	replicaMutex.RLock()
+	for nm, ri := range replicaMap {
+		if nm != serviceName {
+			peers[nm] = ri
+		}
+	}
+	replicaMutex.RUnlock()
+	if len(peers) > 0 {
+		var err error
+		ba, err = json.Marshal(scn)
+		if err != nil {
+			log.Printf("ERROR marshalling SCN for replica fanout: %v", err)
+			return
+		}
+	}
+
+	replicaSenders_mutex.Lock()
+	for nm, rs := range replicaSenders {
+		if _, ok := peers[nm]; !ok {
+			close(rs.q)
+			delete(replicaSenders, nm)
+		}
+	}
+	for nm, ri := range peers {
+		rs, ok := replicaSenders[nm]
+		if !ok {
+			rs = &replicaSender{q: make(chan replicaHandoff, REPLICA_SEND_QUEUE)}
+			replicaSenders[nm] = rs
+			go rs.run()
+		}
+		select {
+		case rs.q <- newReplicaHandoff(ri, scn, ba, deliver):
+		default:
+			rs.lost = true
+			if !deliver {
+				log.Printf("WARNING: Replica '%s' hand-off queue is full, dropping SCN for its streams.",
+					nm)
+				continue
+			}
+			log.Printf("WARNING: Replica '%s' hand-off queue is full, delivering its share locally.",
+				nm)
+			local = append(local, nm)
+		}
+	}
+	replicaSenders_mutex.Unlock()
+
+	for _, nm := range local {
+		lscn := scn
+		lscn.Components = append([]string{}, scn.Components...)
+		planScnSegment(lscn, nm)
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Handle an SCN batch handed off from a peer replica.  It is only delivered
+// to the subscribers this replica owns.
+//
+// w(in):  HTTP response writer
+// r(in):  HTTP request
+// Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func fanoutHandler(w http.ResponseWriter, r *http.Request) {
+	var jdata Scn
+
+	errinst := "/" + URL_FANOUT
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error on message read:", err)
+		pdet := base.NewProblemDetails("about:blank",
+			"Invalid Request",
+			"Error reading inbound request body",
+			errinst, http.StatusBadRequest)
+		base.SendProblemDetails(w, pdet, 0)
+		return
+	}
+
+	err = json.Unmarshal(body, &jdata)
+	if err != nil {
+		log.Println("Error unmarshaling JSON:", err)
+		pdet := base.NewProblemDetails("about:blank",
+			"Invalid Request",
+			"Error unmarshalling SCN JSON",
+			errinst, http.StatusBadRequest)
+		base.SendProblemDetails(w, pdet, 0)
+		return
+	}
+
+	//Older replicas only hand off SCNs to deliver.
+
+	ho := replicaHandoff{scn: jdata, deliver: true}
+	qv := r.URL.Query()
+	if qv.Get("deliver") != "" {
+		ho.deliver, _ = strconv.ParseBool(qv.Get("deliver"))
+	}
+	ho.missed, _ = strconv.ParseBool(qv.Get("missed"))
+
+	select {
+	case fanoutQ <- ho:
+	default:
+		log.Printf("ERROR: Replica fanout queue is full, cannot accept SCN.\n")
+		pdet := base.NewProblemDetails("about:blank",
+			"Service Unavailable",
+			"Replica fanout queue is full",
+			errinst, http.StatusServiceUnavailable)
+		base.SendProblemDetails(w, pdet, 0)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Process the Q of SCNs handed off from other replicas.  Those only for
+// streams are only published to them.
+
+func handleFanoutSCNs() {
+	for {
+		ho := <-fanoutQ
+		if ho.missed {
+			streamMissed()
+		}
+		if ho.deliver {
+			doScn(ho.scn)
+		} else {
+			publishStreamScn(ho.scn)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	base "github.com/Cray-HPE/hms-base/v2"
+)
+
+func TestHashRing(t *testing.T) {
+	var hr *hashRing
+
+	if hr.owner("x0c0s0b0n0") != "" {
+		t.Errorf("ERROR, nil ring should have no owner.")
+	}
+
+	members := []string{"hmnfd-a", "hmnfd-b", "hmnfd-c"}
+	hr = newHashRing(members)
+	if len(hr.points) != len(members)*REPLICA_VNODES {
+		t.Errorf("ERROR, expected %d ring points, got %d",
+			len(members)*REPLICA_VNODES, len(hr.points))
+	}
+
+	//Every replica must agree on ownership regardless of member order.
+
+	hr2 := newHashRing([]string{"hmnfd-c", "hmnfd-a", "hmnfd-b"})
+	counts := make(map[string]int)
+	for ix := 0; ix < 3000; ix++ {
+		xn := fmt.Sprintf("x%dc0s%db0n0", ix/100, ix%100)
+		own := hr.owner(xn)
+		if own != hr2.owner(xn) {
+			t.Errorf("ERROR, ownership of %s differs between rings.", xn)
+		}
+		counts[own]++
+	}
+
+	for _, mm := range members {
+		if counts[mm] < 500 {
+			t.Errorf("ERROR, replica %s only owns %d of 3000 subscribers.",
+				mm, counts[mm])
+		}
+	}
+
+	//Removing a replica should only move that replica's subscribers.
+
+	hr3 := newHashRing([]string{"hmnfd-a", "hmnfd-b"})
+	for ix := 0; ix < 3000; ix++ {
+		xn := fmt.Sprintf("x%dc0s%db0n0", ix/100, ix%100)
+		own := hr.owner(xn)
+		if (own != "hmnfd-c") && (own != hr3.owner(xn)) {
+			t.Errorf("ERROR, %s moved from %s to %s after removing hmnfd-c.",
+				xn, own, hr3.owner(xn))
+		}
+	}
+}
+
+func TestRefreshReplicas(t *testing.T) {
+	var kverr error
+
+	disable_logs()
+	kverr = openTestKV()
+	if kverr != nil {
+		t.Fatal("KV/ETCD open failed:", kverr)
+	}
+	defer kvPurge(t)
+
+	savedName := serviceName
+	serviceName = "hmnfd-a"
+	app_params.Segmented_fanout = 1
+	app_params.Replica_url = "http://10.0.0.1:28600/hmi/v2/fanout"
+	defer func() {
+		serviceName = savedName
+		app_params.Segmented_fanout = 0
+		replicaMap = make(map[string]replicaInfo)
+		replicaRing = nil
+		replicaPrevRing = nil
+	}()
+
+	err := registerReplica()
+	if err != nil {
+		t.Fatal("ERROR registering replica:", err)
+	}
+	err = refreshReplicas()
+	if err != nil {
+		t.Fatal("ERROR refreshing replicas:", err)
+	}
+	if segmentedFanoutActive() {
+		t.Errorf("ERROR, segmented fanout should not be active with one replica.")
+	}
+	if !isSegmentOwner("x0c0s0b0n0", "hmnfd-a") {
+		t.Errorf("ERROR, sole replica should own all subscribers.")
+	}
+
+	//hmnfd-b is live; hmnfd-dead has a registration but its live key's
+	//lease has expired.  Heartbeat times don't matter.
+
+	ba, _ := json.Marshal(replicaInfo{Name: "hmnfd-b", Url: "http://b"})
+	kvHandle.Store(REPLICA_KEY_PREFIX+"hmnfd-b", string(ba))
+	kvHandle.TempKey(REPLICA_LIVE_PREFIX + "hmnfd-b")
+	ba, _ = json.Marshal(replicaInfo{Name: "hmnfd-dead", Url: "http://s",
+		Heartbeat: time.Now().Unix()})
+	kvHandle.Store(REPLICA_KEY_PREFIX+"hmnfd-dead", string(ba))
+
+	err = refreshReplicas()
+	if err != nil {
+		t.Fatal("ERROR refreshing replicas:", err)
+	}
+
+	names := getReplicaNames()
+	if (len(names) != 2) || (names[0] != "hmnfd-a") || (names[1] != "hmnfd-b") {
+		t.Errorf("ERROR, unexpected replica list: %v", names)
+	}
+	_, ok, _ := kvHandle.Get(REPLICA_KEY_PREFIX + "hmnfd-dead")
+	if ok {
+		t.Errorf("ERROR, dead replica key was not removed.")
+	}
+	if !segmentedFanoutActive() {
+		t.Errorf("ERROR, segmented fanout should be active with two replicas.")
+	}
+
+	//Right after the change, hmnfd-a still delivers to everything it had,
+	//in case hmnfd-b hasn't seen the change yet.
+
+	for ix := 0; ix < 100; ix++ {
+		xn := fmt.Sprintf("x0c0s%db0n0", ix)
+		if !isSegmentOwner(xn, "hmnfd-a") {
+			t.Errorf("ERROR, %s dropped by its previous owner while settling.", xn)
+		}
+	}
+
+	//Once settled, each subscriber must be owned by exactly one replica.
+
+	replicaMutex.Lock()
+	replicaRingChanged = time.Now().Add(-REPLICA_SETTLE * time.Second)
+	replicaMutex.Unlock()
+	for ix := 0; ix < 100; ix++ {
+		xn := fmt.Sprintf("x0c0s%db0n0", ix)
+		oa := isSegmentOwner(xn, "hmnfd-a")
+		ob := isSegmentOwner(xn, "hmnfd-b")
+		if oa == ob {
+			t.Errorf("ERROR, %s owned by both or neither replica.", xn)
+		}
+	}
+
+	//A replica which can't read membership delivers to everything.
+
+	replicaMutex.Lock()
+	replicaLastRefresh = time.Now().Add(-2 * REPLICA_STALE * time.Second)
+	replicaMutex.Unlock()
+	for ix := 0; ix < 100; ix++ {
+		xn := fmt.Sprintf("x0c0s%db0n0", ix)
+		if !isSegmentOwner(xn, "hmnfd-a") || !isSegmentOwner(xn, "hmnfd-b") {
+			t.Errorf("ERROR, %s not delivered with unknown membership.", xn)
+		}
+	}
+
+	replicaLeave()
+	_, ok, _ = kvHandle.Get(REPLICA_KEY_PREFIX + "hmnfd-a")
+	_, live, _ := kvHandle.Get(REPLICA_LIVE_PREFIX + "hmnfd-a")
+	if ok || live {
+		t.Errorf("ERROR, replica keys still present after leaving.")
+	}
+}
+
+func TestFanoutHandler(t *testing.T) {
+	disable_logs()
+	handler := http.HandlerFunc(fanoutHandler)
+
+	scn := Scn{Components: []string{"x0c0s0b0n0"}, State: "Ready"}
+	ba, _ := json.Marshal(scn)
+	req, _ := http.NewRequest("POST", "http://localhost:8080/hmi/v2/fanout",
+		bytes.NewBuffer(ba))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("ERROR, fanout POST returned %d", rr.Code)
+	}
+
+	select {
+	case ho := <-fanoutQ:
+		if (len(ho.scn.Components) != 1) || (ho.scn.Components[0] != "x0c0s0b0n0") ||
+			(ho.scn.State != "Ready") || !ho.deliver || ho.missed {
+			t.Errorf("ERROR, queued SCN mismatch: %v", ho)
+		}
+	default:
+		t.Errorf("ERROR, SCN was not queued.")
+	}
+
+	//Hand-offs only for streams, after some were lost.
+
+	req, _ = http.NewRequest("POST",
+		"http://localhost:8080/hmi/v2/fanout?deliver=false&missed=true",
+		bytes.NewBuffer(ba))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	select {
+	case ho := <-fanoutQ:
+		if ho.deliver || !ho.missed {
+			t.Errorf("ERROR, stream hand-off flags mismatch: %v", ho)
+		}
+	default:
+		t.Errorf("ERROR, stream SCN was not queued.")
+	}
+
+	req, _ = http.NewRequest("POST", "http://localhost:8080/hmi/v2/fanout",
+		bytes.NewBuffer([]byte("{xyzzy")))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("ERROR, bad fanout POST returned %d", rr.Code)
+	}
+}
+
+func TestDistributeScn(t *testing.T) {
+	var kverr error
+	var mutex sync.Mutex
+	var handed []string
+	var queries []string
+	var delivered []Scn
+
+	disable_logs()
+	if scnWorkPool == nil {
+		scnWorkPool = base.NewWorkerPool(10, 10)
+		scnWorkPool.Run()
+	}
+	if htrans.transport == nil {
+		htrans.transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		htrans.client = &http.Client{Transport: htrans.transport,
+			Timeout: 5 * time.Second,
+		}
+	}
+	kverr = openTestKV()
+	if kverr != nil {
+		t.Fatal("KV/ETCD open failed:", kverr)
+	}
+	defer kvPurge(t)
+
+	//The first hand-off is slow; the rest must still arrive after it.
+
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var scn Scn
+		json.NewDecoder(r.Body).Decode(&scn)
+		if scn.State == "s0" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		mutex.Lock()
+		handed = append(handed, scn.State)
+		queries = append(queries, r.URL.RawQuery)
+		mutex.Unlock()
+	}))
+	defer peer.Close()
+	sub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var scn Scn
+		json.NewDecoder(r.Body).Decode(&scn)
+		mutex.Lock()
+		delivered = append(delivered, scn)
+		mutex.Unlock()
+	}))
+	defer sub.Close()
+
+	savedName := serviceName
+	serviceName = "hmnfd-a"
+	app_params.Segmented_fanout = 1
+	ring := newHashRing([]string{"hmnfd-a", "hmnfd-b"})
+	replicaMutex.Lock()
+	replicaMap = map[string]replicaInfo{
+		"hmnfd-a": {Name: "hmnfd-a"},
+		"hmnfd-b": {Name: "hmnfd-b", Url: peer.URL},
+	}
+	replicaRing, replicaPrevRing = ring, ring
+	replicaLastRefresh = time.Now()
+	replicaRingChanged = time.Now().Add(-REPLICA_SETTLE * time.Second)
+	replicaMutex.Unlock()
+	defer func() {
+		waitSubQueues(t)
+		serviceName = savedName
+		app_params.Segmented_fanout = 0
+		replicaMutex.Lock()
+		replicaMap = make(map[string]replicaInfo)
+		replicaRing = nil
+		replicaPrevRing = nil
+		replicaMutex.Unlock()
+		distributeScn(Scn{}) //stops the senders
+	}()
+
+	for ix := 0; ix < 10; ix++ {
+		distributeScn(Scn{State: fmt.Sprintf("s%d", ix),
+			Components: []string{"x0c0s0b0n0"}})
+	}
+	start := time.Now()
+	for time.Since(start) < 5*time.Second {
+		mutex.Lock()
+		nh := len(handed)
+		mutex.Unlock()
+		if nh == 10 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mutex.Lock()
+	if fmt.Sprint(handed) != "[s0 s1 s2 s3 s4 s5 s6 s7 s8 s9]" {
+		t.Errorf("ERROR, hand-offs out of order: %v", handed)
+	}
+	mutex.Unlock()
+
+	//A peer which can't be reached has its subscribers' SCNs delivered
+	//from here, without marking the SCN's components for pruning again.
+
+	subxname := ""
+	for ix := 0; subxname == ""; ix++ {
+		if xn := fmt.Sprintf("x1c0s%db0n0", ix); ring.owner(xn) == "hmnfd-b" {
+			subxname = xn
+		}
+	}
+	ssub := ScnSubscribe{Components: []string{"x0c0s0b0n0"}, States: []string{"off"},
+		Url: sub.URL}
+	err := storeSubscriptionEntry(makeSubscriptionKey_V2(ssub, subxname, "pcs"),
+		SubData{Url: sub.URL, ScnNodes: ssub.Components,
+			Generation: newSubscriptionGeneration()})
+	if err != nil {
+		t.Fatal("ERROR storing subscription:", err)
+	}
+	peer.Close()
+	replicaMutex.Lock()
+	replicaMap["hmnfd-b"] = replicaInfo{Name: "hmnfd-b", Url: peer.URL}
+	replicaMutex.Unlock()
+
+	distributeScn(Scn{State: "Off", Components: []string{"X0c0s0b0n0"}})
+	start = time.Now()
+	for time.Since(start) < 5*time.Second {
+		mutex.Lock()
+		nd := len(delivered)
+		mutex.Unlock()
+		if nd > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mutex.Lock()
+	if (len(delivered) != 1) || (delivered[0].State != "Off") ||
+		(fmt.Sprint(delivered[0].Components) != "[x0c0s0b0n0]") {
+		t.Errorf("ERROR, peer's share not delivered locally: %v", delivered)
+	}
+	mutex.Unlock()
+	prunemap_mutex.Lock()
+	if prunemap["x0c0s0b0n0"] {
+		t.Errorf("ERROR, local delivery of peer's share marked a prune.")
+	}
+	prunemap_mutex.Unlock()
+
+	//Without segmented fanout peers still get every SCN, for their streams
+	//only.  The first one to get through says some were missed.
+
+	peer2 := httptest.NewServer(peer.Config.Handler)
+	defer peer2.Close()
+	mutex.Lock()
+	handed, queries = nil, nil
+	mutex.Unlock()
+	app_params.Segmented_fanout = 0
+	replicaMutex.Lock()
+	replicaMap["hmnfd-b"] = replicaInfo{Name: "hmnfd-b", Url: peer2.URL}
+	replicaMutex.Unlock()
+	distributeScn(Scn{State: "On", Components: []string{"x0c0s0b0n0"}})
+	distributeScn(Scn{State: "Ready", Components: []string{"x0c0s0b0n0"}})
+	start = time.Now()
+	for time.Since(start) < 5*time.Second {
+		mutex.Lock()
+		nh := len(handed)
+		mutex.Unlock()
+		if nh == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mutex.Lock()
+	if (fmt.Sprint(handed) != "[On Ready]") ||
+		(fmt.Sprint(queries) != "[deliver=false&missed=true deliver=false]") {
+		t.Errorf("ERROR, bad stream hand-offs: %v %v", handed, queries)
+	}
+	if len(delivered) != 1 {
+		t.Errorf("ERROR, stream hand-offs delivered: %v", delivered)
+	}
+	mutex.Unlock()
+}
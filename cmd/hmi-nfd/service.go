@@ -0,0 +1,302 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	base "github.com/Cray-HPE/hms-base/v2"
+	"github.com/gorilla/mux"
+)
+
+// A note about service subscribers:
+//
+// Subscribers are normally components, identified by XName, and their
+// subscriptions are pruned when the component goes away.  Services (e.g.
+// Kubernetes services) subscribe via /subscriptions/services/{service}
+// instead.  Their subscriptions are keyed by a subscriber ID made from the
+// service name, 'service.<name>', in place of the XName.  This can never
+// match a component, so service subscriptions are never pruned because of
+// component states; they are pruned only when SCNs can't be delivered, or
+// when their lease runs out.
+//
+// A lease is optional.  If LeaseSeconds is given, the subscription must be
+// renewed (PATCHed) within that time, or the leader deletes it.
+//
+// Since service names are free-form, subscription keys are parsed by token
+// rather than by searching for substrings.
+
+/////////////////////////////////////////////////////////////////////////////
+// Constants
+/////////////////////////////////////////////////////////////////////////////
+
+const SUBSCRIBER_SERVICE_PREFIX = "service" + SUBSCRIBER_KEYCAT_DELIM
+
+/////////////////////////////////////////////////////////////////////////////
+// Global Variables
+/////////////////////////////////////////////////////////////////////////////
+
+//Kubernetes service names are DNS labels.
+
+var serviceNameRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+/////////////////////////////////////////////////////////////////////////////
+// Make the subscriber ID used for a service in subscription keys.
+//
+// service(in): Service name.
+// Return:      Subscriber ID.
+/////////////////////////////////////////////////////////////////////////////
+
+func serviceSubscriberID(service string) string {
+	return SUBSCRIBER_SERVICE_PREFIX + service
+}
+
+// Determine if a subscriber ID is a service rather than an XName.
+
+func isServiceSubscriber(subID string) bool {
+	return strings.HasPrefix(subID, SUBSCRIBER_SERVICE_PREFIX)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Validate and normalize a service name.
+//
+// service(in): Service name from the URL path.
+// Return:      Lower cased service name, or "" if it is invalid.
+/////////////////////////////////////////////////////////////////////////////
+
+func verifyServiceName(service string) string {
+	svc := strings.ToLower(service)
+	if !serviceNameRegex.MatchString(svc) {
+		return ""
+	}
+	return svc
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get the subscriber ID and agent from a subscription key.
+//
+// key(in): Subscription key.
+// Return:  Subscriber ID (XName or service subscriber ID); agent, "" if none.
+/////////////////////////////////////////////////////////////////////////////
+
+func parseSubscriptionKey(key string) (string, string) {
+	toks := strings.Split(key, SUBSCRIBER_KEY_DELIM)
+	if len(toks) <= SUBSCRIBER_TOKNUM_XNAME {
+		return "", ""
+	}
+	agent := ""
+	svcTok := SUBSCRIBER_KEY_SVC + SUBSCRIBER_KEYCAT_DELIM
+	for _, tok := range toks[SUBSCRIBER_TOKNUM_XNAME+1:] {
+		if strings.HasPrefix(tok, svcTok) {
+			agent = tok[len(svcTok):]
+		}
+	}
+	return toks[SUBSCRIBER_TOKNUM_XNAME], agent
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Determine if a subscription key subscribes to an SCN attribute, as made by
+// getSCNAttrs().  Only the attribute tokens are looked at, not the
+// subscriber or agent names.
+//
+// key(in):  Subscription key.
+// attr(in): SCN attribute.
+// Return:   true if the key has the attribute.
+/////////////////////////////////////////////////////////////////////////////
+
+func keyHasAttr(key string, attr string) bool {
+	toks := strings.Split(key, SUBSCRIBER_KEY_DELIM)
+	if len(toks) <= SUBSCRIBER_TOKNUM_XNAME {
+		return false
+	}
+	for _, tok := range toks[SUBSCRIBER_TOKNUM_XNAME+1:] {
+		tt := strings.Split(tok, SUBSCRIBER_KEYCAT_DELIM)
+		if tt[0] == SUBSCRIBER_KEY_SVC {
+			continue
+		}
+		for _, val := range tt[1:] {
+			if val == attr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get and validate the service name in a /subscriptions/services request.
+// An error response is sent if it is invalid.
+//
+// w(in):  HTTP response writer.
+// r(in):  HTTP request.
+// Return: Service subscriber ID, or "" if the service name is invalid.
+/////////////////////////////////////////////////////////////////////////////
+
+func serviceFromRequest(w http.ResponseWriter, r *http.Request) string {
+	uvars := mux.Vars(r)
+	svc := verifyServiceName(uvars["service"])
+	if svc == "" {
+		log.Printf("ERROR: Invalid service name.\n")
+		pdet := base.NewProblemDetails("about:blank",
+			"Invalid Request",
+			"Invalid service name in URL path",
+			r.URL.Path, http.StatusBadRequest)
+		base.SendProblemDetails(w, pdet, 0)
+		return ""
+	}
+	return serviceSubscriberID(svc)
+}
+
+// /subscriptions/services/{service}/agents/{agent} POST
+
+func servicesAgentPostHandler(w http.ResponseWriter, r *http.Request) {
+	subID := serviceFromRequest(w, r)
+	if subID == "" {
+		return
+	}
+	postAgentSubscription(w, r, subID, mux.Vars(r)["agent"])
+}
+
+// /subscriptions/services/{service}/agents/{agent} PATCH
+
+func servicesAgentPatchHandler(w http.ResponseWriter, r *http.Request) {
+	subID := serviceFromRequest(w, r)
+	if subID == "" {
+		return
+	}
+	patchAgentSubscription(w, r, subID, mux.Vars(r)["agent"])
+}
+
+// /subscriptions/services/{service}/agents/{agent} DELETE
+
+func servicesAgentDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	subID := serviceFromRequest(w, r)
+	if subID == "" {
+		return
+	}
+	deleteAgentSubscription(w, r, subID, mux.Vars(r)["agent"])
+}
+
+// /subscriptions/services/{service}/agents DELETE
+
+func servicesDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	subID := serviceFromRequest(w, r)
+	if subID == "" {
+		return
+	}
+	deleteSubscriberSubscriptions(w, r, subID)
+}
+
+// /subscriptions/services/{service} GET
+
+func servicesGetHandler(w http.ResponseWriter, r *http.Request) {
+	subID := serviceFromRequest(w, r)
+	if subID == "" {
+		return
+	}
+	getSubscriberSubscriptions(w, r, subID)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Check the lease in a subscription request.  Only service subscriptions
+// can have one.
+//
+// jdata(in): Subscription request.
+// subID(in): Subscriber ID.
+// Return:    nil if OK, error string if not.
+/////////////////////////////////////////////////////////////////////////////
+
+func checkSubscriptionLease(jdata ScnSubscribe, subID string) error {
+	if jdata.LeaseSeconds < 0 {
+		return fmt.Errorf("Subscription request LeaseSeconds can't be negative.")
+	}
+	if (jdata.LeaseSeconds > 0) && !isServiceSubscriber(subID) {
+		return fmt.Errorf("Subscription request LeaseSeconds is only allowed for service subscribers.")
+	}
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Set a subscription's lease, if it has one.
+//
+// sd(in/out): Subscription data.
+// lease(in):  Lease, in seconds; 0 == no lease.
+// Return:     None.
+/////////////////////////////////////////////////////////////////////////////
+
+func setSubscriptionLease(sd *SubData, lease int) {
+	sd.LeaseSeconds = lease
+	sd.LeaseExpires = ""
+	if lease > 0 {
+		sd.LeaseExpires = time.Now().Add(time.Duration(lease) *
+			time.Second).Format(time.RFC3339)
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Delete subscriptions whose leases have run out.  Done by the leader.
+//
+// Args:   None.
+// Return: Number of subscriptions deleted.
+/////////////////////////////////////////////////////////////////////////////
+
+func expireSubscriptionLeases() int {
+	kvlist, kverr := kvHandle.GetRange(SUBSCRIBER_KEYRANGE_START,
+		SUBSCRIBER_KEYRANGE_END)
+	if kverr != nil {
+		log.Println("ERROR fetching subscription keys:", kverr)
+		return 0
+	}
+
+	now := time.Now()
+	nexpired := 0
+	for _, sub := range kvlist {
+		var sd SubData
+		if json.Unmarshal([]byte(sub.Value), &sd) != nil || sd.LeaseExpires == "" {
+			continue
+		}
+		exp, err := time.Parse(time.RFC3339, sd.LeaseExpires)
+		if (err != nil) || now.Before(exp) {
+			continue
+		}
+		err = kvHandle.Delete(sub.Key)
+		if err != nil {
+			log.Println("WARNING, key not deleted:", sub.Key, ":", err)
+			continue
+		}
+		forgetSubscriptionGeneration(sub.Key)
+		cancelStaleSends(sub.Key)
+		logPrune(newPruneRecord(sub.Key, sub.Value,
+			pruneCause{Reason: PRUNE_REASON_LEASE,
+				Trigger: "Lease expired at " + sd.LeaseExpires},
+			PRUNE_ACTION_DELETED))
+		nexpired++
+	}
+	return nexpired
+}
@@ -0,0 +1,175 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseSubscriptionKey(t *testing.T) {
+	tests := []struct {
+		key   string
+		subID string
+		agent string
+	}{
+		{"sub#x1000c0s0b0n0#hs.ready#svc.handler", "x1000c0s0b0n0", "handler"},
+		{"sub#x1000c0s0b0n0#hs.ready", "x1000c0s0b0n0", ""},
+		{"sub#service.cray-svc-mgr#hs.ready#svc.svc-agent", "service.cray-svc-mgr", "svc-agent"},
+		{"sub", "", ""},
+	}
+	for _, tt := range tests {
+		subID, agent := parseSubscriptionKey(tt.key)
+		if (subID != tt.subID) || (agent != tt.agent) {
+			t.Errorf("ERROR parsing '%s', exp: '%s'/'%s', got: '%s'/'%s'",
+				tt.key, tt.subID, tt.agent, subID, agent)
+		}
+	}
+
+	//Only attribute tokens match, not subscriber or agent names.
+
+	key := "sub#service.cray-power-control#hs.ready#enbl.enbl#svc.standby"
+	for attr, exp := range map[string]bool{"ready": true, "enbl": true,
+		"on": false, "standby": false, "control": false} {
+		if keyHasAttr(key, attr) != exp {
+			t.Errorf("ERROR, keyHasAttr('%s') should be %t", attr, exp)
+		}
+	}
+}
+
+func TestServiceSubscriptions(t *testing.T) {
+	var kverr error
+
+	disable_logs()
+	kverr = openTestKV()
+	if kverr != nil {
+		t.Fatal("KV/ETCD open failed:", kverr)
+	}
+	defer kvPurge(t)
+
+	router := newRouter(generateRoutes())
+	svcUrl := "http://localhost:8080/hmi/v2/subscriptions/services/"
+	subKey := "sub#service.cray-power-control#hs.ready#svc.pcs"
+	payload := `{"Components":["x1000c0s0b0n0"],"States":["Ready"],"Url":"http://cray-power-control/scn","LeaseSeconds":60}`
+
+	tests := []struct {
+		method  string
+		url     string
+		payload string
+		code    int
+	}{
+		{"POST", svcUrl + "cray-power-control/agents/pcs", payload, http.StatusOK},
+		{"POST", svcUrl + "Bad_Service!/agents/pcs", payload, http.StatusBadRequest},
+		{"POST", "http://localhost:8080/hmi/v2/subscriptions/x1000c0s1b0n0/agents/pcs",
+			payload, http.StatusBadRequest},
+		{"PATCH", svcUrl + "cray-power-control/agents/pcs", payload, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, tt.url, bytes.NewBufferString(tt.payload))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != tt.code {
+			t.Errorf("ERROR, %s '%s' returned %d, exp %d", tt.method, tt.url,
+				rr.Code, tt.code)
+		}
+	}
+
+	sd, ok := getSubData(t, subKey)
+	if !ok {
+		t.Fatalf("ERROR, service subscription key '%s' not created.", subKey)
+	}
+	if (sd.LeaseSeconds != 60) || (sd.LeaseExpires == "") {
+		t.Errorf("ERROR, service subscription lease not set: %v", sd)
+	}
+
+	//Listed as a service subscriber.
+
+	var sublist SubscriptionList
+	req, _ := http.NewRequest("GET", svcUrl+"cray-power-control", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("ERROR, GET returned %d", rr.Code)
+	}
+	json.Unmarshal(rr.Body.Bytes(), &sublist)
+	if len(sublist.SubscriptionList) != 1 {
+		t.Fatalf("ERROR, GET returned %d subscriptions, exp 1",
+			len(sublist.SubscriptionList))
+	}
+	si := sublist.SubscriptionList[0]
+	if (si.SubscriberService != "cray-power-control") || (si.SubscriberAgent != "pcs") ||
+		(si.SubscriberComponent != "") || (si.LeaseExpires == "") {
+		t.Errorf("ERROR, bad service subscription info: %v", si)
+	}
+
+	//Not a component, so not swept for dead subscribers.
+
+	xnames, _ := subscriberXNames()
+	if len(xnames) != 0 {
+		t.Errorf("ERROR, service subscriber included in XNames: %v", xnames)
+	}
+
+	//Lease runs out.
+
+	sd.LeaseExpires = time.Now().Add(-time.Second).Format(time.RFC3339)
+	storeSubscriptionEntry(subKey, sd)
+	if n := expireSubscriptionLeases(); n != 1 {
+		t.Errorf("ERROR, expected 1 expired lease, got %d", n)
+	}
+	if _, ok := getSubData(t, subKey); ok {
+		t.Errorf("ERROR, service subscription not deleted on lease expiry.")
+	}
+	prunes, _ := getPruneRecords(pruneFilter{reason: PRUNE_REASON_LEASE})
+	if (len(prunes) != 1) || (prunes[0].Subscriber != "pcs@service.cray-power-control") {
+		t.Errorf("ERROR, lease expiry not logged properly: %v", prunes)
+	}
+
+	//Re-subscribe without a lease, then delete.
+
+	req, _ = http.NewRequest("POST", svcUrl+"cray-power-control/agents/pcs",
+		bytes.NewBufferString(`{"Components":["x1000c0s0b0n0"],"States":["Ready"],"Url":"http://cray-power-control/scn"}`))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("ERROR, re-subscribe returned %d", rr.Code)
+	}
+	if n := expireSubscriptionLeases(); n != 0 {
+		t.Errorf("ERROR, subscription without a lease expired.")
+	}
+	req, _ = http.NewRequest("DELETE", svcUrl+"cray-power-control/agents/pcs", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("ERROR, DELETE returned %d", rr.Code)
+	}
+	if _, ok := getSubData(t, subKey); ok {
+		t.Errorf("ERROR, service subscription not deleted.")
+	}
+	prunemap_mutex.Lock()
+	unmarkPrune("pcs@service.cray-power-control")
+	prunemap_mutex.Unlock()
+}
@@ -0,0 +1,573 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	base "github.com/Cray-HPE/hms-base/v2"
+)
+
+// A note about initial snapshots:
+//
+// A subscriber can ask for an initial snapshot when it subscribes.  Once the
+// subscription is stored, the current state of the subscribed components is
+// fetched from HSM and sent to the subscriber as synthetic SCNs, one per
+// subscribed attribute value, via the worker pool like any other SCN.
+//
+// After a reboot many subscribers ask for this at about the same time, for
+// mostly the same components.  Requests are batched for a short time and
+// made to HSM as a single query, and the results are cached for a short
+// time for subscribers which come in a little later.  A cached component is
+// dropped whenever an SCN for it comes in, so a snapshot never has older
+// information than what live SCNs have already delivered.
+//
+// Live SCNs for the new subscription are held by this replica until the
+// snapshot has been sent, and then sent in order.
+
+/////////////////////////////////////////////////////////////////////////////
+// Data Structures
+/////////////////////////////////////////////////////////////////////////////
+
+// Component state as returned by HSM.
+
+type hsmComponent struct {
+	ID             string `json:"ID"`
+	Type           string `json:"Type"`
+	State          string `json:"State"`
+	Flag           string `json:"Flag"`
+	Enabled        *bool  `json:"Enabled,omitempty"`
+	SoftwareStatus string `json:"SoftwareStatus,omitempty"`
+	Role           string `json:"Role,omitempty"`
+	SubRole        string `json:"SubRole,omitempty"`
+}
+
+type hsmComponentArray struct {
+	Components []hsmComponent `json:"Components"`
+}
+
+// HSM component query payload.
+
+type hsmComponentQuery struct {
+	ComponentIDs []string `json:"ComponentIDs"`
+}
+
+// Request for component states, serviced by the snapshot batcher.
+
+type snapshotRequest struct {
+	comps []string
+	rchan chan error
+}
+
+// Cached component state.
+
+type snapshotCacheEntry struct {
+	comp    hsmComponent
+	fetched time.Time
+}
+
+// Live SCNs held for a subscription until its snapshot has been sent.
+
+type snapshotHold struct {
+	subscriber string
+	url        string
+	opts       scnSendOpts
+	scns       []Scn
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Constants
+/////////////////////////////////////////////////////////////////////////////
+
+const HSM_QUERY_PAGE_SIZE = 1000 //max components per HSM query
+
+const (
+	SNAPSHOT_BATCH_WINDOW = 250 //milliseconds to gather requests into a batch
+	SNAPSHOT_CACHE_TTL    = 10  //seconds a fetched component state is used
+	SNAPSHOT_SEND_TIMEOUT = 60  //seconds to wait for snapshot SCNs to be sent
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Global Variables
+/////////////////////////////////////////////////////////////////////////////
+
+var snapshotQ = make(chan snapshotRequest, 10000)
+var snapshotCache = make(map[string]snapshotCacheEntry)
+var snapshotCacheMutex = &sync.Mutex{}
+var snapshotHolds = make(map[string]*snapshotHold)
+var snapshotHoldMutex = &sync.Mutex{}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get the cached states of a list of components.
+//
+// comps(in): List of component XNames, lower case.
+// Return:    Map of XName -> component state, for the ones in the cache;
+//            list of the ones not in the cache.
+/////////////////////////////////////////////////////////////////////////////
+
+func snapshotCacheGet(comps []string) (map[string]hsmComponent, []string) {
+	var missing []string
+	cmap := make(map[string]hsmComponent)
+
+	snapshotCacheMutex.Lock()
+	defer snapshotCacheMutex.Unlock()
+
+	for _, comp := range comps {
+		ce, ok := snapshotCache[comp]
+		if ok && (time.Since(ce.fetched) < (SNAPSHOT_CACHE_TTL * time.Second)) {
+			cmap[comp] = ce.comp
+		} else {
+			missing = append(missing, comp)
+		}
+	}
+	return cmap, missing
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Drop components from the snapshot cache.  Called when an SCN for them
+// comes in, since their cached state is now out of date.
+//
+// comps(in): List of component XNames, lower case.
+// Return:    None.
+/////////////////////////////////////////////////////////////////////////////
+
+func snapshotCacheInvalidate(comps []string) {
+	snapshotCacheMutex.Lock()
+	defer snapshotCacheMutex.Unlock()
+
+	if len(snapshotCache) == 0 {
+		return
+	}
+	for _, comp := range comps {
+		delete(snapshotCache, comp)
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Query HSM for the states of a list of components, a page at a time, so
+// that a very large list never has to be held as one HSM response.  Each
+// page is decoded straight from the response body and handed to a
+// callback.
+//
+// comps(in):  List of component XNames, lower case.
+// pagefn(in): Called with each page of component states.  Components
+//             unknown to HSM are not included.  An error stops the query.
+// Return:     nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func queryComponentPages(comps []string, pagefn func([]hsmComponent) error) error {
+	smURL := app_params.SM_url + URL_DELIM + SM_STATEQUERY
+
+	for ix := 0; ix < len(comps); ix += HSM_QUERY_PAGE_SIZE {
+		var carr hsmComponentArray
+
+		end := ix + HSM_QUERY_PAGE_SIZE
+		if end > len(comps) {
+			end = len(comps)
+		}
+		ba, err := json.Marshal(hsmComponentQuery{ComponentIDs: comps[ix:end]})
+		if err != nil {
+			return err
+		}
+		rsp, err := hsmRequest(http.MethodPost, smURL, ba)
+		if err != nil {
+			return err
+		}
+		err = json.NewDecoder(rsp.Body).Decode(&carr)
+		rsp.Body.Close()
+		if err != nil {
+			return err
+		}
+		err = pagefn(carr.Components)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Query HSM for the states of a list of components.
+//
+// comps(in): List of component XNames, lower case.
+// Return:    Array of component states; nil on success, error string on
+//            error.  Components unknown to HSM are not returned.
+/////////////////////////////////////////////////////////////////////////////
+
+func queryComponentStates(comps []string) ([]hsmComponent, error) {
+	var rcomps []hsmComponent
+
+	err := queryComponentPages(comps, func(page []hsmComponent) error {
+		rcomps = append(rcomps, page...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rcomps, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Fetch component states from HSM and put them in the snapshot cache.
+//
+// comps(in): List of component XNames, lower case.
+// Return:    nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func fetchComponentStates(comps []string) error {
+	carr, err := queryComponentStates(comps)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	snapshotCacheMutex.Lock()
+	for _, comp := range carr {
+		snapshotCache[strings.ToLower(comp.ID)] =
+			snapshotCacheEntry{comp: comp, fetched: now}
+	}
+	snapshotCacheMutex.Unlock()
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Thread func to service component state requests.  Requests arriving
+// within a short window of each other are combined into one HSM query.
+//
+// Args, Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func snapshotBatcher() {
+	for Running {
+		req := <-snapshotQ
+		reqs := []snapshotRequest{req}
+
+		timer := time.NewTimer(SNAPSHOT_BATCH_WINDOW * time.Millisecond)
+	gather:
+		for {
+			select {
+			case nreq := <-snapshotQ:
+				reqs = append(reqs, nreq)
+			case <-timer.C:
+				break gather
+			}
+		}
+
+		//Only fetch what isn't cached by now; an earlier batch may have
+		//picked some of them up.
+
+		compMap := make(map[string]bool)
+		for _, rr := range reqs {
+			for _, comp := range rr.comps {
+				compMap[comp] = true
+			}
+		}
+		var comps []string
+		for comp := range compMap {
+			comps = append(comps, comp)
+		}
+		_, missing := snapshotCacheGet(comps)
+
+		var err error
+		if len(missing) > 0 {
+			if app_params.Debug > 1 {
+				log.Printf("INFO: Fetching %d component states for %d snapshot requests.\n",
+					len(missing), len(reqs))
+			}
+			err = fetchComponentStates(missing)
+		}
+		for _, rr := range reqs {
+			rr.rchan <- err
+		}
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get the current states of a list of components, from the cache if
+// possible, otherwise from HSM via the snapshot batcher.
+//
+// comps(in): List of component XNames, lower case.
+// Return:    Map of XName -> component state; nil on success, error string
+//            on error.  Components unknown to HSM are not in the map.
+/////////////////////////////////////////////////////////////////////////////
+
+func getComponentStates(comps []string) (map[string]hsmComponent, error) {
+	cmap, missing := snapshotCacheGet(comps)
+	if len(missing) == 0 {
+		return cmap, nil
+	}
+
+	rchan := make(chan error, 1)
+	snapshotQ <- snapshotRequest{comps: missing, rchan: rchan}
+	err := <-rchan
+	if err != nil {
+		return nil, err
+	}
+
+	//Use what was fetched even if it has been invalidated since; the
+	//held live SCNs will follow it.
+
+	snapshotCacheMutex.Lock()
+	for _, comp := range missing {
+		ce, ok := snapshotCache[comp]
+		if ok {
+			cmap[comp] = ce.comp
+		}
+	}
+	snapshotCacheMutex.Unlock()
+	return cmap, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Make synthetic SCNs representing the current state of a subscription's
+// components.  One SCN is made for each subscribed attribute value that
+// any of the components currently have, same as a live SCN for that value
+// would look.
+//
+// sub(in):   Subscription, lower case.
+// cmap(in):  Map of XName -> component state.
+// Return:    List of SCNs to send.
+/////////////////////////////////////////////////////////////////////////////
+
+func makeSnapshotScns(sub ScnSubscribe, cmap map[string]hsmComponent) []Scn {
+	var scns []Scn
+
+	ts := time.Now().Format(time.RFC3339Nano)
+
+	//Gather the components having each of the subscribed values of one
+	//attribute.  The SCN carries the value as HSM has it.
+
+	group := func(vals []string, getval func(hsmComponent) string,
+		setval func(*Scn, string)) {
+		for _, val := range vals {
+			var scn Scn
+			for _, xname := range sub.Components {
+				comp, ok := cmap[xname]
+				if !ok || (strings.ToLower(getval(comp)) != val) {
+					continue
+				}
+				if len(scn.Components) == 0 {
+					setval(&scn, getval(comp))
+				}
+				scn.Components = append(scn.Components, xname)
+			}
+			if len(scn.Components) > 0 {
+				scn.Timestamp = ts
+				scns = append(scns, scn)
+			}
+		}
+	}
+
+	if sub.Enabled != nil {
+		enval := func(comp hsmComponent) string {
+			if comp.Enabled == nil {
+				return ""
+			}
+			return fmt.Sprintf("%t", *comp.Enabled)
+		}
+		group([]string{"true", "false"}, enval, func(scn *Scn, val string) {
+			en := (val == "true")
+			scn.Enabled = &en
+		})
+	}
+	group(sub.Roles, func(comp hsmComponent) string { return comp.Role },
+		func(scn *Scn, val string) { scn.Role = val })
+	group(sub.SubRoles, func(comp hsmComponent) string { return comp.SubRole },
+		func(scn *Scn, val string) { scn.SubRole = val })
+	group(sub.SoftwareStatus, func(comp hsmComponent) string { return comp.SoftwareStatus },
+		func(scn *Scn, val string) { scn.SoftwareStatus = val })
+	group(sub.States, func(comp hsmComponent) string { return comp.State },
+		func(scn *Scn, val string) { scn.State = val })
+
+	return scns
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Start holding live SCNs for a subscription.  Must be done before the
+// subscription is stored, so that no live SCN can get ahead of the
+// snapshot.
+//
+// subscriber(in): Subscriber, [agent@]xname.
+// url(in):        Subscriber URL.
+// opts(in):       Subscription's send options.
+// Return:         None.
+/////////////////////////////////////////////////////////////////////////////
+
+func snapshotHoldStart(subscriber string, url string, opts scnSendOpts) {
+	snapshotHoldMutex.Lock()
+	defer snapshotHoldMutex.Unlock()
+	snapshotHolds[subscriber+"|"+url] = &snapshotHold{subscriber: subscriber,
+		url: url, opts: opts}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Hold a live SCN if its subscription is waiting for a snapshot.
+//
+// sd(in):         SCN to be sent.
+// subscriber(in): Subscriber, [agent@]xname.
+// url(in):        Subscriber URL.
+// Return:         true if the SCN was held, false if it should be sent now.
+/////////////////////////////////////////////////////////////////////////////
+
+func snapshotHoldScn(sd Scn, subscriber string, url string) bool {
+	snapshotHoldMutex.Lock()
+	defer snapshotHoldMutex.Unlock()
+
+	if len(snapshotHolds) == 0 {
+		return false
+	}
+	sh, ok := snapshotHolds[subscriber+"|"+url]
+	if !ok {
+		return false
+	}
+	sh.scns = append(sh.scns, sd)
+	return true
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Stop holding live SCNs for a subscription, and send the ones held so far.
+// The held SCNs are taken out and queued without holding the lock, since
+// queueing can wait for room in the worker pool.  The hold stays in place
+// until nothing more was held while queueing, so that newer SCNs can't get
+// ahead of them.
+//
+// The hold only exists on this replica.  Live SCNs for the subscription
+// handled by other replicas aren't held and can arrive before the snapshot.
+//
+// subscriber(in): Subscriber, [agent@]xname.
+// url(in):        Subscriber URL.
+// Return:         None.
+/////////////////////////////////////////////////////////////////////////////
+
+func snapshotHoldRelease(subscriber string, url string) {
+	key := subscriber + "|" + url
+
+	for {
+		snapshotHoldMutex.Lock()
+		sh, ok := snapshotHolds[key]
+		if !ok {
+			snapshotHoldMutex.Unlock()
+			return
+		}
+		scns := sh.scns
+		sh.scns = nil
+		if len(scns) == 0 {
+			delete(snapshotHolds, key)
+			snapshotHoldMutex.Unlock()
+			return
+		}
+		opts := sh.opts
+		snapshotHoldMutex.Unlock()
+
+		for _, sd := range scns {
+			j := NewJobSCNSend(sd, subscriber, url).(*JobSCNSend)
+			j.scnSendOpts = opts
+			queueScnSend(j, subscriber)
+		}
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Queue an SCN send job on its subscriber's queue.  If the queue isn't
+// being served, queue a job to serve it, waiting for room in the worker
+// pool queue if need be.  SCN send jobs are tracked so they can be
+// cancelled if the subscriber is pruned.
+//
+// jj(in):         SCN send job.
+// subscriber(in): Subscriber, [agent@]xname.
+// Return:         None.
+/////////////////////////////////////////////////////////////////////////////
+
+func queueScnSend(jj base.Job, subscriber string) {
+	if j, ok := jj.(*JobSCNSend); ok {
+		trackScnSend(j)
+		if !enqueueScnSend(j, subscriber) {
+			return
+		}
+		jj = NewJobSCNQueue(subscriber)
+	}
+	for {
+		rv := scnWorkPool.Queue(jj)
+		if rv == 0 {
+			break
+		}
+		log.Printf("WARNING: SCN send '%s' blocked due to full Q.\n",
+			subscriber)
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Send the initial snapshot for a new subscription, then release any live
+// SCNs held for it.  The snapshot SCNs are sent one at a time and waited
+// on, so that they arrive before the live ones.
+//
+// sub(in):        Subscription, lower case.
+// subscriber(in): Subscriber, [agent@]xname.
+// opts(in):       Subscription's send options.
+// Return:         None.
+/////////////////////////////////////////////////////////////////////////////
+
+func deliverInitialSnapshot(sub ScnSubscribe, subscriber string, opts scnSendOpts) {
+	defer snapshotHoldRelease(subscriber, sub.Url)
+
+	if app_params.Nosm != 0 {
+		return
+	}
+
+	cmap, err := getComponentStates(sub.Components)
+	if err != nil {
+		log.Printf("ERROR fetching component states for '%s' initial snapshot: %v",
+			subscriber, err)
+		return
+	}
+
+	scns := makeSnapshotScns(sub, cmap)
+	if app_params.Debug > 0 {
+		log.Printf("INFO: Sending %d initial snapshot SCNs to '%s'.\n",
+			len(scns), subscriber)
+	}
+
+	for _, scn := range scns {
+		jj := NewJobSCNSend(scn, subscriber, sub.Url)
+		jj.(*JobSCNSend).scnSendOpts = opts
+		queueScnSend(jj, subscriber)
+
+		start := time.Now()
+		for time.Since(start) < (SNAPSHOT_SEND_TIMEOUT * time.Second) {
+			jstat, _ := jj.GetStatus()
+			if (jstat == base.JSTAT_COMPLETE) ||
+				(jstat == base.JSTAT_ERROR) ||
+				(jstat == base.JSTAT_CANCELLED) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	base "github.com/Cray-HPE/hms-base/v2"
+)
+
+// Fake HSM component state query API.
+
+type fakeHsmStates struct {
+	sync.Mutex
+	comps   map[string]hsmComponent
+	queries int
+}
+
+func (fh *fakeHsmStates) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var qry hsmComponentQuery
+	var carr hsmComponentArray
+
+	//Goroutines left by other tests may call other HSM APIs.
+
+	if (r.Method != http.MethodPost) ||
+		!strings.HasSuffix(r.URL.Path, SM_STATEQUERY) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	fh.Lock()
+	defer fh.Unlock()
+	fh.queries++
+
+	body, _ := ioutil.ReadAll(r.Body)
+	json.Unmarshal(body, &qry)
+	for _, id := range qry.ComponentIDs {
+		if comp, ok := fh.comps[id]; ok {
+			carr.Components = append(carr.Components, comp)
+		}
+	}
+	ba, _ := json.Marshal(carr)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(ba)
+}
+
+// Fake subscriber, records SCNs in the order received.
+
+type fakeSubscriber struct {
+	sync.Mutex
+	scns []Scn
+}
+
+func (fs *fakeSubscriber) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var scn Scn
+
+	body, _ := ioutil.ReadAll(r.Body)
+	json.Unmarshal(body, &scn)
+	fs.Lock()
+	fs.scns = append(fs.scns, scn)
+	fs.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (fs *fakeSubscriber) received() []Scn {
+	fs.Lock()
+	defer fs.Unlock()
+	return append([]Scn{}, fs.scns...)
+}
+
+func TestMakeSnapshotScns(t *testing.T) {
+	enbl := true
+	dsbl := false
+	cmap := map[string]hsmComponent{
+		"x0c0s0b0n0": {ID: "x0c0s0b0n0", State: "Ready", Enabled: &enbl,
+			Role: "Compute", SoftwareStatus: "AdminDown"},
+		"x0c0s0b0n1": {ID: "x0c0s0b0n1", State: "Off", Enabled: &dsbl,
+			Role: "Compute"},
+		"x0c0s0b0n2": {ID: "x0c0s0b0n2", State: "Ready", Enabled: &enbl,
+			Role: "Application"},
+	}
+	sub := ScnSubscribe{
+		Components:     []string{"x0c0s0b0n0", "x0c0s0b0n1", "x0c0s0b0n2", "x0c0s0b0n3"},
+		States:         []string{"ready", "off", "halt"},
+		SoftwareStatus: []string{"admindown"},
+		Roles:          []string{"compute"},
+		Enabled:        &enbl,
+	}
+
+	scns := makeSnapshotScns(sub, cmap)
+	if len(scns) != 6 {
+		t.Fatalf("ERROR, expected 6 snapshot SCNs, got %d: %v", len(scns), scns)
+	}
+
+	check := func(ix int, comps []string) {
+		if len(scns[ix].Components) != len(comps) {
+			t.Errorf("ERROR, SCN %d component mismatch, exp: %v, got: %v",
+				ix, comps, scns[ix].Components)
+			return
+		}
+		for jj := range comps {
+			if scns[ix].Components[jj] != comps[jj] {
+				t.Errorf("ERROR, SCN %d component mismatch, exp: %v, got: %v",
+					ix, comps, scns[ix].Components)
+			}
+		}
+		if scns[ix].Timestamp == "" {
+			t.Errorf("ERROR, SCN %d has no timestamp.", ix)
+		}
+	}
+
+	if (scns[0].Enabled == nil) || !*scns[0].Enabled {
+		t.Errorf("ERROR, expected Enabled=true SCN first, got: %v", scns[0])
+	}
+	check(0, []string{"x0c0s0b0n0", "x0c0s0b0n2"})
+	if (scns[1].Enabled == nil) || *scns[1].Enabled {
+		t.Errorf("ERROR, expected Enabled=false SCN second, got: %v", scns[1])
+	}
+	check(1, []string{"x0c0s0b0n1"})
+	if scns[2].Role != "Compute" {
+		t.Errorf("ERROR, expected Role SCN, got: %v", scns[2])
+	}
+	check(2, []string{"x0c0s0b0n0", "x0c0s0b0n1"})
+	if scns[3].SoftwareStatus != "AdminDown" {
+		t.Errorf("ERROR, expected SoftwareStatus SCN, got: %v", scns[3])
+	}
+	check(3, []string{"x0c0s0b0n0"})
+	if scns[4].State != "Ready" {
+		t.Errorf("ERROR, expected State Ready SCN, got: %v", scns[4])
+	}
+	check(4, []string{"x0c0s0b0n0", "x0c0s0b0n2"})
+	if scns[5].State != "Off" {
+		t.Errorf("ERROR, expected State Off SCN, got: %v", scns[5])
+	}
+	check(5, []string{"x0c0s0b0n1"})
+}
+
+func TestInitialSnapshot(t *testing.T) {
+	disable_logs()
+
+	fh := &fakeHsmStates{comps: map[string]hsmComponent{
+		"x0c0s0b0n0": {ID: "x0c0s0b0n0", State: "Ready"},
+		"x0c0s0b0n1": {ID: "x0c0s0b0n1", State: "Off"},
+		"x0c0s0b0n2": {ID: "x0c0s0b0n2", State: "Ready"},
+	}}
+	hsrv := httptest.NewServer(fh)
+	defer hsrv.Close()
+	fs := &fakeSubscriber{}
+	ssrv := httptest.NewServer(fs)
+	defer ssrv.Close()
+
+	if htrans.transport == nil {
+		htrans.transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		htrans.client = &http.Client{Transport: htrans.transport,
+			Timeout: 5 * time.Second,
+		}
+	}
+	if scnWorkPool == nil {
+		scnWorkPool = base.NewWorkerPool(10, 10)
+		scnWorkPool.Run()
+	}
+	go snapshotBatcher()
+
+	savedSM := app_params.SM_url
+	app_params.SM_url = hsrv.URL
+	app_params.Nosm = 0
+	defer func() {
+		app_params.SM_url = savedSM
+		app_params.Nosm = 1
+		snapshotCacheMutex.Lock()
+		snapshotCache = make(map[string]snapshotCacheEntry)
+		snapshotCacheMutex.Unlock()
+	}()
+
+	//Concurrent requests are batched into a single HSM query.
+
+	var wg sync.WaitGroup
+	for ix := 0; ix < 5; ix++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cmap, err := getComponentStates([]string{"x0c0s0b0n0", "x0c0s0b0n1"})
+			if err != nil {
+				t.Errorf("ERROR getting component states: %v", err)
+			} else if len(cmap) != 2 {
+				t.Errorf("ERROR, expected 2 component states, got %d", len(cmap))
+			}
+		}()
+	}
+	wg.Wait()
+	if fh.queries != 1 {
+		t.Errorf("ERROR, expected 1 HSM query, got %d", fh.queries)
+	}
+
+	//Cached ones aren't fetched again; invalidated ones are.
+
+	getComponentStates([]string{"x0c0s0b0n0", "x0c0s0b0n1"})
+	if fh.queries != 1 {
+		t.Errorf("ERROR, cached component states fetched again.")
+	}
+	snapshotCacheInvalidate([]string{"x0c0s0b0n1"})
+	getComponentStates([]string{"x0c0s0b0n0", "x0c0s0b0n1"})
+	if fh.queries != 2 {
+		t.Errorf("ERROR, invalidated component state not fetched again.")
+	}
+
+	//Live SCNs are held until the snapshot has been delivered.
+
+	sub := ScnSubscribe{Components: []string{"x0c0s0b0n0", "x0c0s0b0n1", "x0c0s0b0n2"},
+		States: []string{"ready", "off"},
+		Url:    ssrv.URL,
+	}
+	snapshotHoldStart("x1c2s3b0n4", sub.Url, scnSendOpts{})
+	live := Scn{Components: []string{"x0c0s0b0n1"}, State: "Ready"}
+	if !snapshotHoldScn(live, "x1c2s3b0n4", sub.Url) {
+		t.Errorf("ERROR, live SCN not held for pending snapshot.")
+	}
+	if snapshotHoldScn(live, "x1c2s3b0n5", sub.Url) {
+		t.Errorf("ERROR, live SCN held for subscriber with no pending snapshot.")
+	}
+
+	deliverInitialSnapshot(sub, "x1c2s3b0n4", scnSendOpts{})
+
+	var got []Scn
+	for ix := 0; ix < 100; ix++ {
+		got = fs.received()
+		if len(got) >= 3 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if len(got) != 3 {
+		t.Fatalf("ERROR, expected 3 SCNs delivered, got %d: %v", len(got), got)
+	}
+	if (got[0].State != "Ready") || (len(got[0].Components) != 2) {
+		t.Errorf("ERROR, first snapshot SCN mismatch: %v", got[0])
+	}
+	if (got[1].State != "Off") || (len(got[1].Components) != 1) {
+		t.Errorf("ERROR, second snapshot SCN mismatch: %v", got[1])
+	}
+	if (got[2].State != "Ready") || (got[2].Components[0] != "x0c0s0b0n1") {
+		t.Errorf("ERROR, live SCN not delivered after snapshot: %v", got[2])
+	}
+	if snapshotHoldScn(live, "x1c2s3b0n4", sub.Url) {
+		t.Errorf("ERROR, live SCN still held after snapshot delivered.")
+	}
+}
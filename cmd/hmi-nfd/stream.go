@@ -0,0 +1,530 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	base "github.com/Cray-HPE/hms-base/v2"
+)
+
+// A note about SCN streams:
+//
+// Clients which can't take POSTs, like CLIs and dashboards behind a
+// firewall, can instead get SCNs as Server-Sent Events, over a long-lived
+// GET of /hmi/v2/stream.  The SCNs a stream gets are given by query
+// parameters, either:
+//
+//   subscriber=[agent@]id  The SCNs matching that subscriber's current
+//                          subscriptions (all of its agents' if no agent
+//                          is given).  These are read when the stream is
+//                          opened; later changes to them need a reconnect.
+//
+// or a filter like a subscription's:
+//
+//   components=x,y,...     Components, required; or all, or allnodes.
+//   states=, softwarestatus=, roles=, subroles=, enabled=true
+//                          SCN attributes; at least one is required.
+//
+// Each SCN is an 'scn' event whose data is the SCN, with only the matching
+// components, and whose ID is the replica's epoch (set when it starts) and
+// a sequence number like the ones batched deliveries get, e.g.
+// 'lq3k9x2a-1792345462273105785'.  The last STREAM_REPLAY_MAX SCNs are
+// kept, so a client which reconnects with a Last-Event-ID header (or
+// lastEventId parameter) gets the ones it missed.  If they're no longer
+// kept, a 'missed' event is sent first, so the client knows to resync.  A
+// heartbeat comment is sent when the stream is otherwise idle, to keep
+// proxies from closing it.
+//
+// Event IDs and the kept SCNs are per replica, and IDs from different
+// replicas aren't ordered.  A Last-Event-ID from another replica (a
+// reconnect which the load balancer sent elsewhere), from before a restart,
+// or which isn't an event ID at all, gets a 'missed' event and no replay.
+//
+// A client which can't keep up has its stream closed rather than holding up
+// SCN processing; it can reconnect and resume.
+//
+// Streams get every SCN, whichever replica it was sent to: each replica
+// hands off every SCN it gets from HSM to the others, with or without
+// segmented fanout (see segment.go).  If a replica misses hand-offs, its
+// open streams get a 'missed' event, and so do clients reconnecting with an
+// ID from before then.
+
+/////////////////////////////////////////////////////////////////////////////
+// Constants and Global Data
+
+const (
+	STREAM_REPLAY_MAX   = 1000 //SCNs kept for reconnecting clients
+	STREAM_MAX_CLIENTS  = 256  //open streams per replica
+	STREAM_CLIENT_QUEUE = 256  //events waiting to be written, per stream
+	STREAM_HEARTBEAT    = 15   //seconds between idle heartbeats
+)
+
+// An SCN kept for streams.  scn is as received; comps and attrs are
+// lower-cased for matching.
+
+type streamEvent struct {
+	id    int64
+	scn   Scn
+	comps []string
+	attrs []string
+}
+
+// One subscription a stream matches SCNs against.
+
+type streamSub struct {
+	key   string
+	nodes []string
+}
+
+// An open stream.  Events are closed when the stream is dropped.
+
+type streamClient struct {
+	subs   []streamSub
+	events chan streamMsg
+}
+
+// An event to write to a stream.  A missed event has no SCN.
+
+type streamMsg struct {
+	id     int64
+	scn    Scn
+	missed bool
+}
+
+var streamHeartbeat = STREAM_HEARTBEAT * time.Second
+var streamEpoch = strconv.FormatInt(time.Now().UnixNano(), 36) //this replica's event IDs
+
+var streamReplay []streamEvent
+var streamEvicted int64 //SCNs with IDs up to this one may not be kept
+var streamClients = make(map[*streamClient]bool)
+var streams_mutex sync.Mutex
+
+/////////////////////////////////////////////////////////////////////////////
+// Match an SCN against a stream's subscriptions.
+//
+// ev(in): SCN to match.
+// Return: SCN to send, with only the matching components; false if none
+//         match.
+/////////////////////////////////////////////////////////////////////////////
+
+func (sc *streamClient) match(ev *streamEvent) (Scn, bool) {
+	var comps []string
+
+	for _, sub := range sc.subs {
+		if (len(sub.nodes) == 0) || !scnAttrMatch(sub.key, ev.attrs) {
+			continue
+		}
+		for _, comp := range intersect(sub.nodes, ev.comps) {
+			if !stringInList(comps, comp) {
+				comps = append(comps, comp)
+			}
+		}
+	}
+	if len(comps) == 0 {
+		return Scn{}, false
+	}
+
+	//Same fields as a POSTed SCN.
+
+	sendData := Scn{Components: comps,
+		Enabled:        ev.scn.Enabled,
+		Role:           ev.scn.Role,
+		SubRole:        ev.scn.SubRole,
+		SoftwareStatus: ev.scn.SoftwareStatus,
+		State:          ev.scn.State,
+		Timestamp:      ev.scn.Timestamp,
+		Reconciled:     ev.scn.Reconciled}
+	return sendData, true
+}
+
+// Check if a string is in a list.
+
+func stringInList(list []string, s string) bool {
+	for _, ls := range list {
+		if ls == s {
+			return true
+		}
+	}
+	return false
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Publish an SCN to open streams, and keep it for reconnecting ones.
+//
+// jdata(in): SCN received by this replica.
+// Return:    None.
+/////////////////////////////////////////////////////////////////////////////
+
+func publishStreamScn(jdata Scn) {
+	ev := streamEvent{scn: jdata}
+	ev.comps = make([]string, len(jdata.Components))
+	for ix, comp := range jdata.Components {
+		ev.comps[ix] = strings.ToLower(comp)
+	}
+	lc := jdata
+	lc.Components = nil
+	scnToLower(&lc)
+	ev.attrs = getSCNAttrs(lc)
+
+	streams_mutex.Lock()
+	defer streams_mutex.Unlock()
+
+	ev.id = newScnSequence()
+	streamReplay = append(streamReplay, ev)
+	if len(streamReplay) > STREAM_REPLAY_MAX {
+		streamEvicted = streamReplay[0].id
+		streamReplay = append([]streamEvent{}, streamReplay[1:]...)
+	}
+
+	for sc := range streamClients {
+		sendData, ok := sc.match(&ev)
+		if !ok {
+			continue
+		}
+		select {
+		case sc.events <- streamMsg{id: ev.id, scn: sendData}:
+		default:
+			log.Printf("WARNING: SCN stream client can't keep up, closing its stream.")
+			delete(streamClients, sc)
+			close(sc.events)
+		}
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Open a stream: register it, and get the kept SCNs it missed.  Done
+// together so no SCN is missed or sent twice.
+//
+// sc(in/out): Stream to open.
+// lastID(in): Sequence number of the last event the client got, 0 if
+//             none, -1 if its ID isn't one of this replica's.
+// Return:     SCNs to replay; true if some were missed that aren't kept;
+//             error if there are too many streams.
+/////////////////////////////////////////////////////////////////////////////
+
+func openStream(sc *streamClient, lastID int64) ([]streamMsg, bool, error) {
+	var replay []streamMsg
+
+	streams_mutex.Lock()
+	defer streams_mutex.Unlock()
+
+	if len(streamClients) >= STREAM_MAX_CLIENTS {
+		return nil, false, fmt.Errorf("Too many open SCN streams")
+	}
+	sc.events = make(chan streamMsg, STREAM_CLIENT_QUEUE)
+	streamClients[sc] = true
+
+	if lastID == 0 {
+		return nil, false, nil
+	}
+	if lastID < 0 {
+		return nil, true, nil
+	}
+	for ix := range streamReplay {
+		if streamReplay[ix].id <= lastID {
+			continue
+		}
+		if sendData, ok := sc.match(&streamReplay[ix]); ok {
+			replay = append(replay, streamMsg{id: streamReplay[ix].id, scn: sendData})
+		}
+	}
+	return replay, lastID < streamEvicted, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Tell streams that SCNs were missed, e.g. because hand-offs from a peer
+// replica were lost.  Open streams get a 'missed' event, and so do clients
+// reconnecting from before now.
+//
+// Args, Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func streamMissed() {
+	streams_mutex.Lock()
+	defer streams_mutex.Unlock()
+
+	streamEvicted = newScnSequence()
+	for sc := range streamClients {
+		select {
+		case sc.events <- streamMsg{missed: true}:
+		default:
+			log.Printf("WARNING: SCN stream client can't keep up, closing its stream.")
+			delete(streamClients, sc)
+			close(sc.events)
+		}
+	}
+}
+
+// Close a stream, if it's still open.
+
+func closeStream(sc *streamClient) {
+	streams_mutex.Lock()
+	defer streams_mutex.Unlock()
+	if streamClients[sc] {
+		delete(streamClients, sc)
+		close(sc.events)
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Close all open streams.  Called on server shutdown, which would otherwise
+// wait for them.
+//
+// Args, Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func closeStreams() {
+	streams_mutex.Lock()
+	defer streams_mutex.Unlock()
+	for sc := range streamClients {
+		delete(streamClients, sc)
+		close(sc.events)
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get a stream's subscriptions from its query parameters.  See the note at
+// the top of this file.
+//
+// r(in):  HTTP request.
+// Return: Subscriptions to match SCNs against; error if the parameters are
+//         invalid or the subscriptions can't be read.
+/////////////////////////////////////////////////////////////////////////////
+
+func parseStreamFilter(r *http.Request) ([]streamSub, error) {
+	var subs []streamSub
+	var jdata ScnSubscribe
+
+	qv := r.URL.Query()
+	splitq := func(name string) []string {
+		var vals []string
+		for _, v := range strings.Split(strings.ToLower(qv.Get(name)), ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				vals = append(vals, v)
+			}
+		}
+		return vals
+	}
+
+	if subscriber := strings.ToLower(qv.Get("subscriber")); subscriber != "" {
+		id, agent := subscriber, ""
+		if ix := strings.Index(subscriber, SUBSCRIBER_SVC_DELIM); ix != -1 {
+			id, agent = subscriber[ix+1:], subscriber[:ix]
+		}
+		kvlist, kverr := kvHandle.GetRange(SUBSCRIBER_KEYRANGE_START,
+			SUBSCRIBER_KEYRANGE_END)
+		if kverr != nil {
+			return nil, fmt.Errorf("KV fetch error: %v", kverr)
+		}
+		for _, sub := range kvlist {
+			var sd SubData
+			kid, kagent := parseSubscriptionKey(sub.Key)
+			if (kid != id) || ((agent != "") && (kagent != agent)) {
+				continue
+			}
+			if (json.Unmarshal([]byte(sub.Value), &sd) != nil) || sd.Suspended {
+				continue
+			}
+			subs = append(subs, streamSub{key: sub.Key, nodes: sd.ScnNodes})
+		}
+		if len(subs) == 0 {
+			return nil, fmt.Errorf("No subscriptions found for subscriber '%s'",
+				subscriber)
+		}
+		return subs, nil
+	}
+
+	jdata.Components = splitq("components")
+	jdata.States = splitq("states")
+	jdata.SoftwareStatus = splitq("softwarestatus")
+	jdata.Roles = splitq("roles")
+	jdata.SubRoles = splitq("subroles")
+	if enbl := qv.Get("enabled"); enbl != "" {
+		ebool, err := strconv.ParseBool(enbl)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid 'enabled', must be true or false")
+		}
+		if ebool {
+			jdata.Enabled = &ebool
+		}
+	}
+
+	if len(jdata.Components) == 0 {
+		return nil, fmt.Errorf("Missing 'subscriber' or 'components'")
+	}
+	if (len(jdata.States) == 0) && (len(jdata.SoftwareStatus) == 0) &&
+		(len(jdata.Roles) == 0) && (len(jdata.SubRoles) == 0) &&
+		(jdata.Enabled == nil) {
+		return nil, fmt.Errorf("Missing states, softwarestatus, roles, subroles or enabled")
+	}
+
+	subs = append(subs, streamSub{key: makeSubscriptionKey_V2(jdata, URL_STREAM, ""),
+		nodes: jdata.Components})
+	return subs, nil
+}
+
+// Make a stream event ID from an SCN's sequence number.
+
+func streamEventID(id int64) string {
+	return streamEpoch + "-" + strconv.FormatInt(id, 10)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get the sequence number of the last event a reconnecting client got.
+//
+// r(in):  HTTP request.
+// Return: Sequence number; 0 if none was given; -1 if the ID isn't one of
+//         this replica's, so the client has to resync.
+/////////////////////////////////////////////////////////////////////////////
+
+func parseLastEventID(r *http.Request) int64 {
+	lid := r.Header.Get("Last-Event-ID")
+	if lid == "" {
+		lid = r.URL.Query().Get("lastEventId")
+	}
+	if lid == "" {
+		return 0
+	}
+	if !strings.HasPrefix(lid, streamEpoch+"-") {
+		return -1
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(lid, streamEpoch+"-"), 10, 64)
+	if (err != nil) || (id <= 0) {
+		return -1
+	}
+	return id
+}
+
+// Write one SCN or missed event to a stream.
+
+func writeStreamEvent(w http.ResponseWriter, msg streamMsg) error {
+	if msg.missed {
+		_, err := fmt.Fprintf(w, "event: missed\ndata: {}\n\n")
+		return err
+	}
+	ba, err := json.Marshal(msg.scn)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: scn\ndata: %s\n\n",
+		streamEventID(msg.id), ba)
+	return err
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Stream SCNs to a client as Server-Sent Events.  See the note at the top
+// of this file.
+//
+// w(in):  HTTP response writer
+// r(in):  HTTP request
+// Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	var sc streamClient
+
+	errinst := "/" + URL_STREAM
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Println("ERROR: SCN stream response can't be flushed.")
+		pdet := base.NewProblemDetails("about:blank",
+			"Internal Server Error",
+			"Streaming not supported",
+			errinst, http.StatusInternalServerError)
+		base.SendProblemDetails(w, pdet, 0)
+		return
+	}
+
+	lastID := parseLastEventID(r)
+	var err error
+	sc.subs, err = parseStreamFilter(r)
+	if err != nil {
+		log.Println("ERROR: Bad SCN stream request:", err)
+		pdet := base.NewProblemDetails("about:blank",
+			"Invalid Request",
+			err.Error(),
+			errinst, http.StatusBadRequest)
+		base.SendProblemDetails(w, pdet, 0)
+		return
+	}
+
+	replay, missed, err := openStream(&sc, lastID)
+	if err != nil {
+		log.Println("ERROR: Can't open SCN stream:", err)
+		pdet := base.NewProblemDetails("about:blank",
+			"Service Unavailable",
+			err.Error(),
+			errinst, http.StatusServiceUnavailable)
+		base.SendProblemDetails(w, pdet, 0)
+		return
+	}
+	defer closeStream(&sc)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if missed {
+		writeStreamEvent(w, streamMsg{missed: true})
+	}
+	for _, msg := range replay {
+		if writeStreamEvent(w, msg) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg, open := <-sc.events:
+			if !open {
+				return
+			}
+			if writeStreamEvent(w, msg) != nil {
+				return
+			}
+			flusher.Flush()
+			heartbeat.Reset(streamHeartbeat)
+		case <-heartbeat.C:
+			if _, err := fmt.Fprintf(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,304 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Reset stream state between tests.
+
+func streamReset() {
+	closeStreams()
+	streams_mutex.Lock()
+	streamReplay = nil
+	streamEvicted = 0
+	streams_mutex.Unlock()
+}
+
+func TestParseStreamFilter(t *testing.T) {
+	var kverr error
+
+	disable_logs()
+	kverr = openTestKV()
+	if kverr != nil {
+		t.Fatal("KV/ETCD open failed:", kverr)
+	}
+	defer kvPurge(t)
+
+	ba, _ := json.Marshal(SubData{Url: "http://a.b/scn",
+		ScnNodes: []string{"x0c0s0b0n0"}})
+	kverr = kvHandle.Store("sub#x1000c0s1b0n0#hs.ready#svc.pcs", string(ba))
+	if kverr != nil {
+		t.Fatal("KV store failed:", kverr)
+	}
+
+	tests := []struct {
+		query string
+		nsubs int
+		bad   bool
+	}{
+		{"components=x0c0s0b0n0&states=Ready,Off", 1, false},
+		{"components=x0c0s0b0n0&enabled=true", 1, false},
+		{"components=x0c0s0b0n0&enabled=maybe", 0, true},
+		{"components=x0c0s0b0n0", 0, true},
+		{"states=Ready", 0, true},
+		{"", 0, true},
+		{"subscriber=pcs@x1000c0s1b0n0", 1, false},
+		{"subscriber=x1000c0s1b0n0", 1, false},
+		{"subscriber=wlm@x1000c0s1b0n0", 0, true},
+	}
+
+	for ix, tt := range tests {
+		req := httptest.NewRequest("GET", "/hmi/v2/stream?"+tt.query, nil)
+		subs, err := parseStreamFilter(req)
+		if (err != nil) != tt.bad {
+			t.Errorf("ERROR, test %d: unexpected error state: %v", ix, err)
+		}
+		if len(subs) != tt.nsubs {
+			t.Errorf("ERROR, test %d: expected %d subscriptions, got %d",
+				ix, tt.nsubs, len(subs))
+		}
+	}
+
+	//Only this replica's event IDs are known.
+
+	ids := []struct {
+		lid string
+		exp int64
+	}{
+		{"", 0},
+		{streamEventID(42), 42},
+		{"42", -1},
+		{"-1", -1},
+		{"0" + streamEpoch + "-42", -1},
+		{streamEpoch + "-x", -1},
+		{streamEpoch + "-0", -1},
+	}
+	for _, tt := range ids {
+		req := httptest.NewRequest("GET", "/hmi/v2/stream", nil)
+		if tt.lid != "" {
+			req.Header.Set("Last-Event-ID", tt.lid)
+		}
+		if id := parseLastEventID(req); id != tt.exp {
+			t.Errorf("ERROR, Last-Event-ID '%s' expected %d, got %d", tt.lid,
+				tt.exp, id)
+		}
+	}
+}
+
+func TestStreamMatch(t *testing.T) {
+	streamReset()
+	defer streamReset()
+
+	req := httptest.NewRequest("GET",
+		"/hmi/v2/stream?components=x0c0s0b0n0,x0c0s1b0n1&states=Ready", nil)
+	subs, err := parseStreamFilter(req)
+	if err != nil {
+		t.Fatal("ERROR parsing stream filter:", err)
+	}
+	sc := streamClient{subs: subs}
+	if _, _, err = openStream(&sc, 0); err != nil {
+		t.Fatal("ERROR opening stream:", err)
+	}
+
+	publishStreamScn(Scn{State: "Off", Components: []string{"x0c0s0b0n0"}})
+	publishStreamScn(Scn{State: "Ready",
+		Components: []string{"X0c0s0b0n0", "x0c0s1b0n1", "x0c0s2b0n0"}})
+
+	select {
+	case msg := <-sc.events:
+		if (msg.scn.State != "Ready") || (len(msg.scn.Components) != 2) {
+			t.Errorf("ERROR, bad stream SCN: %v", msg.scn)
+		}
+	default:
+		t.Fatalf("ERROR, matching SCN not streamed.")
+	}
+	select {
+	case msg := <-sc.events:
+		t.Errorf("ERROR, unexpected stream SCN: %v", msg.scn)
+	default:
+	}
+
+	//A reconnect from before the kept SCNs knows it missed some.
+
+	streams_mutex.Lock()
+	streamEvicted = streamReplay[0].id - 1
+	streams_mutex.Unlock()
+	sc2 := streamClient{subs: subs}
+	replay, missed, _ := openStream(&sc2, 1)
+	if !missed || (len(replay) != 1) {
+		t.Errorf("ERROR, expected missed SCNs and 1 replayed, got %v, %d",
+			missed, len(replay))
+	}
+
+	//So does one from another replica, with nothing replayed.
+
+	sc3 := streamClient{subs: subs}
+	replay, missed, _ = openStream(&sc3, -1)
+	if !missed || (len(replay) != 0) {
+		t.Errorf("ERROR, expected missed SCNs and none replayed, got %v, %d",
+			missed, len(replay))
+	}
+}
+
+// Read one SSE event or comment from a stream.
+
+func readStreamEvent(t *testing.T, rdr *bufio.Reader) map[string]string {
+	ev := make(map[string]string)
+	for {
+		line, err := rdr.ReadString('\n')
+		if err != nil {
+			t.Fatalf("ERROR reading stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return ev
+		}
+		if strings.HasPrefix(line, ":") {
+			ev["comment"] = strings.TrimSpace(line[1:])
+			continue
+		}
+		kv := strings.SplitN(line, ": ", 2)
+		if len(kv) == 2 {
+			ev[kv[0]] = kv[1]
+		}
+	}
+}
+
+func TestStreamHandler(t *testing.T) {
+	streamReset()
+	defer streamReset()
+	disable_logs()
+	savedHB := streamHeartbeat
+	streamHeartbeat = 200 * time.Millisecond
+	defer func() { streamHeartbeat = savedHB }()
+
+	router := newRouter(generateRoutes())
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	surl := srv.URL + "/hmi/v2/stream?components=x0c0s0b0n0&states=ready"
+
+	//Bad filter
+
+	resp, err := http.Get(srv.URL + "/hmi/v2/stream?states=ready")
+	if err != nil {
+		t.Fatal("ERROR opening stream:", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("ERROR, bad filter got status %d", resp.StatusCode)
+	}
+
+	//SCNs published before a reconnect are replayed after its Last-Event-ID.
+
+	publishStreamScn(Scn{State: "Ready", Components: []string{"x0c0s0b0n0"}})
+	streams_mutex.Lock()
+	firstID := streamReplay[0].id
+	streams_mutex.Unlock()
+	publishStreamScn(Scn{State: "Ready", Components: []string{"x0c0s0b0n0"},
+		Timestamp: "second"})
+
+	req, _ := http.NewRequest("GET", surl, nil)
+	req.Header.Set("Last-Event-ID", streamEventID(firstID))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("ERROR opening stream:", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("ERROR, bad stream content type '%s'", ct)
+	}
+	rdr := bufio.NewReader(resp.Body)
+
+	ev := readStreamEvent(t, rdr)
+	var scn Scn
+	if (ev["event"] != "scn") || (json.Unmarshal([]byte(ev["data"]), &scn) != nil) ||
+		(scn.Timestamp != "second") || !strings.HasPrefix(ev["id"], streamEpoch+"-") {
+		t.Fatalf("ERROR, bad replayed event: %v", ev)
+	}
+
+	//A reconnect with another replica's event ID has to resync.
+
+	req2, _ := http.NewRequest("GET", surl, nil)
+	req2.Header.Set("Last-Event-ID", strconv.FormatInt(firstID, 10))
+	resp2, err := http.DefaultClient.Do(req2)
+	if err != nil {
+		t.Fatal("ERROR opening stream:", err)
+	}
+	if ev2 := readStreamEvent(t, bufio.NewReader(resp2.Body)); ev2["event"] != "missed" {
+		t.Errorf("ERROR, expected missed event for a foreign ID, got %v", ev2)
+	}
+	resp2.Body.Close()
+
+	//Live SCNs
+
+	publishStreamScn(Scn{State: "Off", Components: []string{"x0c0s0b0n0"}})
+	publishStreamScn(Scn{State: "Ready", Components: []string{"x0c0s0b0n0"},
+		Timestamp: "third"})
+	ev = readStreamEvent(t, rdr)
+	if (json.Unmarshal([]byte(ev["data"]), &scn) != nil) || (scn.Timestamp != "third") {
+		t.Fatalf("ERROR, bad live event: %v", ev)
+	}
+	thirdID := ev["id"]
+
+	//Idle streams get heartbeats.
+
+	ev = readStreamEvent(t, rdr)
+	if ev["comment"] != "heartbeat" {
+		t.Errorf("ERROR, expected heartbeat, got %v", ev)
+	}
+
+	//Lost hand-offs from peer replicas are signalled to open streams, and
+	//to reconnects from before them.
+
+	streamMissed()
+	ev = readStreamEvent(t, rdr)
+	if ev["event"] != "missed" {
+		t.Errorf("ERROR, expected missed event for lost hand-offs, got %v", ev)
+	}
+	req3, _ := http.NewRequest("GET", surl, nil)
+	req3.Header.Set("Last-Event-ID", thirdID)
+	resp3, err := http.DefaultClient.Do(req3)
+	if err != nil {
+		t.Fatal("ERROR opening stream:", err)
+	}
+	if ev3 := readStreamEvent(t, bufio.NewReader(resp3.Body)); ev3["event"] != "missed" {
+		t.Errorf("ERROR, expected missed event after lost hand-offs, got %v", ev3)
+	}
+	resp3.Body.Close()
+
+	//Shutdown ends the stream.
+
+	closeStreams()
+	if _, err = rdr.ReadString('\n'); err == nil {
+		t.Errorf("ERROR, stream still open after shutdown.")
+	}
+}
@@ -0,0 +1,220 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Cray-HPE/hms-base/v2"
+)
+
+// A note about subscription generations:
+//
+// An SCN send job can sit in the worker pool queue for a while.  If its
+// subscription is deleted or PATCHed (e.g. to a new URL) in the meantime,
+// the job is stale and must not be delivered.  So every POST or PATCH of a
+// subscription stamps it with a new generation, stored with it in ETCD,
+// and each SCN send job carries the subscription key and generation it was
+// made from.  A job sending one SCN for several subscriptions to the same
+// URL carries each of theirs, and is only stale once all of them are;
+// until then the stale ones, and the components only they matched, are
+// taken out of the SCN when it is sent.
+//
+// Deleting or PATCHing a subscription cancels its queued jobs on this
+// replica.  Jobs that can't be cancelled, or that are queued on other
+// replicas, are dropped when they run if their generation is no longer the
+// subscription's current one.  Each replica keeps the newest generation it
+// has seen for each subscription, learned from its own POSTs and PATCHes
+// and from the subscriptions it reads when fanning out SCNs.  Generations
+// are timestamps, so a stale read never moves one backwards.
+//
+// A DELETE or PATCH only cancels jobs on the replica it was sent to, so
+// before each send a job reads its subscriptions' generations from ETCD.
+// What's stored there is the current generation, whichever replica made
+// it; a subscription which isn't there any more has been deleted.  If ETCD
+// can't be read, the generations already known are used.
+
+/////////////////////////////////////////////////////////////////////////////
+// Constants and Global Data
+/////////////////////////////////////////////////////////////////////////////
+
+// Response header giving the number of queued SCN deliveries cancelled by
+// a subscription DELETE.
+
+const CANCELLED_DELIVERIES_HDR = "X-Cancelled-Deliveries"
+
+var subgens = make(map[string]int64)
+var subgens_mutex sync.Mutex
+var lastSubgen int64
+
+/////////////////////////////////////////////////////////////////////////////
+// Make a new subscription generation.  Generations are timestamps, never
+// repeated by this replica.
+//
+// Args:   None.
+// Return: New generation.
+/////////////////////////////////////////////////////////////////////////////
+
+func newSubscriptionGeneration() int64 {
+	subgens_mutex.Lock()
+	defer subgens_mutex.Unlock()
+	gen := time.Now().UnixNano()
+	if gen <= lastSubgen {
+		gen = lastSubgen + 1
+	}
+	lastSubgen = gen
+	return gen
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Note a subscription's generation, if it is newer than the one last seen.
+//
+// key(in): Subscription key.
+// gen(in): Subscription generation.
+// Return:  None.
+/////////////////////////////////////////////////////////////////////////////
+
+func noteSubscriptionGeneration(key string, gen int64) {
+	subgens_mutex.Lock()
+	defer subgens_mutex.Unlock()
+	if cur, ok := subgens[key]; !ok || (gen > cur) {
+		subgens[key] = gen
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Read subscriptions' current generations from ETCD, so that deletes and
+// changes made through other replicas are seen.  Subscriptions no longer
+// in ETCD are forgotten.
+//
+// keys(in): Subscription keys; "" is skipped.
+// Return:   None.
+/////////////////////////////////////////////////////////////////////////////
+
+func refreshSubscriptionGenerations(keys []string) {
+	if kvHandle == nil {
+		return
+	}
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if (key == "") || seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		val, ok, err := kvHandle.Get(key)
+		if err != nil {
+			log.Printf("WARNING: Can't read subscription '%s' to check its generation: %v\n",
+				key, err)
+			continue
+		}
+		if !ok {
+			forgetSubscriptionGeneration(key)
+			continue
+		}
+		var sd SubData
+		if json.Unmarshal([]byte(val), &sd) != nil {
+			continue
+		}
+		subgens_mutex.Lock()
+		subgens[key] = sd.Generation
+		subgens_mutex.Unlock()
+	}
+}
+
+// Forget a deleted subscription's generation.
+
+func forgetSubscriptionGeneration(key string) {
+	subgens_mutex.Lock()
+	defer subgens_mutex.Unlock()
+	delete(subgens, key)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Check if an SCN send job's subscription has been deleted or changed since
+// the job was made.
+//
+// key(in): Subscription key, "" if the job isn't tied to one.
+// gen(in): Subscription generation the job was made from.
+// Return:  true if the job is stale.
+/////////////////////////////////////////////////////////////////////////////
+
+func subscriptionStale(key string, gen int64) bool {
+	if key == "" {
+		return false
+	}
+	subgens_mutex.Lock()
+	defer subgens_mutex.Unlock()
+	cur, ok := subgens[key]
+	return !ok || (cur != gen)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Cancel queued SCN send jobs made from an older generation of a deleted or
+// changed subscription, if they aren't also for other subscriptions still
+// current.  Call after noting the new generation, or after forgetting a
+// deleted subscription's.
+//
+// key(in): Subscription key.
+// Return:  Number of jobs cancelled.
+/////////////////////////////////////////////////////////////////////////////
+
+func cancelStaleSends(key string) int {
+	xname, _ := parseSubscriptionKey(key)
+	ncan := 0
+
+	scnSendJobs_mutex.Lock()
+	defer scnSendJobs_mutex.Unlock()
+	jobs, jok := scnSendJobs[xname]
+	if !jok {
+		return 0
+	}
+	for j := range jobs {
+		if !j.hasSub(key) || !j.subsStale() {
+			continue
+		}
+		if j.Cancel() == base.JSTAT_CANCELLED {
+			delete(jobs, j)
+			ncan++
+		}
+	}
+	if len(jobs) == 0 {
+		delete(scnSendJobs, xname)
+	}
+	if (ncan > 0) && (app_params.Debug > 0) {
+		log.Printf("INFO: Cancelled %d queued SCN sends for subscription '%s'.\n",
+			ncan, key)
+	}
+	return ncan
+}
+
+// Set the cancelled deliveries header on a DELETE response.
+
+func setCancelledHeader(w http.ResponseWriter, ncan int) {
+	w.Header().Set(CANCELLED_DELIVERIES_HDR, strconv.Itoa(ncan))
+}
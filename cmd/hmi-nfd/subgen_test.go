@@ -0,0 +1,297 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Cray-HPE/hms-base/v2"
+)
+
+// Make a tracked, queued SCN send job for a subscription.
+
+func queuedSubJob(key string, gen int64, url string) *JobSCNSend {
+	xname, agent := parseSubscriptionKey(key)
+	j := NewJobSCNSendSub(Scn{State: "Ready"}, agent+SUBSCRIBER_SVC_DELIM+xname,
+		url, key, gen, scnSendOpts{}).(*JobSCNSend)
+	j.SetStatus(base.JSTAT_QUEUED, nil)
+	trackScnSend(j)
+	return j
+}
+
+func TestSubscriptionGenerations(t *testing.T) {
+	key := "sub#x3000c0s1b0n0#hs.ready#svc.hbtd"
+	defer forgetSubscriptionGeneration(key)
+
+	g1 := newSubscriptionGeneration()
+	g2 := newSubscriptionGeneration()
+	if g2 <= g1 {
+		t.Errorf("ERROR, generations not increasing: %d, %d", g1, g2)
+	}
+
+	//Unknown subscriptions are stale; jobs without one never are.
+
+	if !subscriptionStale(key, g1) {
+		t.Errorf("ERROR, job for unknown subscription not stale.")
+	}
+	if subscriptionStale("", 0) {
+		t.Errorf("ERROR, job without a subscription is stale.")
+	}
+
+	//An older generation never replaces a newer one.
+
+	noteSubscriptionGeneration(key, g2)
+	noteSubscriptionGeneration(key, g1)
+	if subscriptionStale(key, g2) || !subscriptionStale(key, g1) {
+		t.Errorf("ERROR, wrong current generation, exp %d", g2)
+	}
+
+	forgetSubscriptionGeneration(key)
+	if !subscriptionStale(key, g2) {
+		t.Errorf("ERROR, job for deleted subscription not stale.")
+	}
+}
+
+func TestCancelStaleSends(t *testing.T) {
+	var kverr error
+	var nsent int32
+
+	disable_logs()
+	if htrans.transport == nil {
+		htrans.transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		htrans.client = &http.Client{Transport: htrans.transport,
+			Timeout: 5 * time.Second,
+		}
+	}
+	kverr = openTestKV()
+	if kverr != nil {
+		t.Fatal("KV/ETCD open failed:", kverr)
+	}
+	defer kvPurge(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&nsent, 1)
+	}))
+	defer srv.Close()
+
+	router := newRouter(generateRoutes())
+	subUrl := "http://localhost:8080/hmi/v2/subscriptions/x3000c0s1b0n0/agents/hbtd"
+	subKey := "sub#x3000c0s1b0n0#hs.ready#svc.hbtd"
+
+	doReq := func(method, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, subUrl, bytes.NewBufferString(payload))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := doReq("POST", `{"Components":["x3000c0s2b0n0"],"States":["Ready"],"Url":"`+
+		srv.URL+`/old"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("ERROR, POST returned %d", rr.Code)
+	}
+	sd, ok := getSubData(t, subKey)
+	if !ok || (sd.Generation == 0) {
+		t.Fatalf("ERROR, subscription not stored with a generation: %v", sd)
+	}
+	oldGen := sd.Generation
+
+	//PATCHing to a new URL cancels jobs made for the old one.
+
+	oldJob := queuedSubJob(subKey, oldGen, srv.URL+"/old")
+	rr = doReq("PATCH", `{"Components":["x3000c0s2b0n0"],"States":["Ready"],"Url":"`+
+		srv.URL+`/new"}`)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("ERROR, PATCH returned %d", rr.Code)
+	}
+	if jstat, _ := oldJob.GetStatus(); jstat != base.JSTAT_CANCELLED {
+		t.Errorf("ERROR, old job not cancelled by PATCH, status %d", jstat)
+	}
+	sd, _ = getSubData(t, subKey)
+	if sd.Generation <= oldGen {
+		t.Errorf("ERROR, PATCH didn't change the generation: %v", sd)
+	}
+
+	//A stale job which was already running or couldn't be cancelled is
+	//dropped when it runs.  A current one is delivered.
+
+	stale := NewJobSCNSendSub(Scn{State: "Ready"}, "hbtd@x3000c0s1b0n0",
+		srv.URL+"/old", subKey, oldGen, scnSendOpts{})
+	stale.Run()
+	if n := atomic.LoadInt32(&nsent); n != 0 {
+		t.Errorf("ERROR, stale job was delivered.")
+	}
+	cur := NewJobSCNSendSub(Scn{State: "Ready"}, "hbtd@x3000c0s1b0n0",
+		srv.URL+"/new", subKey, sd.Generation, scnSendOpts{})
+	cur.Run()
+	if n := atomic.LoadInt32(&nsent); n != 1 {
+		t.Errorf("ERROR, current job not delivered, %d sent", n)
+	}
+
+	//DELETE cancels the rest and says how many.
+
+	queuedSubJob(subKey, sd.Generation, srv.URL+"/new")
+	queuedSubJob(subKey, sd.Generation, srv.URL+"/new")
+	other := queuedSubJob("sub#x3000c0s1b0n0#hs.ready#svc.other", 1, srv.URL)
+	defer untrackScnSend(other)
+
+	defer func() {
+		prunemap_mutex.Lock()
+		unmarkPrune("hbtd@x3000c0s1b0n0")
+		prunemap_mutex.Unlock()
+	}()
+	rr = doReq("DELETE", "")
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("ERROR, DELETE returned %d", rr.Code)
+	}
+	if hdr := rr.Header().Get(CANCELLED_DELIVERIES_HDR); hdr != "2" {
+		t.Errorf("ERROR, expected 2 cancelled deliveries, got '%s'", hdr)
+	}
+	if jstat, _ := other.GetStatus(); jstat != base.JSTAT_QUEUED {
+		t.Errorf("ERROR, other subscription's job was cancelled.")
+	}
+	if !subscriptionStale(subKey, sd.Generation) {
+		t.Errorf("ERROR, deleted subscription's jobs not stale.")
+	}
+}
+
+func TestRemoteStaleSends(t *testing.T) {
+	var nsent int32
+
+	disable_logs()
+	if htrans.transport == nil {
+		htrans.transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		htrans.client = &http.Client{Transport: htrans.transport,
+			Timeout: 5 * time.Second,
+		}
+	}
+	kverr := openTestKV()
+	if kverr != nil {
+		t.Fatal("KV/ETCD open failed:", kverr)
+	}
+	defer kvPurge(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&nsent, 1)
+	}))
+	defer srv.Close()
+
+	subKey := "sub#x3000c0s1b0n0#hs.ready#svc.hbtd"
+	defer forgetSubscriptionGeneration(subKey)
+	store := func(gen int64) {
+		ba, _ := json.Marshal(SubData{Url: srv.URL, Generation: gen})
+		if err := kvHandle.Store(subKey, string(ba)); err != nil {
+			t.Fatal("ERROR storing subscription:", err)
+		}
+	}
+	send := func(gen int64) {
+		NewJobSCNSendSub(Scn{State: "Ready"}, "hbtd@x3000c0s1b0n0", srv.URL,
+			subKey, gen, scnSendOpts{}).Run()
+	}
+
+	//This replica has only seen the first generation.  Another replica
+	//PATCHes the subscription, then DELETEs it; this one's jobs for it are
+	//dropped without being told.
+
+	oldGen := newSubscriptionGeneration()
+	store(oldGen)
+	noteSubscriptionGeneration(subKey, oldGen)
+	send(oldGen)
+	if n := atomic.LoadInt32(&nsent); n != 1 {
+		t.Fatalf("ERROR, current job not delivered, %d sent", n)
+	}
+
+	store(newSubscriptionGeneration())
+	send(oldGen)
+	if n := atomic.LoadInt32(&nsent); n != 1 {
+		t.Errorf("ERROR, job for another replica's PATCHed subscription delivered.")
+	}
+
+	if err := kvHandle.Delete(subKey); err != nil {
+		t.Fatal("ERROR deleting subscription:", err)
+	}
+	send(oldGen)
+	if n := atomic.LoadInt32(&nsent); n != 1 {
+		t.Errorf("ERROR, job for another replica's DELETEd subscription delivered.")
+	}
+}
+
+func TestMergedStaleSends(t *testing.T) {
+	key1 := "sub#x3000c0s1b0n0#hs.ready#svc.hbtd"
+	key2 := "sub#x3000c0s1b0n0#hs.ready#hs.off#svc.hbtd"
+	defer forgetSubscriptionGeneration(key1)
+	defer forgetSubscriptionGeneration(key2)
+
+	g1 := newSubscriptionGeneration()
+	g2 := newSubscriptionGeneration()
+	noteSubscriptionGeneration(key1, g1)
+	noteSubscriptionGeneration(key2, g2)
+
+	j := NewJobSCNSendSub(Scn{Components: []string{"x1", "x2"}, State: "Ready"},
+		"hbtd@x3000c0s1b0n0", "http://a.b.c/scn", key1, g1,
+		scnSendOpts{}).(*JobSCNSend)
+	j.addSub(key2, g2, []string{"x2", "x3"})
+	j.SetStatus(base.JSTAT_QUEUED, nil)
+	trackScnSend(j)
+	defer untrackScnSend(j)
+	if (fmt.Sprint(j.SCNData.Components) != "[x1 x2 x3]") ||
+		(fmt.Sprint(j.SCNData.Subscriptions) != fmt.Sprint([]ScnSubscription{scnSubscription(key1),
+			scnSubscription(key2)})) {
+		t.Errorf("ERROR, bad merged SCN: %v", j.SCNData)
+	}
+
+	//One subscription deleted: not cancelled, but it and the components
+	//only it matched are taken out.
+
+	forgetSubscriptionGeneration(key1)
+	if ncan := cancelStaleSends(key1); ncan != 0 {
+		t.Errorf("ERROR, merged job cancelled with a subscription left.")
+	}
+	if j.trimStaleSubs() ||
+		(fmt.Sprint(j.SCNData.Components) != "[x2 x3]") ||
+		(fmt.Sprint(j.SCNData.Subscriptions) != fmt.Sprint([]ScnSubscription{scnSubscription(key2)})) {
+		t.Errorf("ERROR, bad trimmed SCN: %v", j.SCNData)
+	}
+
+	//Both gone: cancelled.
+
+	noteSubscriptionGeneration(key2, newSubscriptionGeneration())
+	if ncan := cancelStaleSends(key2); ncan != 1 {
+		t.Errorf("ERROR, stale merged job not cancelled, %d cancelled.", ncan)
+	}
+	if !j.trimStaleSubs() {
+		t.Errorf("ERROR, stale merged job still has something to send.")
+	}
+}
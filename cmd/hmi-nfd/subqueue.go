@@ -0,0 +1,454 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Cray-HPE/hms-base/v2"
+)
+
+// A note about subscriber queues:
+//
+// The worker pool has many workers pulling from one queue, so if SCN send
+// jobs were queued to it directly, two SCNs for the same subscriber could
+// be sent at the same time and arrive out of order -- e.g. an Off landing
+// before an earlier Ready, leaving the subscriber with the wrong final
+// state.  So SCN send jobs are put on a FIFO queue per subscriber
+// ([agent@]xname), and the worker pool serves the queues rather than the
+// jobs.  While a queue has SCNs in it, one JTYPE_SCN_QUEUE job is in the
+// worker pool for it, and that job sends its SCNs in order, one at a time.
+// After SCN_QUEUE_SERVE_MAX SCNs it re-queues itself so that one busy
+// subscriber doesn't hold a worker forever.
+//
+// An SCN whose send fails and is to be retried goes back to the head of
+// the queue, so later SCNs still wait behind it.  Rather than a worker
+// sleeping through the backoff, the queue's job ends and a timer queues a
+// new one when the SCN is due to be retried.  A batched subscription's SCN
+// at the head of the queue waits for its batch to fill the same way (see
+// batch.go).
+//
+// Each queue can hold up to Scn_queue_depth SCNs (0 means no limit).  When
+// a queue is full, the Scn_queue_overflow policy says what to do:
+//
+//   DropOldest: the oldest queued SCN is dropped.
+//   Coalesce:   queued SCNs are merged, keeping only the newest state of
+//               each component, and SCNs with the same state are sent as
+//               one.  If that doesn't make room, the oldest is dropped.
+//   Suspend:    the queued SCNs are dropped and the subscriber is pruned
+//               with its subscriptions suspended rather than deleted, so
+//               they resume once it is Ready again.
+
+/////////////////////////////////////////////////////////////////////////////
+// Constants and Global Data
+/////////////////////////////////////////////////////////////////////////////
+
+const (
+	SCN_QUEUE_DEPTH     = 1000
+	SCN_QUEUE_SERVE_MAX = 16
+	SCN_QUEUE_RESUME_MS = 500
+)
+
+const (
+	QUEUE_OVERFLOW_DROP_OLDEST = "DropOldest"
+	QUEUE_OVERFLOW_COALESCE    = "Coalesce"
+	QUEUE_OVERFLOW_SUSPEND     = "Suspend"
+)
+
+var queueOverflowPolicies = []string{QUEUE_OVERFLOW_DROP_OLDEST,
+	QUEUE_OVERFLOW_COALESCE, QUEUE_OVERFLOW_SUSPEND,
+}
+
+// One subscriber's queue of SCN send jobs.
+
+type subQueue struct {
+	jobs       []*JobSCNSend
+	serving    bool        //a JTYPE_SCN_QUEUE job is queued, running or due for it
+	batchTimer *time.Timer //waiting to fill a batch, nil if not
+}
+
+var subqueues = make(map[string]*subQueue)
+var subqueues_mutex sync.Mutex
+
+/////////////////////////////////////////////////////////////////////////////
+// Verify and normalize a queue overflow policy.
+//
+// policy(in): Overflow policy, any case.
+// Return:     QUEUE_OVERFLOW_xxx, or "" if not valid.
+/////////////////////////////////////////////////////////////////////////////
+
+func verifyQueueOverflow(policy string) string {
+	for _, qp := range queueOverflowPolicies {
+		if strings.EqualFold(policy, qp) {
+			return qp
+		}
+	}
+	return ""
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Set the queue overflow policy from the command line or environment.
+//
+// src(in):    Option or env variable it came from, for error messages.
+// policy(in): Overflow policy, any case.
+// Return:     None.
+/////////////////////////////////////////////////////////////////////////////
+
+func setQueueOverflow(src string, policy string) {
+	qp := verifyQueueOverflow(policy)
+	if qp == "" {
+		log.Printf("ERROR: invalid %s value '%s'.\n", src, policy)
+		return
+	}
+	app_params.Scn_queue_overflow = qp
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Queue an SCN send job on its subscriber's queue, handling overflow.
+//
+// j(in):          SCN send job, already tracked.
+// subscriber(in): Subscriber, [agent@]xname.
+// Return:         true if the queue needs a JTYPE_SCN_QUEUE job to serve it.
+/////////////////////////////////////////////////////////////////////////////
+
+func enqueueScnSend(j *JobSCNSend, subscriber string) bool {
+	subqueues_mutex.Lock()
+	defer subqueues_mutex.Unlock()
+
+	q, ok := subqueues[subscriber]
+	if !ok {
+		q = &subQueue{}
+		subqueues[subscriber] = q
+	}
+
+	j.SetStatus(base.JSTAT_QUEUED, nil)
+	if j.queuedAt.IsZero() {
+		j.queuedAt = time.Now()
+		if deliveryBatched(j.Delivery) && (j.SCNData.Sequence == 0) {
+			j.SCNData.Sequence = newScnSequence()
+		}
+	}
+	depth := app_params.Scn_queue_depth
+	if (depth > 0) && (len(q.jobs) >= depth) {
+		q.jobs = liveScnSends(q.jobs)
+	}
+	if (depth > 0) && (len(q.jobs) >= depth) {
+		if !subQueueOverflow(q, j, subscriber) {
+			return false
+		}
+	} else {
+		q.jobs = append(q.jobs, j)
+	}
+
+	//A batch being waited on which is now full is sent right away.
+
+	if (q.batchTimer != nil) && (len(q.jobs) > 0) && (scnBatchWait(q) <= 0) &&
+		q.batchTimer.Stop() {
+		q.batchTimer = nil
+		return true
+	}
+
+	if q.serving {
+		return false
+	}
+	q.serving = true
+	return true
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Handle a full subscriber queue, per the Scn_queue_overflow policy.  Must
+// be called with subqueues_mutex held.
+//
+// q(in):          Subscriber's queue.
+// j(in):          SCN send job being queued.
+// subscriber(in): Subscriber, [agent@]xname.
+// Return:         true if the new job was queued.
+/////////////////////////////////////////////////////////////////////////////
+
+func subQueueOverflow(q *subQueue, j *JobSCNSend, subscriber string) bool {
+	depth := app_params.Scn_queue_depth
+
+	switch verifyQueueOverflow(app_params.Scn_queue_overflow) {
+	case QUEUE_OVERFLOW_SUSPEND:
+		prunemap_mutex.Lock()
+		markPruneCause(subscriber, pruneCause{Reason: PRUNE_REASON_QUEUE_OVERFLOW,
+			Trigger: "SCN queue overflow", Suspend: true})
+		pruned := prunemap[subscriber]
+		prunemap_mutex.Unlock()
+		if pruned {
+			log.Printf("WARNING: SCN queue for '%s' full, suspending subscriber.\n",
+				subscriber)
+			for _, qj := range append(q.jobs, j) {
+				dropScnSend(qj)
+			}
+			q.jobs = nil
+			return false
+		}
+	case QUEUE_OVERFLOW_COALESCE:
+		q.jobs = coalesceScnSends(append(q.jobs, j))
+		if len(q.jobs) <= depth {
+			return true
+		}
+		q.jobs = q.jobs[:len(q.jobs)-1]
+	}
+
+	if app_params.Debug > 0 {
+		log.Printf("WARNING: SCN queue for '%s' full, dropping oldest SCN.\n",
+			subscriber)
+	}
+	dropScnSend(q.jobs[0])
+	q.jobs = append(q.jobs[1:], j)
+	return true
+}
+
+// Cancel and stop tracking a queued SCN send job that won't be sent.
+
+func dropScnSend(j *JobSCNSend) {
+	j.Cancel()
+	untrackScnSend(j)
+}
+
+// Get the SCN send jobs in a list which haven't been cancelled.
+
+func liveScnSends(jobs []*JobSCNSend) []*JobSCNSend {
+	var live []*JobSCNSend
+	for _, j := range jobs {
+		if jstat, _ := j.GetStatus(); jstat != base.JSTAT_CANCELLED {
+			live = append(live, j)
+		}
+	}
+	return live
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Coalesce a subscriber's queued SCN send jobs.  Only the newest SCN of
+// each kind (which of State, SoftwareStatus, Role, SubRole, Enabled and Flag
+// it carries) for each component is kept, so a newer State SCN doesn't
+// supersede a Role SCN.  SCNs with the same attributes, URL and
+// subscriptions are merged into the newest of them.  Jobs left with nothing
+// to send are dropped.
+//
+// jobs(in): Queued SCN send jobs, oldest first.
+// Return:   Coalesced jobs, oldest first.
+/////////////////////////////////////////////////////////////////////////////
+
+func coalesceScnSends(jobs []*JobSCNSend) []*JobSCNSend {
+	jobs = liveScnSends(jobs)
+
+	newest := make(map[string]int)
+	for ix, j := range jobs {
+		kind := scnAttrKind(j.SCNData)
+		for _, comp := range j.SCNData.Components {
+			newest[comp+"|"+kind] = ix
+		}
+	}
+
+	comps := make([][]string, len(jobs))
+	for ix, j := range jobs {
+		kind := scnAttrKind(j.SCNData)
+		for _, comp := range j.SCNData.Components {
+			if newest[comp+"|"+kind] == ix {
+				comps[ix] = append(comps[ix], comp)
+			}
+		}
+	}
+
+	//Merge each job into the newest one like it.
+
+	group := make(map[string]int)
+	for ix, j := range jobs {
+		group[scnSendGroup(j)] = ix
+	}
+	for ix, j := range jobs {
+		gx := group[scnSendGroup(j)]
+		if gx != ix {
+			comps[gx] = append(comps[ix], comps[gx]...)
+			comps[ix] = nil
+			for sx := range j.Subs {
+				jobs[gx].Subs[sx].Components = append(j.Subs[sx].Components,
+					jobs[gx].Subs[sx].Components...)
+			}
+		}
+	}
+
+	var cjobs []*JobSCNSend
+	for ix, j := range jobs {
+		if len(comps[ix]) == 0 {
+			dropScnSend(j)
+			continue
+		}
+		j.SCNData.Components = comps[ix]
+		cjobs = append(cjobs, j)
+	}
+	return cjobs
+}
+
+// Get which attributes an SCN carries, as a key.
+
+func scnAttrKind(sd Scn) string {
+	var kinds []string
+	if sd.State != "" {
+		kinds = append(kinds, "State")
+	}
+	if sd.SoftwareStatus != "" {
+		kinds = append(kinds, "SoftwareStatus")
+	}
+	if sd.Role != "" {
+		kinds = append(kinds, "Role")
+	}
+	if sd.SubRole != "" {
+		kinds = append(kinds, "SubRole")
+	}
+	if sd.Enabled != nil {
+		kinds = append(kinds, "Enabled")
+	}
+	if sd.Flag != "" {
+		kinds = append(kinds, "Flag")
+	}
+	return strings.Join(kinds, ",")
+}
+
+// Make a key for SCN send jobs which can be merged: same SCN attributes,
+// URL and subscription generations.
+
+func scnSendGroup(j *JobSCNSend) string {
+	var subs []string
+	for _, sub := range j.Subs {
+		subs = append(subs, sub.Key+"="+strconv.FormatInt(sub.Generation, 10))
+	}
+	sd := j.SCNData
+	enbl := ""
+	if sd.Enabled != nil {
+		enbl = "false"
+		if *sd.Enabled {
+			enbl = "true"
+		}
+	}
+	return strings.Join([]string{enbl, sd.Flag, sd.Role, sd.SubRole,
+		sd.SoftwareStatus, sd.State, j.Url, strings.Join(subs, ","),
+		strconv.FormatBool(sd.Reconciled)}, "|")
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Send the SCNs on a subscriber's queue, in order.  This is run by the
+// subscriber's JTYPE_SCN_QUEUE job -- don't call directly!  If the SCN at
+// the head of the queue is waiting to be retried, a timer is set to serve
+// the queue again when it is due.
+//
+// subscriber(in): Subscriber, [agent@]xname.
+// Return:         true if the queue still has SCNs and needs serving again.
+/////////////////////////////////////////////////////////////////////////////
+
+func serveSubQueue(subscriber string) bool {
+	for nsent := 0; nsent < SCN_QUEUE_SERVE_MAX; {
+		subqueues_mutex.Lock()
+		q, ok := subqueues[subscriber]
+		if !ok || (len(q.jobs) == 0) {
+			delete(subqueues, subscriber)
+			subqueues_mutex.Unlock()
+			return false
+		}
+		j := q.jobs[0]
+		if jstat, _ := j.GetStatus(); jstat == base.JSTAT_CANCELLED {
+			q.jobs = q.jobs[1:]
+			subqueues_mutex.Unlock()
+			continue
+		}
+		if wait := time.Until(j.RetryAt); wait > 0 {
+			subqueues_mutex.Unlock()
+			time.AfterFunc(wait, func() { resumeSubQueue(subscriber) })
+			return false
+		}
+		q.batchTimer = nil
+		if deliveryBatched(j.Delivery) && !j.batched {
+			if wait := scnBatchWait(q); wait > 0 {
+				q.batchTimer = time.AfterFunc(wait,
+					func() { resumeSubQueue(subscriber) })
+				subqueues_mutex.Unlock()
+				return false
+			}
+			takeScnBatch(q)
+		}
+		q.jobs = q.jobs[1:]
+		subqueues_mutex.Unlock()
+
+		j.SetStatus(base.JSTAT_PROCESSING, nil)
+		j.Run()
+		if !j.RetryAt.IsZero() {
+			subqueues_mutex.Lock()
+			j.SetStatus(base.JSTAT_QUEUED, nil)
+			q.jobs = append([]*JobSCNSend{j}, q.jobs...)
+			subqueues_mutex.Unlock()
+			continue
+		}
+		if jstat, _ := j.GetStatus(); jstat != base.JSTAT_ERROR {
+			j.SetStatus(base.JSTAT_COMPLETE, nil)
+		}
+		nsent++
+	}
+
+	subqueues_mutex.Lock()
+	defer subqueues_mutex.Unlock()
+	if q, ok := subqueues[subscriber]; ok && (len(q.jobs) > 0) {
+		return true
+	}
+	delete(subqueues, subscriber)
+	return false
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Queue a job to serve a subscriber's queue again once an SCN on it is due
+// to be retried.  Called from a timer, so if the worker pool queue is full
+// it tries again later rather than blocking.
+//
+// subscriber(in): Subscriber, [agent@]xname.
+// Return:         None.
+/////////////////////////////////////////////////////////////////////////////
+
+func resumeSubQueue(subscriber string) {
+	if scnWorkPool.Queue(NewJobSCNQueue(subscriber)) != 0 {
+		time.AfterFunc(SCN_QUEUE_RESUME_MS*time.Millisecond,
+			func() { resumeSubQueue(subscriber) })
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Get subscriber queue statistics.
+//
+// Args:   None.
+// Return: Number of subscriber queues; number of SCNs queued in them.
+/////////////////////////////////////////////////////////////////////////////
+
+func subQueueStats() (int, int) {
+	subqueues_mutex.Lock()
+	defer subqueues_mutex.Unlock()
+	nscns := 0
+	for _, q := range subqueues {
+		nscns += len(q.jobs)
+	}
+	return len(subqueues), nscns
+}
@@ -0,0 +1,358 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Cray-HPE/hms-base/v2"
+)
+
+// Make an SCN send job for a subscriber queue test.
+
+func subqJob(state string, comps ...string) *JobSCNSend {
+	return NewJobSCNSend(Scn{State: state, Components: comps},
+		"hbtd@x3000c0s1b0n0", "http://a.b/scn").(*JobSCNSend)
+}
+
+func TestVerifyQueueOverflow(t *testing.T) {
+	for inp, exp := range map[string]string{"dropoldest": QUEUE_OVERFLOW_DROP_OLDEST,
+		"COALESCE": QUEUE_OVERFLOW_COALESCE, "Suspend": QUEUE_OVERFLOW_SUSPEND,
+		"block": "", "": ""} {
+		if qp := verifyQueueOverflow(inp); qp != exp {
+			t.Errorf("ERROR, overflow policy '%s', exp: '%s', got: '%s'", inp, exp, qp)
+		}
+	}
+}
+
+func TestCoalesceScnSends(t *testing.T) {
+	jobs := []*JobSCNSend{subqJob("Ready", "x1", "x2"), subqJob("Off", "x1"),
+		subqJob("Ready", "x3"), subqJob("Off", "x2")}
+
+	cjobs := coalesceScnSends(jobs)
+	if len(cjobs) != 2 {
+		t.Fatalf("ERROR, expected 2 coalesced SCNs, got %d", len(cjobs))
+	}
+	if (cjobs[0].SCNData.State != "Ready") ||
+		!reflect.DeepEqual(cjobs[0].SCNData.Components, []string{"x3"}) {
+		t.Errorf("ERROR, first coalesced SCN mismatch: %v", cjobs[0].SCNData)
+	}
+	if (cjobs[1].SCNData.State != "Off") ||
+		!reflect.DeepEqual(cjobs[1].SCNData.Components, []string{"x1", "x2"}) {
+		t.Errorf("ERROR, second coalesced SCN mismatch: %v", cjobs[1].SCNData)
+	}
+	for _, ix := range []int{0, 1} {
+		if jstat, _ := jobs[ix].GetStatus(); jstat != base.JSTAT_CANCELLED {
+			t.Errorf("ERROR, coalesced-away SCN %d not cancelled.", ix)
+		}
+	}
+}
+
+func TestCoalesceScnSendsMixed(t *testing.T) {
+	enbl := false
+	mk := func(sd Scn) *JobSCNSend {
+		return NewJobSCNSend(sd, "hbtd@x3000c0s1b0n0", "http://a.b/scn").(*JobSCNSend)
+	}
+	jobs := []*JobSCNSend{mk(Scn{State: "Ready", Components: []string{"x1"}}),
+		mk(Scn{Role: "Compute", Components: []string{"x1"}}),
+		mk(Scn{Enabled: &enbl, Components: []string{"x1"}}),
+		mk(Scn{SoftwareStatus: "AdminDown", Components: []string{"x1"}}),
+		mk(Scn{State: "Off", Components: []string{"x1"}}),
+		mk(Scn{SubRole: "Worker", Components: []string{"x1"}})}
+
+	//Only the older State SCN is superseded.
+
+	cjobs := coalesceScnSends(jobs)
+	if len(cjobs) != 5 {
+		t.Fatalf("ERROR, expected 5 coalesced SCNs, got %d", len(cjobs))
+	}
+	if jstat, _ := jobs[0].GetStatus(); jstat != base.JSTAT_CANCELLED {
+		t.Errorf("ERROR, superseded State SCN not cancelled.")
+	}
+	for ix, exp := range jobs[1:] {
+		if cjobs[ix] != exp {
+			t.Errorf("ERROR, coalesced SCN %d mismatch: %v", ix, cjobs[ix].SCNData)
+		}
+	}
+	if cjobs[3].SCNData.State != "Off" {
+		t.Errorf("ERROR, expected the newest State SCN kept, got %v", cjobs[3].SCNData)
+	}
+}
+
+func TestSubQueueOrder(t *testing.T) {
+	var mutex sync.Mutex
+	var states []string
+
+	disable_logs()
+	if htrans.transport == nil {
+		htrans.transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		htrans.client = &http.Client{Transport: htrans.transport,
+			Timeout: 5 * time.Second,
+		}
+	}
+	if scnWorkPool == nil {
+		scnWorkPool = base.NewWorkerPool(10, 10)
+		scnWorkPool.Run()
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var scn Scn
+		json.NewDecoder(r.Body).Decode(&scn)
+		mutex.Lock()
+		states = append(states, scn.State)
+		mutex.Unlock()
+	}))
+	defer srv.Close()
+
+	//Alternating states must arrive in the order they were queued, even
+	//with several workers.
+
+	var exp []string
+	var last base.Job
+	for ix := 0; ix < 40; ix++ {
+		state := "Ready"
+		if ix%2 == 1 {
+			state = "Off"
+		}
+		exp = append(exp, state)
+		last = NewJobSCNSend(Scn{State: state, Components: []string{"x3000c0s1b0n0"}},
+			"hbtd@x3000c0s9b0n0", srv.URL)
+		queueScnSend(last, "hbtd@x3000c0s9b0n0")
+	}
+
+	start := time.Now()
+	for time.Since(start) < 10*time.Second {
+		if jstat, _ := last.GetStatus(); jstat == base.JSTAT_COMPLETE {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !reflect.DeepEqual(states, exp) {
+		t.Errorf("ERROR, SCNs out of order:\nexp: %v\ngot: %v", exp, states)
+	}
+	if nq, _ := subQueueStats(); nq != 0 {
+		t.Errorf("ERROR, %d subscriber queues left after sending.", nq)
+	}
+}
+
+func TestSubQueueOverflow(t *testing.T) {
+	var kverr error
+
+	disable_logs()
+	kverr = openTestKV()
+	if kverr != nil {
+		t.Fatal("KV/ETCD open failed:", kverr)
+	}
+	defer kvPurge(t)
+
+	subscriber := "hbtd@x3000c0s1b0n0"
+	app_params.Scn_queue_depth = 3
+	defer func() {
+		app_params.Scn_queue_depth = SCN_QUEUE_DEPTH
+		app_params.Scn_queue_overflow = QUEUE_OVERFLOW_COALESCE
+		subqueues_mutex.Lock()
+		delete(subqueues, subscriber)
+		subqueues_mutex.Unlock()
+		prunedec_mutex.Lock()
+		prunedecisions = make(map[string]int64)
+		prunedec_mutex.Unlock()
+	}()
+
+	queued := func() []*JobSCNSend {
+		subqueues_mutex.Lock()
+		defer subqueues_mutex.Unlock()
+		return subqueues[subscriber].jobs
+	}
+
+	//Only the first job queued needs serving.  The oldest is dropped.
+
+	app_params.Scn_queue_overflow = QUEUE_OVERFLOW_DROP_OLDEST
+	jobs := []*JobSCNSend{subqJob("Ready", "x1"), subqJob("Off", "x1"),
+		subqJob("Ready", "x1"), subqJob("Off", "x1")}
+	for ix, j := range jobs {
+		if enqueueScnSend(j, subscriber) != (ix == 0) {
+			t.Errorf("ERROR, wrong serving need for job %d", ix)
+		}
+	}
+	if jstat, _ := jobs[0].GetStatus(); jstat != base.JSTAT_CANCELLED {
+		t.Errorf("ERROR, oldest SCN not dropped.")
+	}
+	if q := queued(); !reflect.DeepEqual(q, jobs[1:]) {
+		t.Errorf("ERROR, wrong SCNs queued after dropping oldest.")
+	}
+
+	//Coalescing keeps the newest state for each component.
+
+	app_params.Scn_queue_overflow = QUEUE_OVERFLOW_COALESCE
+	enqueueScnSend(subqJob("Ready", "x2"), subscriber)
+	q := queued()
+	if len(q) != 2 {
+		t.Fatalf("ERROR, expected 2 coalesced SCNs, got %d", len(q))
+	}
+	if (q[0].SCNData.State != "Off") || (q[1].SCNData.State != "Ready") ||
+		!reflect.DeepEqual(q[1].SCNData.Components, []string{"x2"}) {
+		t.Errorf("ERROR, wrong coalesced SCNs: %v, %v", q[0].SCNData, q[1].SCNData)
+	}
+
+	//Suspending drops everything and suspends the subscription.
+
+	sub := ScnSubscribe{Subscriber: "x3000c0s1b0n0",
+		Components: []string{"x3000c0s1b0n0"}, States: []string{"ready"},
+		Url: "http://x3000c0s1b0n0/scn"}
+	key := makeSubscriptionKey_V2(sub, sub.Subscriber, "hbtd")
+	err := storeSubscriptionEntry(key, SubData{Url: sub.Url, ScnNodes: sub.Components})
+	if err != nil {
+		t.Fatal("ERROR storing subscription:", err)
+	}
+
+	app_params.Scn_queue_overflow = QUEUE_OVERFLOW_SUSPEND
+	enqueueScnSend(subqJob("Off", "x3"), subscriber)
+	last := subqJob("Off", "x4")
+	enqueueScnSend(last, subscriber)
+	if len(queued()) != 0 {
+		t.Errorf("ERROR, SCNs still queued for suspended subscriber.")
+	}
+	if jstat, _ := last.GetStatus(); jstat != base.JSTAT_CANCELLED {
+		t.Errorf("ERROR, overflowing SCN not dropped.")
+	}
+
+	prunemap_mutex.Lock()
+	cause := prunecauses[subscriber]
+	subPrune()
+	unmarkPrune(subscriber)
+	prunemap_mutex.Unlock()
+	if (cause.Reason != PRUNE_REASON_QUEUE_OVERFLOW) || !cause.Suspend {
+		t.Errorf("ERROR, wrong prune cause for overflow: %v", cause)
+	}
+	sd, ok := getSubData(t, key)
+	if !ok || !sd.Suspended {
+		t.Errorf("ERROR, overflowing subscriber not suspended: %v", sd)
+	}
+}
+
+func TestSubQueueRetry(t *testing.T) {
+	var mutex sync.Mutex
+	var states []string
+	nfail := 2
+
+	disable_logs()
+	if htrans.transport == nil {
+		htrans.transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		htrans.client = &http.Client{Transport: htrans.transport,
+			Timeout: 5 * time.Second,
+		}
+	}
+	if scnWorkPool == nil {
+		scnWorkPool = base.NewWorkerPool(10, 10)
+		scnWorkPool.Run()
+	}
+
+	saved := app_params
+	app_params.Scn_retries = 5
+	app_params.Scn_backoff = 1
+	app_params.Scn_backoff_jitter = 0
+	defer func() {
+		waitSubQueues(t)
+		restoreAppParams(saved)
+	}()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var scn Scn
+		json.NewDecoder(r.Body).Decode(&scn)
+		mutex.Lock()
+		defer mutex.Unlock()
+		if nfail > 0 {
+			nfail--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		states = append(states, scn.State)
+	}))
+	defer srv.Close()
+
+	//The first SCN fails twice and is retried; the others wait behind it,
+	//and no worker is held during the backoff.
+
+	var jobs []*JobSCNSend
+	for _, state := range []string{"Ready", "Off", "On"} {
+		jj := NewJobSCNSend(Scn{State: state, Components: []string{"x3000c0s1b0n0"}},
+			"hbtd@x3000c0s8b0n0", srv.URL)
+		queueScnSend(jj, "hbtd@x3000c0s8b0n0")
+		jobs = append(jobs, jj.(*JobSCNSend))
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	if len(scnWorkPool.JobQueue) != 0 {
+		t.Errorf("ERROR, worker pool jobs queued during backoff.")
+	}
+	if nq, nscns := subQueueStats(); (nq != 1) || (nscns != 3) {
+		t.Errorf("ERROR, expected 1 queue with 3 SCNs during backoff, got %d/%d",
+			nq, nscns)
+	}
+
+	last := jobs[len(jobs)-1]
+	start := time.Now()
+	for time.Since(start) < 10*time.Second {
+		if jstat, _ := last.GetStatus(); jstat == base.JSTAT_COMPLETE {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !reflect.DeepEqual(states, []string{"Ready", "Off", "On"}) {
+		t.Errorf("ERROR, expected SCNs in order after retries, got %v", states)
+	}
+	if jobs[0].Attempts != 3 {
+		t.Errorf("ERROR, expected 3 attempts for first SCN, got %d", jobs[0].Attempts)
+	}
+}
+
+//Wait for the subscriber queues to empty, so no SCN sends are still running
+//when a test puts back what they use.
+
+func waitSubQueues(t *testing.T) {
+	start := time.Now()
+	for time.Since(start) < 10*time.Second {
+		if nq, _ := subQueueStats(); nq == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("ERROR, subscriber queues still busy.")
+}
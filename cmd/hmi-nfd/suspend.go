@@ -0,0 +1,245 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Cray-HPE/hms-base/v2"
+)
+
+// A note about durable subscriptions:
+//
+// Normally a subscription is deleted when its subscriber is pruned, and a
+// subscriber which comes back has to subscribe again.  A subscription made
+// with 'Durable' set is suspended instead when pruned because of an
+// unavailable SCN, a dead subscriber sweep, or a delivery failure.  Nothing
+// is sent to a suspended subscription, but it is otherwise kept as-is,
+// including its part of the HSM SCN subscription.
+//
+// A suspended subscription is resumed when its subscriber XName is seen to
+// be Ready, either via an SCN or via the leader's periodic check of HSM, or
+// when the leader's health probe of the subscription URL succeeds.  Explicit
+// deletes via the API always delete durable subscriptions.
+
+/////////////////////////////////////////////////////////////////////////////
+// Constants
+/////////////////////////////////////////////////////////////////////////////
+
+const (
+	SUSPEND_CHECK_INTERVAL = 30 //seconds between suspended subscription checks
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Suspend a durable subscription rather than deleting it.
+//
+// key(in):  Subscription key.
+// sd(in):   Subscription data from the key's value.
+// Return:   nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func suspendSubscription(key string, sd SubData) error {
+	if sd.Suspended {
+		return nil
+	}
+	sd.Suspended = true
+	sd.SuspendedAt = time.Now().Format(time.RFC3339)
+	log.Printf("INFO: Suspending subscription '%s'.\n", key)
+	return storeSubscriptionEntry(key, sd)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Resume a suspended subscription.
+//
+// key(in):    Subscription key.
+// value(in):  Subscription key's current value.
+// why(in):    Reason for resuming, for logging.
+// Return:     New key value and true if the subscription was resumed.
+/////////////////////////////////////////////////////////////////////////////
+
+func resumeSubscription(key string, value string, why string) (string, bool) {
+	var sd SubData
+
+	err := json.Unmarshal([]byte(value), &sd)
+	if err != nil {
+		log.Printf("ERROR: Problem unmarshalling ETCD key '%s': %v", key, err)
+		return value, false
+	}
+	if !sd.Suspended {
+		return value, false
+	}
+
+	sd.Suspended = false
+	sd.SuspendedAt = ""
+	ba, err := json.Marshal(sd)
+	if err != nil {
+		log.Println("ERROR marshaling subscription data:", err)
+		return value, false
+	}
+	err = storeSubscriptionEntry(key, sd)
+	if err != nil {
+		log.Printf("ERROR resuming subscription '%s': %v", key, err)
+		return value, false
+	}
+	log.Printf("INFO: Resumed durable subscription '%s' (%s).\n", key, why)
+	return string(ba), true
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Probe a subscription URL to see if the subscriber is back.  Only a 2xx
+// response to a HEAD request counts; a 404 or 405 may well come from a
+// proxy or a different service now at that address.
+//
+// url(in):  Subscription URL.
+// Return:   true if the subscriber responded.
+/////////////////////////////////////////////////////////////////////////////
+
+func probeSubscriberUrl(url string) bool {
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return false
+	}
+	base.SetHTTPUserAgent(req, serviceName)
+	rsp, err := deliveryClient(nil).Do(req)
+	if err != nil {
+		if app_params.Debug > 1 {
+			log.Printf("INFO: Probe of '%s' failed: %v", url, err)
+		}
+		return false
+	}
+	rsp.Body.Close()
+	return (rsp.StatusCode >= http.StatusOK) &&
+		(rsp.StatusCode < http.StatusMultipleChoices)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Check all suspended subscriptions and resume the ones whose subscribers
+// are back: the subscriber is Ready in HSM, or its URL answers a probe.
+//
+// Args:   None.
+// Return: Number of subscriptions resumed; nil on success, error string on
+//         error.
+/////////////////////////////////////////////////////////////////////////////
+
+func resumeSuspended() (int, error) {
+	kvlist, kverr := kvHandle.GetRange(SUBSCRIBER_KEYRANGE_START,
+		SUBSCRIBER_KEYRANGE_END)
+	if kverr != nil {
+		return 0, kverr
+	}
+
+	suspended := make(map[string]SubData)
+	xnMap := make(map[string]bool)
+	values := make(map[string]string)
+
+	for _, sub := range kvlist {
+		var sd SubData
+		if json.Unmarshal([]byte(sub.Value), &sd) != nil || !sd.Suspended {
+			continue
+		}
+		xname, _ := parseSubscriptionKey(sub.Key)
+		suspended[sub.Key] = sd
+		values[sub.Key] = sub.Value
+		if !isServiceSubscriber(xname) {
+			xnMap[xname] = true
+		}
+	}
+	if len(suspended) == 0 {
+		return 0, nil
+	}
+
+	//Subscribers which are Ready in HSM.
+
+	ready := make(map[string]bool)
+	if app_params.Nosm == 0 {
+		var xnames []string
+		for xname := range xnMap {
+			xnames = append(xnames, xname)
+		}
+		sort.Strings(xnames)
+		comps, err := queryComponentStates(xnames)
+		if err != nil {
+			log.Printf("WARNING: Can't get suspended subscriber states from HSM: %v",
+				err)
+		}
+		for _, comp := range comps {
+			if strings.EqualFold(comp.State, base.StateReady.String()) {
+				ready[strings.ToLower(comp.ID)] = true
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(suspended))
+	for key := range suspended {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	nresumed := 0
+	for _, key := range keys {
+		xname, _ := parseSubscriptionKey(key)
+		why := ""
+		if ready[xname] {
+			why = "subscriber Ready in HSM"
+		} else if probeSubscriberUrl(suspended[key].Url) {
+			why = "subscriber URL responded"
+		} else {
+			continue
+		}
+		if _, ok := resumeSubscription(key, values[key], why); ok {
+			nresumed++
+		}
+	}
+	return nresumed, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Thread func for resuming suspended durable subscriptions.  Only the
+// leader checks them.
+//
+// Args, Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func suspendResumer() {
+	for Running {
+		time.Sleep(SUSPEND_CHECK_INTERVAL * time.Second)
+
+		if !isLeader() {
+			continue
+		}
+
+		nresumed, err := resumeSuspended()
+		if err != nil {
+			log.Printf("ERROR checking suspended subscriptions: %v", err)
+			continue
+		}
+		if (nresumed > 0) && (app_params.Debug > 0) {
+			log.Printf("INFO: Resumed %d suspended subscriptions.\n", nresumed)
+		}
+	}
+}
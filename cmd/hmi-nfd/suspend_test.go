@@ -0,0 +1,180 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getSubData(t *testing.T, key string) (SubData, bool) {
+	var sd SubData
+
+	val, ok, err := kvHandle.Get(key)
+	if err != nil {
+		t.Fatalf("ERROR fetching key '%s': %v", key, err)
+	}
+	if !ok {
+		return sd, false
+	}
+	err = json.Unmarshal([]byte(val), &sd)
+	if err != nil {
+		t.Fatalf("ERROR unmarshalling key '%s': %v", key, err)
+	}
+	return sd, true
+}
+
+func TestDurableSubscriptions(t *testing.T) {
+	var kverr error
+
+	disable_logs()
+	if htrans.transport == nil {
+		htrans.transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		htrans.client = &http.Client{Transport: htrans.transport,
+			Timeout: (time.Duration(app_params.SM_timeout) * time.Second),
+		}
+	}
+	savedNosm := app_params.Nosm
+	app_params.Nosm = 1
+	defer func() { app_params.Nosm = savedNosm }()
+
+	kverr = openTestKV()
+	if kverr != nil {
+		t.Fatal("KV/ETCD open failed:", kverr)
+	}
+	defer kvPurge(t)
+
+	//Subscriber whose URL answers probes.
+
+	subSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer subSrv.Close()
+
+	//Something else answering at a subscriber's address.
+
+	goneSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer goneSrv.Close()
+
+	//Subscriber whose URL doesn't.
+
+	deadSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	deadUrl := deadSrv.URL + "/scn"
+	deadSrv.Close()
+
+	subs := []ScnSubscribe{
+		{Subscriber: "x3000c0s1b0n0", Components: []string{"x3000c0s1b0n0"},
+			States: []string{"off"}, Url: deadUrl, Durable: true},
+		{Subscriber: "x3000c0s2b0n0", Components: []string{"x3000c0s2b0n0"},
+			States: []string{"off"}, Url: subSrv.URL + "/scn", Durable: true},
+		{Subscriber: "x3000c0s5b0n0", Components: []string{"x3000c0s5b0n0"},
+			States: []string{"off"}, Url: goneSrv.URL + "/scn", Durable: true},
+		{Subscriber: "x3000c0s3b0n0", Components: []string{"x3000c0s3b0n0"},
+			States: []string{"off"}, Url: deadUrl},
+		{Subscriber: "x3000c0s4b0n0", Components: []string{"x3000c0s4b0n0"},
+			States: []string{"off"}, Url: deadUrl, Durable: true},
+	}
+	var keys []string
+	for _, sub := range subs {
+		key := makeSubscriptionKey_V2(sub, sub.Subscriber, "hbtd")
+		err := storeSubscriptionEntry(key, SubData{Url: sub.Url,
+			ScnNodes: sub.Components, Durable: sub.Durable})
+		if err != nil {
+			t.Fatal("ERROR storing subscription:", err)
+		}
+		keys = append(keys, key)
+	}
+
+	//Prune all of them; the last one is deleted explicitly.
+
+	prunemap_mutex.Lock()
+	prunemap["x3000c0s1b0n0"] = true
+	prunemap["x3000c0s2b0n0"] = true
+	prunemap["x3000c0s5b0n0"] = true
+	prunemap["x3000c0s3b0n0"] = true
+	prunemap["x3000c0s4b0n0"] = true
+	prunemap["hbtd@x3000c0s4b0n0"] = true
+	subPrune()
+	delete(prunemap, "x3000c0s1b0n0")
+	delete(prunemap, "x3000c0s2b0n0")
+	delete(prunemap, "x3000c0s5b0n0")
+	delete(prunemap, "x3000c0s3b0n0")
+	delete(prunemap, "x3000c0s4b0n0")
+	delete(prunemap, "hbtd@x3000c0s4b0n0")
+	prunemap_mutex.Unlock()
+
+	for ix, key := range keys[:3] {
+		sd, ok := getSubData(t, key)
+		if !ok {
+			t.Errorf("ERROR, durable subscription %d deleted by prune.", ix)
+		} else if !sd.Suspended || (sd.SuspendedAt == "") {
+			t.Errorf("ERROR, durable subscription %d not suspended: %v", ix, sd)
+		}
+	}
+	for _, key := range keys[3:] {
+		if _, ok := getSubData(t, key); ok {
+			t.Errorf("ERROR, subscription '%s' not deleted by prune.", key)
+		}
+	}
+
+	//Only the subscriber answering the probe is resumed.
+
+	nresumed, err := resumeSuspended()
+	if err != nil {
+		t.Fatal("ERROR resuming suspended subscriptions:", err)
+	}
+	if nresumed != 1 {
+		t.Errorf("ERROR, expected 1 resumed subscription, got %d", nresumed)
+	}
+	sd, _ := getSubData(t, keys[0])
+	if !sd.Suspended {
+		t.Errorf("ERROR, unreachable subscription was resumed.")
+	}
+	sd, _ = getSubData(t, keys[1])
+	if sd.Suspended || (sd.SuspendedAt != "") || !sd.Durable {
+		t.Errorf("ERROR, reachable subscription not resumed: %v", sd)
+	}
+	sd, _ = getSubData(t, keys[2])
+	if !sd.Suspended {
+		t.Errorf("ERROR, subscription whose URL answers 404 was resumed.")
+	}
+
+	//A Ready SCN for the other subscriber resumes it.
+
+	doScnSegment(Scn{Components: []string{"x3000c0s1b0n0"}, State: "Ready"},
+		serviceName)
+	sd, _ = getSubData(t, keys[0])
+	if sd.Suspended || !sd.Durable {
+		t.Errorf("ERROR, subscription not resumed by Ready SCN: %v", sd)
+	}
+}
@@ -26,6 +26,8 @@ import (
 	"errors"
 	"github.com/Cray-HPE/hms-base/v2"
 	"log"
+	"sync"
+	"time"
 )
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -33,17 +35,19 @@ import (
 ///////////////////////////////////////////////////////////////////////////////
 
 const (
-	JTYPE_INVALID  base.JobType = 0
-	JTYPE_TEST     base.JobType = 1
-	JTYPE_SCN_SEND base.JobType = 2
-	JTYPE_MAX      base.JobType = 3
+	JTYPE_INVALID   base.JobType = 0
+	JTYPE_TEST      base.JobType = 1
+	JTYPE_SCN_SEND  base.JobType = 2
+	JTYPE_SCN_QUEUE base.JobType = 3
+	JTYPE_MAX       base.JobType = 4
 )
 
 var JTypeString = map[base.JobType]string{
-	JTYPE_INVALID:  "JTYPE_INVALID",
-	JTYPE_TEST:     "JTYPE_TEST",
-	JTYPE_SCN_SEND: "JTYPE_SCN_SEND",
-	JTYPE_MAX:      "JTYPE_MAX",
+	JTYPE_INVALID:   "JTYPE_INVALID",
+	JTYPE_TEST:      "JTYPE_TEST",
+	JTYPE_SCN_SEND:  "JTYPE_SCN_SEND",
+	JTYPE_SCN_QUEUE: "JTYPE_SCN_QUEUE",
+	JTYPE_MAX:       "JTYPE_MAX",
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -56,13 +60,41 @@ type JobSCNSend struct {
 	SCNData    Scn
 	Subscriber string
 	Url        string
+	Subs       []scnSendSub //subscriptions the SCN is for, if any
+	Attempts   int          //send attempts made
+	LastErr    string       //last send error
+	RetryAt    time.Time    //when to retry a failed send, zero if not
+	scnSendOpts
+
+	queuedAt  time.Time     //when first queued
+	batched   bool          //batch made, for batched subscriptions
+	batch     []*JobSCNSend //other SCNs sent with this one
+	batchScns []Scn         //SCNs in the batch still to be sent
+
+	statusMutex sync.Mutex //guards Status and Err
+}
+
+// A subscription an SCN send job is for.
+
+type scnSendSub struct {
+	Key        string   //subscription key
+	Generation int64    //subscription generation when made
+	Components []string //components of the SCN it matched
+}
+
+// A subscription's options for sending its SCNs.
+
+type scnSendOpts struct {
+	Delivery *DeliveryPolicy //delivery settings, nil==global
+	Secret   string          //signing secret, encrypted, ""==unsigned
+	Auth     string          //outbound auth, encrypted, ""==none
 }
 
 /////////////////////////////////////////////////////////////////////////////
 // Create a JTYPE_SCN_SEND job data structure.
 //
 // sd(in):         SCN data to send to a subscriber
-// subscriber(in): XName of subscriber.
+// subscriber(in): Subscriber, [agent@]xname.
 // url(in):        URL to send SCN to.
 // Return:         Job data structure to be used by work Q.
 /////////////////////////////////////////////////////////////////////////////
@@ -76,6 +108,141 @@ func NewJobSCNSend(sd Scn, subscriber string, url string) base.Job {
 	return j
 }
 
+/////////////////////////////////////////////////////////////////////////////
+// Create a JTYPE_SCN_SEND job data structure for a subscription.  The job
+// is dropped when run if the subscription has been deleted or changed.
+//
+// sd(in):         SCN data to send to a subscriber
+// subscriber(in): Subscriber, [agent@]xname.
+// url(in):        URL to send SCN to.
+// key(in):        Subscription key.
+// gen(in):        Subscription generation.
+// opts(in):       Subscription's send options.
+// Return:         Job data structure to be used by work Q.
+/////////////////////////////////////////////////////////////////////////////
+
+func NewJobSCNSendSub(sd Scn, subscriber string, url string, key string, gen int64, opts scnSendOpts) base.Job {
+	j := NewJobSCNSend(sd, subscriber, url).(*JobSCNSend)
+	j.SCNData.Components = append([]string{}, sd.Components...)
+	j.SCNData.Subscriptions = []ScnSubscription{scnSubscription(key)}
+	j.Subs = []scnSendSub{{Key: key, Generation: gen,
+		Components: append([]string{}, sd.Components...)}}
+	j.scnSendOpts = opts
+	return j
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Add another subscription to a JTYPE_SCN_SEND job made for a subscription,
+// so that one SCN is sent for both.  The SCN's components become the union
+// of theirs.  The job's send options stay those of its first subscription.
+//
+// key(in):   Subscription key.
+// gen(in):   Subscription generation.
+// comps(in): Components of the SCN the subscription matched.
+// Return:    None.
+/////////////////////////////////////////////////////////////////////////////
+
+func (j *JobSCNSend) addSub(key string, gen int64, comps []string) {
+	have := make(map[string]bool)
+	for _, comp := range j.SCNData.Components {
+		have[comp] = true
+	}
+	for _, comp := range comps {
+		if !have[comp] {
+			j.SCNData.Components = append(j.SCNData.Components, comp)
+			have[comp] = true
+		}
+	}
+	j.SCNData.Subscriptions = append(j.SCNData.Subscriptions,
+		scnSubscription(key))
+	j.Subs = append(j.Subs, scnSendSub{Key: key, Generation: gen,
+		Components: append([]string{}, comps...)})
+}
+
+// Check if a JTYPE_SCN_SEND job is for a subscription.
+
+func (j *JobSCNSend) hasSub(key string) bool {
+	for ix := range j.Subs {
+		if j.Subs[ix].Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Check if all of the subscriptions a JTYPE_SCN_SEND job is for have been
+// deleted or changed since it was made.
+//
+// Args:   None.
+// Return: true if the job is stale.  Jobs not made for a subscription
+//         never are.
+/////////////////////////////////////////////////////////////////////////////
+
+func (j *JobSCNSend) subsStale() bool {
+	if len(j.Subs) == 0 {
+		return false
+	}
+	for ix := range j.Subs {
+		if !subscriptionStale(j.Subs[ix].Key, j.Subs[ix].Generation) {
+			return false
+		}
+	}
+	return true
+}
+
+// Get the keys of the subscriptions a JTYPE_SCN_SEND job, and those batched
+// with it, are for.
+
+func (j *JobSCNSend) subKeys() []string {
+	var keys []string
+	for _, o := range append([]*JobSCNSend{j}, j.batch...) {
+		for _, sub := range o.Subs {
+			keys = append(keys, sub.Key)
+		}
+	}
+	return keys
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Take the subscriptions which have been deleted or changed out of a
+// JTYPE_SCN_SEND job's SCN, along with the components only they matched.
+// The job's subscription list itself is left as it is.
+//
+// Args:   None.
+// Return: true if nothing is left to send.
+/////////////////////////////////////////////////////////////////////////////
+
+func (j *JobSCNSend) trimStaleSubs() bool {
+	if j.subsStale() {
+		return true
+	}
+	var subs []ScnSubscription
+	want := make(map[string]bool)
+	for _, sub := range j.Subs {
+		if subscriptionStale(sub.Key, sub.Generation) {
+			continue
+		}
+		subs = append(subs, scnSubscription(sub.Key))
+		for _, comp := range sub.Components {
+			want[comp] = true
+		}
+	}
+	if len(subs) == len(j.Subs) {
+		return false
+	}
+
+	var comps []string
+	for _, comp := range j.SCNData.Components {
+		if want[comp] {
+			comps = append(comps, comp)
+		}
+	}
+	j.SCNData.Components = comps
+	j.SCNData.Subscriptions = subs
+	return len(comps) == 0
+}
+
 /////////////////////////////////////////////////////////////////////////////
 // Log function for SCN send job.  Note that for now this is just a simple
 // log call, but may be expanded in the future.
@@ -101,14 +268,37 @@ func (j *JobSCNSend) Type() base.JobType {
 }
 
 /////////////////////////////////////////////////////////////////////////////
-// Run a job.  This is done by the worker pool when popping a job off of the
-// work Q/chan.
+// Run a job.  This is done by the subscriber's queue when it gets to the
+// job.  Makes one attempt at sending the SCN, using the subscription's
+// send options.  If it is to be retried, RetryAt is set
+// and the job stays tracked, so it can still be cancelled while it waits.
 //
 // Args,Return: None.
 /////////////////////////////////////////////////////////////////////////////
 
 func (j *JobSCNSend) Run() {
-	sendSCNToSubscriber(j.SCNData, j.Subscriber, j.Url)
+	j.RetryAt = time.Time{}
+	stale := false
+	refreshSubscriptionGenerations(j.subKeys())
+	if j.batched {
+		stale = j.trimStaleBatch()
+	} else {
+		stale = j.trimStaleSubs()
+	}
+	if stale {
+		if app_params.Debug > 0 {
+			log.Printf("Not sending SCN to '%s'/'%s', subscription deleted or changed.\n",
+				j.Subscriber, j.Url)
+		}
+		j.finishBatch()
+		untrackScnSend(j)
+		return
+	}
+	if sendSCNToSubscriber(j) {
+		return
+	}
+	j.finishBatch()
+	untrackScnSend(j)
 }
 
 /////////////////////////////////////////////////////////////////////////////
@@ -119,6 +309,8 @@ func (j *JobSCNSend) Run() {
 /////////////////////////////////////////////////////////////////////////////
 
 func (j *JobSCNSend) GetStatus() (base.JobStatus, error) {
+	j.statusMutex.Lock()
+	defer j.statusMutex.Unlock()
 	if j.Status == base.JSTAT_ERROR {
 		return j.Status, j.Err
 	}
@@ -134,6 +326,8 @@ func (j *JobSCNSend) GetStatus() (base.JobStatus, error) {
 /////////////////////////////////////////////////////////////////////////////
 
 func (j *JobSCNSend) SetStatus(newStatus base.JobStatus, err error) (base.JobStatus, error) {
+	j.statusMutex.Lock()
+	defer j.statusMutex.Unlock()
 	if newStatus >= base.JSTAT_MAX {
 		return j.Status, errors.New("Error: Invalid Status")
 	} else {
@@ -153,8 +347,125 @@ func (j *JobSCNSend) SetStatus(newStatus base.JobStatus, err error) (base.JobSta
 /////////////////////////////////////////////////////////////////////////////
 
 func (j *JobSCNSend) Cancel() base.JobStatus {
+	j.statusMutex.Lock()
+	defer j.statusMutex.Unlock()
 	if j.Status == base.JSTAT_QUEUED || j.Status == base.JSTAT_DEFAULT {
 		j.Status = base.JSTAT_CANCELLED
 	}
 	return j.Status
 }
+
+///////////////////////////////////////////////////////////////////////////////
+// Job: JTYPE_SCN_QUEUE
+///////////////////////////////////////////////////////////////////////////////
+
+type JobSCNQueue struct {
+	Status     base.JobStatus
+	Err        error
+	Subscriber string
+
+	statusMutex sync.Mutex //guards Status and Err
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Create a JTYPE_SCN_QUEUE job data structure.  This job sends the SCNs on
+// a subscriber's queue, in order.
+//
+// subscriber(in): Subscriber, [agent@]xname.
+// Return:         Job data structure to be used by work Q.
+/////////////////////////////////////////////////////////////////////////////
+
+func NewJobSCNQueue(subscriber string) base.Job {
+	j := new(JobSCNQueue)
+	j.Status = base.JSTAT_DEFAULT
+	j.Subscriber = subscriber
+	return j
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Log function for SCN queue job.
+//
+// format(in):  Printf-like format string.
+// a(in):       Printf-like argument list.
+// Return:      None.
+/////////////////////////////////////////////////////////////////////////////
+
+func (j *JobSCNQueue) Log(format string, a ...interface{}) {
+	log.Printf(format, a...)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Return current job type.
+//
+// Args: None
+// Return: Job type.
+/////////////////////////////////////////////////////////////////////////////
+
+func (j *JobSCNQueue) Type() base.JobType {
+	return JTYPE_SCN_QUEUE
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Run a job.  Serves the subscriber's queue for a while, then if it still
+// has SCNs, queues a new job to serve it again.  If the worker pool queue
+// is full, keeps serving it instead.
+//
+// Args,Return: None.
+/////////////////////////////////////////////////////////////////////////////
+
+func (j *JobSCNQueue) Run() {
+	for serveSubQueue(j.Subscriber) {
+		if scnWorkPool.Queue(NewJobSCNQueue(j.Subscriber)) == 0 {
+			break
+		}
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Return the current job status and error info.
+//
+// Args: None
+// Return: Current job status, and any error info (if any).
+/////////////////////////////////////////////////////////////////////////////
+
+func (j *JobSCNQueue) GetStatus() (base.JobStatus, error) {
+	j.statusMutex.Lock()
+	defer j.statusMutex.Unlock()
+	if j.Status == base.JSTAT_ERROR {
+		return j.Status, j.Err
+	}
+	return j.Status, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Set job status.
+//
+// newStatus(in): Status to set job to.
+// err(in):       Error info to associate with the job.
+// Return:        Previous job status; nil on success, error string on error.
+/////////////////////////////////////////////////////////////////////////////
+
+func (j *JobSCNQueue) SetStatus(newStatus base.JobStatus, err error) (base.JobStatus, error) {
+	j.statusMutex.Lock()
+	defer j.statusMutex.Unlock()
+	if newStatus >= base.JSTAT_MAX {
+		return j.Status, errors.New("Error: Invalid Status")
+	}
+	oldStatus := j.Status
+	j.Status = newStatus
+	j.Err = err
+	return oldStatus, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Cancel a job.  SCN queue jobs aren't cancelled; their SCN send jobs are.
+//
+// Args:   None
+// Return: Current job status.
+/////////////////////////////////////////////////////////////////////////////
+
+func (j *JobSCNQueue) Cancel() base.JobStatus {
+	j.statusMutex.Lock()
+	defer j.statusMutex.Unlock()
+	return j.Status
+}
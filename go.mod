@@ -10,6 +10,7 @@ require (
 	github.com/Cray-HPE/hms-msgbus v1.13.0
 	github.com/Cray-HPE/hms-xname v1.4.0
 	github.com/gorilla/mux v1.8.1
+	go.etcd.io/etcd/client/v3 v3.5.19
 )
 
 require (
@@ -24,7 +25,6 @@ require (
 	github.com/sirupsen/logrus v1.9.3 // indirect
 	go.etcd.io/etcd/api/v3 v3.5.19 // indirect
 	go.etcd.io/etcd/client/pkg/v3 v3.5.19 // indirect
-	go.etcd.io/etcd/client/v3 v3.5.19 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
 	go.uber.org/zap v1.27.0 // indirect
 	golang.org/x/net v0.37.0 // indirect
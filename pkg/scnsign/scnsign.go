@@ -0,0 +1,154 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// Package scnsign signs and verifies State Change Notifications delivered
+// by hmnfd to subscriptions which registered a shared secret.
+//
+// Each signed delivery has two headers:
+//
+//	X-HMNFD-Timestamp: Unix time, in seconds, when it was sent.
+//	X-HMNFD-Signature: "sha256=" followed by the hex HMAC-SHA256, keyed
+//	                   with the secret, of the timestamp, a ".", and the
+//	                   request body.
+//
+// A subscriber checks the signature and that the timestamp is recent, so
+// that a captured delivery can't be replayed later:
+//
+//	body, err := scnsign.VerifyRequest(r, secret, scnsign.DefaultTolerance)
+//	if err != nil {
+//		w.WriteHeader(http.StatusUnauthorized)
+//		return
+//	}
+package scnsign
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SignatureHeader  = "X-HMNFD-Signature"
+	TimestampHeader  = "X-HMNFD-Timestamp"
+	SignaturePrefix  = "sha256="
+	DefaultTolerance = 5 * time.Minute
+)
+
+var (
+	ErrNoSignature  = errors.New("missing signature or timestamp header")
+	ErrBadTimestamp = errors.New("malformed timestamp")
+	ErrStale        = errors.New("timestamp outside of tolerance")
+	ErrBadSignature = errors.New("signature mismatch")
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Compute the signature of a delivery.
+//
+// secret(in):    Shared secret.
+// timestamp(in): Value of the timestamp header.
+// body(in):      Request body.
+// Return:        Value of the signature header.
+/////////////////////////////////////////////////////////////////////////////
+
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return SignaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Set the timestamp and signature headers of a delivery request.
+//
+// req(in):    HTTP request.
+// secret(in): Shared secret.
+// body(in):   Request body.
+// now(in):    Time it is sent.
+// Return:     None.
+/////////////////////////////////////////////////////////////////////////////
+
+func SignRequest(req *http.Request, secret []byte, body []byte, now time.Time) {
+	ts := strconv.FormatInt(now.Unix(), 10)
+	req.Header.Set(TimestampHeader, ts)
+	req.Header.Set(SignatureHeader, Sign(secret, ts, body))
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Verify the signature and timestamp of a delivery.
+//
+// secret(in):    Shared secret.
+// timestamp(in): Value of the timestamp header.
+// signature(in): Value of the signature header.
+// body(in):      Request body.
+// now(in):       Current time.
+// tolerance(in): How far the timestamp may be from now.
+// Return:        nil if valid, else ErrXxx.
+/////////////////////////////////////////////////////////////////////////////
+
+func Verify(secret []byte, timestamp string, signature string, body []byte,
+	now time.Time, tolerance time.Duration) error {
+	if (timestamp == "") || (signature == "") {
+		return ErrNoSignature
+	}
+	secs, err := strconv.ParseInt(strings.TrimSpace(timestamp), 10, 64)
+	if err != nil {
+		return ErrBadTimestamp
+	}
+	skew := now.Sub(time.Unix(secs, 0))
+	if (skew > tolerance) || (skew < -tolerance) {
+		return ErrStale
+	}
+	exp := Sign(secret, timestamp, body)
+	if !hmac.Equal([]byte(exp), []byte(strings.TrimSpace(signature))) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Verify a received delivery request.  The body is read, and replaced so
+// the caller can still read it.
+//
+// r(in):         HTTP request.
+// secret(in):    Shared secret.
+// tolerance(in): How far the timestamp may be from now.
+// Return:        Request body; nil if valid, else error.
+/////////////////////////////////////////////////////////////////////////////
+
+func VerifyRequest(r *http.Request, secret []byte, tolerance time.Duration) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, Verify(secret, r.Header.Get(TimestampHeader),
+		r.Header.Get(SignatureHeader), body, time.Now(), tolerance)
+}
@@ -0,0 +1,107 @@
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package scnsign
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	//Known value, so subscribers in other languages can check theirs.
+
+	sig := Sign([]byte("secret"), "1700000000", []byte(`{"State":"On"}`))
+	exp := "sha256=2262239e44aaa87a8e6ac9b639280cc02a656c82232fae442e5c4b9994f5196c"
+	if sig != exp {
+		t.Errorf("ERROR, signature expected '%s', got '%s'", exp, sig)
+	}
+	if sig == Sign([]byte("secret"), "1700000001", []byte(`{"State":"On"}`)) {
+		t.Errorf("ERROR, signature doesn't cover the timestamp.")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	body := []byte(`{"Components":["x0c0s0b0n0"],"State":"Ready"}`)
+	now := time.Unix(1700000000, 0)
+	ts := "1700000000"
+	sig := Sign(secret, ts, body)
+
+	tests := []struct {
+		name string
+		ts   string
+		sig  string
+		body []byte
+		now  time.Time
+		exp  error
+	}{
+		{"good", ts, sig, body, now, nil},
+		{"skewed but in tolerance", ts, sig, body, now.Add(4 * time.Minute), nil},
+		{"no signature", ts, "", body, now, ErrNoSignature},
+		{"no timestamp", "", sig, body, now, ErrNoSignature},
+		{"bad timestamp", "soon", sig, body, now, ErrBadTimestamp},
+		{"replayed", ts, sig, body, now.Add(10 * time.Minute), ErrStale},
+		{"from the future", ts, sig, body, now.Add(-10 * time.Minute), ErrStale},
+		{"altered body", ts, sig, []byte(`{"State":"Off"}`), now, ErrBadSignature},
+		{"wrong secret", ts, Sign([]byte("other"), ts, body), body, now, ErrBadSignature},
+	}
+
+	for _, tt := range tests {
+		err := Verify(secret, tt.ts, tt.sig, tt.body, tt.now, DefaultTolerance)
+		if err != tt.exp {
+			t.Errorf("ERROR, %s: expected '%v', got '%v'", tt.name, tt.exp, err)
+		}
+	}
+}
+
+func TestVerifyRequest(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	body := []byte(`{"State":"On"}`)
+
+	req := httptest.NewRequest(http.MethodPost, "/scn", bytes.NewReader(body))
+	SignRequest(req, secret, body, time.Now())
+	rbody, err := VerifyRequest(req, secret, DefaultTolerance)
+	if err != nil {
+		t.Fatal("ERROR verifying signed request:", err)
+	}
+	if !bytes.Equal(rbody, body) {
+		t.Errorf("ERROR, body mismatch: '%s'", string(rbody))
+	}
+
+	//Body can still be read.
+
+	var buf bytes.Buffer
+	buf.ReadFrom(req.Body)
+	if !bytes.Equal(buf.Bytes(), body) {
+		t.Errorf("ERROR, body not replaced: '%s'", buf.String())
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/scn", bytes.NewReader(body))
+	if _, err = VerifyRequest(req, secret, DefaultTolerance); err != ErrNoSignature {
+		t.Errorf("ERROR, unsigned request: expected '%v', got '%v'",
+			ErrNoSignature, err)
+	}
+}